@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// accessLogSampledOut counts successful requests left out of the access
+// log while it was sampling
+var accessLogSampledOut = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "access_log_sampled_out_total",
+	Help: "Successful requests not written to the access log because it was sampling.",
+})
+
+// logSampler thins the access log under load. Once more than threshold
+// requests arrive within a second, only a rate fraction of the successful
+// ones in the rest of that second are logged. Error responses are always
+// logged.
+type logSampler struct {
+	threshold  int
+	rate       float64
+	now        func() time.Time
+	sampledOut prometheus.Counter
+
+	mu      sync.Mutex
+	window  time.Time
+	count   int
+	credit  float64
+	dropped int
+}
+
+// newLogSampler returns a sampler using ACCESS_LOG_SAMPLE_RPS and
+// ACCESS_LOG_SAMPLE_RATE. A threshold of 0 logs every request.
+func newLogSampler(threshold int, rate float64) *logSampler {
+	return &logSampler{threshold: threshold, rate: rate, now: time.Now, sampledOut: accessLogSampledOut}
+}
+
+// keep reports whether a request answered with status should be logged.
+// When a new second starts, it also returns how many requests the
+// previous one sampled out.
+func (ls *logSampler) keep(status int) (keep bool, droppedBefore int) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if window := ls.now().Truncate(time.Second); !window.Equal(ls.window) {
+		droppedBefore = ls.dropped
+		ls.window, ls.count, ls.credit, ls.dropped = window, 0, 0, 0
+	}
+	ls.count++
+
+	if ls.threshold == 0 || ls.count <= ls.threshold || status >= http.StatusBadRequest {
+		return true, droppedBefore
+	}
+	// Keep every 1/rate-th request rather than picking at random, so the
+	// fraction logged is exact
+	ls.credit += ls.rate
+	if ls.credit >= 1 {
+		ls.credit--
+		return true, droppedBefore
+	}
+	ls.dropped++
+	ls.sampledOut.Inc()
+	return false, droppedBefore
+}
+
+// accessLogWriter records the status and size of a response for the
+// access log
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (aw *accessLogWriter) WriteHeader(status int) {
+	if aw.status == 0 {
+		aw.status = status
+	}
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *accessLogWriter) Write(p []byte) (int, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	n, err := aw.ResponseWriter.Write(p)
+	aw.bytes += n
+	return n, err
+}
+
+// Flush supports streaming handlers
+func (aw *accessLogWriter) Flush() {
+	if f, ok := aw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (aw *accessLogWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
+
+// accessLog logs a line for each request once it has been answered,
+// sampling successful requests under load as configured by
+// ACCESS_LOG_SAMPLE_RPS
+func (s *Server) accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		aw := &accessLogWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r)
+
+		status := aw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		keep, dropped := s.logSampler.keep(status)
+		if dropped > 0 {
+			log.Printf("Access log sampled out %d successful requests in its last busy second", dropped)
+		}
+		if keep {
+			log.Printf("%s %s %d %dB %s from %s (request %s)", r.Method, r.URL.RequestURI(), status, aw.bytes,
+				time.Since(start).Round(time.Microsecond), clientIP(r), requestIDFrom(r.Context()))
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// countingCounter is a counter that also remembers its increments where
+// the test can read them
+type countingCounter struct {
+	prometheus.Counter
+	n int
+}
+
+func (c *countingCounter) Inc() {
+	c.n++
+	c.Counter.Inc()
+}
+
+func TestLogSamplerThinsSuccessesAboveThreshold(t *testing.T) {
+	ls := newLogSampler(10, 0.25)
+	clock := newFakeClock()
+	ls.now = clock.now
+	counter := &countingCounter{Counter: prometheus.NewCounter(prometheus.CounterOpts{Name: "test_sampled_out"})}
+	ls.sampledOut = counter
+
+	kept := 0
+	for i := 0; i < 10; i++ {
+		if keep, _ := ls.keep(http.StatusOK); keep {
+			kept++
+		}
+	}
+	if kept != 10 {
+		t.Fatalf("kept %d of the first 10 requests, want all below the threshold", kept)
+	}
+
+	kept = 0
+	for i := 0; i < 20; i++ {
+		if keep, _ := ls.keep(http.StatusOK); keep {
+			kept++
+		}
+		if keep, _ := ls.keep(http.StatusInternalServerError); !keep {
+			t.Fatal("error response sampled out, want every error logged")
+		}
+	}
+	if kept != 5 {
+		t.Errorf("kept %d of 20 successes above the threshold, want a quarter", kept)
+	}
+	if counter.n != 15 {
+		t.Errorf("sampled-out counter = %d, want 15", counter.n)
+	}
+
+	clock.advance(time.Second)
+	keep, dropped := ls.keep(http.StatusOK)
+	if !keep || dropped != 15 {
+		t.Errorf("first request of the next second: keep %t, dropped %d; want kept with 15 reported", keep, dropped)
+	}
+}
+
+func TestLogSamplerWithoutThresholdKeepsEverything(t *testing.T) {
+	ls := newLogSampler(0, 0.1)
+	for i := 0; i < 100; i++ {
+		if keep, _ := ls.keep(http.StatusOK); !keep {
+			t.Fatalf("request %d sampled out with no threshold set", i+1)
+		}
+	}
+}
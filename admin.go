@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// version is the release version, overridden at build time with
+// -ldflags "-X main.version=..."
+var version = "1.0.0"
+
+// requireAdmin only lets requests carrying the configured admin token
+// through to next
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.AdminToken == "" {
+			writeError(w, r, CodeForbidden, "Admin access is not configured")
+			return
+		}
+
+		if !s.isAdmin(r) {
+			writeError(w, r, CodeUnauthorized, "Admin token required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// isAdmin reports whether r carries the configured admin token
+func (s *Server) isAdmin(r *http.Request) bool {
+	if s.cfg.AdminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AdminToken)) == 1
+}
+
+// adminAddr returns the address the ADMIN_PORT listener binds: the admin
+// port on the LISTEN_ADDR host, so the admin endpoints are never exposed
+// on more interfaces than the public ones
+func adminAddr(cfg Config) string {
+	var host string
+	if cfg.ListenNetwork == "tcp" {
+		host, _, _ = net.SplitHostPort(cfg.ListenAddr)
+	}
+	return net.JoinHostPort(host, cfg.AdminPort)
+}
+
+// splitAdmin returns the handlers for the public and admin listeners. The
+// admin one marks its requests, so separateAdmin can tell which listener
+// they came in on.
+func (s *Server) splitAdmin(h http.Handler) (public, admin http.Handler) {
+	return h, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminListenerKey, true)))
+	})
+}
+
+// separateAdmin serves the routes in adminRoutes only on the ADMIN_PORT
+// listener and every other route only on the public one
+func (s *Server) separateAdmin(adminRoutes map[*mux.Route]bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			onAdmin, _ := r.Context().Value(adminListenerKey).(bool)
+			if adminRoutes[mux.CurrentRoute(r)] != onAdmin {
+				s.notFoundHandler(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Build and runtime diagnostics
+func (s *Server) buildInfoHandler(w http.ResponseWriter, r *http.Request) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		writeError(w, r, CodeInternal, "Build information is unavailable")
+		return
+	}
+
+	settings := make(map[string]string, len(info.Settings))
+	for _, setting := range info.Settings {
+		settings[setting.Key] = setting.Value
+	}
+
+	deps := make([]map[string]string, 0, len(info.Deps))
+	for _, dep := range info.Deps {
+		deps = append(deps, map[string]string{
+			"path":    dep.Path,
+			"version": dep.Version,
+		})
+	}
+
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "Build information retrieved successfully",
+		Data: map[string]interface{}{
+			"version":        version,
+			"go_version":     info.GoVersion,
+			"path":           info.Path,
+			"main_version":   info.Main.Version,
+			"vcs_revision":   settings["vcs.revision"],
+			"vcs_time":       settings["vcs.time"],
+			"vcs_modified":   settings["vcs.modified"] == "true",
+			"build_settings": settings,
+			"dependencies":   deps,
+		},
+	})
+}
+
+// Go runtime memory and GC figures, to watch memory behaviour without a
+// profiler. Reading them briefly stops the world.
+func (s *Server) runtimeStatsHandler(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	var lastGC *time.Time
+	var lastPause time.Duration
+	if mem.NumGC > 0 {
+		t := time.Unix(0, int64(mem.LastGC)).UTC()
+		lastGC = &t
+		lastPause = time.Duration(mem.PauseNs[(mem.NumGC+255)%256])
+	}
+
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "Runtime stats retrieved successfully",
+		Data: map[string]interface{}{
+			"goroutines":        runtime.NumGoroutine(),
+			"gomaxprocs":        runtime.GOMAXPROCS(0),
+			"num_cpu":           runtime.NumCPU(),
+			"heap_alloc_bytes":  mem.HeapAlloc,
+			"heap_inuse_bytes":  mem.HeapInuse,
+			"heap_sys_bytes":    mem.HeapSys,
+			"heap_objects":      mem.HeapObjects,
+			"sys_bytes":         mem.Sys,
+			"num_gc":            mem.NumGC,
+			"last_gc":           lastGC,
+			"last_gc_pause":     lastPause.String(),
+			"gc_pause_total":    time.Duration(mem.PauseTotalNs).String(),
+			"gc_cpu_fraction":   mem.GCCPUFraction,
+			"next_gc_bytes":     mem.NextGC,
+			"total_alloc_bytes": mem.TotalAlloc,
+		},
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestBuildInfoReportsTheGoVersion(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN=admin-secret")
+	h := srv.requireAdmin(srv.buildInfoHandler)
+
+	r := newTestRequest("GET", "/api/v1/debug/buildinfo", nil)
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	var info struct {
+		Version   string `json:"version"`
+		GoVersion string `json:"go_version"`
+	}
+	decodeData(t, decodeResponse(t, serve(h, r), http.StatusOK), &info)
+	if info.GoVersion != runtime.Version() {
+		t.Errorf("go_version = %q, want %q", info.GoVersion, runtime.Version())
+	}
+	if info.Version != version {
+		t.Errorf("version = %q, want %q", info.Version, version)
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN=admin-secret")
+	h := srv.requireAdmin(srv.buildInfoHandler)
+	for _, tt := range []struct {
+		name, header string
+		want         int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer guess", http.StatusUnauthorized},
+		{"admin token", "Bearer admin-secret", http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRequest("GET", "/api/v1/debug/buildinfo", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			decodeResponse(t, serve(h, r), tt.want)
+		})
+	}
+
+	unconfigured := newTestServer(t, "ADMIN_TOKEN=")
+	decodeResponse(t, do(unconfigured.requireAdmin(unconfigured.buildInfoHandler), "GET", "/api/v1/debug/buildinfo", ""), http.StatusForbidden)
+}
+
+func TestRuntimeStatsArePlausible(t *testing.T) {
+	h := newTestServer(t, "ADMIN_TOKEN=admin-secret").Handler()
+	decodeResponse(t, do(h, "GET", "/api/v1/admin/runtime", ""), http.StatusUnauthorized)
+
+	r := newTestRequest("GET", "/api/v1/admin/runtime", nil)
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	var stats struct {
+		Goroutines int    `json:"goroutines"`
+		GOMAXPROCS int    `json:"gomaxprocs"`
+		HeapAlloc  uint64 `json:"heap_alloc_bytes"`
+		HeapSys    uint64 `json:"heap_sys_bytes"`
+	}
+	decodeData(t, decodeResponse(t, serve(h, r), http.StatusOK), &stats)
+	if stats.Goroutines < 1 || stats.Goroutines > 10*runtime.NumGoroutine()+100 {
+		t.Errorf("goroutines = %d, want a plausible count near %d", stats.Goroutines, runtime.NumGoroutine())
+	}
+	if stats.HeapAlloc == 0 || stats.HeapAlloc > stats.HeapSys {
+		t.Errorf("heap alloc %d of %d bytes obtained, want a non-zero figure within the heap", stats.HeapAlloc, stats.HeapSys)
+	}
+	if stats.GOMAXPROCS != runtime.GOMAXPROCS(0) {
+		t.Errorf("gomaxprocs = %d, want %d", stats.GOMAXPROCS, runtime.GOMAXPROCS(0))
+	}
+}
+
+func TestAdminPathsMoveToTheAdminListener(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN=admin-secret", "ADMIN_PORT=9090")
+	public, admin := srv.splitAdmin(srv.Handler())
+
+	// Admin routes outside /admin move too, such as a user's history
+	if _, err := srv.store.Create(context.Background(), User{Name: "Ann", Email: "ann@example.com", Created: time.Now().UTC()}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/api/v1/admin/runtime", "/api/v1/users/1/history"} {
+		r := newTestRequest("GET", path, nil)
+		r.Header.Set("Authorization", "Bearer admin-secret")
+		decodeResponse(t, serve(public, r), http.StatusNotFound)
+		decodeResponse(t, serve(admin, r), http.StatusOK)
+	}
+
+	decodeResponse(t, do(public, "GET", "/api/v1/users", ""), http.StatusOK)
+	decodeResponse(t, do(admin, "GET", "/api/v1/users", ""), http.StatusNotFound)
+}
+
+func TestAdminListenerBindsTheListenHost(t *testing.T) {
+	for _, tt := range []struct {
+		env  []string
+		want string
+	}{
+		{[]string{"ADMIN_PORT=9090"}, ":9090"},
+		{[]string{"LISTEN_ADDR=127.0.0.1:8080", "ADMIN_PORT=9090"}, "127.0.0.1:9090"},
+	} {
+		if got := adminAddr(testConfig(t, tt.env...)); got != tt.want {
+			t.Errorf("%v: admin address = %q, want %q", tt.env, got, tt.want)
+		}
+		t.Setenv("LISTEN_ADDR", "")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// fieldProfileHeader selects a FIELD_ALIASES profile for a request
+const fieldProfileHeader = "X-Field-Profile"
+
+// userFieldNames are the JSON field names of a user, which are the only keys
+// FIELD_ALIASES may rename
+var userFieldNames = func() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeOf(User{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}()
+
+// parseFieldAliases reads the comma-separated FIELD_ALIASES list of
+// profile.field=alias entries, such as mobile.name=full_name, into a map
+// of profile to field renames. Collisions are checked against the keys
+// the fields that aren't renamed are written under in jsonCase.
+func parseFieldAliases(raw, jsonCase string) (map[string]map[string]string, error) {
+	profiles := make(map[string]map[string]string)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, alias, ok := strings.Cut(entry, "=")
+		profile, field, hasField := strings.Cut(strings.TrimSpace(key), ".")
+		alias = strings.TrimSpace(alias)
+		if !ok || !hasField || profile == "" || alias == "" {
+			return nil, fmt.Errorf("FIELD_ALIASES: entry %q must be profile.field=alias", entry)
+		}
+		if !userFieldNames[field] {
+			return nil, fmt.Errorf("FIELD_ALIASES: %q is not a user field", field)
+		}
+		if profiles[profile] == nil {
+			profiles[profile] = make(map[string]string)
+		}
+		profiles[profile][field] = alias
+	}
+
+	// A rename must not land on a key the response already has
+	for profile, aliases := range profiles {
+		used := make(map[string]string, len(userFieldNames))
+		for field := range userFieldNames {
+			if _, renamed := aliases[field]; !renamed {
+				used[responseFormat{JSONCase: jsonCase}.key(field, true)] = field
+			}
+		}
+		fields := make([]string, 0, len(aliases))
+		for field := range aliases {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			alias := aliases[field]
+			if other, taken := used[alias]; taken {
+				return nil, fmt.Errorf("FIELD_ALIASES: %s.%s=%s collides with %s", profile, field, alias, other)
+			}
+			used[alias] = field
+		}
+	}
+	return profiles, nil
+}
+
+// formatResponses puts the request's response format in its context for
+// the response writers. It adds the FIELD_ALIASES profile named by the
+// X-Field-Profile header, or FIELD_PROFILE when it is absent. Renames only
+// apply to the fields of user objects, never inside metadata, and
+// streamed exports are left alone.
+func (s *Server) formatResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := s.format
+		if len(s.cfg.FieldAliases) > 0 {
+			w.Header().Add("Vary", fieldProfileHeader)
+			name := r.Header.Get(fieldProfileHeader)
+			if name == "" {
+				name = s.cfg.FieldProfile
+			}
+			if name != "" {
+				aliases, ok := s.cfg.FieldAliases[name]
+				if !ok {
+					r = r.WithContext(context.WithValue(r.Context(), responseFormatKey, format))
+					writeError(w, r, CodeInvalidRequest, fmt.Sprintf("Unknown field profile %q", name))
+					return
+				}
+				format.Aliases = aliases
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), responseFormatKey, format)))
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestFieldProfileRenamesResponseKeys(t *testing.T) {
+	h := newTestServer(t, "FIELD_ALIASES=mobile.name=full_name").Handler()
+	decodeResponse(t, do(h, "POST", "/api/v1/users", `{"name":"Ann Lee","email":"ann@example.com"}`), http.StatusCreated)
+
+	get := func(profile string) map[string]json.RawMessage {
+		r := newTestRequest("GET", "/api/v1/users/1", nil)
+		if profile != "" {
+			r.Header.Set(fieldProfileHeader, profile)
+		}
+		var fields map[string]json.RawMessage
+		decodeData(t, decodeResponse(t, serve(h, r), http.StatusOK), &fields)
+		return fields
+	}
+
+	mobile := get("mobile")
+	if string(mobile["full_name"]) != `"Ann Lee"` {
+		t.Errorf("full_name = %s, want the user's name", mobile["full_name"])
+	}
+	if _, ok := mobile["name"]; ok {
+		t.Errorf("mobile profile still has name: %v", mobile)
+	}
+	if string(mobile["email"]) != `"ann@example.com"` {
+		t.Errorf("email = %s, want unmapped fields kept", mobile["email"])
+	}
+	if plain := get(""); string(plain["name"]) != `"Ann Lee"` {
+		t.Errorf("no profile: name = %s, want it unchanged", plain["name"])
+	}
+
+	r := newTestRequest("GET", "/api/v1/users/1", nil)
+	r.Header.Set(fieldProfileHeader, "desktop")
+	decodeResponse(t, serve(h, r), http.StatusBadRequest)
+}
+
+func TestFieldAliasesMustNameRealFields(t *testing.T) {
+	for _, raw := range []string{"mobile.nickname=nick", "mobile.name=email", "name=full_name"} {
+		if _, err := parseFieldAliases(raw, jsonCaseSnake); err == nil {
+			t.Errorf("parseFieldAliases(%q) succeeded, want an error", raw)
+		}
+	}
+
+	// Under camelCase a rename collides with the camelCase key of another
+	// field, not its snake_case name
+	if _, err := parseFieldAliases("mobile.name=emailVerified", jsonCaseCamel); err == nil {
+		t.Error("alias colliding with the camelCase emailVerified key accepted")
+	}
+	if _, err := parseFieldAliases("mobile.name=email_verified", jsonCaseCamel); err != nil {
+		t.Errorf("alias matching only the snake_case name under camelCase: %v", err)
+	}
+}
+
+func TestFieldProfilesHaveTheirOwnETags(t *testing.T) {
+	h := newTestServer(t, "FIELD_ALIASES=mobile.name=full_name").Handler()
+	decodeResponse(t, do(h, "POST", "/api/v1/users", `{"name":"Ann Lee","email":"ann@example.com"}`), http.StatusCreated)
+
+	plain := do(h, "GET", "/api/v1/users/1", "").Header().Get("ETag")
+	r := newTestRequest("GET", "/api/v1/users/1", nil)
+	r.Header.Set(fieldProfileHeader, "mobile")
+	mobile := serve(h, r).Header().Get("ETag")
+	if plain == "" || mobile == "" || plain == mobile {
+		t.Errorf("ETags = %q plain and %q mobile, want a distinct tag per profile", plain, mobile)
+	}
+}
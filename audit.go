@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// auditPerUser is how many audit entries are kept for each user, and
+// auditMaxEntries how many are kept across all users
+const (
+	auditPerUser    = 100
+	auditMaxEntries = 100000
+)
+
+// auditEntry records a single change to a user. Before is the user as the
+// previous entry left it, so it is missing for creations and for the
+// first change to a user that existed before the server started. After
+// is missing for deletions.
+type auditEntry struct {
+	ID        int       `json:"id"`
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	UserID    int       `json:"user_id"`
+	Actor     string    `json:"actor,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Before    *User     `json:"before,omitempty"`
+	After     *User     `json:"after,omitempty"`
+
+	// OrgID is the tenant owning the user, used to scope reads
+	OrgID string `json:"-"`
+}
+
+// auditLog keeps the most recent changes to each user in memory. Entry
+// IDs double as the IDs of the events published for the changes.
+type auditLog struct {
+	mu         sync.Mutex
+	entries    map[int][]auditEntry
+	owners     map[int]int
+	nextID     int
+	maxEntries int
+
+	// oldestID is the lowest entry ID that may still be kept
+	oldestID int
+}
+
+// newAuditLog returns an empty log keeping at most auditMaxEntries entries
+func newAuditLog() *auditLog {
+	return &auditLog{
+		entries:    make(map[int][]auditEntry),
+		owners:     make(map[int]int),
+		nextID:     1,
+		maxEntries: auditMaxEntries,
+		oldestID:   1,
+	}
+}
+
+// Record assigns e the next ID and adds it to its user's history, filling
+// in Before from the last entry. The user's oldest entry is dropped once
+// auditPerUser is reached, and the oldest entry of any user once
+// maxEntries is. It returns the ID.
+func (l *auditLog) Record(e auditEntry) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.ID = l.nextID
+	l.nextID++
+
+	history := l.entries[e.UserID]
+	if n := len(history); n > 0 {
+		e.Before = history[n-1].After
+	}
+	if len(history) >= auditPerUser {
+		delete(l.owners, history[0].ID)
+		history = append(history[:0:0], history[1:]...)
+	}
+	l.entries[e.UserID] = append(history, e)
+	l.owners[e.ID] = e.UserID
+
+	for len(l.owners) > l.maxEntries {
+		l.dropOldest()
+	}
+	return e.ID
+}
+
+// dropOldest removes the entry with the lowest ID. Entry IDs grow with
+// time, so it is always the first in its user's history.
+func (l *auditLog) dropOldest() {
+	for ; l.oldestID < l.nextID; l.oldestID++ {
+		userID, ok := l.owners[l.oldestID]
+		if !ok {
+			continue
+		}
+		delete(l.owners, l.oldestID)
+		if history := l.entries[userID][1:]; len(history) > 0 {
+			l.entries[userID] = history
+		} else {
+			delete(l.entries, userID)
+		}
+		l.oldestID++
+		return
+	}
+}
+
+// Forget drops the histories of the users with the given IDs, once they
+// have been permanently removed
+func (l *auditLog) Forget(ids []int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, id := range ids {
+		for _, e := range l.entries[id] {
+			delete(l.owners, e.ID)
+		}
+		delete(l.entries, id)
+	}
+}
+
+// Entry returns the kept entry with the given ID
+func (l *auditLog) Entry(id int) (auditEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	userID, ok := l.owners[id]
+	if !ok {
+		return auditEntry{}, false
+	}
+	for _, e := range l.entries[userID] {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return auditEntry{}, false
+}
+
+// History returns the kept entries for the user with the given ID, oldest
+// first
+func (l *auditLog) History(id int) []auditEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]auditEntry{}, l.entries[id]...)
+}
+
+// audit records a change to u made by the request in ctx and returns the
+// entry's ID
+func (s *Server) audit(ctx context.Context, eventType string, u User) int {
+	e := auditEntry{
+		Time:      s.now().UTC(),
+		Action:    eventType,
+		UserID:    u.ID,
+		Actor:     subjectFrom(ctx),
+		RequestID: requestIDFrom(ctx),
+		OrgID:     u.OrgID,
+	}
+	if eventType != EventUserDeleted {
+		after := cloneUser(u)
+		e.After = &after
+	}
+	return s.auditLog.Record(e)
+}
+
+// Get the recorded changes to a user, oldest first. Only changes made
+// since the server started are known.
+func (s *Server) getUserHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(r)
+	if !ok {
+		writeError(w, r, CodeUserNotFound, "")
+		return
+	}
+
+	history := s.auditLog.History(id)
+	if len(history) == 0 || !s.visible(r.Context(), User{OrgID: history[0].OrgID}) {
+		// Nothing recorded, so fall back to whether the user exists
+		if _, err := s.getUser(r.Context(), id); err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		history = []auditEntry{}
+	}
+
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "User history retrieved successfully",
+		Data:    history,
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestUserHistoryListsChangesInOrder(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN=admin-secret")
+	h := srv.Handler()
+
+	var created User
+	decodeData(t, decodeResponse(t, do(h, "POST", "/api/v1/users", `{"name":"Hal","email":"hal@example.com"}`), http.StatusCreated), &created)
+	path := fmt.Sprintf("/api/v1/users/%d", created.ID)
+	decodeResponse(t, do(h, "PATCH", path, `{"name":"Hal 9000"}`), http.StatusOK)
+
+	r := newTestRequest("GET", path+"/history", nil)
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	var history []auditEntry
+	decodeData(t, decodeResponse(t, serve(h, r), http.StatusOK), &history)
+	if len(history) != 2 {
+		t.Fatalf("got %d history entries, want 2", len(history))
+	}
+	if history[0].Action != EventUserCreated || history[1].Action != EventUserUpdated || history[1].Time.Before(history[0].Time) {
+		t.Errorf("history actions = %s (%s), %s (%s); want created then updated",
+			history[0].Action, history[0].Time, history[1].Action, history[1].Time)
+	}
+	if history[1].Before == nil || history[1].Before.Name != "Hal" || history[1].After == nil || history[1].After.Name != "Hal 9000" {
+		t.Errorf("update entry doesn't snapshot the rename: before %+v, after %+v", history[1].Before, history[1].After)
+	}
+
+	decodeResponse(t, do(h, "GET", path+"/history", ""), http.StatusUnauthorized)
+}
+
+func TestAuditLogKeepsABoundedHistoryPerUser(t *testing.T) {
+	l := newAuditLog()
+	for i := 0; i < auditPerUser+5; i++ {
+		l.Record(auditEntry{Action: EventUserUpdated, UserID: 1, RequestID: fmt.Sprint(i)})
+	}
+
+	history := l.History(1)
+	if len(history) != auditPerUser {
+		t.Fatalf("kept %d entries, want %d", len(history), auditPerUser)
+	}
+	if history[0].RequestID != "5" || history[len(history)-1].RequestID != fmt.Sprint(auditPerUser+4) {
+		t.Errorf("kept entries %s to %s, want the newest %d", history[0].RequestID, history[len(history)-1].RequestID, auditPerUser)
+	}
+}
+
+func TestAuditLogKeepsABoundedHistoryOverall(t *testing.T) {
+	l := newAuditLog()
+	l.maxEntries = 10
+	for user := 1; user <= 6; user++ {
+		for i := 0; i < 2; i++ {
+			l.Record(auditEntry{Action: EventUserUpdated, UserID: user})
+		}
+	}
+
+	// The first user's two entries were the oldest of the twelve
+	if history := l.History(1); len(history) != 0 {
+		t.Errorf("user 1 kept %d entries, want its history dropped as the oldest", len(history))
+	}
+	for user := 2; user <= 6; user++ {
+		if n := len(l.History(user)); n != 2 {
+			t.Errorf("user %d kept %d entries, want 2", user, n)
+		}
+	}
+
+	l.Forget([]int{2, 3})
+	if len(l.History(2)) != 0 || len(l.History(3)) != 0 || len(l.owners) != 6 {
+		t.Errorf("after forgetting users 2 and 3: %d entries left, want the other users' 6", len(l.owners))
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// parseAuthTokens reads AUTH_TOKENS, a comma-separated list of
+// token:userID pairs, into a map from token to subject
+func parseAuthTokens(raw string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	if raw == "" {
+		return tokens, nil
+	}
+
+	for _, entry := range strings.Split(raw, ",") {
+		i := strings.LastIndex(entry, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("AUTH_TOKENS entries must be token:userID, got %q", entry)
+		}
+		token, subject := entry[:i], entry[i+1:]
+		if id, err := strconv.Atoi(subject); err != nil || id < 1 {
+			return nil, fmt.Errorf("AUTH_TOKENS subject must be a user ID, got %q", subject)
+		}
+		tokens[token] = subject
+	}
+	return tokens, nil
+}
+
+// subjectFrom returns the authenticated subject recorded in ctx, or ""
+// for anonymous requests
+func subjectFrom(ctx context.Context) string {
+	subject, _ := ctx.Value(subjectKey).(string)
+	return subject
+}
+
+// tokenSubject returns the subject for token, comparing against every
+// configured token in constant time
+func (s *Server) tokenSubject(token string) string {
+	subject := ""
+	for candidate, sub := range s.cfg.AuthTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1 {
+			subject = sub
+		}
+	}
+	return subject
+}
+
+// authenticate records the subject of a recognised bearer token in the
+// request context. Requests without a valid token continue anonymously;
+// handlers that need a user check subjectFrom.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || len(s.cfg.AuthTokens) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if subject := s.tokenSubject(token); subject != "" {
+			r = r.WithContext(context.WithValue(r.Context(), subjectKey, subject))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Get the user identified by the request's auth token
+func (s *Server) getCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	subject := subjectFrom(r.Context())
+	if subject == "" {
+		writeError(w, r, CodeUnauthorized, "")
+		return
+	}
+
+	id, err := strconv.Atoi(subject)
+	if err != nil {
+		writeError(w, r, CodeUserNotFound, "")
+		return
+	}
+	user, err := s.getUser(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", userETag(user, responseFormatFrom(r.Context())))
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "User found",
+		Data:    user,
+	})
+}
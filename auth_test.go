@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCurrentUser(t *testing.T) {
+	srv := newTestServer(t, "AUTH_TOKENS=alice-token:1,ghost-token:99")
+	h := srv.Handler()
+	alice, err := srv.store.Create(context.Background(), User{Name: "Alice", Email: "alice@example.com", Created: time.Now().UTC()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("authenticated", func(t *testing.T) {
+		r := newTestRequest("GET", "/api/v1/users/me", nil)
+		r.Header.Set("Authorization", "Bearer alice-token")
+		var got User
+		decodeData(t, decodeResponse(t, serve(h, r), http.StatusOK), &got)
+		if got.ID != alice.ID || got.Email != alice.Email {
+			t.Errorf("got user %d %s, want %d %s", got.ID, got.Email, alice.ID, alice.Email)
+		}
+	})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		resp := decodeResponse(t, do(h, "GET", "/api/v1/users/me", ""), http.StatusUnauthorized)
+		if resp.Code != CodeUnauthorized {
+			t.Errorf("code = %s, want %s", resp.Code, CodeUnauthorized)
+		}
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		r := newTestRequest("GET", "/api/v1/users/me", nil)
+		r.Header.Set("Authorization", "Bearer wrong-token")
+		decodeResponse(t, serve(h, r), http.StatusUnauthorized)
+	})
+
+	t.Run("subject gone", func(t *testing.T) {
+		r := newTestRequest("GET", "/api/v1/users/me", nil)
+		r.Header.Set("Authorization", "Bearer ghost-token")
+		decodeResponse(t, serve(h, r), http.StatusNotFound)
+	})
+}
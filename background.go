@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// backgroundTasks tracks long-running goroutines so shutdown can wait for
+// them to exit
+type backgroundTasks struct {
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	running map[string]int
+}
+
+// newBackgroundTasks returns an empty task group
+func newBackgroundTasks() *backgroundTasks {
+	return &backgroundTasks{running: make(map[string]int)}
+}
+
+// Go runs fn in a new goroutine under name. fn must return once the
+// context it was given is cancelled.
+func (b *backgroundTasks) Go(name string, fn func()) {
+	b.mu.Lock()
+	b.running[name]++
+	b.mu.Unlock()
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer func() {
+			b.mu.Lock()
+			b.running[name]--
+			if b.running[name] == 0 {
+				delete(b.running, name)
+			}
+			b.mu.Unlock()
+		}()
+		fn()
+	}()
+}
+
+// Wait blocks until every task has exited or ctx is done. It returns the
+// names of the tasks still running, which is empty on a clean stop.
+func (b *backgroundTasks) Wait(ctx context.Context) []string {
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	names := make([]string, 0, len(b.running))
+	for name := range b.running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// backgroundStopTimeout bounds how long shutdown waits for background
+// tasks to exit
+const backgroundStopTimeout = 5 * time.Second
+
+// stopBackground cancels the background tasks and waits for them to exit,
+// logging any that don't stop in time
+func stopBackground(tasks *backgroundTasks, cancel context.CancelFunc) {
+	cancel()
+
+	ctx, done := context.WithTimeout(context.Background(), backgroundStopTimeout)
+	defer done()
+	if stuck := tasks.Wait(ctx); len(stuck) > 0 {
+		log.Printf("Background tasks did not stop within %s: %v", backgroundStopTimeout, stuck)
+	}
+}
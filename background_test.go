@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStopBackgroundStopsTheJanitor(t *testing.T) {
+	limiter := newIPRateLimiter(10, 5, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	tasks := newBackgroundTasks()
+	exited := make(chan struct{})
+	tasks.Go("rate limiter janitor", func() {
+		defer close(exited)
+		limiter.runJanitor(ctx, time.Millisecond, time.Now)
+	})
+
+	stopBackground(tasks, cancel)
+	select {
+	case <-exited:
+	default:
+		t.Fatal("janitor still running after stopBackground returned")
+	}
+}
+
+func TestBackgroundWaitNamesStuckTasks(t *testing.T) {
+	tasks := newBackgroundTasks()
+	release := make(chan struct{})
+	defer close(release)
+	tasks.Go("stuck", func() { <-release })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if stuck := tasks.Wait(ctx); len(stuck) != 1 || stuck[0] != "stuck" {
+		t.Errorf("Wait = %v, want [stuck]", stuck)
+	}
+}
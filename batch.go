@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// importRetryAfter is the retry hint given to imports turned away because
+// MAX_CONCURRENT_IMPORTS are already running
+const importRetryAfter = 5 * time.Second
+
+// Values accepted by the batch ?mode parameter
+const (
+	batchModeCreate = "create"
+	batchModeUpsert = "upsert"
+)
+
+// batchItemError describes why a single batch element was not created
+type batchItemError struct {
+	Index   int          `json:"index"`
+	Message string       `json:"message"`
+	Errors  []FieldError `json:"errors,omitempty"`
+}
+
+// batchSummary reports the outcome of a batch create. Updated is only
+// reported in upsert mode.
+type batchSummary struct {
+	Processed int              `json:"processed"`
+	Created   []User           `json:"created"`
+	Updated   []User           `json:"updated,omitempty"`
+	Failed    []batchItemError `json:"failed"`
+}
+
+// batchItemMessage returns the per-item message for a store error
+func batchItemMessage(err error) string {
+	switch {
+	case errors.Is(err, ErrDuplicateEmail):
+		return "A user with this email already exists"
+	case errors.Is(err, ErrVersionMismatch):
+		return "User was changed by another request"
+	default:
+		return "Failed to create user"
+	}
+}
+
+// Create users from a JSON array. Elements are decoded and stored one at
+// a time, so a body that is truncated or malformed part way through still
+// reports how many elements were processed before it stopped. A batch
+// running past MAX_BATCH_SIZE elements is a 207 partial success: the
+// users up to the cap are kept and the rest aren't read. With
+// ?mode=upsert an element whose email matches an existing user updates
+// that user instead, so an import can be safely re-run. New users may
+// keep the created time they carry, under the same future timestamp
+// policy as seeding. At most MAX_CONCURRENT_IMPORTS batches run at once.
+func (s *Server) batchCreateUsersHandler(w http.ResponseWriter, r *http.Request) {
+	select {
+	case s.imports <- struct{}{}:
+		defer func() { <-s.imports }()
+	default:
+		writeRetryError(w, r, CodeRateLimited, "Too many imports are already running", importRetryAfter)
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "", batchModeCreate:
+		mode = batchModeCreate
+	case batchModeUpsert:
+	default:
+		writeParamError(w, r, &ParamError{Param: "mode", Message: "must be create or upsert"})
+		return
+	}
+
+	summary := batchSummary{Created: []User{}, Failed: []batchItemError{}}
+	if mode == batchModeUpsert {
+		summary.Updated = []User{}
+	}
+
+	err := s.decodeUserArray(w, r, func(in importInput) error {
+		index := summary.Processed
+		summary.Processed++
+
+		created, errs := in.check(s.cfg, s.now())
+		if len(errs) > 0 {
+			summary.Failed = append(summary.Failed, batchItemError{
+				Index:   index,
+				Message: "Validation failed",
+				Errors:  errs,
+			})
+			return nil
+		}
+
+		// Each upserted row looks up its own email, so earlier rows of the
+		// batch are seen without loading every user
+		var existing User
+		var found bool
+		if mode == batchModeUpsert {
+			users, err := s.getManyUsersByEmail(r.Context(), []string{in.Email})
+			if err != nil {
+				summary.Failed = append(summary.Failed, batchItemError{Index: index, Message: batchItemMessage(err)})
+				return nil
+			}
+			existing, found = users[s.emailKey(in.Email)]
+		}
+		if found {
+			if in.Email != existing.Email {
+				if rejection := s.checkEmailPolicy(r.Context(), in.Email); rejection != nil {
+					summary.Failed = append(summary.Failed, rejection.batchItem(index))
+					return nil
+				}
+			}
+			existing.Name, existing.Email = in.Name, in.Email
+			existing.Tags, existing.Metadata = in.Tags, in.Metadata
+			user, err := s.store.UpdateIfVersion(r.Context(), existing.ID, existing.Version, existing)
+			if err != nil {
+				summary.Failed = append(summary.Failed, batchItemError{Index: index, Message: batchItemMessage(err)})
+				return nil
+			}
+			s.publish(r.Context(), EventUserUpdated, user)
+			summary.Updated = append(summary.Updated, user)
+			return nil
+		}
+
+		release, rejection := s.admitSignup(r.Context(), in.Email)
+		if rejection != nil {
+			summary.Failed = append(summary.Failed, rejection.batchItem(index))
+			return nil
+		}
+		newUser := in.toUser(created)
+		newUser.OrgID = tenantFrom(r.Context())
+		user, err := s.store.Create(r.Context(), newUser)
+		if err != nil {
+			release()
+			summary.Failed = append(summary.Failed, batchItemError{Index: index, Message: batchItemMessage(err)})
+			return nil
+		}
+		s.publish(r.Context(), EventUserCreated, user)
+		summary.Created = append(summary.Created, user)
+		return nil
+	})
+	switch {
+	case errors.Is(err, errBatchTooLarge):
+		// The users before the cap are already stored, so this is a
+		// partial success rather than an error
+		writeJSON(w, r, http.StatusMultiStatus, Response{
+			Status:  "partial",
+			Message: fmt.Sprintf("Processed the first %d users; the rest of the batch was not read since MAX_BATCH_SIZE is %d", summary.Processed, s.cfg.MaxBatchSize),
+			Data:    summary,
+		})
+		return
+	case errors.Is(err, errNotArray):
+		writeDecodeError(w, r, err)
+		return
+	case err != nil:
+		writeBatchDecodeError(w, r, err, summary)
+		return
+	}
+
+	status, result := http.StatusCreated, "success"
+	switch {
+	case len(summary.Created) > 0:
+	case len(summary.Updated) > 0:
+		status = http.StatusOK
+	case len(summary.Failed) > 0:
+		status, result = http.StatusBadRequest, "error"
+	}
+	message := fmt.Sprintf("Created %d of %d users", len(summary.Created), summary.Processed)
+	if mode == batchModeUpsert {
+		message = fmt.Sprintf("Created %d and updated %d of %d users", len(summary.Created), len(summary.Updated), summary.Processed)
+	}
+	writeJSON(w, r, status, Response{
+		Status:  result,
+		Message: message,
+		Data:    summary,
+	})
+}
+
+// writeBatchDecodeError reports a body that stopped decoding part way
+// through a batch, along with the progress made before it
+func writeBatchDecodeError(w http.ResponseWriter, r *http.Request, err error, summary batchSummary) {
+	code, message := CodeInvalidJSON, "Invalid JSON payload"
+	var shapeErr *bodyShapeError
+	switch {
+	case isBodyTooLarge(err):
+		code, message = CodePayloadTooLarge, "Request body too large"
+	case isBodyIncomplete(err):
+		code, message = CodeInvalidRequest, "Incomplete request body"
+	case errors.As(err, &shapeErr):
+		message = shapeErr.message
+	}
+	writeJSON(w, r, lookupError(code).Status, Response{
+		Status:  "error",
+		Code:    code,
+		Message: fmt.Sprintf("%s after %d processed items", message, summary.Processed),
+		Data:    summary,
+	})
+}
+
+// batchValidation is the outcome of checking a single batch element
+type batchValidation struct {
+	Index  int          `json:"index"`
+	Valid  bool         `json:"valid"`
+	Errors []FieldError `json:"errors"`
+}
+
+// batchValidationSummary counts the elements that would and would not be
+// created
+type batchValidationSummary struct {
+	Total   int `json:"total"`
+	Valid   int `json:"valid"`
+	Invalid int `json:"invalid"`
+}
+
+// Check a JSON array of users the way a batch create would, without
+// creating any. Besides the per-user rules, emails repeated within the
+// batch flag every row using them, and emails already taken are reported,
+// so an import file can be fixed before it is sent. Like a batch create
+// it holds at most MAX_BATCH_SIZE users.
+func (s *Server) validateBatchHandler(w http.ResponseWriter, r *http.Request) {
+	// Elements are checked as they are decoded. Only each row's errors
+	// and email key are kept, to flag repeated emails once every row has
+	// been seen.
+	var checked []batchRowCheck
+	rows := make(map[string][]int)
+	var emails []string
+	err := s.decodeUserArray(w, r, func(in importInput) error {
+		check := batchRowCheck{errs: in.validate(s.cfg, s.now())}
+		if in.Email != "" {
+			check.key = s.emailKey(in.Email)
+			if len(rows[check.key]) == 0 {
+				emails = append(emails, in.Email)
+			}
+			rows[check.key] = append(rows[check.key], len(checked))
+			if domain := emailDomain(in.Email); s.cfg.BlockedDomains[domain] {
+				check.blocked = domain
+			}
+		}
+		checked = append(checked, check)
+		return nil
+	})
+	switch {
+	case errors.Is(err, errBatchTooLarge):
+		writeError(w, r, CodePayloadTooLarge, fmt.Sprintf("Batch may contain at most %d users", s.cfg.MaxBatchSize))
+		return
+	case err != nil:
+		writeDecodeError(w, r, err)
+		return
+	}
+
+	// Emails are unique across every tenant, so the batch's emails are
+	// looked up in the whole store rather than the caller's users
+	taken := make(map[string]bool, len(emails))
+	if len(emails) > 0 {
+		found, err := s.store.GetManyByEmail(r.Context(), emails)
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		for _, u := range found {
+			taken[s.emailKey(u.Email)] = true
+		}
+	}
+
+	results := make([]batchValidation, 0, len(checked))
+	summary := batchValidationSummary{Total: len(checked)}
+	for i, check := range checked {
+		errs := check.errs
+		if errs == nil {
+			errs = []FieldError{}
+		}
+		if check.key != "" {
+			if others := otherRows(rows[check.key], i); len(others) > 0 {
+				errs = append(errs, FieldError{Field: "email", Message: fmt.Sprintf("is repeated in the batch at rows %s", others)})
+			}
+			if taken[check.key] {
+				errs = append(errs, FieldError{Field: "email", Message: "is already used by an existing user"})
+			}
+			if check.blocked != "" {
+				errs = append(errs, FieldError{Field: "email", Message: fmt.Sprintf("domain %s is not allowed", check.blocked)})
+			}
+		}
+
+		valid := len(errs) == 0
+		if valid {
+			summary.Valid++
+		} else {
+			summary.Invalid++
+		}
+		results = append(results, batchValidation{Index: i, Valid: valid, Errors: errs})
+	}
+
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: fmt.Sprintf("%d of %d users are valid", summary.Valid, summary.Total),
+		Data: map[string]interface{}{
+			"rows":    results,
+			"summary": summary,
+		},
+	})
+}
+
+// batchRowCheck is what validateBatchHandler keeps of a row while the
+// rest of the batch is decoded
+type batchRowCheck struct {
+	errs    []FieldError
+	key     string
+	blocked string
+}
+
+// otherRows formats the indexes in rows other than index, such as "0, 3",
+// or returns "" when there are none
+func otherRows(rows []int, index int) string {
+	others := make([]string, 0, len(rows))
+	for _, row := range rows {
+		if row != index {
+			others = append(others, strconv.Itoa(row))
+		}
+	}
+	return strings.Join(others, ", ")
+}
+
+// maxBatchGetIDs caps how many users a single batch get may request
+const maxBatchGetIDs = 100
+
+// batchGetRequest lists the user IDs to fetch
+type batchGetRequest struct {
+	IDs []int `json:"ids"`
+}
+
+// Get several users by ID in one request
+func (s *Server) batchGetUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var req batchGetRequest
+	err := s.decodeArrayField(w, r, "ids", maxBatchGetIDs, func(dec *json.Decoder) error {
+		var id jsonID
+		if err := dec.Decode(&id); err != nil {
+			return err
+		}
+		req.IDs = append(req.IDs, int(id))
+		return nil
+	})
+	switch {
+	case errors.Is(err, errBatchTooLarge):
+		writeError(w, r, CodeInvalidRequest, fmt.Sprintf("ids may contain at most %d user IDs", maxBatchGetIDs))
+		return
+	case err != nil:
+		writeDecodeError(w, r, err)
+		return
+	case len(req.IDs) == 0:
+		writeError(w, r, CodeInvalidRequest, "ids must contain at least one user ID")
+		return
+	}
+
+	found, err := s.getManyUsers(r.Context(), req.IDs)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	users := make([]User, 0, len(found))
+	notFound := []int{}
+	seen := make(map[int]bool, len(req.IDs))
+	for _, id := range req.IDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if u, ok := found[id]; ok {
+			users = append(users, u)
+		} else {
+			notFound = append(notFound, id)
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: fmt.Sprintf("Found %d of %d users", len(users), len(seen)),
+		Data: map[string]interface{}{
+			"users":     users,
+			"not_found": notFound,
+		},
+	})
+}
+
+// batchGetByEmailRequest lists the emails of the users to fetch
+type batchGetByEmailRequest struct {
+	Emails []string `json:"emails"`
+}
+
+// Get several users by email in one request. Emails are compared the way
+// the store compares them for uniqueness, so case doesn't matter.
+func (s *Server) batchGetUsersByEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var req batchGetByEmailRequest
+	err := s.decodeArrayField(w, r, "emails", maxBatchGetIDs, func(dec *json.Decoder) error {
+		var email string
+		if err := dec.Decode(&email); err != nil {
+			return err
+		}
+		req.Emails = append(req.Emails, email)
+		return nil
+	})
+	switch {
+	case errors.Is(err, errBatchTooLarge):
+		writeError(w, r, CodeInvalidRequest, fmt.Sprintf("emails may contain at most %d emails", maxBatchGetIDs))
+		return
+	case err != nil:
+		writeDecodeError(w, r, err)
+		return
+	case len(req.Emails) == 0:
+		writeError(w, r, CodeInvalidRequest, "emails must contain at least one email")
+		return
+	}
+
+	byEmail, err := s.getManyUsersByEmail(r.Context(), req.Emails)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	users := []User{}
+	notFound := []string{}
+	seen := make(map[string]bool, len(req.Emails))
+	for _, email := range req.Emails {
+		key := s.emailKey(email)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if u, ok := byEmail[key]; ok {
+			users = append(users, u)
+		} else {
+			notFound = append(notFound, email)
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: fmt.Sprintf("Found %d of %d users", len(users), len(seen)),
+		Data: map[string]interface{}{
+			"users":     users,
+			"not_found": notFound,
+		},
+	})
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBatchCreateReportsProgressOnTruncatedBody(t *testing.T) {
+	srv := newTestServer(t)
+	h := http.HandlerFunc(srv.batchCreateUsersHandler)
+
+	body := `[{"name":"Ann","email":"ann@example.com"},{"name":"Bob","email":"bob@example.com"},{"name":"Cy","ema`
+	resp := decodeResponse(t, do(h, "POST", "/api/v1/users/batch", body), http.StatusBadRequest)
+
+	var summary batchSummary
+	decodeData(t, resp, &summary)
+	if summary.Processed != 2 || len(summary.Created) != 2 {
+		t.Errorf("processed %d and created %d users, want 2 and 2", summary.Processed, len(summary.Created))
+	}
+	if !strings.HasSuffix(resp.Message, "after 2 processed items") {
+		t.Errorf("message = %q, want it to report 2 processed items", resp.Message)
+	}
+}
+
+func TestBatchCreateReportsFailedItems(t *testing.T) {
+	srv := newTestServer(t)
+	h := http.HandlerFunc(srv.batchCreateUsersHandler)
+
+	body := `[{"name":"Ann","email":"ann@example.com"},{"name":"","email":"nobody@example.com"},{"name":"Ann again","email":"ann@example.com"}]`
+	var summary batchSummary
+	decodeData(t, decodeResponse(t, do(h, "POST", "/api/v1/users/batch", body), http.StatusCreated), &summary)
+	if summary.Processed != 3 || len(summary.Created) != 1 || len(summary.Failed) != 2 {
+		t.Fatalf("processed %d, created %d, failed %d; want 3, 1 and 2", summary.Processed, len(summary.Created), len(summary.Failed))
+	}
+	if summary.Failed[0].Index != 1 || summary.Failed[1].Index != 2 {
+		t.Errorf("failed indexes = %d, %d; want 1 and 2", summary.Failed[0].Index, summary.Failed[1].Index)
+	}
+}
+
+func TestBatchCreateAppliesTheFutureTimestampPolicy(t *testing.T) {
+	body := `[{"name":"Skewed","email":"skewed@example.com","created":"2030-01-01T00:00:00Z"}]`
+
+	t.Run("clamp", func(t *testing.T) {
+		srv := newTestServer(t, "REJECT_FUTURE_TIMESTAMPS=false")
+		clock := newFakeClock()
+		srv.now = clock.now
+		var summary batchSummary
+		decodeData(t, decodeResponse(t, do(http.HandlerFunc(srv.batchCreateUsersHandler), "POST", "/api/v1/users/batch", body), http.StatusCreated), &summary)
+		if len(summary.Created) != 1 || !summary.Created[0].Created.Equal(clock.now()) {
+			t.Errorf("created %+v, want one user created now", summary.Created)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		srv := newTestServer(t, "REJECT_FUTURE_TIMESTAMPS=true")
+		var summary batchSummary
+		decodeData(t, decodeResponse(t, do(http.HandlerFunc(srv.batchCreateUsersHandler), "POST", "/api/v1/users/batch", body), http.StatusBadRequest), &summary)
+		if len(summary.Created) != 0 || len(summary.Failed) != 1 {
+			t.Fatalf("created %d, failed %d; want the future-dated user failed", len(summary.Created), len(summary.Failed))
+		}
+		if errs := summary.Failed[0].Errors; len(errs) != 1 || errs[0].Field != "created" {
+			t.Errorf("errors = %+v, want one on created", errs)
+		}
+	})
+}
+
+// countingStore is a memory store that counts single and batch lookups
+type countingStore struct {
+	*MemoryStore
+	gets, getManys int
+}
+
+func (c *countingStore) Get(ctx context.Context, id int) (User, error) {
+	c.gets++
+	return c.MemoryStore.Get(ctx, id)
+}
+
+func (c *countingStore) GetMany(ctx context.Context, ids []int) (map[int]User, error) {
+	c.getManys++
+	return c.MemoryStore.GetMany(ctx, ids)
+}
+
+func TestBatchGetUsesOneLookup(t *testing.T) {
+	store := &countingStore{MemoryStore: NewMemoryStore(nil)}
+	srv, err := NewServer(testConfig(t), store)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	var ids []int
+	for _, name := range []string{"one", "two", "three"} {
+		ids = append(ids, createTestUser(t, store, name).ID)
+	}
+
+	body := fmt.Sprintf(`{"ids":[%d,%d,404,%d,%d,405]}`, ids[2], ids[0], ids[1], ids[0])
+	var result struct {
+		Users    []User `json:"users"`
+		NotFound []int  `json:"not_found"`
+	}
+	decodeData(t, decodeResponse(t, do(http.HandlerFunc(srv.batchGetUsersHandler), "POST", "/api/v1/users/batch-get", body), http.StatusOK), &result)
+
+	if store.getManys != 1 || store.gets != 0 {
+		t.Errorf("batch get made %d GetMany and %d Get calls, want a single GetMany", store.getManys, store.gets)
+	}
+	var got []int
+	for _, u := range result.Users {
+		got = append(got, u.ID)
+	}
+	if want := []int{ids[2], ids[0], ids[1]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("users = %v, want %v in request order without repeats", got, want)
+	}
+	if want := []int{404, 405}; !reflect.DeepEqual(result.NotFound, want) {
+		t.Errorf("not_found = %v, want %v", result.NotFound, want)
+	}
+}
+
+func TestUpsertImportCanBeRerun(t *testing.T) {
+	srv := newTestServer(t)
+	batch := http.HandlerFunc(srv.batchCreateUsersHandler)
+	body := `[{"name":"Ada","email":"ada@example.com"},{"name":"Grace","email":"grace@example.com"}]`
+
+	var first batchSummary
+	decodeData(t, decodeResponse(t, do(batch, "POST", "/api/v1/users/batch?mode=upsert", body), http.StatusCreated), &first)
+	if len(first.Created) != 2 || len(first.Updated) != 0 {
+		t.Fatalf("first run created %d, updated %d; want 2 created", len(first.Created), len(first.Updated))
+	}
+
+	body = `[{"name":"Ada Lovelace","email":"ADA@example.com"},{"name":"Grace","email":"grace@example.com"}]`
+	var second batchSummary
+	decodeData(t, decodeResponse(t, do(batch, "POST", "/api/v1/users/batch?mode=upsert", body), http.StatusOK), &second)
+	if len(second.Created) != 0 || len(second.Updated) != 2 || len(second.Failed) != 0 {
+		t.Errorf("second run created %d, updated %d, failed %d; want only updates",
+			len(second.Created), len(second.Updated), len(second.Failed))
+	}
+
+	users, err := srv.store.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].Name != "Ada Lovelace" {
+		t.Errorf("store holds %+v, want the 2 users with Ada renamed", users)
+	}
+
+	decodeResponse(t, do(batch, "POST", "/api/v1/users/batch?mode=merge", body), http.StatusBadRequest)
+}
+
+func TestUpsertLooksUpEachRowsEmail(t *testing.T) {
+	srv := newTestServer(t)
+	store := &emailLookupStore{MemoryStore: NewMemoryStore(nil)}
+	srv.store = store
+	batch := http.HandlerFunc(srv.batchCreateUsersHandler)
+	body := `[{"name":"Ada","email":"ada@example.com"},{"name":"Grace","email":"grace@example.com"}]`
+
+	decodeResponse(t, do(batch, "POST", "/api/v1/users/batch?mode=upsert", body), http.StatusCreated)
+	var second batchSummary
+	decodeData(t, decodeResponse(t, do(batch, "POST", "/api/v1/users/batch?mode=upsert", body), http.StatusOK), &second)
+	if len(second.Created) != 0 || len(second.Updated) != 2 || len(second.Failed) != 0 {
+		t.Errorf("second run created %d, updated %d, failed %d; want only updates",
+			len(second.Created), len(second.Updated), len(second.Failed))
+	}
+	if len(store.lookedUp) != 4 {
+		t.Errorf("looked up %v, want one lookup per row", store.lookedUp)
+	}
+}
+
+func TestConcurrentImportIsRejectedWhileOneRuns(t *testing.T) {
+	srv := newTestServer(t, "MAX_CONCURRENT_IMPORTS=1")
+	h := http.HandlerFunc(srv.batchCreateUsersHandler)
+
+	// The first import holds its slot while it waits for the rest of the body
+	body, feed := io.Pipe()
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serve(h, newTestRequest("POST", "/api/v1/users/batch", body))
+	}()
+	if _, err := io.WriteString(feed, `[{"name":"Ann","email":"ann@example.com"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := do(h, "POST", "/api/v1/users/batch", `[{"name":"Bob","email":"bob@example.com"}]`)
+	resp := decodeResponse(t, rec, http.StatusTooManyRequests)
+	if resp.Code != CodeRateLimited {
+		t.Errorf("code = %s, want %s", resp.Code, CodeRateLimited)
+	}
+	checkRetryAfter(t, rec, http.StatusTooManyRequests)
+
+	io.WriteString(feed, `]`)
+	feed.Close()
+	decodeResponse(t, <-done, http.StatusCreated)
+	decodeResponse(t, do(h, "POST", "/api/v1/users/batch", `[{"name":"Bob","email":"bob@example.com"}]`), http.StatusCreated)
+}
+
+func TestBatchGetByEmailReportsUnknownEmails(t *testing.T) {
+	srv := newTestServer(t)
+	ann := createTestUser(t, srv.store, "ann")
+	bob := createTestUser(t, srv.store, "bob")
+
+	body := fmt.Sprintf(`{"emails":[%q,"nobody@example.com",%q,%q]}`, strings.ToUpper(bob.Email), ann.Email, bob.Email)
+	var result struct {
+		Users    []User   `json:"users"`
+		NotFound []string `json:"not_found"`
+	}
+	h := http.HandlerFunc(srv.batchGetUsersByEmailHandler)
+	decodeData(t, decodeResponse(t, do(h, "POST", "/api/v1/users/batch-get-by-email", body), http.StatusOK), &result)
+
+	var got []int
+	for _, u := range result.Users {
+		got = append(got, u.ID)
+	}
+	if want := []int{bob.ID, ann.ID}; !reflect.DeepEqual(got, want) {
+		t.Errorf("users = %v, want %v matched case-insensitively without repeats", got, want)
+	}
+	if want := []string{"nobody@example.com"}; !reflect.DeepEqual(result.NotFound, want) {
+		t.Errorf("not_found = %v, want %v", result.NotFound, want)
+	}
+
+	decodeResponse(t, do(h, "POST", "/api/v1/users/batch-get-by-email", `{"emails":[]}`), http.StatusBadRequest)
+	tooMany := `{"emails":["a@example.com"` + strings.Repeat(`,"a@example.com"`, maxBatchGetIDs) + `]}`
+	decodeResponse(t, do(h, "POST", "/api/v1/users/batch-get-by-email", tooMany), http.StatusBadRequest)
+}
+
+func TestValidateBatchFlagsBothDuplicateRows(t *testing.T) {
+	srv := newTestServer(t)
+	existing := createTestUser(t, srv.store, "existing")
+
+	body := fmt.Sprintf(`[
+		{"name":"Ann","email":"ann@example.com"},
+		{"name":"Bob","email":"bob@example.com"},
+		{"name":"Ann again","email":"ANN@example.com"},
+		{"name":"Taken","email":%q},
+		{"name":"","email":"not-an-email"}
+	]`, existing.Email)
+	var result struct {
+		Rows    []batchValidation      `json:"rows"`
+		Summary batchValidationSummary `json:"summary"`
+	}
+	decodeData(t, decodeResponse(t, do(http.HandlerFunc(srv.validateBatchHandler), "POST", "/api/v1/users/validate-batch", body), http.StatusOK), &result)
+
+	if len(result.Rows) != 5 {
+		t.Fatalf("got %d rows, want 5", len(result.Rows))
+	}
+	for _, i := range []int{0, 2} {
+		row := result.Rows[i]
+		if row.Valid || len(row.Errors) != 1 || !strings.Contains(row.Errors[0].Message, "repeated in the batch") {
+			t.Errorf("row %d = %+v, want it flagged as a duplicate", i, row)
+		}
+	}
+	if !result.Rows[1].Valid || len(result.Rows[1].Errors) != 0 {
+		t.Errorf("row 1 = %+v, want it valid", result.Rows[1])
+	}
+	if row := result.Rows[3]; row.Valid || !strings.Contains(row.Errors[0].Message, "existing user") {
+		t.Errorf("row 3 = %+v, want the taken email reported", row)
+	}
+	if result.Rows[4].Valid {
+		t.Errorf("row 4 = %+v, want the format errors reported", result.Rows[4])
+	}
+	if want := (batchValidationSummary{Total: 5, Valid: 1, Invalid: 4}); result.Summary != want {
+		t.Errorf("summary = %+v, want %+v", result.Summary, want)
+	}
+
+	users, _ := srv.store.List(context.Background())
+	if len(users) != 1 {
+		t.Errorf("validation left %d users in the store, want only the existing one", len(users))
+	}
+}
+
+// emailLookupStore is a memory store that records email lookups and
+// refuses to list, so a handler has to look up just the emails it needs
+type emailLookupStore struct {
+	*MemoryStore
+	lookedUp []string
+}
+
+func (e *emailLookupStore) List(ctx context.Context) ([]User, error) {
+	return nil, errors.New("listed every user")
+}
+
+func (e *emailLookupStore) GetManyByEmail(ctx context.Context, emails []string) (map[string]User, error) {
+	e.lookedUp = append(e.lookedUp, emails...)
+	return e.MemoryStore.GetManyByEmail(ctx, emails)
+}
+
+func TestValidateBatchLooksUpOnlyItsEmails(t *testing.T) {
+	srv := newTestServer(t)
+	store := &emailLookupStore{MemoryStore: NewMemoryStore(nil)}
+	srv.store = store
+	existing := createTestUser(t, store, "existing")
+	createTestUser(t, store, "bystander")
+
+	body := fmt.Sprintf(`[{"name":"Ann","email":"ann@example.com"},{"name":"Taken","email":%q},{"name":"Ann again","email":"ANN@example.com"}]`, existing.Email)
+	var result struct {
+		Rows []batchValidation `json:"rows"`
+	}
+	decodeData(t, decodeResponse(t, do(http.HandlerFunc(srv.validateBatchHandler), "POST", "/api/v1/users/validate-batch", body), http.StatusOK), &result)
+	if len(result.Rows) != 3 || result.Rows[1].Valid {
+		t.Fatalf("rows = %+v, want the taken email on row 1 reported", result.Rows)
+	}
+	if want := []string{"ann@example.com", existing.Email}; !reflect.DeepEqual(store.lookedUp, want) {
+		t.Errorf("looked up %v, want each of the batch's emails once: %v", store.lookedUp, want)
+	}
+}
+
+// userArrayBody streams a JSON array of n users, their emails starting
+// with prefix, without building it in memory
+func userArrayBody(prefix string, n int) *io.PipeReader {
+	pr, pw := io.Pipe()
+	go func() {
+		w := bufio.NewWriter(pw)
+		w.WriteString("[")
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				w.WriteString(",")
+			}
+			fmt.Fprintf(w, `{"name":"Imported %d","email":"%s%d@example.com","tags":["bulk"]}`, i, prefix, i)
+		}
+		w.WriteString("]")
+		pw.CloseWithError(w.Flush())
+	}()
+	return pr
+}
+
+func TestBatchCreateImportsALargeArray(t *testing.T) {
+	srv := newTestServer(t, "MAX_BODY_BYTES=0")
+	h := srv.Handler()
+
+	const items = 5000
+	resp := decodeResponse(t, serve(h, newTestRequest("POST", "/api/v1/users/batch", userArrayBody("large", items))), http.StatusCreated)
+	var summary batchSummary
+	decodeData(t, resp, &summary)
+	if summary.Processed != items || len(summary.Created) != items || len(summary.Failed) != 0 {
+		t.Errorf("processed %d, created %d, failed %d; want all %d created", summary.Processed, len(summary.Created), len(summary.Failed), items)
+	}
+	if n, err := srv.store.Count(context.Background(), UserFilter{}); err != nil || n != items {
+		t.Errorf("store holds %d users (%v), want %d", n, err, items)
+	}
+}
+
+func TestBatchCreateStopsAtMaxBatchSize(t *testing.T) {
+	srv := newTestServer(t, "MAX_BODY_BYTES=0", "MAX_BATCH_SIZE=10")
+	h := srv.Handler()
+
+	// The rest of the array is never read, so close it to stop the writer
+	rest := userArrayBody("capped", 1000)
+	defer rest.Close()
+	resp := decodeResponse(t, serve(h, newTestRequest("POST", "/api/v1/users/batch", rest)), http.StatusMultiStatus)
+	var summary batchSummary
+	decodeData(t, resp, &summary)
+	if summary.Processed != 10 || len(summary.Created) != 10 {
+		t.Errorf("processed %d and created %d users, want the first 10", summary.Processed, len(summary.Created))
+	}
+	if resp.Status != "partial" || !strings.Contains(resp.Message, "MAX_BATCH_SIZE is 10") {
+		t.Errorf("capped batch = %s %q, want a partial success naming the cap", resp.Status, resp.Message)
+	}
+
+	body := `{"ids":[` + strings.Repeat("1,", maxBatchGetIDs) + `1]}`
+	resp = decodeResponse(t, do(h, "POST", "/api/v1/users/batch-get", body), http.StatusBadRequest)
+	if !strings.Contains(resp.Message, strconv.Itoa(maxBatchGetIDs)) {
+		t.Errorf("oversized batch get message = %q, want the %d ID cap", resp.Message, maxBatchGetIDs)
+	}
+}
+
+func BenchmarkBatchCreate(b *testing.B) {
+	for _, items := range []int{100, 1000} {
+		b.Run(strconv.Itoa(items), func(b *testing.B) {
+			h := newTestServer(b, "MAX_BODY_BYTES=0").Handler()
+			b.ReportAllocs()
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			for i := 0; i < b.N; i++ {
+				r := newTestRequest("POST", "/api/v1/users/batch", userArrayBody(fmt.Sprintf("bench%d-", i), items))
+				if rec := serve(h, r); rec.Code != http.StatusCreated {
+					b.Fatalf("status = %d, want 201", rec.Code)
+				}
+			}
+			runtime.ReadMemStats(&after)
+			// Streamed elements cost the same whatever the batch size
+			b.ReportMetric(float64(after.TotalAlloc-before.TotalAlloc)/float64(b.N*items), "B/item")
+		})
+	}
+}
+
+func TestBatchEndpointsExplainANonArrayBody(t *testing.T) {
+	h := newTestServer(t).Handler()
+	for _, path := range []string{"/api/v1/users/batch", "/api/v1/users/validate-batch"} {
+		resp := decodeResponse(t, do(h, "POST", path, `{"name":"Ann"}`), http.StatusBadRequest)
+		if resp.Code != CodeInvalidJSON || resp.Message != "Request body must be a JSON array of users" {
+			t.Errorf("%s with an object: %s %q, want INVALID_JSON asking for an array", path, resp.Code, resp.Message)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// bulkRequest selects the users a bulk operation applies to. Tag changes
+// are only used by the bulk tag endpoint.
+type bulkRequest struct {
+	Filter     UserFilter `json:"filter"`
+	AddTags    []string   `json:"add_tags"`
+	RemoveTags []string   `json:"remove_tags"`
+}
+
+// bulkResult lists the users a bulk operation affected, or would affect
+// when previewed
+type bulkResult struct {
+	IDs     []int `json:"ids"`
+	Count   int   `json:"count"`
+	Preview bool  `json:"preview"`
+}
+
+// isEmpty reports whether the filter sets no constraint
+func (f UserFilter) isEmpty() bool {
+	return f.constraints() == 0
+}
+
+// bulkTargets decodes a bulk request and loads the users its filter
+// matches. An empty filter is rejected so a bulk operation can't touch
+// every user by accident. On failure the error response has been written.
+func (s *Server) bulkTargets(w http.ResponseWriter, r *http.Request) (bulkRequest, []User, bool) {
+	var req bulkRequest
+	if err := s.decodeBody(w, r, &req); err != nil {
+		writeDecodeError(w, r, err)
+		return req, nil, false
+	}
+	if req.Filter.isEmpty() {
+		writeError(w, r, CodeInvalidRequest, "filter must set at least one of q, domain, created_after or created_before")
+		return req, nil, false
+	}
+	if err := checkFilterLimit(req.Filter.constraints(), s.cfg.MaxFilters); err != nil {
+		writeParamError(w, r, err)
+		return req, nil, false
+	}
+
+	users, err := s.listUsers(r.Context())
+	if err != nil {
+		writeStoreError(w, r, err)
+		return req, nil, false
+	}
+	return req, filterUsers(users, req.Filter), true
+}
+
+// isPreview reports whether the request only asks what would change
+func isPreview(r *http.Request) bool {
+	return r.URL.Query().Get("preview") == "true"
+}
+
+// writeBulkResult reports the affected user IDs
+func writeBulkResult(w http.ResponseWriter, r *http.Request, message string, users []User, preview bool) {
+	result := bulkResult{IDs: make([]int, 0, len(users)), Count: len(users), Preview: preview}
+	for _, u := range users {
+		result.IDs = append(result.IDs, u.ID)
+	}
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: message,
+		Data:    result,
+	})
+}
+
+// Delete every user matching a filter. With ?preview=true only the IDs
+// that would be deleted are returned.
+func (s *Server) bulkDeleteUsersHandler(w http.ResponseWriter, r *http.Request) {
+	_, users, ok := s.bulkTargets(w, r)
+	if !ok {
+		return
+	}
+	if isPreview(r) {
+		writeBulkResult(w, r, fmt.Sprintf("%d users would be deleted", len(users)), users, true)
+		return
+	}
+
+	deleted := make([]User, 0, len(users))
+	for _, u := range users {
+		if err := s.deleteUser(r.Context(), u.ID); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				// Deleted concurrently
+				continue
+			}
+			writeStoreError(w, r, err)
+			return
+		}
+		s.publish(r.Context(), EventUserDeleted, u)
+		deleted = append(deleted, u)
+	}
+	writeBulkResult(w, r, fmt.Sprintf("Deleted %d users", len(deleted)), deleted, false)
+}
+
+// retag returns tags with add appended and remove dropped, keeping the
+// original order and skipping duplicates
+func retag(tags, add, remove []string) []string {
+	drop := make(map[string]bool, len(remove))
+	for _, tag := range remove {
+		drop[tag] = true
+	}
+	seen := make(map[string]bool, len(tags)+len(add))
+	result := make([]string, 0, len(tags)+len(add))
+	for _, tag := range append(append([]string(nil), tags...), add...) {
+		if !drop[tag] && !seen[tag] {
+			seen[tag] = true
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+// Add and remove tags on every user matching a filter. With
+// ?preview=true only the IDs that would be changed are returned.
+func (s *Server) bulkTagUsersHandler(w http.ResponseWriter, r *http.Request) {
+	req, users, ok := s.bulkTargets(w, r)
+	if !ok {
+		return
+	}
+	if len(req.AddTags) == 0 && len(req.RemoveTags) == 0 {
+		writeError(w, r, CodeInvalidRequest, "add_tags or remove_tags must list at least one tag")
+		return
+	}
+	if errs := validateTags(s.cfg, "add_tags", req.AddTags); len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+
+	// Check every user against the tag limit before changing any
+	for _, u := range users {
+		if tags := retag(u.Tags, req.AddTags, req.RemoveTags); len(tags) > s.cfg.MaxTags {
+			writeError(w, r, CodeInvalidRequest,
+				fmt.Sprintf("User %d would have more than %d tags", u.ID, s.cfg.MaxTags))
+			return
+		}
+	}
+
+	if isPreview(r) {
+		writeBulkResult(w, r, fmt.Sprintf("%d users would be retagged", len(users)), users, true)
+		return
+	}
+
+	updated := make([]User, 0, len(users))
+	for _, u := range users {
+		u.Tags = retag(u.Tags, req.AddTags, req.RemoveTags)
+		u, err := s.store.Update(r.Context(), u)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			writeStoreError(w, r, err)
+			return
+		}
+		s.publish(r.Context(), EventUserUpdated, u)
+		updated = append(updated, u)
+	}
+	writeBulkResult(w, r, fmt.Sprintf("Retagged %d users", len(updated)), updated, false)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBulkPreviewLeavesTheStoreUnchanged(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN=admin-secret")
+	h := srv.Handler()
+	ctx := context.Background()
+	var want []int
+	written := make(map[int]time.Time)
+	for _, email := range []string{"a@one.example", "b@two.example", "c@one.example"} {
+		u, err := srv.store.Create(ctx, User{Name: "Bulk", Email: email, Created: time.Now().UTC()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		written[u.ID] = u.UpdatedAt
+		if strings.HasSuffix(email, "@one.example") {
+			want = append(want, u.ID)
+		}
+	}
+
+	for _, tt := range []struct{ path, body string }{
+		{"/api/v1/users/bulk-delete?preview=true", `{"filter":{"domain":"one.example"}}`},
+		{"/api/v1/users/bulk-tag?preview=true", `{"filter":{"domain":"one.example"},"add_tags":["vip"]}`},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			r := newTestRequest("POST", tt.path, strings.NewReader(tt.body))
+			r.Header.Set("Authorization", "Bearer admin-secret")
+			var result bulkResult
+			decodeData(t, decodeResponse(t, serve(h, r), http.StatusOK), &result)
+			if !result.Preview || result.Count != len(want) || !reflect.DeepEqual(result.IDs, want) {
+				t.Errorf("preview = %+v, want IDs %v", result, want)
+			}
+
+			users, err := srv.store.List(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != 3 {
+				t.Errorf("store has %d users after the preview, want 3", len(users))
+			}
+			for _, u := range users {
+				if len(u.Tags) != 0 || !u.UpdatedAt.Equal(written[u.ID]) {
+					t.Errorf("user %d changed by the preview: tags %v, updated %s", u.ID, u.Tags, u.UpdatedAt)
+				}
+			}
+		})
+	}
+}
+
+func TestBulkTagValidatesTheAddedTags(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN=admin-secret", "MAX_TAGS=2")
+	h := srv.Handler()
+	u := createTestUser(t, srv.store, "tagged")
+	body := `{"filter":{"domain":"example.com"},"add_tags":`
+
+	for _, tags := range []string{`["Not A Slug"]`, `["one","two","three"]`} {
+		r := newTestRequest("POST", "/api/v1/users/bulk-tag", strings.NewReader(body+tags+"}"))
+		r.Header.Set("Authorization", "Bearer admin-secret")
+		decodeResponse(t, serve(h, r), http.StatusBadRequest)
+	}
+	if stored, _ := srv.store.Get(context.Background(), u.ID); len(stored.Tags) != 0 {
+		t.Errorf("tags = %v after rejected bulk tags, want none", stored.Tags)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Values accepted by COMPRESS_ALGO
+const (
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+)
+
+// maxZstdLevel is the highest level zstd accepts
+const maxZstdLevel = 22
+
+// checkCompression validates COMPRESS_ALGO and COMPRESS_LEVEL. Gzip takes
+// levels 1-9 and zstd 1-22; 0 selects each algorithm's default.
+func checkCompression(algo string, level int) error {
+	max := 0
+	switch algo {
+	case "":
+		return nil
+	case compressGzip:
+		max = gzip.BestCompression
+	case compressZstd:
+		max = maxZstdLevel
+	default:
+		return fmt.Errorf("COMPRESS_ALGO must be gzip or zstd, got %q", algo)
+	}
+	if level < 0 || level > max {
+		return fmt.Errorf("COMPRESS_LEVEL must be between 0 and %d for %s, got %d", max, algo, level)
+	}
+	return nil
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows
+// coding, honouring q=0 exclusions and the * wildcard
+func acceptsEncoding(header, coding string) bool {
+	wildcard := false
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != coding && name != "*" {
+			continue
+		}
+		allowed := true
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				allowed = false
+			}
+		}
+		if name == coding {
+			return allowed
+		}
+		wildcard = allowed
+	}
+	return wildcard
+}
+
+// negotiateEncoding picks the response coding for r: the configured
+// algorithm when the client accepts it, otherwise gzip, otherwise none
+func (s *Server) negotiateEncoding(r *http.Request) string {
+	accept := r.Header.Get("Accept-Encoding")
+	if accept == "" {
+		return ""
+	}
+	for _, coding := range []string{s.cfg.CompressAlgo, compressGzip} {
+		if acceptsEncoding(accept, coding) {
+			return coding
+		}
+	}
+	return ""
+}
+
+// encoder is a compressor that can be reused for another response once
+// it has been closed
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// newEncoderPools returns a pool of encoders for each coding the server
+// may answer with. COMPRESS_LEVEL only applies to COMPRESS_ALGO; the gzip
+// fallback for other clients uses gzip's default level.
+func newEncoderPools(cfg Config) map[string]*sync.Pool {
+	gzipLevel := gzip.DefaultCompression
+	if cfg.CompressAlgo == compressGzip && cfg.CompressLevel > 0 {
+		gzipLevel = cfg.CompressLevel
+	}
+	pools := map[string]*sync.Pool{
+		compressGzip: {New: func() interface{} {
+			enc, err := gzip.NewWriterLevel(nil, gzipLevel)
+			if err != nil {
+				log.Printf("Creating gzip encoder failed, responses are sent uncompressed: %v", err)
+				return nil
+			}
+			return enc
+		}},
+	}
+	if cfg.CompressAlgo == compressZstd {
+		opts := []zstd.EOption{}
+		if cfg.CompressLevel > 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(cfg.CompressLevel)))
+		}
+		pools[compressZstd] = &sync.Pool{New: func() interface{} {
+			enc, err := zstd.NewWriter(nil, opts...)
+			if err != nil {
+				log.Printf("Creating zstd encoder failed, responses are sent uncompressed: %v", err)
+				return nil
+			}
+			return enc
+		}}
+	}
+	return pools
+}
+
+// newEncoder returns a pooled writer compressing into w with coding, or
+// nil when none could be created
+func (s *Server) newEncoder(w io.Writer, coding string) encoder {
+	pool, ok := s.encoders[coding]
+	if !ok {
+		return nil
+	}
+	enc, _ := pool.Get().(encoder)
+	if enc != nil {
+		enc.Reset(w)
+	}
+	return enc
+}
+
+// compressWriter compresses the response body once the status is known,
+// leaving bodiless responses untouched
+type compressWriter struct {
+	http.ResponseWriter
+	s        *Server
+	r        *http.Request
+	coding   string
+	enc      encoder
+	wroteHdr bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHdr {
+		return
+	}
+	cw.wroteHdr = true
+
+	h := cw.Header()
+	if status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified &&
+		cw.r.Method != http.MethodHead && h.Get("Content-Encoding") == "" {
+		if enc := cw.s.newEncoder(cw.ResponseWriter, cw.coding); enc != nil {
+			cw.enc = enc
+			h.Set("Content-Encoding", cw.coding)
+			h.Del("Content-Length")
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHdr {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.enc == nil {
+		return cw.ResponseWriter.Write(p)
+	}
+	return cw.enc.Write(p)
+}
+
+// Flush pushes compressed output to the client so streamed responses
+// still arrive incrementally
+func (cw *compressWriter) Flush() {
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack passes connection takeover through to the underlying writer
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := cw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close finishes the compressed stream and returns the encoder to its
+// pool
+func (cw *compressWriter) close() {
+	if cw.enc != nil {
+		cw.enc.Close()
+		cw.s.encoders[cw.coding].Put(cw.enc)
+		cw.enc = nil
+	}
+}
+
+// compress encodes responses with COMPRESS_ALGO or gzip, whichever the
+// client accepts first. The event stream is left alone so events aren't
+// held back in the compressor's buffer.
+func (s *Server) compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		coding := s.negotiateEncoding(r)
+		if coding == "" || r.URL.Path == "/api/v1/events" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, s: s, r: r, coding: coding}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// getEncoded fetches the user list from h accepting the given encodings
+func getEncoded(t *testing.T, h http.Handler, accept string) (*http.Response, []byte) {
+	t.Helper()
+	r := newTestRequest("GET", "/api/v1/users", nil)
+	r.Header.Set("Accept-Encoding", accept)
+	resp := serve(h, r).Result()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestZstdClientGetsAZstdBody(t *testing.T) {
+	srv := newTestServer(t, "COMPRESS_ALGO=zstd", "COMPRESS_LEVEL=3")
+	u := createTestUser(t, srv.store, "compressed")
+	h := srv.Handler()
+
+	resp, body := getEncoded(t, h, "gzip, zstd")
+	if resp.Header.Get("Content-Encoding") != "zstd" || resp.Header.Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("Content-Encoding %q, Vary %q; want zstd varying on Accept-Encoding",
+			resp.Header.Get("Content-Encoding"), resp.Header.Get("Vary"))
+	}
+	dec, err := zstd.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	plain, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatalf("body doesn't decompress as zstd: %v", err)
+	}
+
+	var decoded testResponse
+	var users []User
+	if err := json.Unmarshal(plain, &decoded); err != nil {
+		t.Fatalf("decompressed body isn't JSON: %v", err)
+	}
+	if err := json.Unmarshal(decoded.Data, &users); err != nil || len(users) != 1 || users[0].Email != u.Email {
+		t.Errorf("decompressed users = %+v (%v), want %s", users, err, u.Email)
+	}
+}
+
+func TestCompressionFallsBackToGzip(t *testing.T) {
+	// The zstd level is out of gzip's range, so the fallback must not use it
+	h := newTestServer(t, "COMPRESS_ALGO=zstd", "COMPRESS_LEVEL=19").Handler()
+
+	resp, body := getEncoded(t, h, "gzip;q=1, zstd;q=0")
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip for a client refusing zstd", resp.Header.Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("body isn't gzip: %v", err)
+	}
+	if _, err := io.ReadAll(zr); err != nil {
+		t.Fatalf("body doesn't decompress as gzip: %v", err)
+	}
+
+	if resp, _ := getEncoded(t, h, "identity"); resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("Content-Encoding = %q for a client accepting neither, want none", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestPooledEncodersAreResetBetweenResponses(t *testing.T) {
+	srv := newTestServer(t, "COMPRESS_ALGO=gzip")
+	createTestUser(t, srv.store, "pooled")
+	h := srv.Handler()
+
+	var first []byte
+	for i := 0; i < 3; i++ {
+		_, body := getEncoded(t, h, "gzip")
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("response %d isn't gzip: %v", i+1, err)
+		}
+		plain, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("response %d doesn't decompress: %v", i+1, err)
+		}
+		if first == nil {
+			first = plain
+		} else if !bytes.Equal(plain, first) {
+			t.Errorf("response %d decompresses to %s, want the same list as the first %s", i+1, plain, first)
+		}
+	}
+}
+
+func TestCheckCompression(t *testing.T) {
+	for _, tt := range []struct {
+		algo  string
+		level int
+		ok    bool
+	}{
+		{"", 0, true},
+		{"gzip", 9, true},
+		{"gzip", 10, false},
+		{"zstd", 22, true},
+		{"zstd", 23, false},
+		{"gzip", -1, false},
+		{"br", 0, false},
+	} {
+		if err := checkCompression(tt.algo, tt.level); (err == nil) != tt.ok {
+			t.Errorf("checkCompression(%q, %d) = %v, want ok %v", tt.algo, tt.level, err, tt.ok)
+		}
+	}
+}
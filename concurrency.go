@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// concurrencyRetryAfter is the retry hint given to clients turned away
+// for having too many requests in flight
+const concurrencyRetryAfter = time.Second
+
+// inFlightLimiter caps how many requests each client IP may have in
+// progress at once. Counts are dropped when they reach zero, so the map
+// only holds clients with active requests.
+type inFlightLimiter struct {
+	mu     sync.Mutex
+	active map[string]int
+	max    int
+}
+
+// newInFlightLimiter returns a limiter allowing max concurrent requests
+// per IP
+func newInFlightLimiter(max int) *inFlightLimiter {
+	return &inFlightLimiter{active: make(map[string]int), max: max}
+}
+
+// acquire takes a slot for ip, reporting false when it has none left
+func (l *inFlightLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active[ip] >= l.max {
+		return false
+	}
+	l.active[ip]++
+	return true
+}
+
+// release returns a slot taken by acquire
+func (l *inFlightLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active[ip]--; l.active[ip] <= 0 {
+		delete(l.active, ip)
+	}
+}
+
+// limitConcurrency rejects requests from clients that already have
+// MAX_CONCURRENT_PER_IP requests in flight. The event stream is exempt
+// since it is long-lived by design and has its own subscriber limit.
+func (s *Server) limitConcurrency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/events" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := clientIP(r)
+		if !s.inFlight.acquire(ip) {
+			writeRetryError(w, r, CodeRateLimited, "Too many concurrent requests", concurrencyRetryAfter)
+			return
+		}
+		defer s.inFlight.release(ip)
+		next.ServeHTTP(w, r)
+	})
+}
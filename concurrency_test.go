@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingStore is a memory store whose Get of user 1 waits for release,
+// signalling on entered once each such call is in progress
+type blockingStore struct {
+	*MemoryStore
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingStore) Get(ctx context.Context, id int) (User, error) {
+	if id == 1 {
+		b.entered <- struct{}{}
+		<-b.release
+	}
+	return b.MemoryStore.Get(ctx, id)
+}
+
+func TestConcurrencyLimitIsPerIP(t *testing.T) {
+	const slots = 3
+	cfg := testConfig(t, "MAX_CONCURRENT_PER_IP=3")
+	store := &blockingStore{MemoryStore: NewMemoryStore(nil), entered: make(chan struct{}), release: make(chan struct{})}
+	srv, err := NewServer(cfg, store)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	h := srv.Handler()
+	get := func(ip, path string) int {
+		r := newTestRequest("GET", path, nil)
+		r.RemoteAddr = ip + ":1234"
+		return serve(h, r).Code
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < slots; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get("10.0.0.1", "/api/v1/users/1")
+		}()
+		select {
+		case <-store.entered:
+		case <-time.After(time.Second):
+			t.Fatal("slow request never reached the store")
+		}
+	}
+
+	if code := get("10.0.0.1", "/api/v1/users/2"); code != http.StatusTooManyRequests {
+		t.Errorf("request %d from a busy IP = %d, want 429", slots+1, code)
+	}
+
+	if code := get("10.0.0.2", "/api/v1/users/2"); code != http.StatusNotFound {
+		t.Errorf("request from another IP = %d, want it served (404 for a missing user)", code)
+	}
+
+	close(store.release)
+	wg.Wait()
+	if code := get("10.0.0.1", "/api/v1/users/2"); code != http.StatusNotFound {
+		t.Errorf("request once the slow ones finished = %d, want it served", code)
+	}
+}
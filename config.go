@@ -0,0 +1,759 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	// Embedded zone data so TIMEZONE works on images without tzdata
+	_ "time/tzdata"
+)
+
+// Config holds the runtime settings read from the environment
+type Config struct {
+	Port          string
+	ListenNetwork string
+	ListenAddr    string
+
+	// AdminPort moves the admin endpoints and metrics to a listener of
+	// their own on the LISTEN_ADDR host when set
+	AdminPort  string
+	AdminToken string
+	AuthTokens map[string]string
+
+	RequiredHeader  string
+	ResponseHeaders http.Header
+
+	// FieldAliases maps each FIELD_ALIASES profile to its response key
+	// renames. FieldProfile is applied when a request names none.
+	FieldAliases map[string]map[string]string
+	FieldProfile string
+
+	// HSTSMaxAge sends Strict-Transport-Security on responses to https
+	// requests, recognised by TLS or X-Forwarded-Proto; 0 disables it
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+
+	// CORSOrigins are the origins allowed by CORS. Malformed entries in
+	// CORS_ALLOWED_ORIGINS fail startup when CORSStrict is set and are
+	// skipped with a warning otherwise.
+	CORSOrigins []string
+	CORSStrict  bool
+
+	// Discovery serves the route summary at OPTIONS /api/v1
+	Discovery bool
+
+	PatchAllowedFields map[string]bool
+
+	Store              string
+	StoreBackendHeader bool
+	DegradedReadCache  bool
+	DatabaseURL        string
+	DataFile           string
+
+	// UserCacheTTL serves single-user lookups from memory for this long,
+	// keeping up to UserCacheSize users. WarmCache fills it with the
+	// WarmCacheUsers newest users at startup.
+	UserCacheTTL   time.Duration
+	UserCacheSize  int
+	WarmCache      bool
+	WarmCacheUsers int
+
+	// SlowQueryThreshold logs store calls taking at least this long
+	SlowQueryThreshold time.Duration
+
+	// FileFlushInterval enables write-behind for the file store: changes
+	// are batched and written this often, or once FileFlushAfter are
+	// pending. A crash loses the changes not yet written.
+	FileFlushInterval time.Duration
+	FileFlushAfter    int
+
+	MaxTags      int
+	MaxTagLength int
+	TagPattern   *regexp.Regexp
+
+	MaxMetadataValueBytes int
+	MaxMetadataBytes      int
+
+	// CanonicalizeEmail compares emails by their EmailRules key. Stored
+	// keys are rebuilt at startup when the rules change.
+	CanonicalizeEmail bool
+	EmailRules        emailRules
+
+	EmailMXCheck       bool
+	EmailMXTimeout     time.Duration
+	BlockedDomains     map[string]bool
+	DomainCreateLimit  int
+	DomainCreateWindow time.Duration
+
+	// IdempotencyTTL is how long a create's response is kept for replay
+	// under its Idempotency-Key; at most IdempotencyMaxKeys are kept,
+	// evicting the least recently used
+	IdempotencyTTL     time.Duration
+	IdempotencyMaxKeys int
+
+	RejectFutureTimestamps bool
+	SoftDelete             bool
+
+	MaxSubscribers   int
+	SubscriberBuffer int
+
+	WebhookURLs    []string
+	WebhookQueue   int
+	WebhookTimeout time.Duration
+
+	// WebhookFlushTimeout bounds how long shutdown spends delivering the
+	// queued webhook events; 0 drops them
+	WebhookFlushTimeout time.Duration
+
+	StrictQuery bool
+
+	// AcceptVersionFallback serves requests for an unsupported API
+	// version with the latest one rather than a 406
+	AcceptVersionFallback bool
+
+	// MaxBatchSize caps how many users a batch create or validation may
+	// hold; 0 allows any number
+	MaxBatchSize int
+
+	// MaxFilters caps how many filter constraints a request may combine;
+	// 0 allows any number
+	MaxFilters int
+
+	// APIProfile picks the defaults for the response format settings
+	// below. JSONCase only applies to enveloped and problem responses,
+	// not to streamed exports.
+	APIProfile  string
+	ErrorFormat string
+	JSONCase    string
+	IDFormat    string
+	TimeFormat  string
+
+	Location    *time.Location
+	SeedFile    string
+	MultiTenant bool
+
+	RateLimit    float64
+	RateBurst    int
+	RateLimitTTL time.Duration
+	RateLimitKey string
+	TenantRates  map[string]rateSpec
+	GlobalRate   float64
+	GlobalBurst  int
+
+	MaxConcurrentPerIP   int
+	MaxConcurrentImports int
+
+	ReadinessCacheTTL time.Duration
+	ReadinessCooldown time.Duration
+
+	MaxPageOffset int
+	EmptyList204  bool
+	MaxListBytes  int
+
+	// AccessLog logs every request. Above AccessLogSampleRPS requests a
+	// second only an AccessLogSampleRate fraction of the successful ones
+	// are logged; 0 turns sampling off.
+	AccessLog           bool
+	AccessLogSampleRPS  int
+	AccessLogSampleRate float64
+
+	ShutdownDelay     time.Duration
+	ReadTimeout       time.Duration
+	RequestTimeout    time.Duration
+	LargeRequestBytes int64
+	MaxBodyBytes      int64
+
+	CompressAlgo  string
+	CompressLevel int
+}
+
+// loadConfig reads the configuration from environment variables
+func loadConfig() (Config, error) {
+	cfg := Config{
+		Port:          envString("PORT", "8080"),
+		ListenNetwork: envString("LISTEN_NETWORK", "tcp"),
+		AdminPort:     os.Getenv("ADMIN_PORT"),
+		AdminToken:    os.Getenv("ADMIN_TOKEN"),
+		Store:         envString("STORE", "memory"),
+		DatabaseURL:   os.Getenv("DATABASE_URL"),
+		DataFile:      os.Getenv("DATA_FILE"),
+		SeedFile:      os.Getenv("SEED_FILE"),
+		APIProfile:    envString("API_PROFILE", "legacy"),
+
+		RequiredHeader: os.Getenv("REQUIRED_HEADER"),
+		CompressAlgo:   os.Getenv("COMPRESS_ALGO"),
+		BlockedDomains: parseDomainList(os.Getenv("BLOCKED_EMAIL_DOMAINS")),
+	}
+
+	switch cfg.ListenNetwork {
+	case "tcp":
+		cfg.ListenAddr = envString("LISTEN_ADDR", ":"+cfg.Port)
+	case "unix":
+		cfg.ListenAddr = os.Getenv("LISTEN_ADDR")
+		if cfg.ListenAddr == "" {
+			return cfg, fmt.Errorf("LISTEN_ADDR must be set to a socket path when LISTEN_NETWORK=unix")
+		}
+	default:
+		return cfg, fmt.Errorf("LISTEN_NETWORK must be tcp or unix, got %q", cfg.ListenNetwork)
+	}
+	if err := checkPorts(cfg); err != nil {
+		return cfg, err
+	}
+
+	if err := checkStore(cfg, cfg.Store); err != nil {
+		return cfg, err
+	}
+	profile, ok := apiProfiles[cfg.APIProfile]
+	if !ok {
+		return cfg, fmt.Errorf("API_PROFILE must be legacy or strict, got %q", cfg.APIProfile)
+	}
+	cfg.ErrorFormat = envString("ERROR_FORMAT", profile.ErrorFormat)
+	cfg.JSONCase = envString("JSON_CASE", profile.JSONCase)
+	cfg.IDFormat = envString("ID_FORMAT", profile.IDFormat)
+	cfg.TimeFormat = envString("TIME_FORMAT", profile.TimeFormat)
+	if err := checkTimeFormat(cfg.TimeFormat); err != nil {
+		return cfg, err
+	}
+	if err := checkResponseFormat(cfg); err != nil {
+		return cfg, err
+	}
+	var err error
+	if cfg.Location, err = time.LoadLocation(envString("TIMEZONE", "UTC")); err != nil {
+		return cfg, fmt.Errorf("TIMEZONE: %w", err)
+	}
+	if cfg.ResponseHeaders, err = parseResponseHeaders(os.Getenv("RESPONSE_HEADERS")); err != nil {
+		return cfg, err
+	}
+	if cfg.FieldAliases, err = parseFieldAliases(os.Getenv("FIELD_ALIASES"), cfg.JSONCase); err != nil {
+		return cfg, err
+	}
+	cfg.FieldProfile = os.Getenv("FIELD_PROFILE")
+	if _, ok := cfg.FieldAliases[cfg.FieldProfile]; cfg.FieldProfile != "" && !ok {
+		return cfg, fmt.Errorf("FIELD_PROFILE: %q is not a FIELD_ALIASES profile", cfg.FieldProfile)
+	}
+	if cfg.HSTSMaxAge, err = envDuration("HSTS_MAX_AGE", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.HSTSIncludeSubdomains, err = envBool("HSTS_INCLUDE_SUBDOMAINS", false); err != nil {
+		return cfg, err
+	}
+	if cfg.HSTSPreload, err = envBool("HSTS_PRELOAD", false); err != nil {
+		return cfg, err
+	}
+	if cfg.Discovery, err = envBool("DISCOVERY", true); err != nil {
+		return cfg, err
+	}
+	if cfg.CORSStrict, err = envBool("CORS_STRICT", true); err != nil {
+		return cfg, err
+	}
+	if cfg.CORSOrigins, err = parseOrigins(envString("CORS_ALLOWED_ORIGINS", "*"), cfg.CORSStrict); err != nil {
+		return cfg, err
+	}
+	if cfg.PatchAllowedFields, err = parsePatchFields(envString("PATCH_ALLOWED_FIELDS", defaultPatchFields)); err != nil {
+		return cfg, err
+	}
+	if cfg.AuthTokens, err = parseAuthTokens(os.Getenv("AUTH_TOKENS")); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxTags, err = envInt("MAX_TAGS", 10); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxTagLength, err = envInt("MAX_TAG_LENGTH", 32); err != nil {
+		return cfg, err
+	}
+	if cfg.TagPattern, err = regexp.Compile(envString("TAG_PATTERN", `^[A-Za-z0-9_-]+$`)); err != nil {
+		return cfg, fmt.Errorf("TAG_PATTERN: %w", err)
+	}
+	if cfg.MaxMetadataValueBytes, err = envInt("MAX_METADATA_VALUE_BYTES", 1024); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxMetadataBytes, err = envInt("MAX_METADATA_BYTES", 16*1024); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxSubscribers, err = envInt("MAX_SUBSCRIBERS", 100); err != nil {
+		return cfg, err
+	}
+	if cfg.SubscriberBuffer, err = envInt("SUBSCRIBER_BUFFER", 16); err != nil {
+		return cfg, err
+	}
+	if cfg.SubscriberBuffer < 1 {
+		return cfg, fmt.Errorf("SUBSCRIBER_BUFFER must be at least 1")
+	}
+	if cfg.WebhookURLs, err = parseWebhookURLs(os.Getenv("WEBHOOK_URLS")); err != nil {
+		return cfg, err
+	}
+	if cfg.WebhookQueue, err = envInt("WEBHOOK_QUEUE", 1000); err != nil {
+		return cfg, err
+	}
+	if cfg.WebhookQueue < 1 {
+		return cfg, fmt.Errorf("WEBHOOK_QUEUE must be at least 1")
+	}
+	if cfg.WebhookTimeout, err = envDuration("WEBHOOK_TIMEOUT", 5*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.WebhookFlushTimeout, err = envDuration("WEBHOOK_FLUSH_TIMEOUT", 10*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.StrictQuery, err = envBool("STRICT_QUERY", false); err != nil {
+		return cfg, err
+	}
+	if cfg.CanonicalizeEmail, err = envBool("CANONICALIZE_EMAIL", false); err != nil {
+		return cfg, err
+	}
+	if cfg.CanonicalizeEmail {
+		if cfg.EmailRules, err = parseEmailRules(envString("EMAIL_RULES", defaultEmailRules)); err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.EmailMXCheck, err = envBool("EMAIL_MX_CHECK", false); err != nil {
+		return cfg, err
+	}
+	if cfg.EmailMXTimeout, err = envDuration("EMAIL_MX_TIMEOUT", 2*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.DomainCreateLimit, err = envInt("DOMAIN_CREATE_LIMIT", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.DomainCreateWindow, err = envDuration("DOMAIN_CREATE_WINDOW", time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.DomainCreateLimit > 0 && cfg.DomainCreateWindow <= 0 {
+		return cfg, fmt.Errorf("DOMAIN_CREATE_WINDOW must be positive when DOMAIN_CREATE_LIMIT is set")
+	}
+	if cfg.RejectFutureTimestamps, err = envBool("REJECT_FUTURE_TIMESTAMPS", false); err != nil {
+		return cfg, err
+	}
+	if cfg.IdempotencyTTL, err = envDuration("IDEMPOTENCY_TTL", 24*time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.IdempotencyMaxKeys, err = envInt("IDEMPOTENCY_MAX_KEYS", 10000); err != nil {
+		return cfg, err
+	}
+	if cfg.IdempotencyMaxKeys < 1 {
+		return cfg, fmt.Errorf("IDEMPOTENCY_MAX_KEYS must be at least 1")
+	}
+	if cfg.UserCacheTTL, err = envDuration("USER_CACHE_TTL", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.UserCacheSize, err = envInt("USER_CACHE_SIZE", 10000); err != nil {
+		return cfg, err
+	}
+	if cfg.UserCacheTTL > 0 && cfg.UserCacheSize < 1 {
+		return cfg, fmt.Errorf("USER_CACHE_SIZE must be at least 1 when USER_CACHE_TTL is set")
+	}
+	if cfg.WarmCache, err = envBool("WARM_CACHE", false); err != nil {
+		return cfg, err
+	}
+	if cfg.WarmCacheUsers, err = envInt("WARM_CACHE_USERS", 100); err != nil {
+		return cfg, err
+	}
+	if cfg.WarmCache && cfg.WarmCacheUsers < 1 {
+		return cfg, fmt.Errorf("WARM_CACHE_USERS must be at least 1 when WARM_CACHE is set")
+	}
+	if cfg.SlowQueryThreshold, err = envDuration("SLOW_QUERY_THRESHOLD", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.FileFlushInterval, err = envDuration("FILE_FLUSH_INTERVAL", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.FileFlushAfter, err = envInt("FILE_FLUSH_AFTER", 100); err != nil {
+		return cfg, err
+	}
+	if cfg.FileFlushInterval < 0 || cfg.FileFlushAfter < 0 {
+		return cfg, fmt.Errorf("FILE_FLUSH_INTERVAL and FILE_FLUSH_AFTER must not be negative")
+	}
+	if cfg.SoftDelete, err = envBool("SOFT_DELETE", false); err != nil {
+		return cfg, err
+	}
+	if cfg.StoreBackendHeader, err = envBool("STORE_BACKEND_HEADER", false); err != nil {
+		return cfg, err
+	}
+	if cfg.DegradedReadCache, err = envBool("DEGRADED_READ_CACHE", false); err != nil {
+		return cfg, err
+	}
+	if cfg.MultiTenant, err = envBool("MULTI_TENANT", false); err != nil {
+		return cfg, err
+	}
+	if cfg.RateLimit, err = envFloat("RATE_LIMIT", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.RateBurst, err = envInt("RATE_BURST", 20); err != nil {
+		return cfg, err
+	}
+	if cfg.RateLimit > 0 && cfg.RateBurst == 0 {
+		return cfg, fmt.Errorf("RATE_BURST must be at least 1 when RATE_LIMIT is set")
+	}
+	if cfg.RateLimitTTL, err = envDuration("RATE_LIMIT_TTL", 10*time.Minute); err != nil {
+		return cfg, err
+	}
+	switch cfg.RateLimitKey = envString("RATE_LIMIT_KEY", "ip"); cfg.RateLimitKey {
+	case "ip", "tenant":
+	default:
+		return cfg, fmt.Errorf("RATE_LIMIT_KEY must be ip or tenant, got %q", cfg.RateLimitKey)
+	}
+	if cfg.TenantRates, err = parseTenantRates(os.Getenv("TENANT_RATE_LIMITS"), cfg.RateBurst); err != nil {
+		return cfg, err
+	}
+	if cfg.rateLimited() && cfg.RateLimitTTL <= 0 {
+		return cfg, fmt.Errorf("RATE_LIMIT_TTL must be positive when rate limiting is on")
+	}
+	if cfg.AcceptVersionFallback, err = envBool("ACCEPT_VERSION_FALLBACK", false); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxFilters, err = envInt("MAX_FILTERS", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxBatchSize, err = envInt("MAX_BATCH_SIZE", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxPageOffset, err = envInt("MAX_PAGE_OFFSET", 10000); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxListBytes, err = envInt("MAX_LIST_BYTES", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.EmptyList204, err = envBool("EMPTY_LIST_204", false); err != nil {
+		return cfg, err
+	}
+	if cfg.ReadinessCacheTTL, err = envDuration("READINESS_CACHE_TTL", 5*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.ReadinessCooldown, err = envDuration("READINESS_COOLDOWN", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.AccessLog, err = envBool("ACCESS_LOG", false); err != nil {
+		return cfg, err
+	}
+	if cfg.AccessLogSampleRPS, err = envInt("ACCESS_LOG_SAMPLE_RPS", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.AccessLogSampleRPS < 0 {
+		return cfg, fmt.Errorf("ACCESS_LOG_SAMPLE_RPS must not be negative")
+	}
+	if cfg.AccessLogSampleRate, err = envFloat("ACCESS_LOG_SAMPLE_RATE", 0.1); err != nil {
+		return cfg, err
+	}
+	if cfg.AccessLogSampleRate <= 0 || cfg.AccessLogSampleRate > 1 {
+		return cfg, fmt.Errorf("ACCESS_LOG_SAMPLE_RATE must be above 0 and at most 1, got %g", cfg.AccessLogSampleRate)
+	}
+	if cfg.ShutdownDelay, err = envDuration("SHUTDOWN_DELAY", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.ReadTimeout, err = envDuration("READ_TIMEOUT", 10*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.GlobalRate, err = envFloat("GLOBAL_RATE", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.GlobalBurst, err = envInt("GLOBAL_BURST", 100); err != nil {
+		return cfg, err
+	}
+	if cfg.GlobalRate > 0 && cfg.GlobalBurst == 0 {
+		return cfg, fmt.Errorf("GLOBAL_BURST must be at least 1 when GLOBAL_RATE is set")
+	}
+	if cfg.MaxConcurrentPerIP, err = envInt("MAX_CONCURRENT_PER_IP", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxConcurrentImports, err = envInt("MAX_CONCURRENT_IMPORTS", 1); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxConcurrentImports < 1 {
+		return cfg, fmt.Errorf("MAX_CONCURRENT_IMPORTS must be at least 1")
+	}
+	if cfg.RequestTimeout, err = envDuration("REQUEST_TIMEOUT", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	largeRequestBytes, err := envInt("LARGE_REQUEST_BYTES", 1<<20)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.LargeRequestBytes = int64(largeRequestBytes)
+	maxBodyBytes, err := envInt("MAX_BODY_BYTES", 1<<20)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MaxBodyBytes = int64(maxBodyBytes)
+	if cfg.CompressLevel, err = envInt("COMPRESS_LEVEL", 0); err != nil {
+		return cfg, err
+	}
+	if err := checkCompression(cfg.CompressAlgo, cfg.CompressLevel); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// checkStore reports whether the store backend name can be opened with
+// the settings in cfg
+func checkStore(cfg Config, name string) error {
+	switch name {
+	case "memory":
+	case "file":
+		if cfg.DataFile == "" {
+			return fmt.Errorf("DATA_FILE must be set when STORE=file")
+		}
+	case "postgres":
+		if cfg.DatabaseURL == "" {
+			return fmt.Errorf("DATABASE_URL must be set when STORE=postgres")
+		}
+	case "sqlite", "redis":
+		return fmt.Errorf("STORE=%s is not supported by this build, use memory, file or postgres", name)
+	default:
+		return fmt.Errorf("STORE must be one of memory, file or postgres, got %q", name)
+	}
+	return nil
+}
+
+// rateLimited reports whether any per-client rate limit is configured
+func (c Config) rateLimited() bool {
+	return c.RateLimit > 0 || len(c.TenantRates) > 0
+}
+
+// checkPorts validates ADMIN_PORT and makes sure it differs from the port
+// the public listener binds, which would otherwise fail with a bind error
+// only once the second listener starts
+func checkPorts(cfg Config) error {
+	if cfg.AdminPort == "" {
+		return nil
+	}
+	admin, err := strconv.Atoi(cfg.AdminPort)
+	if err != nil || admin < 1 || admin > 65535 {
+		return fmt.Errorf("ADMIN_PORT must be a port number between 1 and 65535, got %q", cfg.AdminPort)
+	}
+	if cfg.ListenNetwork != "tcp" {
+		return nil
+	}
+	_, rawPublic, err := net.SplitHostPort(cfg.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("LISTEN_ADDR: %w", err)
+	}
+	// Port 0 is assigned by the OS and can't clash
+	if public, _ := strconv.Atoi(rawPublic); public == admin {
+		return fmt.Errorf("ADMIN_PORT %s must differ from the public port set by PORT or LISTEN_ADDR", cfg.AdminPort)
+	}
+	return nil
+}
+
+// parseTenantRates reads the comma-separated TENANT_RATE_LIMITS list of
+// tenant=rate or tenant=rate:burst overrides. Burst defaults to
+// defaultBurst and a rate of 0 leaves the tenant unlimited.
+func parseTenantRates(raw string, defaultBurst int) (map[string]rateSpec, error) {
+	rates := make(map[string]rateSpec)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		tenant, limit, ok := strings.Cut(entry, "=")
+		if !ok || !tenantIDPattern.MatchString(tenant) {
+			return nil, fmt.Errorf("TENANT_RATE_LIMITS: entry %q must be tenant=rate[:burst]", entry)
+		}
+		perSecond, burst, hasBurst := strings.Cut(limit, ":")
+		spec := rateSpec{Burst: defaultBurst}
+		var err error
+		if spec.Rate, err = strconv.ParseFloat(perSecond, 64); err != nil || spec.Rate < 0 {
+			return nil, fmt.Errorf("TENANT_RATE_LIMITS: rate for %s must be a non-negative number, got %q", tenant, perSecond)
+		}
+		if hasBurst {
+			if spec.Burst, err = strconv.Atoi(burst); err != nil || spec.Burst < 1 {
+				return nil, fmt.Errorf("TENANT_RATE_LIMITS: burst for %s must be a positive integer, got %q", tenant, burst)
+			}
+		}
+		rates[tenant] = spec
+	}
+	return rates, nil
+}
+
+// parseEmailRules reads the comma-separated EMAIL_RULES list of
+// domain=rules entries, where rules joins plus, dots or none with "+" and
+// the domain "*" applies to every domain not listed
+func parseEmailRules(raw string) (emailRules, error) {
+	rules := make(map[string]emailRule)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		domain, names, ok := strings.Cut(entry, "=")
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if !ok || domain == "" {
+			return nil, fmt.Errorf("EMAIL_RULES: entry %q must be domain=rules", entry)
+		}
+		var rule emailRule
+		for _, name := range strings.Split(names, "+") {
+			switch strings.TrimSpace(name) {
+			case "plus":
+				rule.Plus = true
+			case "dots":
+				rule.Dots = true
+			case "none":
+			default:
+				return nil, fmt.Errorf("EMAIL_RULES: rule for %s must be plus, dots or none, got %q", domain, name)
+			}
+		}
+		rules[domain] = rule
+	}
+	return rules, nil
+}
+
+// headerNamePattern matches the token characters RFC 9110 allows in a
+// header field name
+var headerNamePattern = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// checkOrigin reports whether origin is "*" or a bare http(s) origin
+// such as https://example.com:8443, with no path, query or credentials
+func checkOrigin(origin string) error {
+	if origin == "*" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("must start with http:// or https://")
+	}
+	if u.Host == "" || u.Hostname() == "" {
+		return fmt.Errorf("has no host")
+	}
+	if u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("must be only a scheme, host and optional port")
+	}
+	return nil
+}
+
+// parseOrigins reads the comma-separated CORS_ALLOWED_ORIGINS list. A
+// malformed origin is an error when strict is set, and is otherwise
+// logged and left out.
+func parseOrigins(raw string, strict bool) ([]string, error) {
+	var origins []string
+	for _, origin := range strings.Split(raw, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		if err := checkOrigin(origin); err != nil {
+			if strict {
+				return nil, fmt.Errorf("CORS_ALLOWED_ORIGINS: origin %q %v", origin, err)
+			}
+			log.Printf("Ignoring CORS origin %q: %v", origin, err)
+			continue
+		}
+		origins = append(origins, strings.TrimSuffix(origin, "/"))
+	}
+	if len(origins) == 0 {
+		return nil, fmt.Errorf("CORS_ALLOWED_ORIGINS must list at least one valid origin")
+	}
+	return origins, nil
+}
+
+// parseResponseHeaders reads the comma-separated RESPONSE_HEADERS list of
+// Name=value pairs
+func parseResponseHeaders(raw string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || !headerNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("RESPONSE_HEADERS: entry %q must be Name=value with a valid header name", entry)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("RESPONSE_HEADERS: value for %s must not contain line breaks", name)
+		}
+		headers.Add(name, value)
+	}
+	return headers, nil
+}
+
+// parsePatchFields reads the comma-separated PATCH_ALLOWED_FIELDS list
+func parsePatchFields(raw string) (map[string]bool, error) {
+	fields := make(map[string]bool)
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if _, known := patchFields[field]; !known {
+			return nil, fmt.Errorf("PATCH_ALLOWED_FIELDS: unknown field %q", field)
+		}
+		fields[field] = true
+	}
+	return fields, nil
+}
+
+// envString returns the value of the environment variable key, or def
+// when it is unset or empty
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt parses the environment variable key as a non-negative integer,
+// returning def when it is unset
+func envInt(key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer, got %q", key, v)
+	}
+	return n, nil
+}
+
+// envBool parses the environment variable key as a boolean, returning def
+// when it is unset
+func envBool(key string, def bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s must be a boolean, got %q", key, v)
+	}
+	return b, nil
+}
+
+// envFloat parses the environment variable key as a non-negative number,
+// returning def when it is unset
+func envFloat(key string, def float64) (float64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative number, got %q", key, v)
+	}
+	return f, nil
+}
+
+// envDuration parses the environment variable key as a non-negative Go
+// duration such as 30s, returning def when it is unset
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative duration, got %q", key, v)
+	}
+	return d, nil
+}
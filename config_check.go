@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// configProblem is a single issue found by checkConfig
+type configProblem struct {
+	Setting string `json:"setting"`
+	Message string `json:"message"`
+}
+
+// checkConfig looks for settings in cfg that conflict or have no effect
+// together. Settings that are invalid on their own never get this far,
+// since loadConfig refuses to start with them.
+func checkConfig(cfg Config) []configProblem {
+	problems := []configProblem{}
+	add := func(setting, format string, args ...interface{}) {
+		problems = append(problems, configProblem{Setting: setting, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if cfg.AccessLogSampleRPS > 0 && !cfg.AccessLog {
+		add("ACCESS_LOG_SAMPLE_RPS", "has no effect unless ACCESS_LOG is set")
+	}
+	if cfg.WarmCache && cfg.UserCacheTTL == 0 {
+		add("WARM_CACHE", "has no effect unless USER_CACHE_TTL is set")
+	}
+	if cfg.DegradedReadCache && cfg.Store == "memory" {
+		add("DEGRADED_READ_CACHE", "has no effect with STORE=memory, which can't become unavailable")
+	}
+	if len(cfg.TenantRates) > 0 && cfg.RateLimitKey != "tenant" {
+		add("TENANT_RATE_LIMITS", "has no effect unless RATE_LIMIT_KEY=tenant")
+	}
+	if cfg.RateLimitKey == "tenant" && !cfg.MultiTenant {
+		add("RATE_LIMIT_KEY", "is set to tenant but MULTI_TENANT is off, so requests are only limited per IP")
+	}
+	if cfg.RateLimitKey == "tenant" && !cfg.rateLimited() {
+		add("RATE_LIMIT_KEY", "is set to tenant but neither RATE_LIMIT nor TENANT_RATE_LIMITS is configured")
+	}
+	if cfg.HSTSPreload && (cfg.HSTSMaxAge < hstsPreloadMinAge || !cfg.HSTSIncludeSubdomains) {
+		add("HSTS_PRELOAD", "needs HSTS_MAX_AGE of at least a year and HSTS_INCLUDE_SUBDOMAINS to be accepted for preloading")
+	}
+	return problems
+}
+
+// Validate the running configuration and check the store is reachable,
+// for deployment smoke tests. Problems are listed with a 422.
+func (s *Server) validateConfigHandler(w http.ResponseWriter, r *http.Request) {
+	problems := checkConfig(s.cfg)
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+	defer cancel()
+	if err := s.checkStore(ctx); err != nil {
+		problems = append(problems, configProblem{Setting: "STORE", Message: fmt.Sprintf("store is unreachable: %v", err)})
+	}
+
+	if len(problems) > 0 {
+		writeJSON(w, r, lookupError(CodeInvalidConfig).Status, Response{
+			Status:  "error",
+			Code:    CodeInvalidConfig,
+			Message: "Configuration is invalid",
+			Data:    problems,
+		})
+		return
+	}
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "Configuration is valid",
+		Data:    problems,
+	})
+}
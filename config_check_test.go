@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// validateConfig calls the config validation endpoint with the admin token
+func validateConfig(t *testing.T, h http.Handler, want int) ([]configProblem, ErrorCode) {
+	t.Helper()
+	r := newTestRequest("GET", "/api/v1/admin/config/validate", nil)
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	resp := decodeResponse(t, serve(h, r), want)
+	var problems []configProblem
+	decodeData(t, resp, &problems)
+	return problems, resp.Code
+}
+
+func TestValidateConfigListsProblems(t *testing.T) {
+	srv, store, _ := newPingingServer(t, "ADMIN_TOKEN=admin-secret")
+	if problems, _ := validateConfig(t, srv.Handler(), http.StatusOK); len(problems) != 0 {
+		t.Errorf("valid config reported %+v", problems)
+	}
+
+	srv, store, _ = newPingingServer(t, "ADMIN_TOKEN=admin-secret",
+		"DEGRADED_READ_CACHE=true", "TENANT_RATE_LIMITS=acme=5", "RATE_LIMIT_KEY=ip")
+	store.setErr(errors.New("connection refused"))
+	problems, code := validateConfig(t, srv.Handler(), http.StatusUnprocessableEntity)
+	if code != CodeInvalidConfig {
+		t.Errorf("code = %s, want %s", code, CodeInvalidConfig)
+	}
+
+	settings := make(map[string]bool, len(problems))
+	for _, p := range problems {
+		settings[p.Setting] = true
+	}
+	for _, want := range []string{"DEGRADED_READ_CACHE", "TENANT_RATE_LIMITS", "STORE"} {
+		if !settings[want] {
+			t.Errorf("no problem reported for %s in %+v", want, problems)
+		}
+	}
+	if len(problems) != 3 {
+		t.Errorf("got %d problems, want 3: %+v", len(problems), problems)
+	}
+}
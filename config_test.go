@@ -0,0 +1,163 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStoreSelectionRequiresItsConnectionSettings(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		env     []string
+		wantErr string
+	}{
+		{"postgres without DATABASE_URL", []string{"STORE=postgres", "DATABASE_URL="}, "DATABASE_URL must be set when STORE=postgres"},
+		{"file without DATA_FILE", []string{"STORE=file", "DATA_FILE="}, "DATA_FILE must be set when STORE=file"},
+		{"unsupported backend", []string{"STORE=redis"}, "STORE=redis is not supported"},
+		{"unknown backend", []string{"STORE=mongo"}, "STORE must be one of"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, setting := range tt.env {
+				name, value, _ := strings.Cut(setting, "=")
+				t.Setenv(name, value)
+			}
+			_, err := loadConfig()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadConfig error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	cfg := testConfig(t, "STORE=postgres", "DATABASE_URL=postgres://localhost/users")
+	if cfg.Store != "postgres" {
+		t.Errorf("Store = %q, want postgres", cfg.Store)
+	}
+}
+
+func TestParseResponseHeadersRejectsBadNames(t *testing.T) {
+	for _, raw := range []string{"X Env=staging", "=staging", "X-Env"} {
+		if _, err := parseResponseHeaders(raw); err == nil {
+			t.Errorf("parseResponseHeaders(%q) succeeded, want an error", raw)
+		}
+	}
+}
+
+func TestParseEmailRules(t *testing.T) {
+	rules, err := parseEmailRules("Example.com=plus+dots, *=none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules["example.com"] != (emailRule{Plus: true, Dots: true}) || rules["*"] != (emailRule{}) {
+		t.Errorf("rules = %+v", rules)
+	}
+	for _, raw := range []string{"example.com", "=plus", "example.com=underscores"} {
+		if _, err := parseEmailRules(raw); err == nil {
+			t.Errorf("parseEmailRules(%q) succeeded, want an error", raw)
+		}
+	}
+}
+
+func TestMalformedCORSOrigin(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.example.com, app.example.org")
+	_, err := loadConfig()
+	if err == nil || !strings.Contains(err.Error(), `origin "app.example.org"`) {
+		t.Errorf("strict loadConfig error = %v, want the malformed origin named", err)
+	}
+
+	cfg := testConfig(t, "CORS_STRICT=false")
+	if len(cfg.CORSOrigins) != 1 || cfg.CORSOrigins[0] != "https://app.example.com" {
+		t.Errorf("lenient origins = %q, want only the valid one", cfg.CORSOrigins)
+	}
+
+	for _, origin := range []string{"*", "http://localhost:3000", "https://example.com/"} {
+		if err := checkOrigin(origin); err != nil {
+			t.Errorf("checkOrigin(%q) = %v, want it accepted", origin, err)
+		}
+	}
+	for _, origin := range []string{"ftp://example.com", "https://", "https://user@example.com", "https://example.com/app"} {
+		if err := checkOrigin(origin); err == nil {
+			t.Errorf("checkOrigin(%q) succeeded, want an error", origin)
+		}
+	}
+}
+
+func TestAdminPortMustDifferFromThePublicPort(t *testing.T) {
+	for _, env := range [][]string{
+		{"PORT=8080", "ADMIN_PORT=8080"},
+		{"LISTEN_ADDR=127.0.0.1:9090", "ADMIN_PORT=9090"},
+		{"ADMIN_PORT=http"},
+	} {
+		for _, setting := range env {
+			name, value, _ := strings.Cut(setting, "=")
+			t.Setenv(name, value)
+		}
+		if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "ADMIN_PORT") {
+			t.Errorf("%v: loadConfig error = %v, want one naming ADMIN_PORT", env, err)
+		}
+		t.Setenv("LISTEN_ADDR", "")
+	}
+
+	cfg := testConfig(t, "PORT=8080", "ADMIN_PORT=9090")
+	if cfg.AdminPort != "9090" {
+		t.Errorf("AdminPort = %q, want 9090", cfg.AdminPort)
+	}
+}
+
+func TestRateLimitNeedsABurst(t *testing.T) {
+	t.Setenv("RATE_LIMIT", "5")
+	t.Setenv("RATE_BURST", "0")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "RATE_BURST") {
+		t.Errorf("loadConfig error = %v, want one naming RATE_BURST", err)
+	}
+
+	t.Setenv("RATE_LIMIT", "0")
+	if _, err := loadConfig(); err != nil {
+		t.Errorf("RATE_BURST=0 without a rate limit: %v", err)
+	}
+}
+
+func TestGlobalRateNeedsABurst(t *testing.T) {
+	t.Setenv("GLOBAL_RATE", "100")
+	t.Setenv("GLOBAL_BURST", "0")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "GLOBAL_BURST") {
+		t.Errorf("loadConfig error = %v, want one naming GLOBAL_BURST", err)
+	}
+}
+
+func TestRateLimitTTLOnlyMattersWhenRateLimiting(t *testing.T) {
+	t.Setenv("RATE_LIMIT", "0")
+	t.Setenv("RATE_LIMIT_TTL", "0s")
+	if _, err := loadConfig(); err != nil {
+		t.Errorf("RATE_LIMIT_TTL=0s without a rate limit: %v", err)
+	}
+
+	t.Setenv("RATE_LIMIT", "5")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "RATE_LIMIT_TTL") {
+		t.Errorf("loadConfig error = %v, want one naming RATE_LIMIT_TTL", err)
+	}
+}
+
+func TestUserCacheSettingsOnlyMatterWhenTheCacheIsOn(t *testing.T) {
+	t.Setenv("USER_CACHE_SIZE", "0")
+	if _, err := loadConfig(); err != nil {
+		t.Errorf("USER_CACHE_SIZE=0 with the cache off: %v", err)
+	}
+	t.Setenv("USER_CACHE_TTL", "1m")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "USER_CACHE_SIZE") {
+		t.Errorf("loadConfig error = %v, want one naming USER_CACHE_SIZE", err)
+	}
+
+	t.Setenv("USER_CACHE_SIZE", "10")
+	t.Setenv("WARM_CACHE", "true")
+	t.Setenv("WARM_CACHE_USERS", "0")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "WARM_CACHE_USERS") {
+		t.Errorf("loadConfig error = %v, want one naming WARM_CACHE_USERS", err)
+	}
+}
+
+func TestSubscriberBufferMustHoldAnEvent(t *testing.T) {
+	t.Setenv("SUBSCRIBER_BUFFER", "0")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "SUBSCRIBER_BUFFER") {
+		t.Errorf("loadConfig error = %v, want one naming SUBSCRIBER_BUFFER", err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// errBodyTruncated is returned when the connection delivered less of the
+// body than the client announced
+var errBodyTruncated = errors.New("request body ended before its announced length")
+
+// truncationReader reports a body cut short in transit as
+// errBodyTruncated. net/http and encoding/json both use
+// io.ErrUnexpectedEOF, so without this a body that was sent whole but
+// holds truncated JSON couldn't be told apart from one that never arrived.
+type truncationReader struct {
+	io.ReadCloser
+}
+
+func (tr truncationReader) Read(p []byte) (int, error) {
+	n, err := tr.ReadCloser.Read(p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = errBodyTruncated
+	}
+	return n, err
+}
+
+// limitBody caps the request body at MAX_BODY_BYTES. Reading past the cap
+// fails with an *http.MaxBytesError, and a body cut short in transit with
+// errBodyTruncated.
+func (s *Server) limitBody(w http.ResponseWriter, r *http.Request) {
+	if _, wrapped := r.Body.(truncationReader); !wrapped {
+		r.Body = truncationReader{r.Body}
+	}
+	if s.cfg.MaxBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)
+	}
+}
+
+// errTrailingData is returned by decodeBody when the body holds more than
+// one JSON value
+var errTrailingData = errors.New("request body must contain a single JSON value")
+
+// decodeBody decodes the JSON request body into v, subject to the body
+// size limit. Trailing whitespace is allowed but a second JSON value is
+// rejected with errTrailingData.
+func (s *Server) decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	s.limitBody(w, r)
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	return expectEnd(dec)
+}
+
+// expectEnd checks that nothing but whitespace follows the JSON value dec
+// has read, returning errTrailingData otherwise
+func expectEnd(dec *json.Decoder) error {
+	if err := dec.Decode(&json.RawMessage{}); err != io.EOF {
+		if err == nil || errors.As(err, new(*json.SyntaxError)) {
+			return errTrailingData
+		}
+		return err
+	}
+	return nil
+}
+
+// errBatchTooLarge is returned by decodeArrayField and decodeUserArray
+// when the array holds more elements than allowed
+var errBatchTooLarge = errors.New("batch has too many elements")
+
+// bodyShapeError is returned when the body is JSON but not the kind of
+// value the endpoint takes. Its message is written to the client as is.
+type bodyShapeError struct {
+	message string
+}
+
+func (e *bodyShapeError) Error() string {
+	return e.message
+}
+
+// errNotArray is returned by decodeUserArray when the body isn't a JSON
+// array
+var errNotArray = &bodyShapeError{"Request body must be a JSON array of users"}
+
+// decodeUserArray decodes a JSON array of users from the request body,
+// passing each to each in turn without holding the array. It stops with
+// errBatchTooLarge before decoding an element past MAX_BATCH_SIZE, so no
+// more of the body is read than needed.
+func (s *Server) decodeUserArray(w http.ResponseWriter, r *http.Request, each func(in importInput) error) error {
+	s.limitBody(w, r)
+	dec := json.NewDecoder(r.Body)
+	if tok, err := dec.Token(); err != nil && (isBodyTooLarge(err) || isBodyIncomplete(err)) {
+		return err
+	} else if err != nil || tok != json.Delim('[') {
+		return errNotArray
+	}
+
+	for n := 0; dec.More(); n++ {
+		if s.cfg.MaxBatchSize > 0 && n == s.cfg.MaxBatchSize {
+			return errBatchTooLarge
+		}
+		var in importInput
+		if err := dec.Decode(&in); err != nil {
+			return err
+		}
+		if err := each(in); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	return expectEnd(dec)
+}
+
+// decodeArrayField decodes a JSON object request body whose field member
+// is an array, such as {"ids": [1, 2]}, passing each element to each in
+// turn. The array is streamed rather than decoded whole, and decoding
+// stops with errBatchTooLarge as soon as it passes max elements. Other
+// members are skipped and a null array has no elements.
+func (s *Server) decodeArrayField(w http.ResponseWriter, r *http.Request, field string, max int, each func(dec *json.Decoder) error) error {
+	s.limitBody(w, r)
+	dec := json.NewDecoder(r.Body)
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('{') {
+		return &bodyShapeError{"Request body must be a JSON object"}
+	}
+
+	n := 0
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		// Members match like encoding/json matches struct fields
+		if name, _ := key.(string); !strings.EqualFold(name, field) {
+			if err := dec.Decode(&json.RawMessage{}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tok, err := dec.Token()
+		switch {
+		case err != nil:
+			return err
+		case tok == nil:
+			continue
+		case tok != json.Delim('['):
+			return &bodyShapeError{fmt.Sprintf("%s must be a JSON array", field)}
+		}
+		for dec.More() {
+			if n++; n > max {
+				return errBatchTooLarge
+			}
+			if err := each(dec); err != nil {
+				return err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	return expectEnd(dec)
+}
+
+// isBodyTooLarge reports whether err came from exceeding the body limit
+func isBodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// isBodyIncomplete reports whether err means the body ended, or stopped
+// arriving, before the length the client announced. A stalled body is cut
+// off by the server's READ_TIMEOUT. JSON that is itself truncated is a
+// syntax problem, not this.
+func isBodyIncomplete(err error) bool {
+	if errors.Is(err, errBodyTruncated) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// writeDecodeError writes a 413 response when err came from exceeding the
+// body size limit and a 400 for anything else
+func writeDecodeError(w http.ResponseWriter, r *http.Request, err error) {
+	var maxErr *http.MaxBytesError
+	var shapeErr *bodyShapeError
+	switch {
+	case errors.As(err, &maxErr):
+		writeError(w, r, CodePayloadTooLarge, fmt.Sprintf("Request body must be at most %d bytes", maxErr.Limit))
+	case isBodyIncomplete(err):
+		writeError(w, r, CodeInvalidRequest, "Incomplete request body")
+	case errors.Is(err, errTrailingData):
+		writeError(w, r, CodeInvalidJSON, "Request body must contain a single JSON value")
+	case errors.As(err, &shapeErr):
+		writeError(w, r, CodeInvalidJSON, shapeErr.message)
+	default:
+		writeError(w, r, CodeInvalidJSON, "")
+	}
+}
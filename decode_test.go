@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOversizedAndMalformedBodiesAreDistinguished(t *testing.T) {
+	srv := newTestServer(t, "MAX_BODY_BYTES=256")
+	create := http.HandlerFunc(srv.createUserHandler)
+
+	oversized := `{"name":"` + strings.Repeat("x", 300) + `","email":"big@example.com"}`
+	if resp := decodeResponse(t, do(create, "POST", "/api/v1/users", oversized), http.StatusRequestEntityTooLarge); resp.Code != CodePayloadTooLarge {
+		t.Errorf("oversized body code = %s, want PAYLOAD_TOO_LARGE", resp.Code)
+	}
+	if resp := decodeResponse(t, do(create, "POST", "/api/v1/users", `{"name":}`), http.StatusBadRequest); resp.Code != CodeInvalidJSON {
+		t.Errorf("malformed body code = %s, want INVALID_JSON", resp.Code)
+	}
+	// JSON cut short but sent whole is malformed, not an incomplete body
+	if resp := decodeResponse(t, do(create, "POST", "/api/v1/users", `{"name":`), http.StatusBadRequest); resp.Code != CodeInvalidJSON {
+		t.Errorf("truncated JSON code = %s, want INVALID_JSON", resp.Code)
+	}
+
+	batch := http.HandlerFunc(srv.batchCreateUsersHandler)
+	body := `[{"name":"Fits","email":"fits@example.com"},{"name":"` + strings.Repeat("x", 300) + `"}]`
+	resp := decodeResponse(t, do(batch, "POST", "/api/v1/users/batch", body), http.StatusRequestEntityTooLarge)
+	if resp.Code != CodePayloadTooLarge || !strings.Contains(resp.Message, "after 1 processed items") {
+		t.Errorf("oversized batch = %s %q, want PAYLOAD_TOO_LARGE with the progress made", resp.Code, resp.Message)
+	}
+}
+
+func TestBodyMayEndInWhitespaceButNotASecondValue(t *testing.T) {
+	create := http.HandlerFunc(newTestServer(t).createUserHandler)
+
+	decodeResponse(t, do(create, "POST", "/api/v1/users", "{\"name\":\"Trailing\",\"email\":\"trailing@example.com\"}\n \r\n"), http.StatusCreated)
+
+	for _, body := range []string{
+		`{"name":"One","email":"one@example.com"}{"name":"Two","email":"two@example.com"}`,
+		`{"name":"One","email":"one@example.com"} garbage`,
+	} {
+		resp := decodeResponse(t, do(create, "POST", "/api/v1/users", body), http.StatusBadRequest)
+		if resp.Code != CodeInvalidJSON || resp.Message != "Request body must contain a single JSON value" {
+			t.Errorf("%s: got %s %q, want INVALID_JSON about a single value", body, resp.Code, resp.Message)
+		}
+	}
+}
+
+// postShortBody creates a user on srv sending body while announcing
+// contentLength bytes, half-closing the connection afterwards when
+// closeWrite is set. It returns the response and how long it took.
+func postShortBody(t *testing.T, srv *httptest.Server, body string, contentLength int, closeWrite bool) (testResponse, int, time.Duration) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	req := "POST /api/v1/users HTTP/1.1\r\nHost: test\r\nContent-Type: application/json\r\n" +
+		"Content-Length: " + strconv.Itoa(contentLength) + "\r\n\r\n" + body
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	if closeWrite {
+		conn.(*net.TCPConn).CloseWrite()
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	defer resp.Body.Close()
+	var decoded testResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	return decoded, resp.StatusCode, time.Since(start)
+}
+
+func TestOverstatedContentLengthIsAPromptBadRequest(t *testing.T) {
+	srv := newTestServer(t)
+	ts := httptest.NewUnstartedServer(srv.Handler())
+	ts.Config.ReadTimeout = 200 * time.Millisecond
+	ts.Start()
+	defer ts.Close()
+
+	// The decoder needs more bytes than arrive, so it waits on the body
+	body := `{"name":"Short","email":"short@exa`
+	for _, tt := range []struct {
+		name       string
+		closeWrite bool
+	}{
+		{"body ends early", true},
+		{"body stalls", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, status, took := postShortBody(t, ts, body, len(body)+100, tt.closeWrite)
+			if status != http.StatusBadRequest || resp.Message != "Incomplete request body" {
+				t.Errorf("got %d %q, want 400 Incomplete request body", status, resp.Message)
+			}
+			if took > 2*time.Second {
+				t.Errorf("response took %s, want it within the read timeout", took)
+			}
+		})
+	}
+}
+
+// liveHeap returns the bytes still reachable after a collection
+func liveHeap() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+func TestDecodeUserArrayStreamsInBoundedMemory(t *testing.T) {
+	srv := newTestServer(t, "MAX_BODY_BYTES=0")
+	const items = 50000
+	var decoded int
+	var early, late uint64
+	r := httptest.NewRequest("POST", "/api/v1/users/batch", userArrayBody("imported", items))
+	err := srv.decodeUserArray(httptest.NewRecorder(), r, func(in importInput) error {
+		if in.Email != fmt.Sprintf("imported%d@example.com", decoded) {
+			return fmt.Errorf("element %d has email %s", decoded, in.Email)
+		}
+		decoded++
+		switch decoded {
+		case 100:
+			early = liveHeap()
+		case items:
+			late = liveHeap()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("decodeUserArray: %v", err)
+	}
+	if decoded != items {
+		t.Fatalf("decoded %d elements, want %d", decoded, items)
+	}
+	// Holding every element would keep several MB live by the end
+	if late > early && late-early > 1<<20 {
+		t.Errorf("live heap grew by %d bytes over %d elements, want the array streamed", late-early, items)
+	}
+}
+
+func BenchmarkDecodeUserArray(b *testing.B) {
+	for _, items := range []int{100, 10000} {
+		b.Run(strconv.Itoa(items), func(b *testing.B) {
+			srv := newTestServer(b, "MAX_BODY_BYTES=0")
+			b.ReportAllocs()
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			for i := 0; i < b.N; i++ {
+				r := httptest.NewRequest("POST", "/api/v1/users/batch", userArrayBody("imported", items))
+				if err := srv.decodeUserArray(httptest.NewRecorder(), r, func(importInput) error { return nil }); err != nil {
+					b.Fatal(err)
+				}
+			}
+			runtime.ReadMemStats(&after)
+			// Streamed elements cost the same whatever the batch size
+			b.ReportMetric(float64(after.TotalAlloc-before.TotalAlloc)/float64(b.N*items), "B/item")
+		})
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrStoreUnavailable wraps errors from a store that can't be reached
+var ErrStoreUnavailable = errors.New("store unavailable")
+
+// staleWarning is the Warning header sent with reads served from cache
+const staleWarning = `110 - "Response is stale"`
+
+// cachedStore keeps the last successful reads from its primary store and
+// serves them when the primary fails, so reads survive a database outage.
+// Writes are never served from the cache; they fail with
+// ErrStoreUnavailable instead.
+type cachedStore struct {
+	UserStore
+
+	mu       sync.RWMutex
+	users    map[int]User
+	modified time.Time
+	degraded bool
+}
+
+// newCachedStore wraps primary with a last-known-good read cache
+func newCachedStore(primary UserStore) *cachedStore {
+	return &cachedStore{UserStore: primary, users: make(map[int]User)}
+}
+
+// failed reports whether err means the primary couldn't answer, as
+// opposed to answering with a not-found or conflict
+func failed(err error) bool {
+	return err != nil &&
+		!errors.Is(err, ErrNotFound) && !errors.Is(err, ErrDuplicateEmail) && !errors.Is(err, ErrDuplicateID) &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// fallback records that the primary failed with err and marks the request
+// as served stale
+func (c *cachedStore) fallback(ctx context.Context, err error) {
+	c.mu.Lock()
+	if !c.degraded {
+		log.Printf("Store unavailable, serving cached reads: %v", err)
+		c.degraded = true
+	}
+	c.mu.Unlock()
+
+	if stale, ok := ctx.Value(staleKey).(*atomic.Bool); ok {
+		stale.Store(true)
+	}
+}
+
+// recovered clears the degraded state after a successful primary call
+func (c *cachedStore) recovered() {
+	if c.degraded {
+		log.Printf("Store recovered")
+		c.degraded = false
+	}
+}
+
+// unavailable wraps a failed write
+func unavailable(err error) error {
+	if failed(err) {
+		return fmt.Errorf("%w: %v", ErrStoreUnavailable, err)
+	}
+	return err
+}
+
+// List returns all users, from the cache when the primary fails
+func (c *cachedStore) List(ctx context.Context) ([]User, error) {
+	users, err := c.UserStore.List(ctx)
+	if failed(err) {
+		c.fallback(ctx, err)
+		return c.cachedUsers(UserFilter{}), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.recovered()
+	c.users = make(map[int]User, len(users))
+	for _, u := range users {
+		c.users[u.ID] = cloneUser(u)
+	}
+	return users, nil
+}
+
+// cachedUsers returns the cached users matching f, ordered by ID
+func (c *cachedStore) cachedUsers(f UserFilter) []User {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	users := make([]User, 0, len(c.users))
+	for _, u := range c.users {
+		if f.Matches(u) {
+			users = append(users, cloneUser(u))
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users
+}
+
+// remember stores u in the cache
+func (c *cachedStore) remember(u User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.recovered()
+	c.users[u.ID] = cloneUser(u)
+}
+
+// Get returns a user, from the cache when the primary fails
+func (c *cachedStore) Get(ctx context.Context, id int) (User, error) {
+	u, err := c.UserStore.Get(ctx, id)
+	if failed(err) {
+		c.fallback(ctx, err)
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		cached, ok := c.users[id]
+		if !ok {
+			return User{}, unavailable(err)
+		}
+		return cloneUser(cached), nil
+	}
+	if err != nil {
+		return User{}, err
+	}
+	c.remember(u)
+	return u, nil
+}
+
+// GetMany returns users by ID, from the cache when the primary fails
+func (c *cachedStore) GetMany(ctx context.Context, ids []int) (map[int]User, error) {
+	found, err := c.UserStore.GetMany(ctx, ids)
+	if failed(err) {
+		c.fallback(ctx, err)
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		found = make(map[int]User, len(ids))
+		for _, id := range ids {
+			if u, ok := c.users[id]; ok {
+				found[id] = cloneUser(u)
+			}
+		}
+		return found, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range found {
+		c.remember(u)
+	}
+	return found, nil
+}
+
+// GetManyByEmail needs the primary, since the cache isn't keyed by email
+func (c *cachedStore) GetManyByEmail(ctx context.Context, emails []string) (map[string]User, error) {
+	found, err := c.UserStore.GetManyByEmail(ctx, emails)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	for _, u := range found {
+		c.remember(u)
+	}
+	return found, nil
+}
+
+// Count counts matching users, from the cache when the primary fails
+func (c *cachedStore) Count(ctx context.Context, f UserFilter) (int, error) {
+	n, err := c.UserStore.Count(ctx, f)
+	if failed(err) {
+		c.fallback(ctx, err)
+		return len(c.cachedUsers(f)), nil
+	}
+	return n, err
+}
+
+// Domains lists the users' email domains, from the cache when the primary
+// fails
+func (c *cachedStore) Domains(ctx context.Context, f UserFilter) ([]string, error) {
+	domains, err := c.UserStore.Domains(ctx, f)
+	if failed(err) {
+		c.fallback(ctx, err)
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return userDomains(c.users, f), nil
+	}
+	return domains, err
+}
+
+// ListPage lists a page of users, from the cache when the primary fails
+func (c *cachedStore) ListPage(ctx context.Context, f UserFilter, order UserSort, offset, limit int) ([]User, int, error) {
+	users, total, err := c.UserStore.ListPage(ctx, f, order, offset, limit)
+	if failed(err) {
+		c.fallback(ctx, err)
+		cached := c.cachedUsers(f)
+		sortUsers(cached, order)
+		return pageOf(cached, offset, limit), len(cached), nil
+	}
+	for _, u := range users {
+		c.remember(u)
+	}
+	return users, total, err
+}
+
+// Modified reports the primary's last change, or the last one seen when
+// the primary fails
+func (c *cachedStore) Modified(ctx context.Context) (time.Time, int, error) {
+	modified, count, err := c.UserStore.Modified(ctx)
+	if failed(err) {
+		c.fallback(ctx, err)
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return c.modified, len(c.users), nil
+	}
+	if err == nil {
+		c.mu.Lock()
+		c.modified = modified
+		c.mu.Unlock()
+	}
+	return modified, count, err
+}
+
+// ModifiedSince can't be answered from the cache, which has no tombstones
+func (c *cachedStore) ModifiedSince(ctx context.Context, since time.Time) ([]User, error) {
+	users, err := c.UserStore.ModifiedSince(ctx, since)
+	return users, unavailable(err)
+}
+
+// IterateModifiedSince can't be answered from the cache either
+func (c *cachedStore) IterateModifiedSince(ctx context.Context, since time.Time, fn func(User) error) error {
+	return unavailable(c.UserStore.IterateModifiedSince(ctx, since, fn))
+}
+
+// Oldest finds the earliest created user, from the cache when the primary
+// fails
+func (c *cachedStore) Oldest(ctx context.Context, f UserFilter) (User, error) {
+	return c.boundary(ctx, f, false)
+}
+
+// Newest finds the latest created user, from the cache when the primary
+// fails
+func (c *cachedStore) Newest(ctx context.Context, f UserFilter) (User, error) {
+	return c.boundary(ctx, f, true)
+}
+
+func (c *cachedStore) boundary(ctx context.Context, f UserFilter, newest bool) (User, error) {
+	var u User
+	var err error
+	if newest {
+		u, err = c.UserStore.Newest(ctx, f)
+	} else {
+		u, err = c.UserStore.Oldest(ctx, f)
+	}
+	if failed(err) {
+		c.fallback(ctx, err)
+		users := c.cachedUsers(f)
+		if len(users) == 0 {
+			return User{}, unavailable(err)
+		}
+		best := users[0]
+		for _, u := range users[1:] {
+			if createdBefore(u, best) != newest {
+				best = u
+			}
+		}
+		return best, nil
+	}
+	if err != nil {
+		return User{}, err
+	}
+	c.remember(u)
+	return u, nil
+}
+
+// Create stores u in the primary and caches the result
+func (c *cachedStore) Create(ctx context.Context, u User) (User, error) {
+	u, err := c.UserStore.Create(ctx, u)
+	if err != nil {
+		return User{}, unavailable(err)
+	}
+	c.remember(u)
+	return u, nil
+}
+
+// Insert stores u in the primary and caches the result
+func (c *cachedStore) Insert(ctx context.Context, u User) (User, error) {
+	u, err := c.UserStore.Insert(ctx, u)
+	if err != nil {
+		return User{}, unavailable(err)
+	}
+	c.remember(u)
+	return u, nil
+}
+
+// Update replaces u in the primary and caches the result
+func (c *cachedStore) Update(ctx context.Context, u User) (User, error) {
+	u, err := c.UserStore.Update(ctx, u)
+	if err != nil {
+		return User{}, unavailable(err)
+	}
+	c.remember(u)
+	return u, nil
+}
+
+// UpdateIfVersion replaces u in the primary if its version is unchanged
+// and caches the result
+func (c *cachedStore) UpdateIfVersion(ctx context.Context, id, expectedVersion int, u User) (User, error) {
+	u, err := c.UserStore.UpdateIfVersion(ctx, id, expectedVersion, u)
+	if err != nil {
+		return User{}, unavailable(err)
+	}
+	c.remember(u)
+	return u, nil
+}
+
+// Delete removes the user from the primary and the cache
+func (c *cachedStore) Delete(ctx context.Context, id int) error {
+	if err := c.UserStore.Delete(ctx, id); err != nil {
+		return unavailable(err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.users, id)
+	return nil
+}
+
+// SoftDelete moves the user to the primary's trash and drops it from the
+// cache
+func (c *cachedStore) SoftDelete(ctx context.Context, id int) error {
+	if err := c.UserStore.SoftDelete(ctx, id); err != nil {
+		return unavailable(err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.users, id)
+	return nil
+}
+
+// DeleteIfVersion removes the user from the primary if its version is
+// unchanged, and from the cache
+func (c *cachedStore) DeleteIfVersion(ctx context.Context, id, expectedVersion int, soft bool) error {
+	if err := c.UserStore.DeleteIfVersion(ctx, id, expectedVersion, soft); err != nil {
+		return unavailable(err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.users, id)
+	return nil
+}
+
+// Trash can't be answered from the cache, which only holds live users
+func (c *cachedStore) Trash(ctx context.Context) ([]User, error) {
+	users, err := c.UserStore.Trash(ctx)
+	return users, unavailable(err)
+}
+
+// PurgeTrash needs the primary
+func (c *cachedStore) PurgeTrash(ctx context.Context, ids []int) (int, error) {
+	n, err := c.UserStore.PurgeTrash(ctx, ids)
+	return n, unavailable(err)
+}
+
+// Ping checks the primary store
+func (c *cachedStore) Ping(ctx context.Context) error {
+	if p, ok := c.UserStore.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// Close closes the primary store
+func (c *cachedStore) Close() error {
+	if closer, ok := c.UserStore.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// staleResponseWriter adds the stale Warning header once the response
+// starts if any store read for the request was served from cache
+type staleResponseWriter struct {
+	http.ResponseWriter
+	stale *atomic.Bool
+	wrote bool
+}
+
+func (sw *staleResponseWriter) WriteHeader(status int) {
+	if !sw.wrote {
+		sw.wrote = true
+		if sw.stale.Load() {
+			sw.Header().Set("Warning", staleWarning)
+		}
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *staleResponseWriter) Write(p []byte) (int, error) {
+	if !sw.wrote {
+		sw.WriteHeader(http.StatusOK)
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// Flush supports streaming handlers
+func (sw *staleResponseWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (sw *staleResponseWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// markStale lets the cached store flag responses built from stale data
+func (s *Server) markStale(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stale := new(atomic.Bool)
+		ctx := context.WithValue(r.Context(), staleKey, stale)
+		next.ServeHTTP(&staleResponseWriter{ResponseWriter: w, stale: stale}, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// errOutage is what outageStore fails with while it's down
+var errOutage = errors.New("connection refused")
+
+// outageStore is a memory store whose reads and writes fail while down is
+// set, standing in for an unreachable database
+type outageStore struct {
+	*MemoryStore
+	down atomic.Bool
+}
+
+func (o *outageStore) Get(ctx context.Context, id int) (User, error) {
+	if o.down.Load() {
+		return User{}, errOutage
+	}
+	return o.MemoryStore.Get(ctx, id)
+}
+
+func (o *outageStore) List(ctx context.Context) ([]User, error) {
+	if o.down.Load() {
+		return nil, errOutage
+	}
+	return o.MemoryStore.List(ctx)
+}
+
+func (o *outageStore) ListPage(ctx context.Context, f UserFilter, order UserSort, offset, limit int) ([]User, int, error) {
+	if o.down.Load() {
+		return nil, 0, errOutage
+	}
+	return o.MemoryStore.ListPage(ctx, f, order, offset, limit)
+}
+
+func (o *outageStore) Create(ctx context.Context, u User) (User, error) {
+	if o.down.Load() {
+		return User{}, errOutage
+	}
+	return o.MemoryStore.Create(ctx, u)
+}
+
+func TestDegradedReadCacheServesStaleReads(t *testing.T) {
+	cfg := testConfig(t, "DEGRADED_READ_CACHE=true")
+	primary := &outageStore{MemoryStore: NewMemoryStore(nil)}
+	srv, err := NewServer(cfg, newCachedStore(primary))
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	h := srv.Handler()
+	u, err := srv.store.Create(context.Background(), User{Name: "Cached", Email: "cached@example.com", Created: time.Now().UTC()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/api/v1/users/" + strconv.Itoa(u.ID)
+
+	rec := do(h, "GET", path, "")
+	decodeResponse(t, rec, http.StatusOK)
+	if w := rec.Header().Get("Warning"); w != "" {
+		t.Errorf("Warning = %q while the store is up, want none", w)
+	}
+
+	primary.down.Store(true)
+	rec = do(h, "GET", path, "")
+	var got User
+	decodeData(t, decodeResponse(t, rec, http.StatusOK), &got)
+	if got.ID != u.ID || got.Email != u.Email {
+		t.Errorf("stale read got user %d %s, want %d %s", got.ID, got.Email, u.ID, u.Email)
+	}
+	if w := rec.Header().Get("Warning"); w != staleWarning {
+		t.Errorf("Warning = %q, want %q", w, staleWarning)
+	}
+
+	rec = do(h, "GET", "/api/v1/users", "")
+	var users []User
+	decodeData(t, decodeResponse(t, rec, http.StatusOK), &users)
+	if len(users) != 1 || rec.Header().Get("Warning") != staleWarning {
+		t.Errorf("stale list got %d users, Warning %q; want 1 with the stale warning", len(users), rec.Header().Get("Warning"))
+	}
+
+	resp := decodeResponse(t, do(h, "POST", "/api/v1/users", `{"name":"New","email":"new@example.com"}`), http.StatusServiceUnavailable)
+	if resp.Code != CodeUnavailable {
+		t.Errorf("write during the outage got code %s, want %s", resp.Code, CodeUnavailable)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// apiPrefix is the path every API route is registered under
+const apiPrefix = "/api/v1"
+
+// discoveryResource is one top-level API resource in the discovery
+// document
+type discoveryResource struct {
+	Name    string   `json:"name"`
+	Href    string   `json:"href"`
+	Methods []string `json:"methods"`
+	Paths   []string `json:"paths"`
+}
+
+// discoveryResources groups the API routes registered on router by their
+// first path segment
+func discoveryResources(router *mux.Router) []discoveryResource {
+	byName := make(map[string]*discoveryResource)
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(tmpl, apiPrefix+"/") {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+
+		name, _, _ := strings.Cut(strings.TrimPrefix(tmpl, apiPrefix+"/"), "/")
+		res, ok := byName[name]
+		if !ok {
+			res = &discoveryResource{Name: name, Href: apiPrefix + "/" + name}
+			byName[name] = res
+		}
+		res.Methods = appendMissing(res.Methods, methods...)
+		res.Paths = appendMissing(res.Paths, tmpl)
+		return nil
+	})
+
+	resources := make([]discoveryResource, 0, len(byName))
+	for _, res := range byName {
+		sort.Strings(res.Methods)
+		sort.Strings(res.Paths)
+		resources = append(resources, *res)
+	}
+	sort.Slice(resources, func(i, j int) bool { return resources[i].Name < resources[j].Name })
+	return resources
+}
+
+// appendMissing appends the values not already in list
+func appendMissing(list []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, existing := range list {
+			if existing == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// isDiscoveryRequest reports whether r asks for the discovery document
+// rather than being a CORS preflight, which also uses OPTIONS
+func isDiscoveryRequest(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.URL.Path == apiPrefix &&
+		r.Header.Get("Access-Control-Request-Method") == ""
+}
+
+// discoveryHandler serves OPTIONS /api/v1 with the resources registered
+// on router so far, so it must be created after every API route
+func (s *Server) discoveryHandler(router *mux.Router) http.HandlerFunc {
+	resources := discoveryResources(router)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", "OPTIONS")
+		writeJSON(w, r, http.StatusOK, Response{
+			Status:  "success",
+			Message: "API resources retrieved successfully",
+			Data:    map[string]interface{}{"resources": resources},
+		})
+	}
+}
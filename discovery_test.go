@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDiscoveryListsTheUsersResource(t *testing.T) {
+	h := newTestServer(t).Handler()
+
+	var doc struct {
+		Resources []discoveryResource `json:"resources"`
+	}
+	decodeData(t, decodeResponse(t, do(h, "OPTIONS", "/api/v1", ""), http.StatusOK), &doc)
+	var users *discoveryResource
+	for i, res := range doc.Resources {
+		if res.Name == "users" {
+			users = &doc.Resources[i]
+		}
+	}
+	if users == nil {
+		t.Fatalf("discovery resources = %+v, want users listed", doc.Resources)
+	}
+	if users.Href != "/api/v1/users" {
+		t.Errorf("users href = %q, want /api/v1/users", users.Href)
+	}
+	for _, want := range []string{"GET", "POST", "DELETE"} {
+		if !containsString(users.Methods, want) {
+			t.Errorf("users methods = %v, want %s among them", users.Methods, want)
+		}
+	}
+	if !containsString(users.Paths, "/api/v1/users/{id:[0-9]+}") {
+		t.Errorf("users paths = %v, want the single user route", users.Paths)
+	}
+
+	// A CORS preflight to the same path is still answered as one
+	r := newTestRequest("OPTIONS", "/api/v1", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	if rec := serve(h, r); rec.Header().Get("Access-Control-Allow-Origin") == "" {
+		t.Errorf("preflight got no CORS headers: %v", rec.Header())
+	}
+}
+
+func TestDiscoveryCanBeTurnedOff(t *testing.T) {
+	h := newTestServer(t, "DISCOVERY=false").Handler()
+	if rec := do(h, "OPTIONS", "/api/v1", ""); rec.Code == http.StatusOK && rec.Body.Len() > 0 {
+		t.Errorf("disabled discovery answered %d %s", rec.Code, rec.Body)
+	}
+}
+
+// containsString reports whether list holds s
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// domainQuota limits how many users may be created per email domain
+// within a sliding window
+type domainQuota struct {
+	mu      sync.Mutex
+	max     int
+	window  time.Duration
+	created map[string][]time.Time
+}
+
+// newDomainQuota returns a quota allowing max creations per domain in
+// each window
+func newDomainQuota(max int, window time.Duration) *domainQuota {
+	return &domainQuota{max: max, window: window, created: make(map[string][]time.Time)}
+}
+
+// reserve counts a user about to be created for domain at now, unless
+// the domain is already at its quota, in which case it reports how long
+// until the oldest creation leaves the window. Checking and counting
+// happen under one lock so concurrent creates can't overshoot the quota.
+func (q *domainQuota) reserve(domain string, now time.Time) (time.Duration, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	times := q.trim(domain, now)
+	if len(times) >= q.max {
+		return times[0].Add(q.window).Sub(now), false
+	}
+	q.created[domain] = append(times, now)
+	return 0, true
+}
+
+// release gives back a reservation made at for a creation that failed
+func (q *domainQuota) release(domain string, at time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	times := q.created[domain]
+	for i := len(times) - 1; i >= 0; i-- {
+		if times[i].Equal(at) {
+			times = append(times[:i:i], times[i+1:]...)
+			break
+		}
+	}
+	if len(times) == 0 {
+		delete(q.created, domain)
+		return
+	}
+	q.created[domain] = times
+}
+
+// trim drops creations older than the window and returns the rest. The
+// caller must hold the lock.
+func (q *domainQuota) trim(domain string, now time.Time) []time.Time {
+	times := q.created[domain]
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= q.window {
+		i++
+	}
+	times = times[i:]
+	if len(times) == 0 {
+		delete(q.created, domain)
+		return nil
+	}
+	q.created[domain] = times
+	return times
+}
+
+// parseDomainList reads a comma-separated list of email domains
+func parseDomainList(raw string) map[string]bool {
+	domains := make(map[string]bool)
+	for _, domain := range strings.Split(raw, ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			domains[domain] = true
+		}
+	}
+	return domains
+}
+
+// emailRejection explains why an email may not be used for a user
+type emailRejection struct {
+	code       ErrorCode
+	message    string
+	retryAfter time.Duration
+	fields     []FieldError
+}
+
+// write sends the rejection as the response
+func (e *emailRejection) write(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case len(e.fields) > 0:
+		writeValidationErrors(w, r, e.fields)
+	case e.retryAfter > 0:
+		writeRetryError(w, r, e.code, e.message, e.retryAfter)
+	default:
+		writeError(w, r, e.code, e.message)
+	}
+}
+
+// batchItem reports the rejection as the failure of batch element index
+func (e *emailRejection) batchItem(index int) batchItemError {
+	message := e.message
+	if len(e.fields) > 0 {
+		message = "Validation failed"
+	}
+	return batchItemError{Index: index, Message: message, Errors: e.fields}
+}
+
+// checkEmailPolicy rejects email when its domain is in
+// BLOCKED_EMAIL_DOMAINS or, with EMAIL_MX_CHECK, doesn't accept mail. It
+// applies to every write that gives a user a new email.
+func (s *Server) checkEmailPolicy(ctx context.Context, email string) *emailRejection {
+	domain := emailDomain(email)
+	if s.cfg.BlockedDomains[domain] {
+		return &emailRejection{code: CodeForbidden, message: fmt.Sprintf("Email domain %s is not allowed", domain)}
+	}
+	if s.cfg.EmailMXCheck {
+		return s.checkEmailDomain(ctx, email)
+	}
+	return nil
+}
+
+// admitSignup runs checkEmailPolicy for a user about to be created with
+// email and reserves a slot in its DOMAIN_CREATE_LIMIT. The caller must
+// call release if the user ends up not being created, so the slot isn't
+// held against the domain.
+func (s *Server) admitSignup(ctx context.Context, email string) (release func(), rejection *emailRejection) {
+	if rejection := s.checkEmailPolicy(ctx, email); rejection != nil {
+		return nil, rejection
+	}
+	if s.domainQuota == nil {
+		return func() {}, nil
+	}
+	domain, now := emailDomain(email), s.now()
+	if delay, ok := s.domainQuota.reserve(domain, now); !ok {
+		return nil, &emailRejection{
+			code:       CodeRateLimited,
+			message:    fmt.Sprintf("Too many users created for %s", domain),
+			retryAfter: delay,
+		}
+	}
+	return func() { s.domainQuota.release(domain, now) }, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDomainCreateLimit(t *testing.T) {
+	srv := newTestServer(t, "DOMAIN_CREATE_LIMIT=2", "DOMAIN_CREATE_WINDOW=1h")
+	clock := newFakeClock()
+	srv.now = clock.now
+	h := srv.Handler()
+	n := 0
+	create := func(domain string) *httptest.ResponseRecorder {
+		n++
+		return do(h, "POST", "/api/v1/users", fmt.Sprintf(`{"name":"Signup","email":"user%d@%s"}`, n, domain))
+	}
+
+	for i := 0; i < 2; i++ {
+		decodeResponse(t, create("spam.example"), http.StatusCreated)
+	}
+	rec := create("spam.example")
+	resp := decodeResponse(t, rec, http.StatusTooManyRequests)
+	if resp.Code != CodeRateLimited || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("over-quota create: code %s, Retry-After %q; want rate_limited with a retry hint", resp.Code, rec.Header().Get("Retry-After"))
+	}
+	decodeResponse(t, create("other.example"), http.StatusCreated)
+
+	clock.advance(time.Hour)
+	decodeResponse(t, create("spam.example"), http.StatusCreated)
+}
+
+func TestBlockedEmailDomainIsForbidden(t *testing.T) {
+	srv := newTestServer(t, "BLOCKED_EMAIL_DOMAINS=disposable.example")
+	h := srv.Handler()
+
+	resp := decodeResponse(t, do(h, "POST", "/api/v1/users", `{"name":"Throwaway","email":"x@disposable.example"}`), http.StatusForbidden)
+	if resp.Code != CodeForbidden {
+		t.Errorf("code = %s, want %s", resp.Code, CodeForbidden)
+	}
+	decodeResponse(t, do(h, "POST", "/api/v1/users", `{"name":"Kept","email":"x@kept.example"}`), http.StatusCreated)
+}
+
+func TestBatchCreatesPassTheDomainChecks(t *testing.T) {
+	srv := newTestServer(t, "DOMAIN_CREATE_LIMIT=1", "DOMAIN_CREATE_WINDOW=1h", "BLOCKED_EMAIL_DOMAINS=disposable.example")
+	srv.now = newFakeClock().now
+	h := srv.Handler()
+
+	body := `[{"name":"First","email":"first@quota.example"},{"name":"Second","email":"second@quota.example"},{"name":"Throwaway","email":"x@disposable.example"}]`
+	var summary batchSummary
+	decodeData(t, decodeResponse(t, do(h, "POST", "/api/v1/users/batch", body), http.StatusCreated), &summary)
+	if len(summary.Created) != 1 || summary.Created[0].Email != "first@quota.example" {
+		t.Errorf("created %+v, want only the first user in the domain's quota", summary.Created)
+	}
+	if len(summary.Failed) != 2 || summary.Failed[0].Index != 1 || summary.Failed[1].Index != 2 {
+		t.Errorf("failed %+v, want the over-quota and blocked rows", summary.Failed)
+	}
+
+	// The batch used the domain's quota, so a single create is refused too
+	decodeResponse(t, do(h, "POST", "/api/v1/users", `{"name":"Third","email":"third@quota.example"}`), http.StatusTooManyRequests)
+}
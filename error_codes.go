@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+)
+
+// ErrorCode is a stable, machine-readable identifier for an API error
+type ErrorCode string
+
+// Error codes returned in the code field of error responses
+const (
+	CodeInvalidJSON         ErrorCode = "INVALID_JSON"
+	CodeInvalidRequest      ErrorCode = "INVALID_REQUEST"
+	CodeInvalidParameter    ErrorCode = "INVALID_PARAMETER"
+	CodeValidationFailed    ErrorCode = "VALIDATION_FAILED"
+	CodePayloadTooLarge     ErrorCode = "PAYLOAD_TOO_LARGE"
+	CodeUnauthorized        ErrorCode = "UNAUTHORIZED"
+	CodeForbidden           ErrorCode = "FORBIDDEN"
+	CodeNotFound            ErrorCode = "NOT_FOUND"
+	CodeMethodNotAllowed    ErrorCode = "METHOD_NOT_ALLOWED"
+	CodeNotAcceptable       ErrorCode = "NOT_ACCEPTABLE"
+	CodeUserNotFound        ErrorCode = "USER_NOT_FOUND"
+	CodeDuplicateEmail      ErrorCode = "DUPLICATE_EMAIL"
+	CodePreconditionFailed  ErrorCode = "PRECONDITION_FAILED"
+	CodeVersionConflict     ErrorCode = "VERSION_CONFLICT"
+	CodeIdempotencyConflict ErrorCode = "IDEMPOTENCY_CONFLICT"
+	CodeRateLimited         ErrorCode = "RATE_LIMITED"
+	CodeInvalidConfig       ErrorCode = "INVALID_CONFIG"
+	CodeInternal            ErrorCode = "INTERNAL_ERROR"
+	CodeUnavailable         ErrorCode = "SERVICE_UNAVAILABLE"
+)
+
+// errorDefinition is the HTTP status and default message for an error code
+type errorDefinition struct {
+	Code    ErrorCode `json:"code"`
+	Status  int       `json:"status"`
+	Message string    `json:"message"`
+}
+
+// errorCatalog lists every error code the API can return
+var errorCatalog = map[ErrorCode]errorDefinition{
+	CodeInvalidJSON:         {Status: http.StatusBadRequest, Message: "Invalid JSON payload"},
+	CodeInvalidRequest:      {Status: http.StatusBadRequest, Message: "Invalid request"},
+	CodeInvalidParameter:    {Status: http.StatusBadRequest, Message: "Invalid query parameters"},
+	CodeValidationFailed:    {Status: http.StatusBadRequest, Message: "Validation failed"},
+	CodePayloadTooLarge:     {Status: http.StatusRequestEntityTooLarge, Message: "Request body too large"},
+	CodeUnauthorized:        {Status: http.StatusUnauthorized, Message: "Authentication required"},
+	CodeForbidden:           {Status: http.StatusForbidden, Message: "Access denied"},
+	CodeNotFound:            {Status: http.StatusNotFound, Message: "Resource not found"},
+	CodeMethodNotAllowed:    {Status: http.StatusMethodNotAllowed, Message: "Method not allowed"},
+	CodeNotAcceptable:       {Status: http.StatusNotAcceptable, Message: "Requested API version is not supported"},
+	CodeUserNotFound:        {Status: http.StatusNotFound, Message: "User not found"},
+	CodeDuplicateEmail:      {Status: http.StatusConflict, Message: "A user with this email already exists"},
+	CodePreconditionFailed:  {Status: http.StatusPreconditionFailed, Message: "Precondition failed"},
+	CodeVersionConflict:     {Status: http.StatusConflict, Message: "User was changed by another request, retry with its current state"},
+	CodeIdempotencyConflict: {Status: http.StatusConflict, Message: "A request with this idempotency key is still in progress"},
+	CodeRateLimited:         {Status: http.StatusTooManyRequests, Message: "Rate limit exceeded"},
+	CodeInvalidConfig:       {Status: http.StatusUnprocessableEntity, Message: "Configuration is invalid"},
+	CodeInternal:            {Status: http.StatusInternalServerError, Message: "Internal server error"},
+	CodeUnavailable:         {Status: http.StatusServiceUnavailable, Message: "Service unavailable"},
+}
+
+// lookupError returns the catalog entry for code
+func lookupError(code ErrorCode) errorDefinition {
+	def, ok := errorCatalog[code]
+	if !ok {
+		def = errorCatalog[CodeInternal]
+	}
+	def.Code = code
+	return def
+}
+
+// List the machine-readable error codes with their statuses and messages
+func (s *Server) errorCatalogHandler(w http.ResponseWriter, r *http.Request) {
+	defs := make([]errorDefinition, 0, len(errorCatalog))
+	for code := range errorCatalog {
+		defs = append(defs, lookupError(code))
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Code < defs[j].Code })
+
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "Error catalog retrieved successfully",
+		Data:    defs,
+	})
+}
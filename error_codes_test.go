@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestErrorCatalogListsKnownCodes(t *testing.T) {
+	srv := newTestServer(t)
+	var defs []errorDefinition
+	decodeData(t, decodeResponse(t, do(http.HandlerFunc(srv.errorCatalogHandler), "GET", "/api/v1/errors", ""), http.StatusOK), &defs)
+
+	if len(defs) != len(errorCatalog) {
+		t.Errorf("catalog lists %d codes, want %d", len(defs), len(errorCatalog))
+	}
+	found := false
+	for _, def := range defs {
+		if def.Code == CodeUserNotFound {
+			found = true
+			if def.Status != http.StatusNotFound || def.Message == "" {
+				t.Errorf("USER_NOT_FOUND = %+v, want status 404 with a message", def)
+			}
+		}
+	}
+	if !found {
+		t.Error("catalog has no USER_NOT_FOUND entry")
+	}
+}
+
+func TestErrorResponsesCarryTheirCode(t *testing.T) {
+	srv := newTestServer(t)
+	resp := decodeResponse(t, serve(http.HandlerFunc(srv.getUserHandler), userRequest("GET", 42)), http.StatusNotFound)
+	if resp.Code != CodeUserNotFound || resp.Message != "User not found" {
+		t.Errorf("missing user error = %s %q, want USER_NOT_FOUND with the default message", resp.Code, resp.Message)
+	}
+}
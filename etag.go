@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// userETag returns a strong entity tag for the current state of u as
+// format writes it, so each field profile gets a tag of its own
+func userETag(u User, format responseFormat) string {
+	data, _ := format.encode(u)
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// etagMatches reports whether an If-Match header value matches etag,
+// using the strong comparison RFC 9110 requires for If-Match
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// listETag returns a weak entity tag for a list response. It is derived
+// from the store's modification time and size plus the query, which is
+// much cheaper than hashing the response body. The tenant is included
+// since it changes which users the list contains.
+func listETag(modified time.Time, count int, tenant string, query url.Values) string {
+	sum := sha256.Sum256([]byte(tenant + "?" + query.Encode()))
+	return fmt.Sprintf(`W/"%x-%d-%s"`, modified.UnixNano(), count, hex.EncodeToString(sum[:4]))
+}
+
+// weakETagMatches reports whether an If-None-Match header value matches
+// etag, using the weak comparison RFC 9110 specifies for If-None-Match
+func weakETagMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// userRequest returns a request for the user with the given ID, with the
+// route variable set as the router would
+func userRequest(method string, id int) *http.Request {
+	r := newTestRequest(method, "/api/v1/users/"+strconv.Itoa(id), nil)
+	return mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(id)})
+}
+
+func TestDeleteWithStaleETagIsRefused(t *testing.T) {
+	srv := newTestServer(t)
+	user := createTestUser(t, srv.store, "Etta")
+	del := http.HandlerFunc(srv.deleteUserHandler)
+
+	current := serve(http.HandlerFunc(srv.getUserHandler), userRequest("GET", user.ID)).Header().Get("ETag")
+	if current == "" {
+		t.Fatal("GET returned no ETag")
+	}
+	earlier := user
+	earlier.Name = "Etta (before rename)"
+
+	r := userRequest("DELETE", user.ID)
+	r.Header.Set("If-Match", userETag(earlier, newResponseFormat(srv.cfg)))
+	rec := serve(del, r)
+	decodeResponse(t, rec, http.StatusPreconditionFailed)
+	if got := rec.Header().Get("ETag"); got != current {
+		t.Errorf("412 ETag = %s, want the current %s", got, current)
+	}
+	if _, err := srv.store.Get(context.Background(), user.ID); err != nil {
+		t.Fatalf("user is gone after a refused delete: %v", err)
+	}
+
+	r = userRequest("DELETE", user.ID)
+	r.Header.Set("If-Match", current)
+	if rec := serve(del, r); rec.Code != http.StatusOK {
+		t.Fatalf("delete with the current ETag = %d, want 200; body: %s", rec.Code, rec.Body.String())
+	}
+	if _, err := srv.store.Get(context.Background(), user.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after delete = %v, want ErrNotFound", err)
+	}
+}
+
+// racingStore is a memory store that renames a user between handing it
+// out and the next write, like a concurrent update
+type racingStore struct {
+	*MemoryStore
+}
+
+func (s racingStore) Get(ctx context.Context, id int) (User, error) {
+	u, err := s.MemoryStore.Get(ctx, id)
+	if err == nil {
+		renamed := u
+		renamed.Name += " (renamed)"
+		s.MemoryStore.Update(ctx, renamed)
+	}
+	return u, err
+}
+
+func TestDeleteRacingAnUpdateIsRefused(t *testing.T) {
+	srv := newTestServer(t)
+	memory := NewMemoryStore(nil)
+	user := createTestUser(t, memory, "Racer")
+	srv.store = racingStore{memory}
+
+	r := userRequest("DELETE", user.ID)
+	r.Header.Set("If-Match", userETag(user, newResponseFormat(srv.cfg)))
+	decodeResponse(t, serve(http.HandlerFunc(srv.deleteUserHandler), r), http.StatusPreconditionFailed)
+	if _, err := memory.Get(context.Background(), user.ID); err != nil {
+		t.Fatalf("user updated during the delete is gone: %v", err)
+	}
+}
+
+func TestListRevalidatesWithWeakETag(t *testing.T) {
+	srv := newTestServer(t)
+	createTestUser(t, srv.store, "Lister")
+	list := http.HandlerFunc(srv.getUsersHandler)
+
+	etag := do(list, "GET", "/api/v1/users?limit=5", "").Header().Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) || !strings.HasSuffix(etag, `"`) {
+		t.Fatalf("list ETag = %q, want a weak W/\"...\" tag", etag)
+	}
+
+	r := newTestRequest("GET", "/api/v1/users?limit=5", nil)
+	r.Header.Set("If-None-Match", etag)
+	if rec := serve(list, r); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("revalidation = %d with %d body bytes, want an empty 304", rec.Code, rec.Body.Len())
+	}
+
+	if other := do(list, "GET", "/api/v1/users?limit=6", "").Header().Get("ETag"); other == etag {
+		t.Error("a different query has the same ETag")
+	}
+
+	createTestUser(t, srv.store, "Newcomer")
+	r = newTestRequest("GET", "/api/v1/users?limit=5", nil)
+	r.Header.Set("If-None-Match", etag)
+	decodeResponse(t, serve(list, r), http.StatusOK)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event types published when users change
+const (
+	EventUserCreated = "user.created"
+	EventUserUpdated = "user.updated"
+	EventUserDeleted = "user.deleted"
+)
+
+// sseWriteTimeout bounds how long a single event write may block on a
+// client that has stopped reading
+const sseWriteTimeout = 10 * time.Second
+
+// sseHeartbeat is how often an idle event stream is sent a comment line.
+// A client that vanished without closing its connection, as happens
+// behind some proxies, is only noticed when a write fails, so without it
+// a quiet stream would hold its goroutine and hub slot indefinitely.
+const sseHeartbeat = 30 * time.Second
+
+// subscriberRetryAfter is the retry hint given to clients turned away
+// because the hub is full
+const subscriberRetryAfter = 5 * time.Second
+
+// ErrTooManySubscribers is returned by Subscribe when the hub is full
+var ErrTooManySubscribers = errors.New("too many subscribers")
+
+// Event describes a change to a user
+type Event struct {
+	// ID identifies the change in the audit log, so the event can be
+	// replayed. Replay is set on replayed deliveries.
+	ID     int       `json:"id"`
+	Replay bool      `json:"replay,omitempty"`
+	Type   string    `json:"type"`
+	UserID int       `json:"user_id"`
+	User   *User     `json:"user,omitempty"`
+	Time   time.Time `json:"time"`
+
+	// OrgID is the tenant owning the user, used to scope delivery
+	OrgID string `json:"-"`
+}
+
+// subscriber is a single connected event stream client. The hub closes
+// events when it drops the subscriber.
+type subscriber struct {
+	events chan Event
+}
+
+// Hub fans events out to connected subscribers
+type Hub struct {
+	mu      sync.Mutex
+	subs    map[*subscriber]struct{}
+	max     int
+	buffer  int
+	dropped int
+}
+
+// NewHub returns a hub accepting at most max concurrent subscribers, or
+// any number when max is 0. Each subscriber may have up to buffer events
+// queued before it is considered too slow and dropped.
+func NewHub(max, buffer int) *Hub {
+	return &Hub{subs: make(map[*subscriber]struct{}), max: max, buffer: buffer}
+}
+
+// Subscribe registers a new subscriber
+func (h *Hub) Subscribe() (*subscriber, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.max > 0 && len(h.subs) >= h.max {
+		return nil, ErrTooManySubscribers
+	}
+	sub := &subscriber{events: make(chan Event, h.buffer)}
+	h.subs[sub] = struct{}{}
+	return sub, nil
+}
+
+// Unsubscribe removes sub from the hub
+func (h *Hub) Unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, sub)
+}
+
+// Publish delivers e to every subscriber without blocking. A subscriber
+// whose buffer is full is dropped so it can't hold up the publisher.
+func (h *Hub) Publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subs {
+		select {
+		case sub.events <- e:
+		default:
+			delete(h.subs, sub)
+			close(sub.events)
+			h.dropped++
+			log.Printf("Dropped slow event subscriber (%d dropped so far)", h.dropped)
+		}
+	}
+}
+
+// Close drops every subscriber, ending their event streams
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subs {
+		delete(h.subs, sub)
+		close(sub.events)
+	}
+}
+
+// Count returns the number of connected subscribers
+func (h *Hub) Count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// Dropped returns how many subscribers have been dropped for falling behind
+func (h *Hub) Dropped() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.dropped
+}
+
+// publish notifies subscribers and webhooks of a change to u made by the
+// request in ctx and records it in the audit log. Deletion events carry
+// only the user's ID.
+func (s *Server) publish(ctx context.Context, eventType string, u User) {
+	id := s.audit(ctx, eventType, u)
+
+	e := Event{ID: id, Type: eventType, UserID: u.ID, OrgID: u.OrgID, Time: s.now().UTC()}
+	if eventType != EventUserDeleted {
+		e.User = &u
+	}
+	s.events.Publish(e)
+	if s.webhooks != nil {
+		s.webhooks.Enqueue(e)
+	}
+}
+
+// Stream user change events to the client as server-sent events
+func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, CodeInternal, "Streaming is not supported")
+		return
+	}
+
+	sub, err := s.events.Subscribe()
+	if err != nil {
+		writeRetryError(w, r, CodeUnavailable,
+			fmt.Sprintf("Too many event subscribers (limit %d)", s.cfg.MaxSubscribers), subscriberRetryAfter)
+		return
+	}
+	defer s.events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	rc := http.NewResponseController(w)
+	format := responseFormatFrom(r.Context()).streamed()
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case e, ok := <-sub.events:
+			if !ok {
+				// Dropped by the hub for falling behind
+				return
+			}
+			if !s.visible(r.Context(), User{OrgID: e.OrgID}) {
+				continue
+			}
+			data, err := format.encode(e)
+			if err != nil {
+				continue
+			}
+			rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+			heartbeat.Reset(sseHeartbeat)
+		}
+	}
+}
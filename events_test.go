@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// subscribe opens the event stream at url, closing it when the test ends
+func subscribe(t *testing.T, client *http.Client, url string) *http.Response {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestEventStreamRejectsSubscribersPastTheCap(t *testing.T) {
+	srv := newTestServer(t, "MAX_SUBSCRIBERS=2")
+	ts := httptest.NewServer(http.HandlerFunc(srv.eventsHandler))
+	t.Cleanup(ts.Close) // runs after the subscribers' cleanups
+
+	for i := 0; i < 2; i++ {
+		if resp := subscribe(t, ts.Client(), ts.URL); resp.StatusCode != http.StatusOK {
+			t.Fatalf("subscriber %d got %d, want 200", i+1, resp.StatusCode)
+		}
+	}
+	if n := srv.events.Count(); n != 2 {
+		t.Errorf("hub counts %d subscribers, want 2", n)
+	}
+	if resp := subscribe(t, ts.Client(), ts.URL); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("third subscriber got %d, want 503", resp.StatusCode)
+	}
+}
+
+func TestEventStreamDeliversChanges(t *testing.T) {
+	srv := newTestServer(t)
+	ts := httptest.NewServer(http.HandlerFunc(srv.eventsHandler))
+	t.Cleanup(ts.Close) // runs after the subscribers' cleanups
+	resp := subscribe(t, ts.Client(), ts.URL)
+
+	decodeResponse(t, do(http.HandlerFunc(srv.createUserHandler), "POST", "/api/v1/users", `{"name":"Eve","email":"eve@example.com"}`), http.StatusCreated)
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	select {
+	case line := <-lines:
+		if line != "event: "+EventUserCreated {
+			t.Errorf("first line = %q, want the created event", line)
+		}
+		if data := <-lines; !strings.Contains(data, `"email":"eve@example.com"`) {
+			t.Errorf("event data = %q, want the created user", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event received")
+	}
+}
+
+func TestHubDropsSubscribersThatFallBehind(t *testing.T) {
+	hub := NewHub(0, 2)
+	slow, _ := hub.Subscribe()
+	fast, _ := hub.Subscribe()
+
+	for i := 1; i <= 5; i++ {
+		hub.Publish(Event{Type: EventUserCreated, UserID: i})
+		if e := <-fast.events; e.UserID != i {
+			t.Fatalf("fast subscriber got event for user %d, want %d", e.UserID, i)
+		}
+	}
+
+	queued := 0
+	for range slow.events {
+		queued++
+	}
+	if queued != 2 {
+		t.Errorf("slow subscriber had %d events queued before its channel closed, want 2", queued)
+	}
+	if n := hub.Dropped(); n != 1 {
+		t.Errorf("Dropped() = %d, want 1", n)
+	}
+	if n := hub.Count(); n != 1 {
+		t.Errorf("Count() = %d, want only the fast subscriber", n)
+	}
+}
+
+func TestDisconnectedSubscribersLeaveNoGoroutines(t *testing.T) {
+	srv := newTestServer(t)
+	ts := httptest.NewServer(http.HandlerFunc(srv.eventsHandler))
+	defer ts.Close()
+	client := ts.Client()
+	before := runtime.NumGoroutine()
+
+	const clients = 10
+	cancels := make([]context.CancelFunc, clients)
+	for i := range cancels {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels[i] = cancel
+		req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+	}
+	if n := srv.events.Count(); n != clients {
+		t.Fatalf("hub counts %d subscribers, want %d", n, clients)
+	}
+	for _, cancel := range cancels {
+		cancel()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		client.CloseIdleConnections()
+		n, goroutines := srv.events.Count(), runtime.NumGoroutine()
+		if n == 0 && goroutines <= before {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("after disconnecting %d clients: %d subscribers and %d goroutines remain, want 0 and at most %d", clients, n, goroutines, before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// userParams are the query parameters accepted by the single user lookup
+var userParams = []string{"expand"}
+
+// expandOptions are the values accepted by ?expand
+var expandOptions = map[string]bool{"stats": true}
+
+// userStats holds fields computed for ?expand=stats
+type userStats struct {
+	AccountAge        string `json:"account_age"`
+	AccountAgeSeconds int64  `json:"account_age_seconds"`
+	EmailVerified     bool   `json:"email_verified"`
+}
+
+// expandedUser is a user with the optional sections requested via ?expand.
+// It embeds storedUser so User's MarshalJSON isn't promoted over Stats.
+type expandedUser struct {
+	storedUser
+	Stats *userStats `json:"stats,omitempty"`
+}
+
+// parseExpand reads the comma-separated ?expand parameter
+func parseExpand(r *http.Request) (map[string]bool, error) {
+	expand := make(map[string]bool)
+	raw := r.URL.Query().Get("expand")
+	if raw == "" {
+		return expand, nil
+	}
+
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if !expandOptions[name] {
+			valid := make([]string, 0, len(expandOptions))
+			for option := range expandOptions {
+				valid = append(valid, option)
+			}
+			sort.Strings(valid)
+			return nil, &ParamError{Param: "expand", Message: "must be one of " + strings.Join(valid, ", ")}
+		}
+		expand[name] = true
+	}
+	return expand, nil
+}
+
+// expandUser adds the requested sections to u
+func (s *Server) expandUser(u User, expand map[string]bool) expandedUser {
+	e := expandedUser{storedUser: storedUser(u)}
+	if expand["stats"] {
+		age := s.now().Sub(u.Created).Truncate(time.Second)
+		if age < 0 {
+			age = 0
+		}
+		e.Stats = &userStats{
+			AccountAge:        age.String(),
+			AccountAgeSeconds: int64(age / time.Second),
+			EmailVerified:     u.EmailVerified,
+		}
+	}
+	return e
+}
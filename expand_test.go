@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestExpandStatsOnlyWhenRequested(t *testing.T) {
+	srv := newTestServer(t)
+	clock := newFakeClock()
+	srv.now = clock.now
+	user, _ := srv.store.Create(context.Background(), User{Name: "Vera", Email: "vera@example.com", Created: clock.now(), EmailVerified: true})
+	clock.advance(36 * time.Hour)
+	get := http.HandlerFunc(srv.getUserHandler)
+
+	lookup := func(query string, want int) testResponse {
+		r := newTestRequest("GET", "/api/v1/users/"+strconv.Itoa(user.ID)+query, nil)
+		return decodeResponse(t, serve(get, mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(user.ID)})), want)
+	}
+
+	var plain map[string]json.RawMessage
+	decodeData(t, lookup("", http.StatusOK), &plain)
+	if _, ok := plain["stats"]; ok {
+		t.Errorf("plain lookup includes stats: %s", plain["stats"])
+	}
+
+	// Decoded field by field, since User's UnmarshalJSON would be promoted
+	// from an embedded User and skip the stats
+	var expanded struct {
+		Email string     `json:"email"`
+		Stats *userStats `json:"stats"`
+	}
+	decodeData(t, lookup("?expand=stats", http.StatusOK), &expanded)
+	want := userStats{AccountAge: "36h0m0s", AccountAgeSeconds: 36 * 3600, EmailVerified: true}
+	if expanded.Stats == nil || *expanded.Stats != want {
+		t.Errorf("stats = %+v, want %+v", expanded.Stats, want)
+	}
+	if expanded.Email != user.Email {
+		t.Errorf("expanded user email = %q, want the base fields too", expanded.Email)
+	}
+
+	lookup("?expand=friends", http.StatusBadRequest)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Export the users matching a filter as a downloadable JSON array
+func (s *Server) exportUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var filter UserFilter
+	if err := s.decodeBody(w, r, &filter); err != nil && !errors.Is(err, io.EOF) {
+		writeDecodeError(w, r, err)
+		return
+	}
+
+	users, err := s.listUsers(r.Context())
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	users = filterUsers(users, filter)
+
+	w.Header().Set("Content-Disposition", `attachment; filename="users-export.json"`)
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(users)))
+	writeJSONArray(w, r, users)
+}
+
+// Download every user as a ZIP archive holding one users/{id}.json entry
+// per user. The archive is written straight to the response, so an error
+// part way through can only be logged.
+func (s *Server) archiveUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := s.listUsers(r.Context())
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="users-archive.zip"`)
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(users)))
+	w.WriteHeader(http.StatusOK)
+
+	format := responseFormatFrom(r.Context()).streamed()
+	zw := zip.NewWriter(w)
+	for _, user := range users {
+		if r.Context().Err() != nil {
+			return
+		}
+		entry, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     fmt.Sprintf("users/%d.json", user.ID),
+			Method:   zip.Deflate,
+			Modified: user.UpdatedAt,
+		})
+		if err != nil {
+			log.Printf("Failed to archive user %d: %v", user.ID, err)
+			return
+		}
+		data, err := format.encode(user)
+		if err == nil {
+			_, err = entry.Write(append(data, '\n'))
+		}
+		if err != nil {
+			log.Printf("Failed to archive user %d: %v", user.ID, err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Failed to finish user archive: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestExportDownloadsTheFilteredUsers(t *testing.T) {
+	srv := newTestServer(t)
+	createUserWithEmail(t, srv.store, "ann@acme.com")
+	createUserWithEmail(t, srv.store, "bob@globex.com")
+	carl := createUserWithEmail(t, srv.store, "carl@acme.com")
+	carl.Metadata = map[string]string{"plan": "pro"}
+	srv.store.Update(context.Background(), carl)
+
+	rec := do(http.HandlerFunc(srv.exportUsersHandler), "POST", "/api/v1/users/export", `{"domain":"ACME.com"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200; body: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("X-Total-Count"); got != "2" {
+		t.Errorf("X-Total-Count = %q, want 2", got)
+	}
+	var users []User
+	if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+		t.Fatalf("export is not a JSON array: %v; body: %s", err, rec.Body.String())
+	}
+	if len(users) != 2 || users[0].Email != "ann@acme.com" || users[1].Email != "carl@acme.com" {
+		t.Fatalf("exported %+v, want the two acme.com users", users)
+	}
+	if users[1].Metadata["plan"] != "pro" {
+		t.Errorf("exported metadata = %v, want the full user shape", users[1].Metadata)
+	}
+
+	rec = do(http.HandlerFunc(srv.exportUsersHandler), "POST", "/api/v1/users/export", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil || len(users) != 3 {
+		t.Errorf("unfiltered export = %d users (%v), want all 3", len(users), err)
+	}
+}
+
+func TestArchiveHoldsOneJSONEntryPerUser(t *testing.T) {
+	srv := newTestServer(t)
+	want := make(map[string]User)
+	for _, name := range []string{"ada", "grace", "linus"} {
+		u := createTestUser(t, srv.store, name)
+		want[fmt.Sprintf("users/%d.json", u.ID)] = u
+	}
+
+	rec := do(srv.Handler(), "GET", "/api/v1/users/archive", "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("archive = %d %s, want a 200 ZIP", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Disposition"), "attachment;") {
+		t.Errorf("Content-Disposition = %q, want an attachment", rec.Header().Get("Content-Disposition"))
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatalf("response isn't a ZIP archive: %v", err)
+	}
+	if len(zr.File) != len(want) {
+		t.Errorf("archive holds %d entries, want %d", len(zr.File), len(want))
+	}
+	for _, f := range zr.File {
+		expected, ok := want[f.Name]
+		if !ok {
+			t.Errorf("unexpected entry %s", f.Name)
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got User
+		err = json.NewDecoder(rc).Decode(&got)
+		rc.Close()
+		if err != nil {
+			t.Errorf("%s isn't valid JSON: %v", f.Name, err)
+		} else if got.ID != expected.ID || got.Email != expected.Email {
+			t.Errorf("%s holds user %d %s, want %d %s", f.Name, got.ID, got.Email, expected.ID, expected.Email)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import "net/http"
+
+// features reports which optional behaviours cfg turns on, by name. Only
+// whether each is enabled is exposed, never its settings.
+func features(cfg Config) map[string]bool {
+	return map[string]bool{
+		"admin":                    cfg.AdminToken != "",
+		"auth_tokens":              len(cfg.AuthTokens) > 0,
+		"multi_tenant":             cfg.MultiTenant,
+		"soft_delete":              cfg.SoftDelete,
+		"degraded_read_cache":      cfg.DegradedReadCache,
+		"user_cache":               cfg.UserCacheTTL > 0,
+		"file_write_behind":        cfg.Store == "file" && cfg.FileFlushInterval > 0,
+		"strict_query":             cfg.StrictQuery,
+		"reject_future_timestamps": cfg.RejectFutureTimestamps,
+		"canonicalize_email":       cfg.CanonicalizeEmail,
+		"email_mx_check":           cfg.EmailMXCheck,
+		"blocked_email_domains":    len(cfg.BlockedDomains) > 0,
+		"domain_create_limit":      cfg.DomainCreateLimit > 0,
+		"rate_limit":               cfg.rateLimited(),
+		"global_rate_limit":        cfg.GlobalRate > 0,
+		"concurrency_limit":        cfg.MaxConcurrentPerIP > 0,
+		"compression":              cfg.CompressAlgo != "",
+		"empty_list_204":           cfg.EmptyList204,
+		"webhooks":                 len(cfg.WebhookURLs) > 0,
+		"discovery":                cfg.Discovery,
+		"field_aliases":            len(cfg.FieldAliases) > 0,
+		"request_timeout":          cfg.RequestTimeout > 0,
+		"access_log":               cfg.AccessLog,
+	}
+}
+
+// List the optional features and whether this server has them enabled
+func (s *Server) featuresHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "Features retrieved successfully",
+		Data:    features(s.cfg),
+	})
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFeaturesReportToggledFlags(t *testing.T) {
+	h := newTestServer(t, "SOFT_DELETE=true", "ADMIN_TOKEN=admin-secret", "STRICT_QUERY=false").Handler()
+
+	resp := decodeResponse(t, do(h, "GET", "/api/v1/features", ""), http.StatusOK)
+	var flags map[string]bool
+	decodeData(t, resp, &flags)
+	if !flags["soft_delete"] || !flags["admin"] {
+		t.Errorf("features = %v, want soft_delete and admin enabled", flags)
+	}
+	if enabled, ok := flags["strict_query"]; !ok || enabled {
+		t.Errorf("strict_query = %v (listed %v), want it listed as disabled", enabled, ok)
+	}
+	if strings.Contains(string(resp.Data), "admin-secret") {
+		t.Errorf("features expose the admin token: %s", resp.Data)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileStore is a UserStore that keeps users in memory and writes the full
+// data set to a JSON file after every change, or in write-behind mode
+// batches changes and writes them periodically
+type FileStore struct {
+	*MemoryStore
+	path string
+
+	saveMu sync.Mutex
+
+	// writeMu serializes changes while they are written straight away,
+	// so one can be rolled back without losing another
+	writeMu sync.Mutex
+
+	// Write-behind state, unused when kick is nil. pending counts the
+	// changes not yet on disk.
+	flushAfter int
+	pendingMu  sync.Mutex
+	pending    int
+	kick       chan struct{}
+	stop       chan struct{}
+	stopped    chan struct{}
+	closeOnce  sync.Once
+}
+
+// NewFileStore opens the store persisted at path, creating an empty one
+// if the file doesn't exist yet. Emails are compared by rules.
+func NewFileStore(path string, rules emailRules) (*FileStore, error) {
+	f := &FileStore{MemoryStore: NewMemoryStore(rules), path: path}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snap memorySnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := f.restore(snap); err != nil {
+		return nil, fmt.Errorf("load %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// Create stores u and persists the change
+func (f *FileStore) Create(ctx context.Context, u User) (User, error) {
+	var created User
+	err := f.apply(func() (err error) {
+		created, err = f.MemoryStore.Create(ctx, u)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return created, nil
+}
+
+// Insert stores u under its own ID and persists the change
+func (f *FileStore) Insert(ctx context.Context, u User) (User, error) {
+	var inserted User
+	err := f.apply(func() (err error) {
+		inserted, err = f.MemoryStore.Insert(ctx, u)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return inserted, nil
+}
+
+// InsertMany stores each user under its own ID and persists them with a
+// single write. errs holds the error for each user that wasn't stored;
+// when the write fails, none are.
+func (f *FileStore) InsertMany(ctx context.Context, users []User) (errs []error, err error) {
+	errs = make([]error, len(users))
+	err = f.apply(func() error {
+		for i, u := range users {
+			_, errs[i] = f.MemoryStore.Insert(ctx, u)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+// Update replaces u and persists the change
+func (f *FileStore) Update(ctx context.Context, u User) (User, error) {
+	var updated User
+	err := f.apply(func() (err error) {
+		updated, err = f.MemoryStore.Update(ctx, u)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return updated, nil
+}
+
+// UpdateIfVersion replaces u if its version is unchanged and persists the
+// change
+func (f *FileStore) UpdateIfVersion(ctx context.Context, id, expectedVersion int, u User) (User, error) {
+	var updated User
+	err := f.apply(func() (err error) {
+		updated, err = f.MemoryStore.UpdateIfVersion(ctx, id, expectedVersion, u)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return updated, nil
+}
+
+// Delete removes the user and persists the change
+func (f *FileStore) Delete(ctx context.Context, id int) error {
+	return f.apply(func() error { return f.MemoryStore.Delete(ctx, id) })
+}
+
+// SoftDelete moves the user to the trash and persists the change
+func (f *FileStore) SoftDelete(ctx context.Context, id int) error {
+	return f.apply(func() error { return f.MemoryStore.SoftDelete(ctx, id) })
+}
+
+// DeleteIfVersion removes the user if its version is unchanged and
+// persists the change
+func (f *FileStore) DeleteIfVersion(ctx context.Context, id, expectedVersion int, soft bool) error {
+	return f.apply(func() error { return f.MemoryStore.DeleteIfVersion(ctx, id, expectedVersion, soft) })
+}
+
+// PurgeTrash empties the trash entries for ids and persists the change
+func (f *FileStore) PurgeTrash(ctx context.Context, ids []int) (int, error) {
+	var n int
+	err := f.apply(func() (err error) {
+		n, err = f.MemoryStore.PurgeTrash(ctx, ids)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// apply makes a change to the users in memory and persists it. When
+// every change is written straight away, a failed write rolls the change
+// back so the store never reports what the file doesn't hold; changes
+// are applied one at a time for that. Write-behind changes are only
+// counted towards the next flush.
+func (f *FileStore) apply(change func() error) error {
+	if f.kick != nil {
+		if err := change(); err != nil {
+			return err
+		}
+		return f.persist()
+	}
+
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	before := f.snapshot()
+	if err := change(); err != nil {
+		return err
+	}
+	if err := f.save(); err != nil {
+		if rerr := f.restore(before); rerr != nil {
+			log.Printf("Failed to roll back a change %s could not be written with: %v", f.path, rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// writeBehind switches the store to batching changes in memory. They are
+// written every interval, or as soon as flushAfter changes are pending
+// when flushAfter is positive, and on Close.
+func (f *FileStore) writeBehind(interval time.Duration, flushAfter int) {
+	f.flushAfter = flushAfter
+	f.kick = make(chan struct{}, 1)
+	f.stop = make(chan struct{})
+	f.stopped = make(chan struct{})
+	go f.runFlusher(interval)
+}
+
+// persist counts the change just made towards the next write-behind
+// flush
+func (f *FileStore) persist() error {
+	f.pendingMu.Lock()
+	f.pending++
+	full := f.flushAfter > 0 && f.pending >= f.flushAfter
+	f.pendingMu.Unlock()
+	if full {
+		select {
+		case f.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// runFlusher writes pending changes until Close stops it
+func (f *FileStore) runFlusher(interval time.Duration) {
+	defer close(f.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		case <-f.kick:
+		}
+		if err := f.flush(); err != nil {
+			log.Printf("Failed to write %s: %v", f.path, err)
+		}
+	}
+}
+
+// flush saves the store if any changes are pending. On failure they stay
+// pending for the next attempt.
+func (f *FileStore) flush() error {
+	f.pendingMu.Lock()
+	n := f.pending
+	f.pending = 0
+	f.pendingMu.Unlock()
+	if n == 0 {
+		return nil
+	}
+
+	if err := f.save(); err != nil {
+		f.pendingMu.Lock()
+		f.pending += n
+		f.pendingMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Close stops write-behind flushing and writes any pending changes
+func (f *FileStore) Close() error {
+	if f.kick == nil {
+		return nil
+	}
+	f.closeOnce.Do(func() { close(f.stop) })
+	<-f.stopped
+	return f.flush()
+}
+
+// save writes the current state to a temporary file and renames it into
+// place so a crash never leaves a half-written file behind
+func (f *FileStore) save() error {
+	f.saveMu.Lock()
+	defer f.saveMu.Unlock()
+
+	data, err := json.MarshalIndent(f.snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
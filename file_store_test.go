@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStorePersistsAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	f, err := NewFileStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := createTestUser(t, f, "kept")
+	gone := createTestUser(t, f, "gone")
+	if err := f.Delete(context.Background(), gone.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileStore(path, nil)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	users, _ := reopened.List(context.Background())
+	if len(users) != 1 || users[0].Email != kept.Email {
+		t.Fatalf("reopened store holds %+v, want only %s", users, kept.Email)
+	}
+	next := createTestUser(t, reopened, "next")
+	if next.ID <= gone.ID {
+		t.Errorf("new user got ID %d, want IDs after %d to stay unused", next.ID, gone.ID)
+	}
+}
+
+// createUsers adds n users to store
+func createUsers(t *testing.T, store UserStore, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if _, err := store.Create(context.Background(), User{Name: "Burst", Email: testEmail(fmt.Sprintf("burst%d", i)), Created: time.Now().UTC()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// savedUsers reopens the file at path and returns how many users it holds
+func savedUsers(t *testing.T, path string) int {
+	t.Helper()
+	f, err := NewFileStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := f.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(users)
+}
+
+func TestWriteBehindCoalescesWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	f, err := NewFileStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.writeBehind(time.Hour, 5)
+	defer f.Close()
+
+	createUsers(t, f, 4)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("file written before flushAfter changes were pending: %v", err)
+	}
+
+	createUsers(t, f, 1)
+	deadline := time.Now().Add(time.Second)
+	for {
+		f.pendingMu.Lock()
+		pending := f.pending
+		f.pendingMu.Unlock()
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d changes still pending after flushAfter was reached", pending)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := savedUsers(t, path); n != 5 {
+		t.Errorf("one flush saved %d users, want all 5", n)
+	}
+}
+
+func TestCloseFlushesPendingWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	f, err := NewFileStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.writeBehind(time.Hour, 0)
+
+	createUsers(t, f, 20)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("file written before the flush interval: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if n := savedUsers(t, path); n != 20 {
+		t.Errorf("Close saved %d users, want 20", n)
+	}
+}
+
+func TestLoadFailsWhenTheEmailRulesMergeUsers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	f, err := NewFileStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, email := range []string{"ann@example.com", "ann+news@example.com"} {
+		if _, err := f.Create(ctx, User{Name: "Ann", Email: email, Created: time.Now().UTC()}); err != nil {
+			t.Fatalf("Create %s without rules: %v", email, err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := parseEmailRules(defaultEmailRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileStore(path, rules); err == nil {
+		t.Error("loaded two users whose emails collide under the rules, want an error")
+	}
+	if _, err := NewFileStore(path, nil); err != nil {
+		t.Errorf("reopening without rules: %v", err)
+	}
+}
+
+func TestFailedWriteRollsTheChangeBack(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFileStore(filepath.Join(dir, "users.json"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	kept, err := f.Create(ctx, User{Name: "Kept", Email: "kept@example.com", Created: time.Now().UTC()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With the directory gone the file can't be written
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Create(ctx, User{Name: "Lost", Email: "lost@example.com", Created: time.Now().UTC()}); err == nil {
+		t.Fatal("Create succeeded without a data directory, want the write error")
+	}
+	if err := f.Delete(ctx, kept.ID); err == nil {
+		t.Fatal("Delete succeeded without a data directory, want the write error")
+	}
+
+	users, err := f.List(ctx)
+	if err != nil || len(users) != 1 || users[0].ID != kept.ID {
+		t.Errorf("store holds %+v (%v) after the failed writes, want only the first user", users, err)
+	}
+
+	// The rolled back email is free again once writes work
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Create(ctx, User{Name: "Lost", Email: "lost@example.com", Created: time.Now().UTC()}); err != nil {
+		t.Errorf("Create after the directory is back: %v", err)
+	}
+}
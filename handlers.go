@@ -0,0 +1,614 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+// Server holds the dependencies shared by the HTTP handlers
+type Server struct {
+	cfg    Config
+	store  UserStore
+	events *Hub
+
+	limiter       *ipRateLimiter
+	globalLimiter *rate.Limiter
+	inFlight      *inFlightLimiter
+	domainQuota   *domainQuota
+	imports       chan struct{}
+	readiness     *readinessChecker
+	latency       *latencyTracker
+	panics        *panicLog
+	auditLog      *auditLog
+	idempotency   *idempotencyCache
+	logSampler    *logSampler
+	webhooks      *webhookDispatcher
+	encoders      map[string]*sync.Pool
+
+	// format is the configured response format, before any FIELD_ALIASES
+	// profile a request selects
+	format responseFormat
+
+	// resolver performs the EMAIL_MX_CHECK lookups
+	resolver mxResolver
+
+	// listener is opened by Listen. activated is set when it was
+	// inherited through socket activation.
+	listener  net.Listener
+	activated bool
+
+	// shuttingDown is set once shutdown begins, so probes report draining
+	shuttingDown atomic.Bool
+
+	// now is the clock used for timestamps and relative time filters
+	now func() time.Time
+}
+
+// errNoStore is returned by NewServer when it is given no store
+var errNoStore = errors.New("no user store is configured")
+
+// storeRetryAfter is how long a client is asked to wait when the store is
+// unavailable
+const storeRetryAfter = 5 * time.Second
+
+// isNilStore reports whether store is nil, including a nil pointer to a
+// store implementation
+func isNilStore(store UserStore) bool {
+	if store == nil {
+		return true
+	}
+	v := reflect.ValueOf(store)
+	return v.Kind() == reflect.Pointer && v.IsNil()
+}
+
+// NewServer returns a Server using cfg and backed by the given store
+func NewServer(cfg Config, store UserStore) (*Server, error) {
+	if isNilStore(store) {
+		return nil, errNoStore
+	}
+	s := &Server{
+		cfg:         cfg,
+		store:       store,
+		events:      NewHub(cfg.MaxSubscribers, cfg.SubscriberBuffer),
+		limiter:     newIPRateLimiter(cfg.RateLimit, cfg.RateBurst, cfg.RateLimitTTL),
+		latency:     newLatencyTracker(),
+		panics:      newPanicLog(),
+		auditLog:    newAuditLog(),
+		idempotency: newIdempotencyCache(cfg.IdempotencyTTL, cfg.IdempotencyMaxKeys),
+		imports:     make(chan struct{}, cfg.MaxConcurrentImports),
+		format:      newResponseFormat(cfg),
+		encoders:    newEncoderPools(cfg),
+		now:         time.Now,
+
+		resolver: net.DefaultResolver,
+	}
+	for tenant, spec := range cfg.TenantRates {
+		s.limiter.setLimit(tenantBucket(tenant), spec)
+	}
+	if cfg.DomainCreateLimit > 0 {
+		s.domainQuota = newDomainQuota(cfg.DomainCreateLimit, cfg.DomainCreateWindow)
+	}
+	if len(cfg.WebhookURLs) > 0 {
+		s.webhooks = newWebhookDispatcher(cfg.WebhookURLs, cfg.WebhookQueue, cfg.WebhookTimeout, newResponseFormat(cfg).streamed())
+	}
+	if cfg.MaxConcurrentPerIP > 0 {
+		s.inFlight = newInFlightLimiter(cfg.MaxConcurrentPerIP)
+	}
+	if cfg.AccessLog {
+		s.logSampler = newLogSampler(cfg.AccessLogSampleRPS, cfg.AccessLogSampleRate)
+	}
+	if cfg.GlobalRate > 0 {
+		s.globalLimiter = rate.NewLimiter(rate.Limit(cfg.GlobalRate), cfg.GlobalBurst)
+	}
+	s.readiness = newReadinessChecker(s.checkStore, cfg.ReadinessCacheTTL, cfg.ReadinessCooldown)
+	return s, nil
+}
+
+// writeJSON writes response as JSON with the given status code. Nothing is
+// written once the request deadline has passed, since the timeout response
+// has been sent in its place. A context cancelled by a failed body read
+// still gets its error response.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, response Response) {
+	if err := r.Context().Err(); errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("Dropping %d response for %s %s: %v", status, r.Method, r.URL.Path, err)
+		return
+	}
+
+	if responseFormatFrom(r.Context()).ErrorFormat == errorFormatProblem && response.Status == "error" {
+		writeProblem(w, r, status, response)
+		return
+	}
+	writeEncoded(w, r, status, "application/json", response)
+}
+
+// writeEncoded writes v as the response body in the request's response
+// format. It is encoded before anything is sent, so an encoding failure
+// can still become a 500.
+func writeEncoded(w http.ResponseWriter, r *http.Request, status int, contentType string, v interface{}) {
+	data, err := responseFormatFrom(r.Context()).encode(v)
+	if err != nil {
+		log.Printf("Failed to encode response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
+// writeError writes a standard error response for code. An empty message
+// uses the code's default message from the error catalog.
+func writeError(w http.ResponseWriter, r *http.Request, code ErrorCode, message string) {
+	def := lookupError(code)
+	if message == "" {
+		message = def.Message
+	}
+	writeJSON(w, r, def.Status, Response{
+		Status:  "error",
+		Code:    code,
+		Message: message,
+	})
+}
+
+// writeStoreError maps a store error onto the matching HTTP response
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeError(w, r, CodeUserNotFound, "")
+	case errors.Is(err, ErrDuplicateEmail):
+		writeError(w, r, CodeDuplicateEmail, "")
+	case errors.Is(err, ErrVersionMismatch):
+		writeError(w, r, CodeVersionConflict, "")
+	case errors.Is(err, ErrStoreUnavailable):
+		log.Printf("Store error: %v", err)
+		writeRetryError(w, r, CodeUnavailable, "The data store is unavailable", storeRetryAfter)
+	default:
+		log.Printf("Store error: %v", err)
+		writeError(w, r, CodeInternal, "")
+	}
+}
+
+// userID extracts the numeric user ID from the route variables
+func userID(r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	return id, err == nil
+}
+
+// Fallback for paths that match no route, such as /docs or
+// /openapi.json, so they get the standard JSON envelope
+func (s *Server) notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, CodeNotFound, "")
+}
+
+// Fallback for known paths requested with an unsupported method
+func (s *Server) methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, CodeMethodNotAllowed, "")
+}
+
+// Health check endpoint
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	message, state := "API is healthy", "serving"
+	if s.ShuttingDown() {
+		message, state = "API is shutting down", "shutting_down"
+	}
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: message,
+		Data: map[string]interface{}{
+			"timestamp": s.now().UTC().Format(time.RFC3339),
+			"version":   version,
+			"service":   "go-backend-api",
+			"state":     state,
+		},
+	})
+}
+
+// Get a page of users, optionally only those created within
+// ?since=<duration>. With ?modified_since=<RFC 3339 time> the page holds
+// the users written since then plus tombstones for deleted users, for
+// incremental sync. A ?cursor= page is tagged with its next_cursor, so a
+// client polling for new users sends it back in If-None-Match and gets a
+// 304 while there are none. A page with no users is a 200 with an empty
+// array, or a 204 No Content when EMPTY_LIST_204 is set.
+func (s *Server) getUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if err := checkQueryParams(s.cfg, r, listParams); err != nil {
+		writeParamError(w, r, err)
+		return
+	}
+
+	q, err := parseListQuery(r, s.cfg.MaxPageOffset)
+	if err == nil {
+		err = checkFilterLimit(q.constraints(), s.cfg.MaxFilters)
+	}
+	if err != nil {
+		writeParamError(w, r, err)
+		return
+	}
+
+	// Relative windows move with the clock, so only absolute queries can be
+	// revalidated against the store's modification time. Cursor pages are
+	// revalidated by their position instead.
+	if q.since == 0 && q.Cursor == "" && !wantsNDJSON(r) {
+		modified, count, err := s.store.Modified(r.Context())
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		etag := listETag(modified, count, tenantFrom(r.Context()), r.URL.Query())
+		w.Header().Set("ETag", etag)
+		if noneMatch := r.Header.Get("If-None-Match"); noneMatch != "" && weakETagMatches(noneMatch, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	// A delta fetched as NDJSON is streamed straight from the store in
+	// modification order rather than buffered, unless another order was
+	// asked for
+	if !q.modifiedSince.IsZero() && q.Cursor == "" && q.Sort == "" && wantsNDJSON(r) {
+		s.streamModifiedNDJSON(w, r, q.modifiedSince, q.filter())
+		return
+	}
+
+	// A JSON delta page is cut from the same iteration, holding no more
+	// users than the page and those before it. Sorted and cursor deltas
+	// are still loaded whole below.
+	if !q.modifiedSince.IsZero() && q.Cursor == "" && q.Sort == "" {
+		collector := newPageCollector(q.start(), q.Limit)
+		err := s.iterateModified(r.Context(), q.modifiedSince, q.filter(), func(u User) error {
+			collector.add(u)
+			return nil
+		})
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		users, meta := collector.page(q.start(), q.Page, q.Limit)
+		s.writeUserPage(w, r, q, users, meta)
+		return
+	}
+
+	// A plain or cursor page is fetched from the store alone, so SQL
+	// backends don't load every row to return one page
+	if q.inStore() && !wantsNDJSON(r) {
+		offset := q.start()
+		users, total, err := s.listPage(r.Context(), q.filter(), q.order, offset, q.Limit)
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		if cursorNotModified(w, r, q, users) {
+			return
+		}
+		meta := newPageMeta(total, q.Page, q.Limit)
+		if q.order.byID() && len(users) > 0 && len(users) < total-offset {
+			meta.NextCursor = encodeCursor(users[len(users)-1].ID)
+		}
+		s.writeUserPage(w, r, q, users, meta)
+		return
+	}
+
+	var users []User
+	if !q.modifiedSince.IsZero() {
+		users, err = s.modifiedUsers(r.Context(), q.modifiedSince)
+	} else {
+		users, err = s.listUsers(r.Context())
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	if q.since > 0 {
+		users = createdAfter(users, s.now().Add(-q.since))
+	}
+	if q.IDFrom > 0 || q.IDTo > 0 {
+		users = usersInIDRange(users, q.IDFrom, q.IDTo)
+	}
+	if q.Cursor != "" {
+		users = usersAfter(users, q.after)
+		if !wantsNDJSON(r) && cursorNotModified(w, r, q, users) {
+			return
+		}
+	}
+
+	if !q.order.byID() {
+		sortUsers(users, q.order)
+	}
+
+	if wantsNDJSON(r) {
+		writeNDJSON(w, r, users)
+		return
+	}
+
+	users, meta := paginateFrom(users, q.start(), q.Page, q.Limit)
+	if !q.order.byID() {
+		// Cursors resume in ID order
+		meta.NextCursor = ""
+	}
+	s.writeUserPage(w, r, q, users, meta)
+}
+
+// cursorNotModified answers a cursor poll that found no new users with a
+// 304 when the client already holds the cursor, reporting whether it did
+func cursorNotModified(w http.ResponseWriter, r *http.Request, q listQuery, users []User) bool {
+	if q.Cursor == "" || len(users) > 0 {
+		return false
+	}
+	etag := `"` + q.Cursor + `"`
+	w.Header().Set("ETag", etag)
+	if noneMatch := r.Header.Get("If-None-Match"); noneMatch != "" && weakETagMatches(noneMatch, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// writeUserPage finishes a user list response, applying MAX_LIST_BYTES
+// and the cursor and empty page handling
+func (s *Server) writeUserPage(w http.ResponseWriter, r *http.Request, q listQuery, users []User, meta pageMeta) {
+	meta.Applied = q
+	if s.cfg.MaxListBytes > 0 {
+		var truncated bool
+		if users, truncated = truncateToBudget(users, s.cfg.MaxListBytes, responseFormatFrom(r.Context())); truncated {
+			meta.Truncated = true
+			var options []string
+			if q.Cursor == "" {
+				meta.NextPageOffset = q.start() + len(users)
+				options = append(options, fmt.Sprintf("continue with offset=%d", meta.NextPageOffset))
+			}
+			if q.order.byID() {
+				meta.NextCursor = encodeCursor(users[len(users)-1].ID)
+				options = append(options, "follow next_cursor")
+			}
+			options = append(options, "request a smaller limit")
+			meta.Hint = fmt.Sprintf("Page truncated to %d users to fit the response size limit; %s", len(users), strings.Join(options, ", or "))
+		}
+	}
+	if q.Cursor != "" {
+		// Cursor clients resume from the last user seen even at the end
+		// of the list, to poll for users created later
+		if meta.NextCursor == "" {
+			meta.NextCursor = q.Cursor
+			if len(users) > 0 {
+				meta.NextCursor = encodeCursor(users[len(users)-1].ID)
+			}
+		}
+		w.Header().Set("ETag", `"`+meta.NextCursor+`"`)
+	}
+	if len(users) == 0 && s.cfg.EmptyList204 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "Users retrieved successfully",
+		Data:    users,
+		Meta:    meta,
+	})
+}
+
+// Get the pagination metadata the user list would return for the same
+// filters, without the users. The count runs in the store, except for
+// deltas.
+func (s *Server) getPageInfoHandler(w http.ResponseWriter, r *http.Request) {
+	if err := checkQueryParams(s.cfg, r, pageInfoParams); err != nil {
+		writeParamError(w, r, err)
+		return
+	}
+
+	q, err := parseListQuery(r, s.cfg.MaxPageOffset)
+	if err == nil {
+		err = checkFilterLimit(q.constraints(), s.cfg.MaxFilters)
+	}
+	if err != nil {
+		writeParamError(w, r, err)
+		return
+	}
+
+	filter := q.filter()
+	if q.since > 0 {
+		after := s.now().Add(-q.since)
+		filter.CreatedAfter = &after
+	}
+	var total int
+	if !q.modifiedSince.IsZero() {
+		// The delta includes tombstones, which the store can't count, so
+		// they are counted while iterating it
+		err = s.iterateModified(r.Context(), q.modifiedSince, filter, func(User) error {
+			total++
+			return nil
+		})
+	} else {
+		total, err = s.countUsers(r.Context(), filter)
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	meta := newPageMeta(total, q.Page, q.Limit)
+	meta.Applied = q
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "Page information retrieved successfully",
+		Data:    meta,
+	})
+}
+
+// createdAfter returns the users created at or after t
+func createdAfter(users []User, t time.Time) []User {
+	filtered := make([]User, 0, len(users))
+	for _, u := range users {
+		if !u.Created.Before(t) {
+			filtered = append(filtered, u)
+		}
+	}
+	return filtered
+}
+
+// Get user by ID
+func (s *Server) getUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(r)
+	if !ok {
+		writeError(w, r, CodeUserNotFound, "")
+		return
+	}
+
+	if err := checkQueryParams(s.cfg, r, userParams); err != nil {
+		writeParamError(w, r, err)
+		return
+	}
+	expand, err := parseExpand(r)
+	if err != nil {
+		writeParamError(w, r, err)
+		return
+	}
+
+	user, err := s.getUser(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	// Expanded sections change over time, so only the plain
+	// representation carries the user's entity tag
+	if len(expand) == 0 {
+		w.Header().Set("ETag", userETag(user, responseFormatFrom(r.Context())))
+	}
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "User found",
+		Data:    s.expandUser(user, expand),
+	})
+}
+
+// userInput is the client-supplied payload for creating a user
+type userInput struct {
+	Name     string            `json:"name"`
+	Email    string            `json:"email"`
+	Tags     []string          `json:"tags"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// validate returns the problems with the input, or nil when it is
+// acceptable
+func (in userInput) validate(cfg Config) []FieldError {
+	var errs []FieldError
+	if in.Name == "" {
+		errs = append(errs, FieldError{Field: "name", Message: "is required"})
+	}
+	if in.Email == "" {
+		errs = append(errs, FieldError{Field: "email", Message: "is required"})
+	} else if !validEmail(in.Email) {
+		errs = append(errs, FieldError{Field: "email", Message: "must be a valid email address"})
+	}
+	errs = append(errs, validateTags(cfg, "tags", in.Tags)...)
+	return append(errs, validateMetadata(cfg, "metadata", in.Metadata)...)
+}
+
+// toUser builds a new, not yet stored, user from the input, created at
+// the given time
+func (in userInput) toUser(created time.Time) User {
+	return User{
+		Name:     in.Name,
+		Email:    in.Email,
+		Created:  created.UTC().Truncate(time.Second),
+		Tags:     in.Tags,
+		Metadata: in.Metadata,
+	}
+}
+
+// Create new user
+func (s *Server) createUserHandler(w http.ResponseWriter, r *http.Request) {
+	var newUser userInput
+
+	if err := s.decodeBody(w, r, &newUser); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+
+	if errs := newUser.validate(s.cfg); len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+	release, rejection := s.admitSignup(r.Context(), newUser.Email)
+	if rejection != nil {
+		rejection.write(w, r)
+		return
+	}
+
+	user := newUser.toUser(s.now())
+	user.OrgID = tenantFrom(r.Context())
+	user, err := s.store.Create(r.Context(), user)
+	if err != nil {
+		release()
+		writeStoreError(w, r, err)
+		return
+	}
+	s.publish(r.Context(), EventUserCreated, user)
+
+	writeJSON(w, r, http.StatusCreated, Response{
+		Status:  "success",
+		Message: "User created successfully",
+		Data:    user,
+	})
+}
+
+// Delete user. When If-Match is sent, the delete only happens if it
+// matches the user's current ETag, and the store checks the version
+// again so a concurrent update still stops it.
+func (s *Server) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(r)
+	if !ok {
+		writeError(w, r, CodeUserNotFound, "")
+		return
+	}
+
+	user, err := s.getUser(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" && !etagMatches(ifMatch, userETag(user, responseFormatFrom(r.Context()))) {
+		w.Header().Set("ETag", userETag(user, responseFormatFrom(r.Context())))
+		writeError(w, r, CodePreconditionFailed, "User has changed since the supplied ETag")
+		return
+	}
+
+	if ifMatch != "" {
+		err = s.deleteUserIfVersion(r.Context(), id, user.Version)
+	} else {
+		err = s.deleteUser(r.Context(), id)
+	}
+	if errors.Is(err, ErrVersionMismatch) {
+		writeError(w, r, CodePreconditionFailed, "User has changed since the supplied ETag")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	s.publish(r.Context(), EventUserDeleted, user)
+
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "User deleted successfully",
+	})
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// testResponse is a decoded API response, with data left raw for the
+// test to decode into what it expects
+type testResponse struct {
+	Status  string          `json:"status"`
+	Code    ErrorCode       `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+	Meta    json.RawMessage `json:"meta"`
+}
+
+// testConfig loads the default configuration with env, a list of
+// NAME=value settings, applied on top
+func testConfig(t testing.TB, env ...string) Config {
+	t.Helper()
+	for _, setting := range env {
+		name, value, _ := strings.Cut(setting, "=")
+		t.Setenv(name, value)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	return cfg
+}
+
+// newTestServer returns a server over an empty memory store, configured
+// as testConfig does
+func newTestServer(t testing.TB, env ...string) *Server {
+	t.Helper()
+	srv, err := NewServer(testConfig(t, env...), NewMemoryStore(nil))
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	return srv
+}
+
+// fakeClock is a settable clock for Server.now
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// newTestRequest returns a request for path with body, if any, as JSON
+func newTestRequest(method, path string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, path, body)
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	return r
+}
+
+// serve runs r through h and returns the recorded response
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+// do sends a request with body, when it isn't empty, through h
+func do(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	return serve(h, newTestRequest(method, path, reader))
+}
+
+// decodeResponse decodes the recorded API response, failing the test
+// when its status isn't want
+func decodeResponse(t *testing.T, rec *httptest.ResponseRecorder, want int) testResponse {
+	t.Helper()
+	if rec.Code != want {
+		t.Fatalf("status = %d, want %d; body: %s", rec.Code, want, rec.Body.String())
+	}
+	var resp testResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v; body: %s", err, rec.Body.String())
+	}
+	return resp
+}
+
+// decodeData decodes the data member of a response into v
+func decodeData(t *testing.T, resp testResponse, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(resp.Data, v); err != nil {
+		t.Fatalf("decode data: %v; data: %s", err, resp.Data)
+	}
+}
+
+func TestListUsersCreatedSince(t *testing.T) {
+	srv := newTestServer(t)
+	clock := newFakeClock()
+	srv.now = clock.now
+	create := http.HandlerFunc(srv.createUserHandler)
+	list := http.HandlerFunc(srv.getUsersHandler)
+
+	decodeResponse(t, do(create, "POST", "/api/v1/users", `{"name":"Old","email":"old@example.com"}`), http.StatusCreated)
+	clock.advance(2 * time.Hour)
+	decodeResponse(t, do(create, "POST", "/api/v1/users", `{"name":"New","email":"new@example.com"}`), http.StatusCreated)
+	clock.advance(10 * time.Minute)
+
+	var users []User
+	decodeData(t, decodeResponse(t, do(list, "GET", "/api/v1/users?since=1h", ""), http.StatusOK), &users)
+	if len(users) != 1 || users[0].Name != "New" {
+		t.Errorf("since=1h listed %+v, want only the recent user", users)
+	}
+
+	for _, since := range []string{"yesterday", "-1h", "0s"} {
+		decodeResponse(t, do(list, "GET", "/api/v1/users?since="+since, ""), http.StatusBadRequest)
+	}
+}
+
+func TestDeltaPullIncludesUpdatesAndTombstones(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	list := http.HandlerFunc(srv.getUsersHandler)
+	unchanged := createTestUser(t, srv.store, "unchanged")
+	updated := createTestUser(t, srv.store, "updated")
+	deleted := createTestUser(t, srv.store, "deleted")
+
+	time.Sleep(time.Millisecond)
+	since := time.Now().UTC()
+	updated.Name = "Updated"
+	if _, err := srv.store.Update(ctx, updated); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.store.Delete(ctx, deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	var users []User
+	path := "/api/v1/users?modified_since=" + url.QueryEscape(since.Format(time.RFC3339Nano))
+	decodeData(t, decodeResponse(t, do(list, "GET", path, ""), http.StatusOK), &users)
+	if len(users) != 2 {
+		t.Fatalf("delta pull returned %+v, want the updated user and the tombstone", users)
+	}
+	byID := map[int]User{users[0].ID: users[0], users[1].ID: users[1]}
+	if _, ok := byID[unchanged.ID]; ok {
+		t.Errorf("delta pull includes user %d, which wasn't modified", unchanged.ID)
+	}
+	if u := byID[updated.ID]; u.Name != "Updated" || u.DeletedAt != nil {
+		t.Errorf("updated user = %+v, want the new name and no deletion time", u)
+	}
+	if u := byID[deleted.ID]; u.DeletedAt == nil || u.DeletedAt.Before(since) {
+		t.Errorf("tombstone = %+v, want a deletion time after %s", u, since)
+	}
+
+	var raw []map[string]interface{}
+	decodeData(t, decodeResponse(t, do(list, "GET", path, ""), http.StatusOK), &raw)
+	for _, entry := range raw {
+		if entry["id"] != float64(deleted.ID) {
+			continue
+		}
+		for _, field := range []string{"name", "email", "created", "version"} {
+			if _, ok := entry[field]; ok {
+				t.Errorf("tombstone has a %s field, want only the ID and deletion times: %v", field, entry)
+			}
+		}
+	}
+}
+
+// iterateOnlyStore is a memory store that can only hand out deltas one
+// user at a time, so a handler loading a delta whole fails
+type iterateOnlyStore struct {
+	*MemoryStore
+}
+
+func (iterateOnlyStore) ModifiedSince(ctx context.Context, since time.Time) ([]User, error) {
+	return nil, errors.New("delta loaded whole")
+}
+
+func TestDeltaPagesAreCutWhileIterating(t *testing.T) {
+	srv := newTestServer(t)
+	srv.store = iterateOnlyStore{NewMemoryStore(nil)}
+	ctx := context.Background()
+	since := time.Now().UTC().Add(-time.Second)
+	var users []User
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		users = append(users, createTestUser(t, srv.store, name))
+	}
+	// Touch the first users last, so modification order isn't ID order
+	for _, u := range users[:2] {
+		u.Name += " updated"
+		if _, err := srv.store.Update(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := http.HandlerFunc(srv.getUsersHandler)
+	path := "/api/v1/users?limit=2&page=2&modified_since=" + url.QueryEscape(since.Format(time.RFC3339Nano))
+	resp := decodeResponse(t, do(list, "GET", path, ""), http.StatusOK)
+	var page []User
+	decodeData(t, resp, &page)
+	if len(page) != 2 || page[0].ID != users[2].ID || page[1].ID != users[3].ID {
+		t.Errorf("page 2 = %+v, want users %d and %d in ID order", page, users[2].ID, users[3].ID)
+	}
+	var meta pageMeta
+	if err := json.Unmarshal(resp.Meta, &meta); err != nil {
+		t.Fatalf("decode meta: %v; meta: %s", err, resp.Meta)
+	}
+	if meta.Total != 5 || meta.NextCursor != encodeCursor(users[3].ID) {
+		t.Errorf("meta = %s, want a total of 5 and a cursor after user %d", resp.Meta, users[3].ID)
+	}
+
+	var info pageMeta
+	decodeData(t, decodeResponse(t, do(http.HandlerFunc(srv.getPageInfoHandler), "GET", strings.Replace(path, "/users", "/users/page-info", 1), ""), http.StatusOK), &info)
+	if info.Total != 5 {
+		t.Errorf("page-info total = %d, want 5", info.Total)
+	}
+}
+
+func TestUnmatchedRoutesGetTheJSONEnvelope(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(srv.notFoundHandler)
+	router.MethodNotAllowedHandler = http.HandlerFunc(srv.methodNotAllowedHandler)
+	router.HandleFunc("/api/v1/health", srv.healthHandler).Methods("GET")
+
+	for _, path := range []string{"/docs", "/openapi.json"} {
+		if resp := decodeResponse(t, do(router, "GET", path, ""), http.StatusNotFound); resp.Status != "error" || resp.Code != CodeNotFound {
+			t.Errorf("GET %s = %s %s, want an error with code NOT_FOUND", path, resp.Status, resp.Code)
+		}
+	}
+	if resp := decodeResponse(t, do(router, "POST", "/api/v1/health", ""), http.StatusMethodNotAllowed); resp.Code != CodeMethodNotAllowed {
+		t.Errorf("POST /api/v1/health code = %s, want METHOD_NOT_ALLOWED", resp.Code)
+	}
+}
+
+func TestEmptyListStatus(t *testing.T) {
+	var users []User
+	resp := decodeResponse(t, do(http.HandlerFunc(newTestServer(t).getUsersHandler), "GET", "/api/v1/users", ""), http.StatusOK)
+	decodeData(t, resp, &users)
+	if users == nil || len(users) != 0 {
+		t.Errorf("default empty page data = %s, want []", resp.Data)
+	}
+
+	srv := newTestServer(t, "EMPTY_LIST_204=true")
+	list := http.HandlerFunc(srv.getUsersHandler)
+	if rec := do(list, "GET", "/api/v1/users", ""); rec.Code != http.StatusNoContent || rec.Body.Len() != 0 {
+		t.Errorf("EMPTY_LIST_204 empty page: status %d with %d body bytes, want an empty 204", rec.Code, rec.Body.Len())
+	}
+	createTestUser(t, srv.store, "present")
+	decodeResponse(t, do(list, "GET", "/api/v1/users", ""), http.StatusOK)
+}
+
+func TestNewServerRequiresAStore(t *testing.T) {
+	var missing *MemoryStore
+	for name, store := range map[string]UserStore{"nil": nil, "nil pointer": missing} {
+		if srv, err := NewServer(testConfig(t), store); !errors.Is(err, errNoStore) || srv != nil {
+			t.Errorf("%s store: NewServer = %v, %v; want errNoStore", name, srv, err)
+		}
+	}
+
+	unbuilt := &Server{cfg: testConfig(t)}
+	resp := decodeResponse(t, do(unbuilt.Handler(), "GET", "/api/v1/users", ""), http.StatusInternalServerError)
+	if resp.Code != CodeInternal || !strings.Contains(resp.Message, errNoStore.Error()) {
+		t.Errorf("storeless server answered %s %q, want an internal error naming the missing store", resp.Code, resp.Message)
+	}
+}
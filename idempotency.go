@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// idempotencyKeyHeader lets a client retry a create without creating
+// twice: a repeated key gets the first response back
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength bounds the keys clients may send
+const maxIdempotencyKeyLength = 255
+
+// idempotencyRetryAfter is how long a client is asked to wait when every
+// cached key belongs to a request still running
+const idempotencyRetryAfter = time.Second
+
+// errIdempotencyFull is returned by begin when the cache is full of keys
+// whose first request hasn't finished, none of which may be evicted
+var errIdempotencyFull = errors.New("idempotency cache is full of pending keys")
+
+// replayedHeaders are the response headers kept for replay
+var replayedHeaders = []string{"Content-Type", "ETag", "Location"}
+
+// idempotentResponse is a response recorded for an idempotency key.
+// Pending is set while the first request is still running.
+type idempotentResponse struct {
+	key         string
+	fingerprint [sha256.Size]byte
+	expires     time.Time
+	pending     bool
+
+	status int
+	header http.Header
+	body   []byte
+}
+
+// idempotencyCache keeps the responses for up to max keys, each for ttl.
+// When full, the least recently used key whose response has been recorded
+// is evicted. Pending keys are never evicted, or a retry could run the
+// request a second time while the first is still going.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	max     int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// newIdempotencyCache returns an empty cache
+func newIdempotencyCache(ttl time.Duration, max int) *idempotencyCache {
+	return &idempotencyCache{ttl: ttl, max: max, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// begin looks up key, returning the recorded or pending response for it.
+// When there is none, fresh is set and a pending entry is added for the
+// caller to finish with complete or abandon. It fails with
+// errIdempotencyFull when no room can be made for the entry.
+func (c *idempotencyCache) begin(key string, fingerprint [sha256.Size]byte, now time.Time) (existing idempotentResponse, fresh bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, found := c.entries[key]; found {
+		entry := el.Value.(*idempotentResponse)
+		if now.Before(entry.expires) {
+			c.order.MoveToFront(el)
+			return *entry, false, nil
+		}
+		c.remove(el)
+	}
+
+	for el := c.order.Back(); el != nil && c.order.Len() >= c.max; {
+		prev := el.Prev()
+		if !el.Value.(*idempotentResponse).pending {
+			c.remove(el)
+		}
+		el = prev
+	}
+	if c.order.Len() >= c.max {
+		return idempotentResponse{}, false, errIdempotencyFull
+	}
+	entry := &idempotentResponse{key: key, fingerprint: fingerprint, expires: now.Add(c.ttl), pending: true}
+	c.entries[key] = c.order.PushFront(entry)
+	return idempotentResponse{}, true, nil
+}
+
+// complete records the response for a pending key
+func (c *idempotencyCache) complete(key string, status int, header http.Header, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, found := c.entries[key]; found {
+		entry := el.Value.(*idempotentResponse)
+		entry.pending = false
+		entry.status, entry.header, entry.body = status, header, body
+	}
+}
+
+// abandon forgets a pending key, so the request can be retried
+func (c *idempotencyCache) abandon(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, found := c.entries[key]; found && el.Value.(*idempotentResponse).pending {
+		c.remove(el)
+	}
+}
+
+// remove drops el. The caller must hold the lock.
+func (c *idempotencyCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*idempotentResponse).key)
+}
+
+// recordingWriter passes a response through while keeping a copy
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(p)
+	return rw.ResponseWriter.Write(p)
+}
+
+// idempotent replays the recorded response when a request repeats an
+// Idempotency-Key. Keys are scoped to the tenant and caller, and a key
+// reused with a different body is rejected. Server errors aren't
+// recorded, so they can be retried.
+func (s *Server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, r, CodeInvalidRequest,
+				idempotencyKeyHeader+" must be at most "+strconv.Itoa(maxIdempotencyKeyLength)+" characters")
+			return
+		}
+
+		s.limitBody(w, r)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		scoped := tenantFrom(r.Context()) + "\x00" + subjectFrom(r.Context()) + "\x00" + r.URL.Path + "\x00" + key
+		fingerprint := sha256.Sum256(body)
+		existing, fresh, err := s.idempotency.begin(scoped, fingerprint, s.now())
+		switch {
+		case err != nil:
+			writeRetryError(w, r, CodeUnavailable, "Too many requests with an "+idempotencyKeyHeader+" are in progress", idempotencyRetryAfter)
+			return
+		case fresh:
+		case existing.fingerprint != fingerprint:
+			writeError(w, r, CodeInvalidRequest, idempotencyKeyHeader+" was already used with a different request body")
+			return
+		case existing.pending:
+			writeError(w, r, CodeIdempotencyConflict, "")
+			return
+		default:
+			for name, values := range existing.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(existing.status)
+			w.Write(existing.body)
+			return
+		}
+
+		rw := &recordingWriter{ResponseWriter: w}
+		defer func() {
+			if rw.status == 0 || rw.status >= http.StatusInternalServerError {
+				s.idempotency.abandon(scoped)
+				return
+			}
+			header := make(http.Header)
+			for _, name := range replayedHeaders {
+				if v := w.Header().Values(name); len(v) > 0 {
+					header[name] = append([]string(nil), v...)
+				}
+			}
+			s.idempotency.complete(scoped, rw.status, header, rw.body.Bytes())
+		}()
+		next(rw, r)
+	}
+}
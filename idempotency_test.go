@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"testing"
+	"time"
+)
+
+// beginCompleted begins key and records a response for it
+func beginCompleted(t *testing.T, c *idempotencyCache, key string, now time.Time) {
+	t.Helper()
+	if _, fresh, err := c.begin(key, sha256.Sum256([]byte(key)), now); err != nil || !fresh {
+		t.Fatalf("begin(%s) = fresh %t, %v; want a fresh entry", key, fresh, err)
+	}
+	c.complete(key, 201, nil, []byte(key))
+}
+
+func TestIdempotencyCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newIdempotencyCache(time.Hour, 3)
+	now := time.Now()
+	for _, key := range []string{"a", "b", "c"} {
+		beginCompleted(t, c, key, now)
+	}
+	// Replaying a makes b the least recently used
+	if _, fresh, _ := c.begin("a", sha256.Sum256([]byte("a")), now); fresh {
+		t.Fatal("replay of a treated as a new key")
+	}
+
+	beginCompleted(t, c, "d", now)
+	if _, found := c.entries["b"]; found {
+		t.Error("b kept, want it evicted as least recently used")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, found := c.entries[key]; !found {
+			t.Errorf("%s evicted, want it kept", key)
+		}
+	}
+}
+
+func TestIdempotencyCacheNeverEvictsPendingKeys(t *testing.T) {
+	c := newIdempotencyCache(time.Hour, 2)
+	now := time.Now()
+	for _, key := range []string{"a", "b"} {
+		if _, _, err := c.begin(key, sha256.Sum256([]byte(key)), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := c.begin("c", sha256.Sum256([]byte("c")), now); !errors.Is(err, errIdempotencyFull) {
+		t.Errorf("begin with every key pending: got %v, want errIdempotencyFull", err)
+	}
+
+	c.complete("a", 201, nil, nil)
+	if _, fresh, err := c.begin("c", sha256.Sum256([]byte("c")), now); err != nil || !fresh {
+		t.Fatalf("begin once a finished: fresh %t, %v", fresh, err)
+	}
+	if _, found := c.entries["a"]; found {
+		t.Error("a kept, want the finished key evicted")
+	}
+	if _, found := c.entries["b"]; !found {
+		t.Error("pending key b evicted")
+	}
+}
+
+func TestIdempotencyCacheExpiresKeys(t *testing.T) {
+	c := newIdempotencyCache(time.Minute, 10)
+	now := time.Now()
+	beginCompleted(t, c, "a", now)
+	if _, fresh, _ := c.begin("a", sha256.Sum256([]byte("a")), now.Add(2*time.Minute)); !fresh {
+		t.Error("expired key replayed, want it treated as new")
+	}
+}
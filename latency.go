@@ -0,0 +1,202 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// latencyWindow is how many recent requests per route the latency
+// percentiles are computed from
+const latencyWindow = 1024
+
+// latencySamples is a fixed-size ring of recent request durations
+type latencySamples struct {
+	durations []time.Duration
+	next      int
+	total     int
+}
+
+// httpRequestsInFlight is the number of requests being served
+var httpRequestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "http_requests_in_flight",
+	Help: "Number of HTTP requests currently being served.",
+})
+
+// latencyTracker keeps a sliding window of request durations per route,
+// and how many requests are still running
+type latencyTracker struct {
+	mu     sync.Mutex
+	routes map[string]*latencySamples
+
+	inFlight atomic.Int64
+}
+
+// newLatencyTracker returns an empty tracker
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{routes: make(map[string]*latencySamples)}
+}
+
+// Record adds a request duration for route, evicting the oldest sample
+// once the window is full
+func (t *latencyTracker) Record(route string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	samples, ok := t.routes[route]
+	if !ok {
+		samples = &latencySamples{durations: make([]time.Duration, 0, latencyWindow)}
+		t.routes[route] = samples
+	}
+	if len(samples.durations) < latencyWindow {
+		samples.durations = append(samples.durations, d)
+	} else {
+		samples.durations[samples.next] = d
+	}
+	samples.next = (samples.next + 1) % latencyWindow
+	samples.total++
+}
+
+// routeLatency summarises the recent latency of one route
+type routeLatency struct {
+	Route   string  `json:"route"`
+	Samples int     `json:"samples"`
+	Total   int     `json:"total"`
+	P50Ms   float64 `json:"p50_ms"`
+	P90Ms   float64 `json:"p90_ms"`
+	P99Ms   float64 `json:"p99_ms"`
+}
+
+// Summary returns the percentiles of every route, sorted by route
+func (t *latencyTracker) Summary() []routeLatency {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	summary := make([]routeLatency, 0, len(t.routes))
+	for route, samples := range t.routes {
+		sorted := append([]time.Duration(nil), samples.durations...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		summary = append(summary, routeLatency{
+			Route:   route,
+			Samples: len(sorted),
+			Total:   samples.total,
+			P50Ms:   percentileMs(sorted, 0.50),
+			P90Ms:   percentileMs(sorted, 0.90),
+			P99Ms:   percentileMs(sorted, 0.99),
+		})
+	}
+	sort.Slice(summary, func(i, j int) bool { return summary[i].Route < summary[j].Route })
+	return summary
+}
+
+// routeCount is the number of requests served by one route
+type routeCount struct {
+	Route string `json:"route"`
+	Count int    `json:"count"`
+}
+
+// Counts returns how many requests every route has served, busiest first
+func (t *latencyTracker) Counts() []routeCount {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	counts := make([]routeCount, 0, len(t.routes))
+	for route, samples := range t.routes {
+		counts = append(counts, routeCount{Route: route, Count: samples.total})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Route < counts[j].Route
+	})
+	return counts
+}
+
+// percentileMs returns the nearest-rank percentile p of sorted, in
+// milliseconds
+func percentileMs(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
+
+// recordLatency times each request under its route template and counts
+// it as in flight until it finishes
+func (s *Server) recordLatency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.latency.inFlight.Add(1)
+		httpRequestsInFlight.Inc()
+		defer func() {
+			s.latency.inFlight.Add(-1)
+			httpRequestsInFlight.Dec()
+		}()
+
+		start := time.Now()
+		next.ServeHTTP(w, r)
+
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		s.latency.Record(r.Method+" "+route, time.Since(start))
+	})
+}
+
+// topEndpointsParams are the query parameters accepted by the top
+// endpoints report
+var topEndpointsParams = []string{"limit"}
+
+// defaultTopEndpoints is how many routes the top endpoints report lists
+// by default
+const defaultTopEndpoints = 10
+
+// Report the ?limit= routes that have served the most requests since the
+// server started
+func (s *Server) topEndpointsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := checkQueryParams(s.cfg, r, topEndpointsParams); err != nil {
+		writeParamError(w, r, err)
+		return
+	}
+	limit, err := parseIntParam(r, "limit", defaultTopEndpoints, 1, maxListLimit)
+	if err != nil {
+		writeParamError(w, r, err)
+		return
+	}
+
+	counts := s.latency.Counts()
+	routes := len(counts)
+	if limit < len(counts) {
+		counts = counts[:limit]
+	}
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "Top endpoints retrieved successfully",
+		Data:    counts,
+		Meta:    map[string]int{"limit": limit, "routes": routes},
+	})
+}
+
+// Report request latency percentiles per route
+func (s *Server) latencyHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "Latency percentiles retrieved successfully",
+		Data:    s.latency.Summary(),
+		Meta:    map[string]int{"window": latencyWindow},
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLatencyPercentilesArePopulatedAndOrdered(t *testing.T) {
+	h := newTestServer(t, "ADMIN_TOKEN=admin-secret").Handler()
+	for i := 0; i < 50; i++ {
+		do(h, "GET", "/api/v1/users", "")
+	}
+
+	r := newTestRequest("GET", "/api/v1/admin/latency", nil)
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	var summary []routeLatency
+	decodeData(t, decodeResponse(t, serve(h, r), http.StatusOK), &summary)
+
+	for _, route := range summary {
+		if route.Route != "GET /api/v1/users" {
+			continue
+		}
+		if route.Samples != 50 || route.P99Ms <= 0 {
+			t.Errorf("list latency = %+v, want 50 samples with percentiles", route)
+		}
+		if route.P50Ms > route.P90Ms || route.P90Ms > route.P99Ms {
+			t.Errorf("percentiles out of order: p50 %v, p90 %v, p99 %v", route.P50Ms, route.P90Ms, route.P99Ms)
+		}
+		return
+	}
+	t.Fatalf("no latency recorded for the user list in %+v", summary)
+}
+
+func TestLatencyWindowEvictsOldestSamples(t *testing.T) {
+	tracker := newLatencyTracker()
+	for i := 0; i < latencyWindow; i++ {
+		tracker.Record("GET /slow", time.Second)
+	}
+	for i := 0; i < latencyWindow; i++ {
+		tracker.Record("GET /slow", time.Millisecond)
+	}
+
+	summary := tracker.Summary()
+	if len(summary) != 1 || summary[0].Samples != latencyWindow || summary[0].Total != 2*latencyWindow {
+		t.Fatalf("summary = %+v, want one full window of %d", summary, latencyWindow)
+	}
+	if summary[0].P99Ms != 1 {
+		t.Errorf("p99 = %vms after the window turned over, want 1ms", summary[0].P99Ms)
+	}
+}
+
+func TestTopEndpointsAreSortedByTraffic(t *testing.T) {
+	h := newTestServer(t, "ADMIN_TOKEN=admin-secret").Handler()
+	for i := 0; i < 3; i++ {
+		do(h, "GET", "/api/v1/users", "")
+	}
+	for i := 0; i < 2; i++ {
+		do(h, "GET", "/api/v1/users/1", "")
+	}
+
+	r := newTestRequest("GET", "/api/v1/admin/top-endpoints?limit=2", nil)
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	var counts []routeCount
+	decodeData(t, decodeResponse(t, serve(h, r), http.StatusOK), &counts)
+	want := []routeCount{{"GET /api/v1/users", 3}, {"GET /api/v1/users/{id:[0-9]+}", 2}}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("top endpoints = %+v, want %+v", counts, want)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// listParams are the query parameters accepted by the user list
+var listParams = []string{"page", "offset", "cursor", "limit", "since", "modified_since", "id_from", "id_to", "sort", "format"}
+
+// pageInfoParams are the query parameters accepted by the page preview
+var pageInfoParams = []string{"page", "limit", "since", "modified_since", "id_from", "id_to", "sort"}
+
+// listQuery holds the resolved parameters of a user list request. It is
+// echoed back in the list meta so clients can see the effective values
+// after defaulting and validation.
+type listQuery struct {
+	Page   int    `json:"page"`
+	Offset int    `json:"offset,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+	Limit  int    `json:"limit"`
+	Since  string `json:"since,omitempty"`
+
+	ModifiedSince string `json:"modified_since,omitempty"`
+
+	// IDFrom and IDTo select an inclusive window of user IDs; 0 leaves
+	// that end open
+	IDFrom int `json:"id_from,omitempty"`
+	IDTo   int `json:"id_to,omitempty"`
+
+	// Sort is a field name, prefixed with "-" for descending order
+	Sort string `json:"sort,omitempty"`
+
+	since         time.Duration
+	modifiedSince time.Time
+	after         int
+	order         UserSort
+}
+
+// start returns how many users come before the requested page: ?offset
+// when it is set, otherwise the users on earlier pages
+func (q listQuery) start() int {
+	if q.Offset > 0 {
+		return q.Offset
+	}
+	return pageOffset(q.Page, q.Limit)
+}
+
+// inStore reports whether the page can be fetched with a single
+// UserStore.ListPage call, rather than by loading and filtering every
+// user
+func (q listQuery) inStore() bool {
+	return q.since == 0 && q.modifiedSince.IsZero()
+}
+
+// constraints returns how many of the filtering and ordering parameters
+// are set. Paging parameters don't count.
+func (q listQuery) constraints() int {
+	n := 0
+	for _, set := range []bool{q.since > 0, !q.modifiedSince.IsZero(), q.IDFrom > 0, q.IDTo > 0, q.Sort != ""} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+// filter returns the store filter for the query's ID window, narrowed to
+// the users after the cursor when there is one
+func (q listQuery) filter() UserFilter {
+	f := UserFilter{IDFrom: q.IDFrom, IDTo: q.IDTo}
+	if q.Cursor != "" && q.after >= f.IDFrom {
+		f.IDFrom = q.after + 1
+	}
+	return f
+}
+
+// parseListQuery reads and validates the user list query parameters. Pages
+// starting beyond maxOffset users are rejected so deep pagination goes
+// through cursors instead; a maxOffset of 0 disables the check.
+func parseListQuery(r *http.Request, maxOffset int) (listQuery, error) {
+	var q listQuery
+	var err error
+
+	if q.Page, err = parsePage(r); err != nil {
+		return q, err
+	}
+	if q.Limit, err = parseLimit(r, defaultListLimit, maxListLimit); err != nil {
+		return q, err
+	}
+	if maxOffset > 0 && q.Page-1 > maxOffset/q.Limit {
+		return q, &ParamError{
+			Param:   "page",
+			Message: fmt.Sprintf("starts beyond the maximum offset of %d users, page through with cursor and meta.next_cursor instead", maxOffset),
+		}
+	}
+	if q.Offset, err = parseIntParam(r, "offset", 0, 0, maxOffset); err != nil {
+		return q, err
+	}
+	if q.Offset > 0 && r.URL.Query().Get("page") != "" {
+		return q, &ParamError{Param: "offset", Message: "cannot be combined with page"}
+	}
+
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		if r.URL.Query().Get("page") != "" || q.Offset > 0 {
+			return q, &ParamError{Param: "cursor", Message: "cannot be combined with page or offset"}
+		}
+		if q.after, err = decodeCursor(v); err != nil {
+			return q, &ParamError{Param: "cursor", Message: "is malformed"}
+		}
+		q.Cursor = v
+	}
+
+	if v := r.URL.Query().Get("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return q, &ParamError{Param: "since", Message: "must be a positive duration such as 24h or 90m"}
+		}
+		q.since = d
+		q.Since = d.String()
+	}
+
+	if v := r.URL.Query().Get("modified_since"); v != "" {
+		if q.since > 0 {
+			return q, &ParamError{Param: "modified_since", Message: "cannot be combined with since"}
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, &ParamError{Param: "modified_since", Message: "must be an RFC 3339 timestamp"}
+		}
+		q.modifiedSince = t
+		q.ModifiedSince = t.UTC().Format(time.RFC3339Nano)
+	}
+
+	if q.IDFrom, err = parseIntParam(r, "id_from", 0, 1, 0); err != nil {
+		return q, err
+	}
+	if q.IDTo, err = parseIntParam(r, "id_to", 0, 1, 0); err != nil {
+		return q, err
+	}
+	if q.IDFrom > 0 && q.IDTo > 0 && q.IDFrom > q.IDTo {
+		return q, &ParamError{Param: "id_from", Message: "must not be greater than id_to"}
+	}
+
+	if v := r.URL.Query().Get("sort"); v != "" {
+		field, desc := strings.CutPrefix(v, "-")
+		if _, ok := sortColumns[field]; !ok {
+			return q, &ParamError{Param: "sort", Message: "must be id, name, email or created, optionally prefixed with -"}
+		}
+		q.order = UserSort{Field: field, Desc: desc}
+		if q.Cursor != "" && !q.order.byID() {
+			return q, &ParamError{Param: "sort", Message: "cannot be combined with cursor, which pages in ID order"}
+		}
+		q.Sort = v
+	}
+	return q, nil
+}
+
+// checkQueryParams rejects query parameters outside allowed when strict
+// query checking is enabled. Otherwise unknown parameters are ignored.
+func checkQueryParams(cfg Config, r *http.Request, allowed []string) error {
+	if !cfg.StrictQuery {
+		return nil
+	}
+
+	known := make(map[string]bool, len(allowed))
+	for _, name := range allowed {
+		known[name] = true
+	}
+
+	var unknown []string
+	for name := range r.URL.Query() {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+
+	sort.Strings(unknown)
+	return &ParamError{Param: unknown[0], Message: "is not a recognized query parameter"}
+}
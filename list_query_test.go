@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// appliedQuery returns the applied parameters echoed in a list response
+func appliedQuery(t *testing.T, resp testResponse) listQuery {
+	t.Helper()
+	var meta struct {
+		Applied listQuery `json:"applied"`
+	}
+	if err := json.Unmarshal(resp.Meta, &meta); err != nil {
+		t.Fatalf("decode meta: %v; meta: %s", err, resp.Meta)
+	}
+	return meta.Applied
+}
+
+func TestListEchoesAppliedParameters(t *testing.T) {
+	srv := newTestServer(t)
+	list := http.HandlerFunc(srv.getUsersHandler)
+
+	got := appliedQuery(t, decodeResponse(t, do(list, "GET", "/api/v1/users", ""), http.StatusOK))
+	if want := (listQuery{Page: 1, Limit: defaultListLimit}); got != want {
+		t.Errorf("applied with no parameters = %+v, want the defaults %+v", got, want)
+	}
+
+	got = appliedQuery(t, decodeResponse(t, do(list, "GET", "/api/v1/users?page=3&limit=5&since=90m", ""), http.StatusOK))
+	if want := (listQuery{Page: 3, Limit: 5, Since: "1h30m0s"}); got != want {
+		t.Errorf("applied = %+v, want %+v", got, want)
+	}
+}
+
+func TestStrictQueryRejectsUnknownParameters(t *testing.T) {
+	lenient := newTestServer(t)
+	decodeResponse(t, do(http.HandlerFunc(lenient.getUsersHandler), "GET", "/api/v1/users?foo=bar", ""), http.StatusOK)
+
+	strict := newTestServer(t, "STRICT_QUERY=true")
+	list := http.HandlerFunc(strict.getUsersHandler)
+	resp := decodeResponse(t, do(list, "GET", "/api/v1/users?limit=5&foo=bar", ""), http.StatusBadRequest)
+	if resp.Message != "foo is not a recognized query parameter" {
+		t.Errorf("message = %q, want it to name foo", resp.Message)
+	}
+	decodeResponse(t, do(list, "GET", "/api/v1/users?page=1&limit=5&since=1h&format=json", ""), http.StatusOK)
+}
+
+func TestIDRangeSelectsOnlyTheWindow(t *testing.T) {
+	srv := newTestServer(t)
+	for i := 0; i < 6; i++ {
+		createTestUser(t, srv.store, fmt.Sprintf("window%d", i))
+	}
+	list := http.HandlerFunc(srv.getUsersHandler)
+
+	for query, want := range map[string][]int{
+		"?id_from=2&id_to=4": {2, 3, 4},
+		"?id_from=5":         {5, 6},
+		"?id_to=1":           {1},
+		"?id_from=3&id_to=3": {3},
+		"?id_from=50":        {},
+	} {
+		var users []User
+		resp := decodeResponse(t, do(list, "GET", "/api/v1/users"+query, ""), http.StatusOK)
+		decodeData(t, resp, &users)
+		got := []int{}
+		for _, u := range users {
+			got = append(got, u.ID)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s listed %v, want %v", query, got, want)
+		}
+	}
+
+	resp := decodeResponse(t, do(list, "GET", "/api/v1/users?id_from=5&id_to=3", ""), http.StatusBadRequest)
+	if resp.Code != CodeInvalidParameter {
+		t.Errorf("reversed window: code %s, want %s", resp.Code, CodeInvalidParameter)
+	}
+	decodeResponse(t, do(list, "GET", "/api/v1/users?id_from=0", ""), http.StatusBadRequest)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation
+const listenFDsStart = 3
+
+// listen opens the listener described by the configuration. For unix
+// sockets a stale socket file left behind by a previous run is removed
+// first.
+func listen(cfg Config) (net.Listener, error) {
+	switch cfg.ListenNetwork {
+	case "tcp":
+		return net.Listen("tcp", cfg.ListenAddr)
+	case "unix":
+		if err := removeStaleSocket(cfg.ListenAddr); err != nil {
+			return nil, err
+		}
+		return net.Listen("unix", cfg.ListenAddr)
+	default:
+		return nil, fmt.Errorf("unsupported LISTEN_NETWORK %q", cfg.ListenNetwork)
+	}
+}
+
+// removeStaleSocket deletes path if it is a leftover unix socket. Any
+// other kind of file is left alone so a typo can't delete real data.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a unix socket", path)
+	}
+	return os.Remove(path)
+}
+
+// listenFDs reports how many sockets systemd passed to this process
+// following the sd_listen_fds protocol: LISTEN_PID must name pid and
+// LISTEN_FDS holds the count. It returns 0 when the process wasn't socket
+// activated.
+func listenFDs(getenv func(string) string, pid int) (int, error) {
+	rawPID, rawFDs := getenv("LISTEN_PID"), getenv("LISTEN_FDS")
+	if rawPID == "" || rawFDs == "" {
+		return 0, nil
+	}
+
+	listenPID, err := strconv.Atoi(rawPID)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LISTEN_PID %q", rawPID)
+	}
+	if listenPID != pid {
+		// Meant for another process, e.g. our parent
+		return 0, nil
+	}
+	n, err := strconv.Atoi(rawFDs)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid LISTEN_FDS %q", rawFDs)
+	}
+	return n, nil
+}
+
+// activatedListener returns the listener inherited through systemd socket
+// activation, or nil when there is none. Only the first socket is used.
+func activatedListener() (net.Listener, error) {
+	n, err := listenFDs(os.Getenv, os.Getpid())
+	if err != nil || n == 0 {
+		return nil, err
+	}
+
+	// Keep the variables from leaking into child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(uintptr(listenFDsStart), "LISTEN_FD_3")
+	ln, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("use socket from systemd: %w", err)
+	}
+	return ln, nil
+}
+
+// Listen opens the server's listener, preferring a socket inherited from
+// systemd so the socket stays open across restarts. With PORT=0 the
+// kernel picks a free port; Addr reports which one.
+func (s *Server) Listen() error {
+	ln, err := activatedListener()
+	if err != nil {
+		return err
+	}
+	if ln != nil {
+		s.listener = ln
+		s.activated = true
+		return nil
+	}
+
+	ln, err = listen(s.cfg)
+	if err != nil {
+		return err
+	}
+	s.listener = ln
+	return nil
+}
+
+// Activated reports whether the listener was inherited from systemd
+func (s *Server) Activated() bool {
+	return s.activated
+}
+
+// Addr returns the address the server is listening on, or "" before
+// Listen has been called
+func (s *Server) Addr() string {
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// Serve runs httpServer on the listener opened by Listen
+func (s *Server) Serve(httpServer *http.Server) error {
+	if s.listener == nil {
+		return fmt.Errorf("server is not listening")
+	}
+	return httpServer.Serve(s.listener)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixSocketServesHealth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.sock")
+	// A socket left behind by a crashed run
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	cfg := testConfig(t, "LISTEN_NETWORK=unix", "LISTEN_ADDR="+path)
+	ln, err := listen(cfg)
+	if err != nil {
+		t.Fatalf("listen over a stale socket: %v", err)
+	}
+	srv, err := NewServer(cfg, NewMemoryStore(nil))
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	httpServer := &http.Server{Handler: http.HandlerFunc(srv.healthHandler)}
+	go httpServer.Serve(ln)
+	defer httpServer.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://unix/api/v1/health")
+	if err != nil {
+		t.Fatalf("GET over the unix socket: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestListenLeavesNonSocketFilesAlone(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	if err := os.WriteFile(path, []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen(testConfig(t, "LISTEN_NETWORK=unix", "LISTEN_ADDR="+path)); err == nil {
+		t.Fatal("listen replaced a regular file")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("regular file removed: %v", err)
+	}
+}
+
+func TestEphemeralPortServesHealth(t *testing.T) {
+	srv := newTestServer(t, "PORT=0", "LISTEN_NETWORK=tcp")
+	if srv.Addr() != "" {
+		t.Errorf("Addr before Listen = %q, want empty", srv.Addr())
+	}
+	if err := srv.Listen(); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	httpServer := &http.Server{Handler: srv.Handler()}
+	go srv.Serve(httpServer)
+	defer httpServer.Close()
+
+	if _, port, _ := net.SplitHostPort(srv.Addr()); port == "" || port == "0" {
+		t.Fatalf("Addr = %q, want the port the kernel chose", srv.Addr())
+	}
+	resp, err := http.Get("http://" + srv.Addr() + "/api/v1/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("health on %s = %d, want 200", srv.Addr(), resp.StatusCode)
+	}
+}
+
+func TestListenFDsDetection(t *testing.T) {
+	const pid = 4242
+	for _, tt := range []struct {
+		name    string
+		env     map[string]string
+		want    int
+		wantErr bool
+	}{
+		{"not activated", map[string]string{}, 0, false},
+		{"activated", map[string]string{"LISTEN_PID": "4242", "LISTEN_FDS": "1"}, 1, false},
+		{"two sockets", map[string]string{"LISTEN_PID": "4242", "LISTEN_FDS": "2"}, 2, false},
+		{"meant for another process", map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"}, 0, false},
+		{"only the count", map[string]string{"LISTEN_FDS": "1"}, 0, false},
+		{"bad pid", map[string]string{"LISTEN_PID": "me", "LISTEN_FDS": "1"}, 0, true},
+		{"bad count", map[string]string{"LISTEN_PID": "4242", "LISTEN_FDS": "-1"}, 0, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			getenv := func(key string) string { return tt.env[key] }
+			n, err := listenFDs(getenv, pid)
+			if (err != nil) != tt.wantErr || n != tt.want {
+				t.Errorf("listenFDs = %d, %v; want %d with error %v", n, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,202 +1,198 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
+	"flag"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
-
-	"github.com/gorilla/handlers"
-	"github.com/gorilla/mux"
 )
 
 // User represents a user in our system
 type User struct {
-	ID      int    `json:"id"`
-	Name    string `json:"name"`
-	Email   string `json:"email"`
-	Created string `json:"created"`
+	ID      int       `json:"id"`
+	Name    string    `json:"name"`
+	Email   string    `json:"email"`
+	Created time.Time `json:"created"`
+
+	// Version starts at 1 and is incremented by the store on every update
+	Version int `json:"version"`
+
+	Role          string `json:"role,omitempty"`
+	EmailVerified bool   `json:"email_verified"`
+
+	// UpdatedAt is set by the store on every write. DeletedAt is only set
+	// on the tombstones returned by UserStore.ModifiedSince.
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+
+	Tags     []string          `json:"tags,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	OrgID    string            `json:"org_id,omitempty"`
 }
 
 // Response represents a standard API response
 type Response struct {
 	Status  string      `json:"status"`
+	Code    ErrorCode   `json:"code,omitempty"`
 	Message string      `json:"message"`
 	Data    interface{} `json:"data,omitempty"`
+	Meta    interface{} `json:"meta,omitempty"`
 }
 
-// In-memory storage for demo purposes
-var users []User
-var nextID = 1
-
-// Health check endpoint
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	response := Response{
-		Status:  "success",
-		Message: "API is healthy",
-		Data: map[string]interface{}{
-			"timestamp": time.Now().UTC().Format(time.RFC3339),
-			"version":   "1.0.0",
-			"service":   "go-backend-api",
-		},
+func main() {
+	migrate := flag.Bool("migrate-data", false, "copy all users from the --from store to the --to store and exit")
+	from := flag.String("from", "", "source store for --migrate-data (memory, file or postgres)")
+	to := flag.String("to", "", "destination store for --migrate-data (memory, file or postgres)")
+	flag.Parse()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal("Invalid configuration:", err)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
-
-// Get all users
-func getUsersHandler(w http.ResponseWriter, r *http.Request) {
-	response := Response{
-		Status:  "success",
-		Message: "Users retrieved successfully",
-		Data:    users,
+	if *migrate {
+		if err := runMigration(cfg, *from, *to); err != nil {
+			log.Fatal("Migration failed:", err)
+		}
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
+	store, err := openStore(context.Background(), cfg)
+	if err != nil {
+		log.Fatal("Failed to open store:", err)
+	}
+	log.Printf("Using %s store", cfg.Store)
 
-// Get user by ID
-func getUserHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	userID := vars["id"]
-
-	for _, user := range users {
-		if fmt.Sprintf("%d", user.ID) == userID {
-			response := Response{
-				Status:  "success",
-				Message: "User found",
-				Data:    user,
+	if cfg.SeedFile != "" {
+		n, err := seedUsers(context.Background(), cfg, store, cfg.SeedFile, time.Now())
+		if err != nil {
+			log.Fatal("Failed to seed users:", err)
+		}
+		log.Printf("Seeded %d users from %s", n, cfg.SeedFile)
+	} else if cfg.Store == "memory" {
+		// Initialize with some sample data
+		for _, u := range []User{
+			{Name: "John Doe", Email: "john@example.com"},
+			{Name: "Jane Smith", Email: "jane@example.com"},
+		} {
+			u.Created = time.Now().UTC().Truncate(time.Second)
+			if _, err := store.Create(context.Background(), u); err != nil {
+				log.Fatal("Failed to seed sample data:", err)
 			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(response)
-			return
 		}
 	}
 
-	w.WriteHeader(http.StatusNotFound)
-	response := Response{
-		Status:  "error",
-		Message: "User not found",
-	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
+	warmUserCache(context.Background(), cfg, store)
 
-// Create new user
-func createUserHandler(w http.ResponseWriter, r *http.Request) {
-	var newUser struct {
-		Name  string `json:"name"`
-		Email string `json:"email"`
+	srv, err := NewServer(cfg, store)
+	if err != nil {
+		log.Fatal("Failed to start server:", err)
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&newUser); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		response := Response{
-			Status:  "error",
-			Message: "Invalid JSON payload",
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
-		return
+	background, cancelBackground := context.WithCancel(context.Background())
+	tasks := newBackgroundTasks()
+	if cfg.rateLimited() {
+		tasks.Go("rate limiter janitor", func() {
+			srv.limiter.runJanitor(background, cfg.RateLimitTTL/2, srv.now)
+		})
 	}
-
-	if newUser.Name == "" || newUser.Email == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		response := Response{
-			Status:  "error",
-			Message: "Name and email are required",
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
-		return
+	if cfg.ReadinessCacheTTL > 0 {
+		tasks.Go("readiness refresher", func() {
+			srv.readiness.runRefresher(background, cfg.ReadinessCacheTTL, srv.now)
+		})
 	}
 
-	user := User{
-		ID:      nextID,
-		Name:    newUser.Name,
-		Email:   newUser.Email,
-		Created: time.Now().UTC().Format(time.RFC3339),
+	if srv.webhooks != nil {
+		tasks.Go("webhook dispatcher", func() {
+			srv.webhooks.run(background)
+		})
 	}
 
-	users = append(users, user)
-	nextID++
-
-	w.WriteHeader(http.StatusCreated)
-	response := Response{
-		Status:  "success",
-		Message: "User created successfully",
-		Data:    user,
+	if err := srv.Listen(); err != nil {
+		log.Fatal("Server failed to start:", err)
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
 
-// Delete user
-func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	userID := vars["id"]
-
-	for i, user := range users {
-		if fmt.Sprintf("%d", user.ID) == userID {
-			users = append(users[:i], users[i+1:]...)
-			response := Response{
-				Status:  "success",
-				Message: "User deleted successfully",
-			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(response)
-			return
+	handler := srv.Handler()
+	var adminServer *http.Server
+	if cfg.AdminPort != "" {
+		var adminHandler http.Handler
+		handler, adminHandler = srv.splitAdmin(handler)
+		adminListener, err := net.Listen("tcp", adminAddr(cfg))
+		if err != nil {
+			log.Fatal("Admin listener failed to start:", err)
 		}
+		adminServer = &http.Server{Handler: adminHandler, ReadTimeout: cfg.ReadTimeout}
+		go func() {
+			if err := adminServer.Serve(adminListener); err != nil && err != http.ErrServerClosed {
+				log.Fatal("Admin server failed:", err)
+			}
+		}()
+		log.Printf("Admin endpoints listening on %s", adminListener.Addr())
 	}
 
-	w.WriteHeader(http.StatusNotFound)
-	response := Response{
-		Status:  "error",
-		Message: "User not found",
-	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
+	httpServer := &http.Server{Handler: handler, ReadTimeout: cfg.ReadTimeout}
+	// Event streams never finish on their own, so end them when shutdown
+	// starts rather than waiting out the timeout
+	httpServer.RegisterOnShutdown(srv.events.Close)
 
-func main() {
-	// Initialize with some sample data
-	users = []User{
-		{ID: 1, Name: "John Doe", Email: "john@example.com", Created: time.Now().UTC().Format(time.RFC3339)},
-		{ID: 2, Name: "Jane Smith", Email: "jane@example.com", Created: time.Now().UTC().Format(time.RFC3339)},
+	go func() {
+		if err := srv.Serve(httpServer); err != nil && err != http.ErrServerClosed {
+			log.Fatal("Server failed:", err)
+		}
+	}()
+
+	if srv.Activated() {
+		log.Printf("Server listening on socket %s from systemd", srv.Addr())
+	} else if cfg.ListenNetwork == "unix" {
+		log.Printf("Server listening on unix socket %s", srv.Addr())
+	} else {
+		log.Printf("Server listening on %s", srv.Addr())
+		log.Printf("Health check available at: http://%s/api/v1/health", srv.Addr())
 	}
-	nextID = 3
 
-	router := mux.NewRouter()
-
-	// API routes
-	api := router.PathPrefix("/api/v1").Subrouter()
-	api.HandleFunc("/health", healthHandler).Methods("GET")
-	api.HandleFunc("/users", getUsersHandler).Methods("GET")
-	api.HandleFunc("/users/{id:[0-9]+}", getUserHandler).Methods("GET")
-	api.HandleFunc("/users", createUserHandler).Methods("POST")
-	api.HandleFunc("/users/{id:[0-9]+}", deleteUserHandler).Methods("DELETE")
-
-	// CORS middleware
-	corsHandler := handlers.CORS(
-		handlers.AllowedOrigins([]string{"*"}),
-		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}),
-		handlers.AllowedHeaders([]string{"Content-Type", "Authorization"}),
-	)(router)
-
-	// Get port from environment or use default
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// Wait for an interrupt, then drain in-flight requests
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	log.Printf("Shutting down")
+	srv.BeginShutdown()
+	if cfg.ShutdownDelay > 0 {
+		// Keep serving while load balancers notice the failing readiness
+		log.Printf("Draining for %s before closing listeners", cfg.ShutdownDelay)
+		time.Sleep(cfg.ShutdownDelay)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("Graceful shutdown failed: %v", err)
+	}
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			log.Printf("Admin server shutdown failed: %v", err)
+		}
+	}
+	stopBackground(tasks, cancelBackground)
+
+	// Nothing is published once the server has shut down, so whatever is
+	// queued now is all that is left to deliver
+	if srv.webhooks != nil {
+		flushCtx, cancelFlush := context.WithTimeout(context.Background(), cfg.WebhookFlushTimeout)
+		srv.webhooks.Flush(flushCtx)
+		cancelFlush()
 	}
 
-	log.Printf("Server starting on port %s", port)
-	log.Printf("Health check available at: http://localhost:%s/api/v1/health", port)
+	closeStore(store)
 
-	if err := http.ListenAndServe(":"+port, corsHandler); err != nil {
-		log.Fatal("Server failed to start:", err)
+	// A socket inherited from systemd belongs to systemd
+	if cfg.ListenNetwork == "unix" && !srv.Activated() {
+		if err := os.Remove(cfg.ListenAddr); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove socket %s: %v", cfg.ListenAddr, err)
+		}
 	}
 }
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-memory UserStore, suitable for demos and tests
+type MemoryStore struct {
+	mu         sync.RWMutex
+	users      map[int]User
+	byEmail    map[string]int
+	tombstones map[int]User
+	trash      map[int]User
+	nextID     int
+	modified   time.Time
+
+	// rules decide which emails count as the same for byEmail
+	rules emailRules
+}
+
+// NewMemoryStore returns an empty in-memory store comparing emails by
+// rules
+func NewMemoryStore(rules emailRules) *MemoryStore {
+	return &MemoryStore{
+		rules:      rules,
+		users:      make(map[int]User),
+		byEmail:    make(map[string]int),
+		tombstones: make(map[int]User),
+		trash:      make(map[int]User),
+		nextID:     1,
+		modified:   time.Now(),
+	}
+}
+
+// List returns all users ordered by ID
+func (m *MemoryStore) List(ctx context.Context) ([]User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	users := make([]User, 0, len(m.users))
+	for _, u := range m.users {
+		users = append(users, cloneUser(u))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+// Get returns the user with the given ID
+func (m *MemoryStore) Get(ctx context.Context, id int) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return cloneUser(u), nil
+}
+
+// GetMany returns the users with the given IDs, keyed by ID
+func (m *MemoryStore) GetMany(ctx context.Context, ids []int) (map[int]User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	found := make(map[int]User, len(ids))
+	for _, id := range ids {
+		if u, ok := m.users[id]; ok {
+			found[id] = cloneUser(u)
+		}
+	}
+	return found, nil
+}
+
+// GetManyByEmail returns the users with the given emails, keyed by email
+// key
+func (m *MemoryStore) GetManyByEmail(ctx context.Context, emails []string) (map[string]User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	found := make(map[string]User, len(emails))
+	for _, email := range emails {
+		key := m.rules.key(email)
+		if id, ok := m.byEmail[key]; ok {
+			found[key] = cloneUser(m.users[id])
+		}
+	}
+	return found, nil
+}
+
+// Create assigns the next ID to u and stores it
+func (m *MemoryStore) Create(ctx context.Context, u User) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := m.rules.key(u.Email)
+	if _, exists := m.byEmail[key]; exists {
+		return User{}, ErrDuplicateEmail
+	}
+
+	m.modified = time.Now()
+	u = cloneUser(u)
+	u.ID = m.nextID
+	u.UpdatedAt = m.modified.UTC()
+	u.Version = 1
+	m.nextID++
+	m.users[u.ID] = u
+	m.byEmail[key] = u.ID
+	return cloneUser(u), nil
+}
+
+// Insert stores u under its own ID
+func (m *MemoryStore) Insert(ctx context.Context, u User) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.users[u.ID]; exists {
+		return User{}, ErrDuplicateID
+	}
+	key := m.rules.key(u.Email)
+	if _, exists := m.byEmail[key]; exists {
+		return User{}, ErrDuplicateEmail
+	}
+
+	m.modified = time.Now()
+	u = cloneUser(u)
+	if u.UpdatedAt.IsZero() {
+		u.UpdatedAt = m.modified.UTC()
+	}
+	if u.Version == 0 {
+		u.Version = 1
+	}
+	m.users[u.ID] = u
+	m.byEmail[key] = u.ID
+	delete(m.tombstones, u.ID)
+	delete(m.trash, u.ID)
+	if u.ID >= m.nextID {
+		m.nextID = u.ID + 1
+	}
+	return cloneUser(u), nil
+}
+
+// Update replaces the stored user with the same ID as u
+func (m *MemoryStore) Update(ctx context.Context, u User) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.users[u.ID]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return m.update(existing, u)
+}
+
+// UpdateIfVersion replaces the stored user with ID id by u if its version
+// is still expectedVersion
+func (m *MemoryStore) UpdateIfVersion(ctx context.Context, id, expectedVersion int, u User) (User, error) {
+	u.ID = id
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.users[u.ID]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	if existing.Version != expectedVersion {
+		return User{}, ErrVersionMismatch
+	}
+	return m.update(existing, u)
+}
+
+// update replaces existing with u. The caller must hold the write lock.
+func (m *MemoryStore) update(existing, u User) (User, error) {
+	oldKey, newKey := m.rules.key(existing.Email), m.rules.key(u.Email)
+	if newKey != oldKey {
+		if _, taken := m.byEmail[newKey]; taken {
+			return User{}, ErrDuplicateEmail
+		}
+		delete(m.byEmail, oldKey)
+		m.byEmail[newKey] = u.ID
+	}
+
+	m.modified = time.Now()
+	u = cloneUser(u)
+	u.UpdatedAt = m.modified.UTC()
+	u.Version = existing.Version + 1
+	m.users[u.ID] = u
+	return cloneUser(u), nil
+}
+
+// Delete removes the user with the given ID
+func (m *MemoryStore) Delete(ctx context.Context, id int) error {
+	return m.remove(id, false, 0)
+}
+
+// SoftDelete removes the user with the given ID and keeps it in the trash
+func (m *MemoryStore) SoftDelete(ctx context.Context, id int) error {
+	return m.remove(id, true, 0)
+}
+
+// DeleteIfVersion removes the user with the given ID if its version is
+// still expectedVersion
+func (m *MemoryStore) DeleteIfVersion(ctx context.Context, id, expectedVersion int, soft bool) error {
+	return m.remove(id, soft, expectedVersion)
+}
+
+// remove deletes a user, recording a tombstone and, when soft is set, a
+// trash entry. A non-zero expectedVersion limits the delete to that
+// version; versions start at 1.
+func (m *MemoryStore) remove(id int, soft bool, expectedVersion int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if expectedVersion != 0 && u.Version != expectedVersion {
+		return ErrVersionMismatch
+	}
+	delete(m.users, id)
+	if key := m.rules.key(u.Email); m.byEmail[key] == id {
+		delete(m.byEmail, key)
+	}
+	m.modified = time.Now()
+	m.tombstones[id] = newTombstone(u, m.modified.UTC())
+	if soft {
+		m.trash[id] = newTrashEntry(u, m.modified.UTC())
+	}
+	m.pruneTombstones(m.modified)
+	return nil
+}
+
+// pruneTombstones forgets deletions, and empties trash entries, older than
+// tombstoneRetention
+func (m *MemoryStore) pruneTombstones(now time.Time) {
+	for id, t := range m.tombstones {
+		if now.Sub(*t.DeletedAt) > tombstoneRetention {
+			delete(m.tombstones, id)
+		}
+	}
+	for id, u := range m.trash {
+		if now.Sub(*u.DeletedAt) > tombstoneRetention {
+			delete(m.trash, id)
+		}
+	}
+}
+
+// Trash returns the soft-deleted users ordered by ID
+func (m *MemoryStore) Trash(ctx context.Context) ([]User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	users := make([]User, 0, len(m.trash))
+	for _, u := range m.trash {
+		users = append(users, cloneUser(u))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+// PurgeTrash empties the trash entries for ids
+func (m *MemoryStore) PurgeTrash(ctx context.Context, ids []int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for _, id := range ids {
+		if _, ok := m.trash[id]; ok {
+			delete(m.trash, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// ModifiedSince returns the users and tombstones changed at or after
+// since, ordered by ID
+func (m *MemoryStore) ModifiedSince(ctx context.Context, since time.Time) ([]User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var changed []User
+	for _, u := range m.users {
+		if !u.UpdatedAt.Before(since) {
+			changed = append(changed, cloneUser(u))
+		}
+	}
+	for _, t := range m.tombstones {
+		if !t.UpdatedAt.Before(since) {
+			changed = append(changed, t)
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i].ID < changed[j].ID })
+	if changed == nil {
+		changed = []User{}
+	}
+	return changed, nil
+}
+
+// IterateModifiedSince calls fn for the users and tombstones changed at
+// or after since in UpdatedAt order. fn runs without the lock held.
+func (m *MemoryStore) IterateModifiedSince(ctx context.Context, since time.Time, fn func(User) error) error {
+	changed, _ := m.ModifiedSince(ctx, since)
+	sort.SliceStable(changed, func(i, j int) bool { return changed[i].UpdatedAt.Before(changed[j].UpdatedAt) })
+	for _, u := range changed {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Count returns the number of users matching f
+func (m *MemoryStore) Count(ctx context.Context, f UserFilter) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	n := 0
+	for _, u := range m.users {
+		if f.Matches(u) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Domains returns the distinct email domains of the users matching f
+func (m *MemoryStore) Domains(ctx context.Context, f UserFilter) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return userDomains(m.users, f), nil
+}
+
+// ListPage sorts the users matching f and returns the requested page
+func (m *MemoryStore) ListPage(ctx context.Context, f UserFilter, order UserSort, offset, limit int) ([]User, int, error) {
+	m.mu.RLock()
+	matched := make([]User, 0, len(m.users))
+	for _, u := range m.users {
+		if f.Matches(u) {
+			matched = append(matched, u)
+		}
+	}
+	m.mu.RUnlock()
+
+	sortUsers(matched, order)
+	page := pageOf(matched, offset, limit)
+	for i, u := range page {
+		page[i] = cloneUser(u)
+	}
+	return page, len(matched), nil
+}
+
+// Oldest returns the earliest created user matching f
+func (m *MemoryStore) Oldest(ctx context.Context, f UserFilter) (User, error) {
+	return m.boundary(f, false)
+}
+
+// Newest returns the latest created user matching f
+func (m *MemoryStore) Newest(ctx context.Context, f UserFilter) (User, error) {
+	return m.boundary(f, true)
+}
+
+// boundary finds the oldest or newest user matching f in a single pass
+func (m *MemoryStore) boundary(f UserFilter, newest bool) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var best User
+	found := false
+	for _, u := range m.users {
+		if !f.Matches(u) {
+			continue
+		}
+		if !found || createdBefore(u, best) != newest {
+			best, found = u, true
+		}
+	}
+	if !found {
+		return User{}, ErrNotFound
+	}
+	return cloneUser(best), nil
+}
+
+// Modified reports when the store last changed and how many users it holds
+func (m *MemoryStore) Modified(ctx context.Context) (time.Time, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.modified, len(m.users), nil
+}
+
+// cloneUser copies the slices and maps in u so the stored value doesn't
+// share memory with the caller. It is used both when a user is stored and
+// when one is handed back.
+func cloneUser(u User) User {
+	u.Tags = append([]string(nil), u.Tags...)
+	if u.Metadata != nil {
+		metadata := make(map[string]string, len(u.Metadata))
+		for k, v := range u.Metadata {
+			metadata[k] = v
+		}
+		u.Metadata = metadata
+	}
+	return u
+}
+
+// memorySnapshot is the complete state of a MemoryStore
+type memorySnapshot struct {
+	NextID     int          `json:"next_id"`
+	Users      []storedUser `json:"users"`
+	Tombstones []storedUser `json:"tombstones,omitempty"`
+	Trash      []storedUser `json:"trash,omitempty"`
+}
+
+// snapshot returns a copy of the store's state
+func (m *MemoryStore) snapshot() memorySnapshot {
+	users, _ := m.List(context.Background())
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	snap := memorySnapshot{NextID: m.nextID, Users: make([]storedUser, 0, len(users))}
+	for _, u := range users {
+		snap.Users = append(snap.Users, storedUser(u))
+	}
+	for _, t := range m.tombstones {
+		snap.Tombstones = append(snap.Tombstones, storedUser(t))
+	}
+	sort.Slice(snap.Tombstones, func(i, j int) bool { return snap.Tombstones[i].ID < snap.Tombstones[j].ID })
+	for _, u := range m.trash {
+		snap.Trash = append(snap.Trash, storedUser(u))
+	}
+	sort.Slice(snap.Trash, func(i, j int) bool { return snap.Trash[i].ID < snap.Trash[j].ID })
+	return snap
+}
+
+// restore replaces the store's state with snap. It fails without changing
+// anything when two users' emails have the same key, which happens when
+// CANONICALIZE_EMAIL is turned on over data that was written without it.
+func (m *MemoryStore) restore(snap memorySnapshot) error {
+	byEmail := make(map[string]int, len(snap.Users))
+	for _, u := range snap.Users {
+		key := m.rules.key(u.Email)
+		if other, taken := byEmail[key]; taken {
+			return fmt.Errorf("users %d and %d both have email %s under the email rules", other, u.ID, key)
+		}
+		byEmail[key] = u.ID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.users = make(map[int]User, len(snap.Users))
+	m.byEmail = byEmail
+	m.tombstones = make(map[int]User, len(snap.Tombstones))
+	m.trash = make(map[int]User, len(snap.Trash))
+	m.nextID = snap.NextID
+	for _, stored := range snap.Users {
+		u := User(stored)
+		if u.Version == 0 {
+			u.Version = 1
+		}
+		m.users[u.ID] = cloneUser(u)
+		if u.ID >= m.nextID {
+			m.nextID = u.ID + 1
+		}
+	}
+	for _, t := range snap.Tombstones {
+		if t.DeletedAt != nil {
+			m.tombstones[t.ID] = User(t)
+		}
+	}
+	for _, u := range snap.Trash {
+		if u.DeletedAt != nil {
+			m.trash[u.ID] = cloneUser(User(u))
+		}
+	}
+	m.modified = time.Now()
+	return nil
+}
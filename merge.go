@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// mergeRequest identifies the users to merge
+type mergeRequest struct {
+	PrimaryID   jsonID `json:"primary_id"`
+	DuplicateID jsonID `json:"duplicate_id"`
+}
+
+// mergeUsers folds the duplicate's tags and metadata into primary. The
+// primary's values win when both users set the same metadata key.
+func mergeUsers(primary, duplicate User) User {
+	seen := make(map[string]bool, len(primary.Tags))
+	tags := make([]string, 0, len(primary.Tags)+len(duplicate.Tags))
+	for _, tag := range append(append([]string(nil), primary.Tags...), duplicate.Tags...) {
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	primary.Tags = tags
+
+	if len(duplicate.Metadata) > 0 {
+		metadata := make(map[string]string, len(primary.Metadata)+len(duplicate.Metadata))
+		for k, v := range duplicate.Metadata {
+			metadata[k] = v
+		}
+		for k, v := range primary.Metadata {
+			metadata[k] = v
+		}
+		primary.Metadata = metadata
+	}
+	return primary
+}
+
+// Merge a duplicate user into a primary user and delete the duplicate
+func (s *Server) mergeUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var req mergeRequest
+	if err := s.decodeBody(w, r, &req); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+
+	if req.PrimaryID == 0 || req.DuplicateID == 0 {
+		writeError(w, r, CodeInvalidRequest, "primary_id and duplicate_id are required")
+		return
+	}
+	if req.PrimaryID == req.DuplicateID {
+		writeError(w, r, CodeInvalidRequest, "primary_id and duplicate_id must differ")
+		return
+	}
+
+	primaryID, duplicateID := int(req.PrimaryID), int(req.DuplicateID)
+	found, err := s.getManyUsers(r.Context(), []int{primaryID, duplicateID})
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	primary, ok := found[primaryID]
+	if !ok {
+		writeError(w, r, CodeUserNotFound, "Primary user not found")
+		return
+	}
+	duplicate, ok := found[duplicateID]
+	if !ok {
+		writeError(w, r, CodeUserNotFound, "Duplicate user not found")
+		return
+	}
+
+	merged := mergeUsers(primary, duplicate)
+	errs := validateTags(s.cfg, "tags", merged.Tags)
+	errs = append(errs, validateMetadata(s.cfg, "metadata", merged.Metadata)...)
+	if len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+	// The merged user is written back like a new signup, so its email must
+	// still pass the domain checks
+	if rejection := s.checkEmailPolicy(r.Context(), merged.Email); rejection != nil {
+		rejection.write(w, r)
+		return
+	}
+
+	// The store can't update one user and delete another atomically, so
+	// a failed delete puts the primary back as it was. The version checks
+	// keep either write from overwriting a concurrent change.
+	merged, err = s.store.UpdateIfVersion(r.Context(), primary.ID, primary.Version, merged)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if err := s.deleteUser(r.Context(), duplicate.ID); err != nil {
+		if _, rerr := s.store.UpdateIfVersion(r.Context(), primary.ID, merged.Version, primary); rerr != nil {
+			log.Printf("Merge: failed to restore user %d after the duplicate %d could not be deleted: %v", primary.ID, duplicate.ID, rerr)
+		}
+		writeStoreError(w, r, err)
+		return
+	}
+	s.publish(r.Context(), EventUserUpdated, merged)
+	s.publish(r.Context(), EventUserDeleted, duplicate)
+
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "Users merged successfully",
+		Data:    merged,
+	})
+}
+
+// diffParams are the query parameters accepted by the user diff
+var diffParams = []string{"a", "b"}
+
+// fieldDiff holds both users' values for a field that differs
+type fieldDiff struct {
+	A json.RawMessage `json:"a"`
+	B json.RawMessage `json:"b"`
+}
+
+// userDiff is a field-by-field comparison of two users. A and B are the
+// users' IDs in the ID_FORMAT.
+type userDiff struct {
+	A         interface{}          `json:"a"`
+	B         interface{}          `json:"b"`
+	Matching  []string             `json:"matching"`
+	Differing map[string]fieldDiff `json:"differing"`
+}
+
+// userFields returns the value of each field of u as encoded in format
+func userFields(u User, format responseFormat) (map[string]json.RawMessage, error) {
+	data, err := format.encode(u)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	return fields, json.Unmarshal(data, &fields)
+}
+
+// diffUsers compares a and b using their API field names. The ID is left
+// out since it always differs; a field one user omits compares as null.
+// Values are compared as format encodes them, keeping the snake_case
+// names the response writer converts.
+func diffUsers(a, b User, format responseFormat) (userDiff, error) {
+	diff := userDiff{A: format.id(a.ID), B: format.id(b.ID), Matching: []string{}, Differing: map[string]fieldDiff{}}
+
+	format = format.streamed()
+	fieldsA, err := userFields(a, format)
+	if err != nil {
+		return diff, err
+	}
+	fieldsB, err := userFields(b, format)
+	if err != nil {
+		return diff, err
+	}
+
+	names := make([]string, 0, len(fieldsA)+len(fieldsB))
+	for name := range fieldsA {
+		names = append(names, name)
+	}
+	for name := range fieldsB {
+		if _, ok := fieldsA[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	null := json.RawMessage("null")
+	for _, name := range names {
+		if name == "id" {
+			continue
+		}
+		va, ok := fieldsA[name]
+		if !ok {
+			va = null
+		}
+		vb, ok := fieldsB[name]
+		if !ok {
+			vb = null
+		}
+		if bytes.Equal(va, vb) {
+			diff.Matching = append(diff.Matching, name)
+		} else {
+			diff.Differing[name] = fieldDiff{A: va, B: vb}
+		}
+	}
+	return diff, nil
+}
+
+// Compare two users field by field, to review likely duplicates before
+// merging them
+func (s *Server) diffUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if err := checkQueryParams(s.cfg, r, diffParams); err != nil {
+		writeParamError(w, r, err)
+		return
+	}
+
+	ids := make([]int, len(diffParams))
+	for i, name := range diffParams {
+		id, err := parseIntParam(r, name, 0, 1, 0)
+		if err == nil && id == 0 {
+			err = &ParamError{Param: name, Message: "is required"}
+		}
+		if err != nil {
+			writeParamError(w, r, err)
+			return
+		}
+		ids[i] = id
+	}
+
+	found, err := s.getManyUsers(r.Context(), ids)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	for _, id := range ids {
+		if _, ok := found[id]; !ok {
+			writeError(w, r, CodeUserNotFound, fmt.Sprintf("User %d not found", id))
+			return
+		}
+	}
+
+	diff, err := diffUsers(found[ids[0]], found[ids[1]], responseFormatFrom(r.Context()))
+	if err != nil {
+		writeError(w, r, CodeInternal, "")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "Users compared successfully",
+		Data:    diff,
+	})
+}
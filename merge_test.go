@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeUsers(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN=admin-secret")
+	ctx := context.Background()
+	primary, _ := srv.store.Create(ctx, User{
+		Name: "Primary", Email: "primary@example.com", Created: time.Now().UTC().Truncate(time.Second),
+		Tags:     []string{"vip", "beta"},
+		Metadata: map[string]string{"plan": "pro", "region": "eu"},
+	})
+	duplicate, _ := srv.store.Create(ctx, User{
+		Name: "Duplicate", Email: "duplicate@example.com", Created: time.Now().UTC().Truncate(time.Second),
+		Tags:     []string{"beta", "newsletter"},
+		Metadata: map[string]string{"plan": "free", "source": "import"},
+	})
+
+	r := newTestRequest("POST", "/api/v1/users/merge",
+		strings.NewReader(fmt.Sprintf(`{"primary_id":%d,"duplicate_id":%d}`, primary.ID, duplicate.ID)))
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	var merged User
+	decodeData(t, decodeResponse(t, serve(srv.requireAdmin(srv.mergeUsersHandler), r), http.StatusOK), &merged)
+
+	if want := []string{"vip", "beta", "newsletter"}; !reflect.DeepEqual(merged.Tags, want) {
+		t.Errorf("merged tags = %v, want %v", merged.Tags, want)
+	}
+	if want := map[string]string{"plan": "pro", "region": "eu", "source": "import"}; !reflect.DeepEqual(merged.Metadata, want) {
+		t.Errorf("merged metadata = %v, want %v", merged.Metadata, want)
+	}
+	if stored, _ := srv.store.Get(ctx, primary.ID); !reflect.DeepEqual(stored.Tags, merged.Tags) {
+		t.Errorf("stored primary tags = %v, want the merged %v", stored.Tags, merged.Tags)
+	}
+	if _, err := srv.store.Get(ctx, duplicate.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(duplicate) = %v, want ErrNotFound", err)
+	}
+}
+
+// undeletableStore is a memory store whose deletes always fail
+type undeletableStore struct {
+	*MemoryStore
+}
+
+func (undeletableStore) Delete(ctx context.Context, id int) error {
+	return ErrStoreUnavailable
+}
+
+func TestFailedMergeRestoresThePrimary(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN=admin-secret")
+	srv.store = undeletableStore{NewMemoryStore(nil)}
+	ctx := context.Background()
+	primary, _ := srv.store.Create(ctx, User{Name: "Primary", Email: "primary@example.com", Created: time.Now().UTC(), Tags: []string{"vip"}})
+	duplicate, _ := srv.store.Create(ctx, User{Name: "Duplicate", Email: "duplicate@example.com", Created: time.Now().UTC(), Tags: []string{"beta"}})
+
+	r := newTestRequest("POST", "/api/v1/users/merge",
+		strings.NewReader(fmt.Sprintf(`{"primary_id":%d,"duplicate_id":%d}`, primary.ID, duplicate.ID)))
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	decodeResponse(t, serve(srv.requireAdmin(srv.mergeUsersHandler), r), http.StatusServiceUnavailable)
+
+	if stored, _ := srv.store.Get(ctx, primary.ID); !reflect.DeepEqual(stored.Tags, primary.Tags) {
+		t.Errorf("primary tags = %v after a failed merge, want them restored to %v", stored.Tags, primary.Tags)
+	}
+	if _, err := srv.store.Get(ctx, duplicate.ID); err != nil {
+		t.Errorf("Get(duplicate) = %v, want it kept", err)
+	}
+}
+
+func TestMergeUsersValidatesIDs(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN=admin-secret")
+	user := createTestUser(t, srv.store, "Solo")
+	h := srv.requireAdmin(srv.mergeUsersHandler)
+	for _, tt := range []struct {
+		name, body string
+		want       int
+	}{
+		{"missing", `{"primary_id":1}`, http.StatusBadRequest},
+		{"same", fmt.Sprintf(`{"primary_id":%d,"duplicate_id":%d}`, user.ID, user.ID), http.StatusBadRequest},
+		{"unknown", fmt.Sprintf(`{"primary_id":%d,"duplicate_id":999}`, user.ID), http.StatusNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRequest("POST", "/api/v1/users/merge", strings.NewReader(tt.body))
+			r.Header.Set("Authorization", "Bearer admin-secret")
+			decodeResponse(t, serve(h, r), tt.want)
+		})
+	}
+
+	decodeResponse(t, do(h, "POST", "/api/v1/users/merge", `{"primary_id":1,"duplicate_id":2}`), http.StatusUnauthorized)
+}
+
+func TestDiffUsersFlagsMatchingAndDifferingFields(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	created := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	a, _ := srv.store.Create(ctx, User{Name: "Sam Lee", Email: "sam@example.com", Created: created, Tags: []string{"beta"}})
+	b, _ := srv.store.Create(ctx, User{Name: "Sam Lee", Email: "sam.lee@example.com", Created: created, Tags: []string{"vip"}})
+	diff := http.HandlerFunc(srv.diffUsersHandler)
+
+	var got userDiff
+	rec := do(diff, "GET", fmt.Sprintf("/api/v1/users/diff?a=%d&b=%d", a.ID, b.ID), "")
+	decodeData(t, decodeResponse(t, rec, http.StatusOK), &got)
+
+	matching := make(map[string]bool, len(got.Matching))
+	for _, name := range got.Matching {
+		matching[name] = true
+	}
+	for _, name := range []string{"name", "created", "version"} {
+		if !matching[name] {
+			t.Errorf("%s not listed as matching in %v", name, got.Matching)
+		}
+	}
+	if d, ok := got.Differing["email"]; !ok || string(d.A) != `"sam@example.com"` || string(d.B) != `"sam.lee@example.com"` {
+		t.Errorf("email diff = %+v, want both addresses", d)
+	}
+	if _, ok := got.Differing["tags"]; !ok {
+		t.Errorf("tags not listed as differing in %v", got.Differing)
+	}
+	if _, ok := got.Differing["id"]; ok || matching["id"] {
+		t.Error("id compared, want it left out")
+	}
+
+	decodeResponse(t, do(diff, "GET", fmt.Sprintf("/api/v1/users/diff?a=%d&b=999", a.ID), ""), http.StatusNotFound)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// requestBodyBytes records how many body bytes each request sent
+var requestBodyBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "http_request_body_bytes",
+	Help:    "Size of HTTP request bodies in bytes.",
+	Buckets: prometheus.ExponentialBuckets(64, 4, 10),
+})
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// measureRequestSize records the size of each request body and logs a
+// warning for bodies larger than LARGE_REQUEST_BYTES
+func (s *Server) measureRequestSize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody {
+			requestBodyBytes.Observe(0)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		next.ServeHTTP(w, r)
+
+		requestBodyBytes.Observe(float64(body.n))
+		if s.cfg.LargeRequestBytes > 0 && body.n > s.cfg.LargeRequestBytes {
+			log.Printf("Large request body: %s %s from %s sent %d bytes (threshold %d)",
+				r.Method, r.URL.Path, clientIP(r), body.n, s.cfg.LargeRequestBytes)
+		}
+	})
+}
+
+// Report the in-process request metrics as JSON, for monitoring that
+// doesn't read the Prometheus format: requests and latency percentiles
+// per route, as in the latency report, and the requests in flight
+func (s *Server) metricsJSONHandler(w http.ResponseWriter, r *http.Request) {
+	routes := s.latency.Summary()
+	total := 0
+	for _, route := range routes {
+		total += route.Total
+	}
+
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "Metrics retrieved successfully",
+		Data: map[string]interface{}{
+			"requests_total":       total,
+			"requests_in_flight":   s.latency.inFlight.Load(),
+			"rate_limiter_clients": s.limiter.size(),
+			"routes":               routes,
+		},
+		Meta: map[string]int{"window": latencyWindow},
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// captureLog redirects the standard logger into the returned buffer for
+// the rest of the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(prev) })
+	return &buf
+}
+
+func TestLargeRequestBodyIsLogged(t *testing.T) {
+	srv := newTestServer(t, "LARGE_REQUEST_BYTES=1024")
+	logs := captureLog(t)
+	h := srv.measureRequestSize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+
+	do(h, "POST", "/api/v1/users", strings.Repeat("x", 512))
+	if logs.Len() != 0 {
+		t.Errorf("small body logged %q, want nothing", logs.String())
+	}
+
+	do(h, "POST", "/api/v1/users", strings.Repeat("x", 4096))
+	if !strings.Contains(logs.String(), "Large request body: POST /api/v1/users") || !strings.Contains(logs.String(), "sent 4096 bytes") {
+		t.Errorf("log = %q, want a large request warning with the body size", logs.String())
+	}
+}
+
+func TestMetricsJSONCountsRequestsPerRoute(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN=admin-secret")
+	h := srv.Handler()
+	for i := 0; i < 3; i++ {
+		do(h, "GET", "/api/v1/users", "")
+	}
+	do(h, "GET", "/api/v1/users/1", "")
+	do(h, "GET", "/api/v1/users/2", "")
+
+	r := newTestRequest("GET", "/api/v1/admin/metrics.json", nil)
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	var metrics struct {
+		RequestsTotal    int            `json:"requests_total"`
+		RequestsInFlight int            `json:"requests_in_flight"`
+		Routes           []routeLatency `json:"routes"`
+	}
+	decodeData(t, decodeResponse(t, serve(h, r), http.StatusOK), &metrics)
+
+	totals := make(map[string]int)
+	for _, route := range metrics.Routes {
+		totals[route.Route] = route.Total
+		if route.Samples == 0 || route.P99Ms < route.P50Ms {
+			t.Errorf("route %s has %d samples, p50 %.3fms, p99 %.3fms", route.Route, route.Samples, route.P50Ms, route.P99Ms)
+		}
+	}
+	if totals["GET /api/v1/users"] != 3 {
+		t.Errorf("GET /api/v1/users counted %d times, want 3; routes: %v", totals["GET /api/v1/users"], totals)
+	}
+	byID := 0
+	for route, n := range totals {
+		if strings.HasPrefix(route, "GET /api/v1/users/{id") {
+			byID += n
+		}
+	}
+	if byID != 2 {
+		t.Errorf("requests by user ID counted %d times under their route template, want 2; routes: %v", byID, totals)
+	}
+	if metrics.RequestsTotal != 5 {
+		t.Errorf("requests_total = %d, want 5", metrics.RequestsTotal)
+	}
+	// The metrics request itself is the only one in flight
+	if metrics.RequestsInFlight != 1 {
+		t.Errorf("requests_in_flight = %d, want 1", metrics.RequestsInFlight)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// storeBackendHeader reports the configured store backend in
+// X-Store-Backend, to check which deployment served a request
+func (s *Server) storeBackendHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Store-Backend", s.cfg.Store)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// responseHeaders adds the RESPONSE_HEADERS to every response
+func (s *Server) responseHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range s.cfg.ResponseHeaders {
+			w.Header()[name] = append([]string(nil), values...)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hstsPreloadMinAge is the shortest max-age browser preload lists accept
+const hstsPreloadMinAge = 365 * 24 * time.Hour
+
+// hstsHeader returns the Strict-Transport-Security value for cfg
+func hstsHeader(cfg Config) string {
+	value := "max-age=" + strconv.FormatInt(int64(cfg.HSTSMaxAge/time.Second), 10)
+	if cfg.HSTSIncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if cfg.HSTSPreload {
+		value += "; preload"
+	}
+	return value
+}
+
+// isHTTPS reports whether the client connected over https, either to this
+// server or to a proxy in front of it
+func isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
+// strictTransport adds Strict-Transport-Security to responses to https
+// requests. Browsers ignore the header over plain http, and sending it
+// there would only mislead.
+func (s *Server) strictTransport(next http.Handler) http.Handler {
+	value := hstsHeader(s.cfg)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isHTTPS(r) {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// probePaths are hit directly by the orchestrator rather than through the
+// gateway, so they are exempt from REQUIRED_HEADER and the rate limits. A
+// busy client must not be able to fail the probes or hide the metrics.
+var probePaths = map[string]bool{
+	"/readyz":        true,
+	"/metrics":       true,
+	"/api/v1/health": true,
+}
+
+// requireHeader rejects requests that lack REQUIRED_HEADER, so the
+// service only answers traffic that came through the gateway injecting it
+func (s *Server) requireHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(s.cfg.RequiredHeader) == "" && !probePaths[r.URL.Path] {
+			writeError(w, r, CodeInvalidRequest, fmt.Sprintf("%s header is required", s.cfg.RequiredHeader))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isStreamingRequest reports whether r asks for a long-lived streamed
+// response
+func isStreamingRequest(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/api/v1/events", "/api/v1/users/export", "/api/v1/users/archive":
+		return true
+	}
+	return wantsNDJSON(r)
+}
+
+// onceWriter lets a response start only once. A second WriteHeader, such
+// as an error response attempted after a stream has begun, is logged and
+// it and any body that follows are dropped rather than appended to the
+// response already sent.
+type onceWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	status  int
+	discard bool
+}
+
+func (ow *onceWriter) WriteHeader(status int) {
+	if ow.status != 0 {
+		log.Printf("Dropped second response (status %d) for %s %s after status %d was sent (request %s)",
+			status, ow.r.Method, ow.r.URL.Path, ow.status, requestIDFrom(ow.r.Context()))
+		ow.discard = true
+		return
+	}
+	ow.status = status
+	ow.ResponseWriter.WriteHeader(status)
+}
+
+func (ow *onceWriter) Write(p []byte) (int, error) {
+	if ow.status == 0 {
+		ow.WriteHeader(http.StatusOK)
+	}
+	if ow.discard {
+		return len(p), nil
+	}
+	return ow.ResponseWriter.Write(p)
+}
+
+// Flush supports streaming handlers
+func (ow *onceWriter) Flush() {
+	if f, ok := ow.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (ow *onceWriter) Unwrap() http.ResponseWriter {
+	return ow.ResponseWriter
+}
+
+// writeOnce guards every response with an onceWriter, so no handler or
+// middleware can trigger net/http's superfluous WriteHeader warning
+func (s *Server) writeOnce(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&onceWriter{ResponseWriter: w, r: r}, r)
+	})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingWriter is a ResponseWriter that counts what is written to it
+type countingWriter struct {
+	header       http.Header
+	writeHeaders int
+	bytes        int
+}
+
+func (c *countingWriter) Header() http.Header {
+	if c.header == nil {
+		c.header = make(http.Header)
+	}
+	return c.header
+}
+
+func (c *countingWriter) WriteHeader(int) { c.writeHeaders++ }
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.bytes += len(p)
+	return len(p), nil
+}
+
+func TestWriteJSONSkipsExpiredRequests(t *testing.T) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	r := newTestRequest("GET", "/api/v1/users", nil).WithContext(ctx)
+
+	w := &countingWriter{}
+	writeJSON(w, r, http.StatusOK, Response{Status: "success", Message: "too late"})
+	writeError(w, r, CodeInternal, "")
+	if w.writeHeaders != 0 || w.bytes != 0 {
+		t.Errorf("wrote %d headers and %d body bytes after the deadline, want nothing", w.writeHeaders, w.bytes)
+	}
+}
+
+func TestExpiredRequestIsAnsweredOnce(t *testing.T) {
+	srv := newTestServer(t)
+	u := createTestUser(t, srv.store, "ada")
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	requests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		path    string
+		body    string
+	}{
+		{"get", srv.getUserHandler, "GET", fmt.Sprintf("/api/v1/users/%d", u.ID), ""},
+		{"list", srv.getUsersHandler, "GET", "/api/v1/users", ""},
+		{"create", srv.createUserHandler, "POST", "/api/v1/users", `{"name":"Grace","email":"grace@example.com"}`},
+	}
+	for _, tc := range requests {
+		t.Run(tc.name, func(t *testing.T) {
+			newRequest := func() *http.Request {
+				var body io.Reader
+				if tc.body != "" {
+					body = strings.NewReader(tc.body)
+				}
+				return newTestRequest(tc.method, tc.path, body).WithContext(ctx)
+			}
+
+			w := &countingWriter{}
+			tc.handler.ServeHTTP(w, newRequest())
+			if w.writeHeaders != 0 || w.bytes != 0 {
+				t.Errorf("handler wrote %d headers and %d body bytes after the deadline, want nothing", w.writeHeaders, w.bytes)
+			}
+
+			rec := serve(srv.Handler(), newRequest())
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Fatalf("status = %d, want 503", rec.Code)
+			}
+			dec := json.NewDecoder(rec.Body)
+			var resp Response
+			if err := dec.Decode(&resp); err != nil || resp.Code != CodeUnavailable {
+				t.Fatalf("body decoded to %+v (%v), want the timeout error", resp, err)
+			}
+			if dec.More() {
+				t.Error("a second response body followed the timeout error")
+			}
+		})
+	}
+}
+
+func TestTimeoutResponseIsNotClobbered(t *testing.T) {
+	srv := newTestServer(t, "REQUEST_TIMEOUT=20ms")
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		writeJSON(w, r, http.StatusOK, Response{Status: "success", Message: "finished late"})
+	})
+
+	rec := do(srv.timeout(slow), "GET", "/api/v1/users", "")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", rec.Code)
+	}
+	var resp Response
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || resp.Code != CodeUnavailable {
+		t.Fatalf("body decoded to %+v (%v), want the timeout error", resp, err)
+	}
+	if rest := rec.Body.String(); strings.TrimSpace(rest) != "" {
+		t.Errorf("late response appended after the timeout: %s", rest)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("timeout response has no Retry-After header")
+	}
+}
+
+func TestHandlerGivingUpOnTheDeadlineTimesOut(t *testing.T) {
+	srv := newTestServer(t, "REQUEST_TIMEOUT=5ms")
+	// Returns as soon as the deadline passes, racing the timer, without
+	// writing anything
+	silent := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	blocking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	for name, h := range map[string]http.Handler{"silent": silent, "blocking": blocking} {
+		for i := 0; i < 20; i++ {
+			rec := do(srv.timeout(h), "GET", "/api/v1/users", "")
+			if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+				t.Fatalf("%s handler: status %d, Retry-After %q; want a 503 asking for a retry",
+					name, rec.Code, rec.Header().Get("Retry-After"))
+			}
+		}
+	}
+}
+
+func TestClientCancellationReachesTimedHandlers(t *testing.T) {
+	srv := newTestServer(t, "REQUEST_TIMEOUT=5s")
+	seen := make(chan error, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		seen <- r.Context().Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := newTestRequest("GET", "/api/v1/users", nil).WithContext(ctx)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	go serve(srv.timeout(handler), r)
+	select {
+	case err := <-seen:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("handler context ended with %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler still running a second after the client went away")
+	}
+}
+
+func TestStoreBackendHeaderReflectsTheConfiguredStore(t *testing.T) {
+	h := newTestServer(t).Handler()
+	if got := do(h, "GET", "/health", "").Header().Get("X-Store-Backend"); got != "" {
+		t.Errorf("X-Store-Backend = %q with the header off, want it unset", got)
+	}
+
+	for _, store := range []string{"memory", "file"} {
+		h := newTestServer(t, "STORE_BACKEND_HEADER=true", "STORE="+store, "DATA_FILE="+t.TempDir()+"/users.json").Handler()
+		for _, path := range []string{"/health", "/api/v1/no-such-route"} {
+			if got := do(h, "GET", path, "").Header().Get("X-Store-Backend"); got != store {
+				t.Errorf("%s with STORE=%s: X-Store-Backend = %q", path, store, got)
+			}
+		}
+	}
+}
+
+func TestRequiredHeaderGatesEveryRouteButProbes(t *testing.T) {
+	h := newTestServer(t, "REQUIRED_HEADER=X-Gateway-Auth").Handler()
+
+	resp := decodeResponse(t, do(h, "GET", "/api/v1/users", ""), http.StatusBadRequest)
+	if resp.Code != CodeInvalidRequest || resp.Message != "X-Gateway-Auth header is required" {
+		t.Errorf("missing header = %s %q, want INVALID_REQUEST naming the header", resp.Code, resp.Message)
+	}
+
+	r := newTestRequest("GET", "/api/v1/users", nil)
+	r.Header.Set("X-Gateway-Auth", "gateway")
+	decodeResponse(t, serve(h, r), http.StatusOK)
+
+	if rec := do(h, "GET", "/readyz", ""); rec.Code != http.StatusOK {
+		t.Errorf("readyz without the header = %d, want 200", rec.Code)
+	}
+
+	h = newTestServer(t, "REQUIRED_HEADER=").Handler()
+	decodeResponse(t, do(h, "GET", "/api/v1/users", ""), http.StatusOK)
+}
+
+func TestResponseHeadersAreAddedEverywhere(t *testing.T) {
+	h := newTestServer(t, "RESPONSE_HEADERS=X-Environment=staging, X-Trace-Hint=sampled").Handler()
+	for _, path := range []string{"/api/v1/users", "/readyz", "/api/v1/no-such-route"} {
+		rec := do(h, "GET", path, "")
+		if got := rec.Header().Get("X-Environment"); got != "staging" {
+			t.Errorf("%s: X-Environment = %q, want staging", path, got)
+		}
+		if got := rec.Header().Get("X-Trace-Hint"); got != "sampled" {
+			t.Errorf("%s: X-Trace-Hint = %q, want sampled", path, got)
+		}
+	}
+}
+
+func TestSecondResponseIsDroppedWithoutTheSuperfluousWarning(t *testing.T) {
+	srv := newTestServer(t)
+	logs := captureLog(t)
+	var serverLog bytes.Buffer
+	ts := httptest.NewUnstartedServer(srv.writeOnce(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "first")
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "second")
+	})))
+	ts.Config.ErrorLog = log.New(&serverLog, "", 0)
+	ts.Start()
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	ts.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "first" {
+		t.Errorf("got %d %q, want only the first response", resp.StatusCode, body)
+	}
+	if strings.Contains(serverLog.String(), "superfluous") {
+		t.Errorf("net/http warned about the second WriteHeader: %s", serverLog.String())
+	}
+	if !strings.Contains(logs.String(), "Dropped second response (status 500)") {
+		t.Errorf("log = %q, want the dropped response recorded", logs.String())
+	}
+}
+
+func TestHSTSOnlyOnHTTPSRequests(t *testing.T) {
+	h := newTestServer(t, "HSTS_MAX_AGE=8760h", "HSTS_INCLUDE_SUBDOMAINS=true").Handler()
+
+	forwarded := newTestRequest("GET", "/health", nil)
+	forwarded.Header.Set("X-Forwarded-Proto", "https")
+	if got := serve(h, forwarded).Header().Get("Strict-Transport-Security"); got != "max-age=31536000; includeSubDomains" {
+		t.Errorf("forwarded https Strict-Transport-Security = %q, want max-age=31536000; includeSubDomains", got)
+	}
+
+	plain := newTestRequest("GET", "/health", nil)
+	plain.Header.Set("X-Forwarded-Proto", "http")
+	if got := serve(h, plain).Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("plain http got Strict-Transport-Security %q, want none", got)
+	}
+}
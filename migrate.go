@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// migrateProgressEvery is how often, in users, migration progress is logged
+const migrateProgressEvery = 1000
+
+// batchInserter is implemented by stores that write many users at once
+// more cheaply than one Insert each. errs holds the error for each user
+// that wasn't stored; err is set when nothing could be stored.
+type batchInserter interface {
+	InsertMany(ctx context.Context, users []User) (errs []error, err error)
+}
+
+// migrateUsers copies every user from src to dst, preserving IDs and
+// timestamps. Users whose email or ID already exists in dst are logged and
+// skipped. A dst that inserts in batches takes all the users in one.
+func migrateUsers(ctx context.Context, src, dst UserStore) (migrated, skipped int, err error) {
+	users, err := src.List(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("read source: %w", err)
+	}
+
+	tally := func(u User, err error) error {
+		if err == nil {
+			migrated++
+			return nil
+		}
+		if !errors.Is(err, ErrDuplicateEmail) && !errors.Is(err, ErrDuplicateID) {
+			return fmt.Errorf("write user %d: %w", u.ID, err)
+		}
+		log.Printf("Migrate: skipping user %d (%s): %v", u.ID, u.Email, err)
+		skipped++
+		return nil
+	}
+
+	if batch, ok := dst.(batchInserter); ok {
+		errs, err := batch.InsertMany(ctx, users)
+		if err != nil {
+			return 0, 0, fmt.Errorf("write users: %w", err)
+		}
+		for i, u := range users {
+			if err := tally(u, errs[i]); err != nil {
+				return migrated, skipped, err
+			}
+		}
+		return migrated, skipped, nil
+	}
+
+	for i, u := range users {
+		_, err := dst.Insert(ctx, u)
+		if err := tally(u, err); err != nil {
+			return migrated, skipped, err
+		}
+		if (i+1)%migrateProgressEvery == 0 {
+			log.Printf("Migrate: %d of %d users processed", i+1, len(users))
+		}
+	}
+	return migrated, skipped, nil
+}
+
+// runMigration opens the from and to backends using the connection
+// settings in cfg and copies all users between them
+func runMigration(cfg Config, from, to string) error {
+	if from == "" || to == "" {
+		return fmt.Errorf("--migrate-data requires --from and --to")
+	}
+	if from == to {
+		return fmt.Errorf("--from and --to must name different stores")
+	}
+	for _, name := range []string{from, to} {
+		if err := checkStore(cfg, name); err != nil {
+			return err
+		}
+	}
+
+	// The backends are opened without the caches and timing openStore
+	// adds, which only get in the way of a one-off copy
+	ctx := context.Background()
+	open := func(name string) (UserStore, error) {
+		c := cfg
+		c.Store = name
+		return openBackend(ctx, c)
+	}
+
+	src, err := open(from)
+	if err != nil {
+		return fmt.Errorf("open %s store: %w", from, err)
+	}
+	defer closeStore(src)
+	dst, err := open(to)
+	if err != nil {
+		return fmt.Errorf("open %s store: %w", to, err)
+	}
+	defer closeStore(dst)
+
+	migrated, skipped, err := migrateUsers(ctx, src, dst)
+	if err != nil {
+		return err
+	}
+	log.Printf("Migrated %d users from %s to %s (%d skipped)", migrated, from, to, skipped)
+	return nil
+}
+
+// closeStore closes store if it holds resources
+func closeStore(store UserStore) {
+	if closer, ok := store.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Failed to close store: %v", err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMigrateUsersPreservesIDsAndTimestamps(t *testing.T) {
+	ctx := context.Background()
+	src, err := NewFileStore(filepath.Join(t.TempDir(), "users.json"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var users []User
+	for _, name := range []string{"ada", "grace", "gone", "linus"} {
+		users = append(users, createTestUser(t, src, name))
+	}
+	// Leave a gap in the IDs so renumbering would show
+	if err := src.Delete(ctx, users[2].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := NewMemoryStore(nil)
+	conflict := users[1]
+	if _, err := dst.Insert(ctx, User{ID: 100, Name: "Taken", Email: conflict.Email, Created: conflict.Created}); err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, skipped, err := migrateUsers(ctx, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 2 || skipped != 1 {
+		t.Errorf("migrated %d, skipped %d; want 2 and 1", migrated, skipped)
+	}
+
+	for _, u := range []User{users[0], users[3]} {
+		got, err := dst.Get(ctx, u.ID)
+		if err != nil {
+			t.Fatalf("user %d missing after migration: %v", u.ID, err)
+		}
+		if !reflect.DeepEqual(got, u) {
+			t.Errorf("user %d = %+v, want %+v", u.ID, got, u)
+		}
+	}
+	if _, err := dst.Get(ctx, conflict.ID); err != ErrNotFound {
+		t.Errorf("conflicting user %d: err = %v, want it skipped", conflict.ID, err)
+	}
+
+	next, err := dst.Create(ctx, User{Name: "Next", Email: testEmail("next")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.ID <= 100 {
+		t.Errorf("next ID = %d, want it above every migrated ID", next.ID)
+	}
+}
+
+func TestMigrateIntoAFileStoreKeepsEveryUser(t *testing.T) {
+	ctx := context.Background()
+	src := NewMemoryStore(nil)
+	var users []User
+	for _, name := range []string{"ada", "grace", "linus"} {
+		users = append(users, createTestUser(t, src, name))
+	}
+
+	path := filepath.Join(t.TempDir(), "users.json")
+	dst, err := NewFileStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conflict := users[1]
+	if _, err := dst.Insert(ctx, User{ID: 100, Name: "Taken", Email: conflict.Email, Created: conflict.Created}); err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, skipped, err := migrateUsers(ctx, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 2 || skipped != 1 {
+		t.Errorf("migrated %d, skipped %d; want 2 and 1", migrated, skipped)
+	}
+
+	reopened, err := NewFileStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []User{users[0], users[2]} {
+		got, err := reopened.Get(ctx, u.ID)
+		if err != nil {
+			t.Fatalf("user %d not written to disk: %v", u.ID, err)
+		}
+		if !reflect.DeepEqual(got, u) {
+			t.Errorf("user %d = %+v, want %+v", u.ID, got, u)
+		}
+	}
+	if _, err := reopened.Get(ctx, conflict.ID); err != ErrNotFound {
+		t.Errorf("conflicting user %d: err = %v, want it skipped", conflict.ID, err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// mxResolver looks up mail exchangers. *net.Resolver implements it.
+type mxResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// errNoMX is returned by checkMX for domains that don't accept mail
+var errNoMX = errors.New("domain has no MX records")
+
+// mxRetryAfter is how long a client is asked to wait when its email domain
+// couldn't be checked
+const mxRetryAfter = 5 * time.Second
+
+// checkMX reports whether domain publishes at least one usable MX record.
+// A lookup that fails for any reason other than the name or records not
+// existing is returned as is, since it says nothing about the domain.
+func checkMX(ctx context.Context, resolver mxResolver, domain string) error {
+	records, err := resolver.LookupMX(ctx, domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return errNoMX
+	}
+	if err != nil {
+		return err
+	}
+	for _, mx := range records {
+		// A lone "." is a null MX, declaring that the domain takes no mail
+		if mx.Host != "." && mx.Host != "" {
+			return nil
+		}
+	}
+	return errNoMX
+}
+
+// checkEmailDomain performs the EMAIL_MX_CHECK lookup for email,
+// returning why it was rejected when the domain can't take mail
+func (s *Server) checkEmailDomain(ctx context.Context, email string) *emailRejection {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.EmailMXTimeout)
+	defer cancel()
+
+	err := checkMX(ctx, s.resolver, emailDomain(email))
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errNoMX):
+		return &emailRejection{fields: []FieldError{{Field: "email", Message: "must use a domain that accepts mail"}}}
+	default:
+		return &emailRejection{code: CodeUnavailable, message: "Could not verify the email domain", retryAfter: mxRetryAfter}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// fakeResolver answers MX lookups from a fixed table. Domains not listed
+// don't exist; err, when set, fails every lookup.
+type fakeResolver struct {
+	records map[string][]*net.MX
+	err     error
+}
+
+func (f fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	records, ok := f.records[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+func TestEmailMXCheck(t *testing.T) {
+	srv := newTestServer(t, "EMAIL_MX_CHECK=true")
+	srv.resolver = fakeResolver{records: map[string][]*net.MX{
+		"mail.example":   {{Host: "mx1.mail.example.", Pref: 10}},
+		"nomail.example": {{Host: ".", Pref: 0}},
+	}}
+	h := srv.Handler()
+
+	decodeResponse(t, do(h, "POST", "/api/v1/users", `{"name":"Has Mail","email":"a@mail.example"}`), http.StatusCreated)
+	for _, email := range []string{"b@nomail.example", "c@missing.example"} {
+		resp := decodeResponse(t, do(h, "POST", "/api/v1/users", `{"name":"No Mail","email":"`+email+`"}`), http.StatusBadRequest)
+		if resp.Code != CodeValidationFailed {
+			t.Errorf("%s: code = %s, want %s", email, resp.Code, CodeValidationFailed)
+		}
+	}
+
+	srv.resolver = fakeResolver{err: errors.New("resolver unreachable")}
+	decodeResponse(t, do(h, "POST", "/api/v1/users", `{"name":"Unknown","email":"d@mail.example"}`), http.StatusServiceUnavailable)
+}
+
+func TestEmailMXCheckIsOffByDefault(t *testing.T) {
+	srv := newTestServer(t)
+	srv.resolver = fakeResolver{err: errors.New("resolver must not be called")}
+	decodeResponse(t, do(srv.Handler(), "POST", "/api/v1/users", `{"name":"Offline","email":"a@missing.example"}`), http.StatusCreated)
+}
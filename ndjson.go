@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// lineEncoder writes values one per line in a response format, like a
+// json.Encoder
+type lineEncoder struct {
+	w      io.Writer
+	format responseFormat
+}
+
+func newLineEncoder(w io.Writer, format responseFormat) *lineEncoder {
+	return &lineEncoder{w: w, format: format}
+}
+
+// Encode writes v and a newline
+func (e *lineEncoder) Encode(v interface{}) error {
+	data, err := e.format.encode(v)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(append(data, '\n'))
+	return err
+}
+
+// wantsNDJSON reports whether the client asked for newline-delimited JSON,
+// either with ?format=ndjson or an Accept header
+func wantsNDJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "ndjson" {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept)); err == nil && mediaType == ndjsonContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNDJSON streams users one JSON object per line without the standard
+// response envelope, flushing after each line so consumers can process
+// records as they arrive
+func writeNDJSON(w http.ResponseWriter, r *http.Request, users []User) {
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	enc := newLineEncoder(w, responseFormatFrom(r.Context()).streamed())
+	for _, user := range users {
+		if r.Context().Err() != nil {
+			return
+		}
+		if err := enc.Encode(user); err != nil {
+			log.Printf("Failed to stream user %d: %v", user.ID, err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// streamModifiedNDJSON writes the users and tombstones changed since t
+// that match f as NDJSON while iterating the store, so the delta is never
+// held in memory. They come in modification order. Store errors before
+// the first line get a normal error response; later ones can only end the
+// stream.
+func (s *Server) streamModifiedNDJSON(w http.ResponseWriter, r *http.Request, t time.Time, f UserFilter) {
+	flusher, _ := w.(http.Flusher)
+	enc := newLineEncoder(w, responseFormatFrom(r.Context()).streamed())
+	started := false
+	start := func() {
+		if !started {
+			w.Header().Set("Content-Type", ndjsonContentType)
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+	}
+
+	err := s.iterateModified(r.Context(), t, f, func(u User) error {
+		start()
+		if err := enc.Encode(u); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	switch {
+	case err == nil:
+		start()
+	case !started:
+		writeStoreError(w, r, err)
+	case r.Context().Err() == nil:
+		log.Printf("Failed to stream modified users: %v", err)
+	}
+}
+
+// writeJSONArray streams users as a single JSON array, encoding and
+// flushing one element at a time instead of marshaling the whole slice
+func writeJSONArray(w http.ResponseWriter, r *http.Request, users []User) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	format := responseFormatFrom(r.Context()).streamed()
+	io.WriteString(w, "[")
+	for i, user := range users {
+		if r.Context().Err() != nil {
+			return
+		}
+		if i > 0 {
+			io.WriteString(w, ",")
+		}
+		data, err := format.encode(user)
+		if err != nil {
+			log.Printf("Failed to stream user %d: %v", user.ID, err)
+			return
+		}
+		if _, err := w.Write(data); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	io.WriteString(w, "]\n")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestListUsersAsNDJSON(t *testing.T) {
+	srv := newTestServer(t)
+	for i := 0; i < 3; i++ {
+		u := User{Name: fmt.Sprintf("Line %d", i), Email: fmt.Sprintf("line%d@example.com", i), Created: time.Now().UTC().Truncate(time.Second)}
+		if _, err := srv.store.Create(context.Background(), u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := http.HandlerFunc(srv.getUsersHandler)
+
+	for name, r := range map[string]*http.Request{
+		"format": newTestRequest("GET", "/api/v1/users?format=ndjson", nil),
+		"accept": newTestRequest("GET", "/api/v1/users", nil),
+	} {
+		if name == "accept" {
+			r.Header.Set("Accept", "application/json;q=0.5, application/x-ndjson")
+		}
+		t.Run(name, func(t *testing.T) {
+			rec := serve(h, r)
+			if ct := rec.Header().Get("Content-Type"); ct != ndjsonContentType {
+				t.Fatalf("Content-Type = %q, want %s", ct, ndjsonContentType)
+			}
+			seen := make(map[int]bool)
+			lines := bufio.NewScanner(rec.Body)
+			for lines.Scan() {
+				var u User
+				if err := json.Unmarshal(lines.Bytes(), &u); err != nil {
+					t.Fatalf("line %q is not a user: %v", lines.Text(), err)
+				}
+				if u.ID == 0 || seen[u.ID] {
+					t.Errorf("line %q repeats or lacks an ID", lines.Text())
+				}
+				seen[u.ID] = true
+			}
+			if len(seen) != 3 {
+				t.Errorf("got %d users, want 3", len(seen))
+			}
+		})
+	}
+}
+
+func TestModifiedSinceStreamsAsNDJSON(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	createTestUser(t, srv.store, "stale")
+	changed := createTestUser(t, srv.store, "changed")
+	time.Sleep(2 * time.Millisecond)
+	since := time.Now().UTC()
+	changed.Name = "Changed"
+	if _, err := srv.store.Update(ctx, changed); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := do(http.HandlerFunc(srv.getUsersHandler), "GET", "/api/v1/users?format=ndjson&modified_since="+since.Format(time.RFC3339Nano), "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != ndjsonContentType {
+		t.Fatalf("status %d, Content-Type %q; want a 200 NDJSON stream", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var users []User
+	lines := bufio.NewScanner(rec.Body)
+	for lines.Scan() {
+		var u User
+		if err := json.Unmarshal(lines.Bytes(), &u); err != nil {
+			t.Fatalf("line %q is not a user: %v", lines.Text(), err)
+		}
+		users = append(users, u)
+	}
+	if len(users) != 1 || users[0].ID != changed.ID || users[0].Name != "Changed" {
+		t.Errorf("delta stream = %+v, want only the changed user", users)
+	}
+}
+
+func TestModifiedSinceStreamAppliesTheIDWindowAndSort(t *testing.T) {
+	srv := newTestServer(t)
+	since := time.Now().UTC().Add(-time.Second)
+	var users []User
+	for _, name := range []string{"first", "second", "third"} {
+		users = append(users, createTestUser(t, srv.store, name))
+	}
+
+	stream := func(query string) []int {
+		t.Helper()
+		rec := do(http.HandlerFunc(srv.getUsersHandler), "GET", "/api/v1/users?format=ndjson&modified_since="+since.Format(time.RFC3339Nano)+query, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d, want 200", query, rec.Code)
+		}
+		var ids []int
+		lines := bufio.NewScanner(rec.Body)
+		for lines.Scan() {
+			var u User
+			if err := json.Unmarshal(lines.Bytes(), &u); err != nil {
+				t.Fatalf("line %q is not a user: %v", lines.Text(), err)
+			}
+			ids = append(ids, u.ID)
+		}
+		return ids
+	}
+
+	window := fmt.Sprintf("&id_from=%d&id_to=%d", users[1].ID, users[2].ID)
+	if got, want := stream(window), []int{users[1].ID, users[2].ID}; !reflect.DeepEqual(got, want) {
+		t.Errorf("delta with %s = %v, want %v", window, got, want)
+	}
+	if got, want := stream("&sort=-id"), []int{users[2].ID, users[1].ID, users[0].ID}; !reflect.DeepEqual(got, want) {
+		t.Errorf("delta sorted by -id = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Default and maximum page sizes for the user list
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+// maxPage is the highest ?page accepted. It keeps the offset of any page
+// within a 32-bit int at the largest page size.
+const maxPage = math.MaxInt32 / maxListLimit
+
+// ParamError reports an invalid query parameter
+type ParamError struct {
+	Param   string
+	Message string
+}
+
+func (e *ParamError) Error() string {
+	return fmt.Sprintf("%s %s", e.Param, e.Message)
+}
+
+// writeParamError writes a 400 response for a ParamError, or a generic 400
+// for any other error
+func writeParamError(w http.ResponseWriter, r *http.Request, err error) {
+	var pe *ParamError
+	if errors.As(err, &pe) {
+		writeError(w, r, CodeInvalidParameter, pe.Error())
+		return
+	}
+	writeError(w, r, CodeInvalidParameter, "")
+}
+
+// parseLimit reads the ?limit parameter, returning defaultV when it is
+// absent. Values must be between 1 and maxV.
+func parseLimit(r *http.Request, defaultV, maxV int) (int, error) {
+	return parseIntParam(r, "limit", defaultV, 1, maxV)
+}
+
+// parsePage reads the 1-based ?page parameter, defaulting to the first
+// page. Values must be between 1 and maxPage.
+func parsePage(r *http.Request) (int, error) {
+	return parseIntParam(r, "page", 1, 1, maxPage)
+}
+
+// pageOffset returns how many items come before the 1-based page of size
+// limit, saturating at math.MaxInt rather than overflowing
+func pageOffset(page, limit int) int {
+	if page <= 1 || limit <= 0 {
+		return 0
+	}
+	if page-1 > math.MaxInt/limit {
+		return math.MaxInt
+	}
+	return (page - 1) * limit
+}
+
+// parseIntParam reads an integer query parameter within [minV, maxV]. A
+// maxV of 0 leaves the value unbounded above.
+func parseIntParam(r *http.Request, name string, defaultV, minV, maxV int) (int, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return defaultV, nil
+	}
+
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, &ParamError{Param: name, Message: "must be an integer"}
+	}
+	if n < minV {
+		return 0, &ParamError{Param: name, Message: fmt.Sprintf("must be at least %d", minV)}
+	}
+	if maxV > 0 && n > maxV {
+		return 0, &ParamError{Param: name, Message: fmt.Sprintf("must be at most %d", maxV)}
+	}
+	return n, nil
+}
+
+// pageMeta describes the page returned by a paginated list
+type pageMeta struct {
+	Page       int       `json:"page"`
+	Limit      int       `json:"limit"`
+	Total      int       `json:"total"`
+	TotalPages int       `json:"total_pages"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+	Applied    listQuery `json:"applied"`
+
+	// Truncated is set when the page was cut short to fit MAX_LIST_BYTES,
+	// with Hint explaining how to get complete pages. NextPageOffset is
+	// the ?offset the rest of the page starts at, so no users are skipped
+	// by moving on to the next page.
+	Truncated      bool   `json:"truncated,omitempty"`
+	NextPageOffset int    `json:"next_page_offset,omitempty"`
+	Hint           string `json:"hint,omitempty"`
+}
+
+// newPageMeta describes the 1-based page of size limit out of total items
+func newPageMeta(total, page, limit int) pageMeta {
+	return pageMeta{
+		Page:       page,
+		Limit:      limit,
+		Total:      total,
+		TotalPages: (total + limit - 1) / limit,
+	}
+}
+
+// paginate returns the requested 1-based page of users and its metadata
+func paginate(users []User, page, limit int) ([]User, pageMeta) {
+	return paginateFrom(users, pageOffset(page, limit), page, limit)
+}
+
+// paginateFrom returns up to limit users starting at offset start, with
+// the metadata of the 1-based page they are reported as
+func paginateFrom(users []User, start, page, limit int) ([]User, pageMeta) {
+	meta := newPageMeta(len(users), page, limit)
+
+	if start >= len(users) {
+		return []User{}, meta
+	}
+	end := len(users)
+	if limit < end-start {
+		end = start + limit
+		meta.NextCursor = encodeCursor(users[end-1].ID)
+	}
+	return users[start:end], meta
+}
+
+// pageCollector cuts a page in ID order from users arriving in any order,
+// keeping only the lowest IDs up to the end of the page rather than every
+// user
+type pageCollector struct {
+	end   int
+	users []User
+	total int
+}
+
+// newPageCollector returns a collector for the limit users starting at
+// offset start
+func newPageCollector(start, limit int) *pageCollector {
+	end := start + limit
+	if end < start {
+		end = math.MaxInt
+	}
+	return &pageCollector{end: end}
+}
+
+// add counts u and keeps it while it is among the lowest end IDs seen
+func (c *pageCollector) add(u User) {
+	c.total++
+	i := sort.Search(len(c.users), func(i int) bool { return c.users[i].ID > u.ID })
+	if len(c.users) == c.end {
+		if i == len(c.users) {
+			return
+		}
+		c.users = c.users[:len(c.users)-1]
+	}
+	c.users = append(c.users, User{})
+	copy(c.users[i+1:], c.users[i:])
+	c.users[i] = u
+}
+
+// page returns the users from offset start onwards, with the metadata of
+// the 1-based page they are reported as
+func (c *pageCollector) page(start, page, limit int) ([]User, pageMeta) {
+	meta := newPageMeta(c.total, page, limit)
+	if start >= len(c.users) {
+		return []User{}, meta
+	}
+	users := c.users[start:]
+	if start+len(users) < c.total {
+		meta.NextCursor = encodeCursor(users[len(users)-1].ID)
+	}
+	return users, meta
+}
+
+// truncateToBudget returns the longest prefix of users whose encoding in
+// format fits in budget bytes, keeping at least one user so every page
+// makes progress, and whether any users were dropped
+func truncateToBudget(users []User, budget int, format responseFormat) ([]User, bool) {
+	size := 0
+	for i, u := range users {
+		data, err := format.encode(u)
+		if err != nil {
+			return users, false
+		}
+		// One byte for the separating comma
+		size += len(data) + 1
+		if size > budget && i > 0 {
+			return users[:i], true
+		}
+	}
+	return users, false
+}
+
+// cursorPrefix marks user list cursors so other tokens aren't accepted
+const cursorPrefix = "after:"
+
+// encodeCursor returns the opaque cursor resuming a list after the user
+// with the given ID
+func encodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursorPrefix + strconv.Itoa(id)))
+}
+
+// decodeCursor returns the user ID a cursor resumes after
+func decodeCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	id, ok := strings.CutPrefix(string(raw), cursorPrefix)
+	if !ok {
+		return 0, errors.New("missing cursor prefix")
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid cursor ID")
+	}
+	return n, nil
+}
+
+// usersAfter returns the users with IDs above id. users must be ordered
+// by ID.
+func usersAfter(users []User, id int) []User {
+	i := sort.Search(len(users), func(i int) bool { return users[i].ID > id })
+	return users[i:]
+}
+
+// usersInIDRange returns the users with IDs from from to to inclusive. A
+// bound of 0 leaves that end open. users must be ordered by ID.
+func usersInIDRange(users []User, from, to int) []User {
+	start := sort.Search(len(users), func(i int) bool { return users[i].ID >= from })
+	end := len(users)
+	if to > 0 {
+		end = sort.Search(len(users), func(i int) bool { return users[i].ID > to })
+	}
+	if start > end {
+		return users[:0]
+	}
+	return users[start:end]
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    int
+		wantErr string
+	}{
+		{"missing", "", 20, ""},
+		{"valid", "?limit=50", 50, ""},
+		{"max", "?limit=100", 100, ""},
+		{"zero", "?limit=0", 0, "must be at least 1"},
+		{"negative", "?limit=-5", 0, "must be at least 1"},
+		{"over max", "?limit=101", 0, "must be at most 100"},
+		{"not a number", "?limit=ten", 0, "must be an integer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/users"+tt.query, nil)
+			got, err := parseLimit(r, 20, 100)
+
+			if tt.wantErr == "" {
+				if err != nil || got != tt.want {
+					t.Errorf("parseLimit = %d, %v; want %d, nil", got, err, tt.want)
+				}
+				return
+			}
+			var paramErr *ParamError
+			if !errors.As(err, &paramErr) {
+				t.Fatalf("parseLimit error = %v, want a *ParamError", err)
+			}
+			if paramErr.Param != "limit" || paramErr.Message != tt.wantErr {
+				t.Errorf("parseLimit error = %s %s, want limit %s", paramErr.Param, paramErr.Message, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPageOffsetSaturates(t *testing.T) {
+	for _, tt := range []struct{ page, limit, want int }{
+		{1, 20, 0},
+		{3, 20, 40},
+		{0, 20, 0},
+		{2, 0, 0},
+		{math.MaxInt, 100, math.MaxInt},
+	} {
+		if got := pageOffset(tt.page, tt.limit); got != tt.want {
+			t.Errorf("pageOffset(%d, %d) = %d, want %d", tt.page, tt.limit, got, tt.want)
+		}
+	}
+	if users := pageOf([]User{{ID: 1}, {ID: 2}}, math.MaxInt, 10); len(users) != 0 {
+		t.Errorf("page past the end holds %d users, want none", len(users))
+	}
+
+	h := newTestServer(t).Handler()
+	resp := decodeResponse(t, do(h, "GET", fmt.Sprintf("/api/v1/users?page=%d", maxPage+1), ""), http.StatusBadRequest)
+	if resp.Code != CodeInvalidParameter {
+		t.Errorf("page past maxPage got code %s, want %s", resp.Code, CodeInvalidParameter)
+	}
+}
+
+func TestPageInfoMatchesTheListPaging(t *testing.T) {
+	srv := newTestServer(t)
+	h := srv.Handler()
+	for i := 0; i < 5; i++ {
+		created := time.Now().UTC()
+		if i == 0 {
+			created = created.Add(-48 * time.Hour)
+		}
+		if _, err := srv.store.Create(context.Background(), User{Name: "Paged", Email: fmt.Sprintf("paged%d@example.com", i), Created: created}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	modifiedSince := url.QueryEscape(time.Now().Add(-time.Hour).UTC().Format(time.RFC3339))
+	for _, query := range []string{"?limit=2", "?limit=2&page=3", "?limit=2&since=24h", "?limit=2&id_from=2&id_to=4", "?limit=2&sort=email", "?limit=2&modified_since=" + modifiedSince} {
+		var list, info pageMeta
+		if err := json.Unmarshal(decodeResponse(t, do(h, "GET", "/api/v1/users"+query, ""), http.StatusOK).Meta, &list); err != nil {
+			t.Fatal(err)
+		}
+		resp := decodeResponse(t, do(h, "GET", "/api/v1/users/page-info"+query, ""), http.StatusOK)
+		decodeData(t, resp, &info)
+		// Cursors only make sense alongside the users they follow
+		list.NextCursor = ""
+		if info != list {
+			t.Errorf("%s: page-info = %+v, want the list's %+v", query, info, list)
+		}
+
+		var fields map[string]json.RawMessage
+		decodeData(t, resp, &fields)
+		for name, value := range fields {
+			if len(value) > 0 && value[0] == '[' {
+				t.Errorf("%s: page-info returned a list in %q, want only metadata", query, name)
+			}
+		}
+	}
+}
+
+func TestPageBeyondTheOffsetCapIsRejected(t *testing.T) {
+	list := http.HandlerFunc(newTestServer(t, "MAX_PAGE_OFFSET=100").getUsersHandler)
+
+	decodeResponse(t, do(list, "GET", "/api/v1/users?limit=10&page=11", ""), http.StatusOK)
+
+	resp := decodeResponse(t, do(list, "GET", "/api/v1/users?limit=10&page=12", ""), http.StatusBadRequest)
+	if resp.Code != CodeInvalidParameter || !strings.Contains(resp.Message, "cursor") {
+		t.Errorf("over-cap page = %s %q, want INVALID_PARAMETER pointing at cursor pagination", resp.Code, resp.Message)
+	}
+}
+
+func TestCursorPagesThroughEveryUser(t *testing.T) {
+	srv := newTestServer(t)
+	for i := 0; i < 5; i++ {
+		createTestUser(t, srv.store, fmt.Sprintf("cursor%d", i))
+	}
+	list := http.HandlerFunc(srv.getUsersHandler)
+
+	var ids []int
+	path := "/api/v1/users?limit=2"
+	for pages := 0; path != ""; pages++ {
+		if pages == 6 {
+			t.Fatalf("still paging after %d pages", pages)
+		}
+		resp := decodeResponse(t, do(list, "GET", path, ""), http.StatusOK)
+		var users []User
+		var meta pageMeta
+		decodeData(t, resp, &users)
+		if err := json.Unmarshal(resp.Meta, &meta); err != nil {
+			t.Fatal(err)
+		}
+		for _, u := range users {
+			ids = append(ids, u.ID)
+		}
+		// Cursor pages keep their next_cursor at the end of the list, for
+		// polling, so an empty page is the end
+		path = ""
+		if meta.NextCursor != "" && len(users) > 0 {
+			path = "/api/v1/users?limit=2&cursor=" + meta.NextCursor
+		}
+	}
+	if want := []int{1, 2, 3, 4, 5}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("cursor pages listed %v, want %v", ids, want)
+	}
+
+	decodeResponse(t, do(list, "GET", "/api/v1/users?cursor=bm90LWEtY3Vyc29y", ""), http.StatusBadRequest)
+}
+
+func TestCursorPollIsNotModifiedUntilANewUser(t *testing.T) {
+	srv := newTestServer(t)
+	createTestUser(t, srv.store, "poll0")
+	list := http.HandlerFunc(srv.getUsersHandler)
+
+	var meta pageMeta
+	if err := json.Unmarshal(decodeResponse(t, do(list, "GET", "/api/v1/users?cursor="+encodeCursor(0), ""), http.StatusOK).Meta, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.NextCursor == "" {
+		t.Fatal("last cursor page has no next_cursor to poll with")
+	}
+
+	poll := func() *httptest.ResponseRecorder {
+		r := newTestRequest("GET", "/api/v1/users?cursor="+meta.NextCursor, nil)
+		r.Header.Set("If-None-Match", `"`+meta.NextCursor+`"`)
+		return serve(list, r)
+	}
+	for i := 0; i < 2; i++ {
+		if rec := poll(); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Fatalf("idle poll %d: status %d with %d body bytes, want an empty 304", i, rec.Code, rec.Body.Len())
+		}
+	}
+
+	created := createTestUser(t, srv.store, "poll1")
+	var users []User
+	decodeData(t, decodeResponse(t, poll(), http.StatusOK), &users)
+	if len(users) != 1 || users[0].ID != created.ID {
+		t.Errorf("poll after a create listed %+v, want only user %d", users, created.ID)
+	}
+}
+
+func TestLargePagesAreTruncatedToTheByteBudget(t *testing.T) {
+	srv := newTestServer(t, "MAX_LIST_BYTES=3000")
+	for i := 0; i < 5; i++ {
+		u := User{Name: strings.Repeat("x", 1000), Email: fmt.Sprintf("large%d@example.com", i), Created: time.Now().UTC().Truncate(time.Second)}
+		if _, err := srv.store.Create(context.Background(), u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := http.HandlerFunc(srv.getUsersHandler)
+
+	rec := do(list, "GET", "/api/v1/users?limit=5", "")
+	resp := decodeResponse(t, rec, http.StatusOK)
+	var users []User
+	var meta pageMeta
+	decodeData(t, resp, &users)
+	if err := json.Unmarshal(resp.Meta, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || !meta.Truncated {
+		t.Fatalf("got %d users with truncated %v, want 2 and a truncated page", len(users), meta.Truncated)
+	}
+	if !strings.Contains(meta.Hint, "smaller limit") || meta.NextCursor == "" {
+		t.Errorf("hint %q and next_cursor %q, want guidance and a cursor to resume from", meta.Hint, meta.NextCursor)
+	}
+	if rec.Body.Len() > 3000+1000 {
+		t.Errorf("truncated response is %d bytes, want about the 3000 byte budget", rec.Body.Len())
+	}
+
+	var rest []User
+	decodeData(t, decodeResponse(t, do(list, "GET", "/api/v1/users?limit=5&cursor="+meta.NextCursor, ""), http.StatusOK), &rest)
+	if len(rest) != 2 || rest[0].ID != users[1].ID+1 {
+		t.Errorf("next page starts at user %v, want the users after %d", rest, users[1].ID)
+	}
+
+	// Sorted pages can't take a cursor, so the rest of a truncated page is
+	// reached by its offset
+	resp = decodeResponse(t, do(list, "GET", "/api/v1/users?limit=5&sort=email", ""), http.StatusOK)
+	meta = pageMeta{}
+	json.Unmarshal(resp.Meta, &meta)
+	if !meta.Truncated || meta.NextPageOffset != 2 || !strings.Contains(meta.Hint, "offset=2") {
+		t.Fatalf("sorted truncated page meta = %+v, want next_page_offset 2 in the hint", meta)
+	}
+	decodeData(t, decodeResponse(t, do(list, "GET", "/api/v1/users?limit=5&sort=email&offset=2", ""), http.StatusOK), &rest)
+	if len(rest) != 2 || rest[0].Email != "large2@example.com" {
+		t.Errorf("page at offset 2 = %v, want the third user onwards", rest)
+	}
+	decodeResponse(t, do(list, "GET", "/api/v1/users?page=2&offset=2", ""), http.StatusBadRequest)
+
+	var small pageMeta
+	json.Unmarshal(decodeResponse(t, do(list, "GET", "/api/v1/users?limit=1", ""), http.StatusOK).Meta, &small)
+	if small.Truncated || small.Hint != "" {
+		t.Errorf("page within the budget is flagged: %+v", small)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// validRoles are the values accepted for User.Role
+var validRoles = map[string]bool{"user": true, "admin": true}
+
+// patchFields maps each field accepted by PATCH to the function applying
+// its new value. Values are decoded into fresh variables so the stored
+// user's slices and maps are never written through.
+var patchFields = map[string]func(u *User, raw json.RawMessage) error{
+	"name": func(u *User, raw json.RawMessage) error {
+		return json.Unmarshal(raw, &u.Name)
+	},
+	"email": func(u *User, raw json.RawMessage) error {
+		return json.Unmarshal(raw, &u.Email)
+	},
+	"tags": func(u *User, raw json.RawMessage) error {
+		var tags []string
+		if err := json.Unmarshal(raw, &tags); err != nil {
+			return err
+		}
+		u.Tags = tags
+		return nil
+	},
+	"metadata": func(u *User, raw json.RawMessage) error {
+		var metadata map[string]string
+		if err := json.Unmarshal(raw, &metadata); err != nil {
+			return err
+		}
+		u.Metadata = metadata
+		return nil
+	},
+	"role": func(u *User, raw json.RawMessage) error {
+		return json.Unmarshal(raw, &u.Role)
+	},
+	"email_verified": func(u *User, raw json.RawMessage) error {
+		return json.Unmarshal(raw, &u.EmailVerified)
+	},
+}
+
+// defaultPatchFields are the fields any client may change with PATCH
+const defaultPatchFields = "name,email,tags,metadata"
+
+// validateUser checks a complete user against the same rules as creation
+func validateUser(cfg Config, u User) []FieldError {
+	in := userInput{Name: u.Name, Email: u.Email, Tags: u.Tags, Metadata: u.Metadata}
+	errs := in.validate(cfg)
+	if u.Role != "" && !validRoles[u.Role] {
+		errs = append(errs, FieldError{Field: "role", Message: "must be user or admin"})
+	}
+	return errs
+}
+
+// Update some fields of a user. Fields outside PATCH_ALLOWED_FIELDS may
+// only be changed with the admin token. When If-Match is sent, the update
+// only happens if it matches the user's current ETag. The write is
+// conditional on the version read, so a concurrent change is reported as
+// a conflict rather than silently overwritten.
+func (s *Server) patchUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(r)
+	if !ok {
+		writeError(w, r, CodeUserNotFound, "")
+		return
+	}
+
+	var patch map[string]json.RawMessage
+	if err := s.decodeBody(w, r, &patch); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+
+	fields := make([]string, 0, len(patch))
+	for field := range patch {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var errs []FieldError
+	for _, field := range fields {
+		if _, known := patchFields[field]; !known {
+			errs = append(errs, FieldError{Field: field, Message: "is not a recognized field"})
+		}
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+
+	if !s.isAdmin(r) {
+		for _, field := range fields {
+			if !s.cfg.PatchAllowedFields[field] {
+				writeError(w, r, CodeForbidden, fmt.Sprintf("Field %s may not be changed", field))
+				return
+			}
+		}
+	}
+
+	user, err := s.getUser(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !etagMatches(ifMatch, userETag(user, responseFormatFrom(r.Context()))) {
+		w.Header().Set("ETag", userETag(user, responseFormatFrom(r.Context())))
+		writeError(w, r, CodePreconditionFailed, "User has changed since the supplied ETag")
+		return
+	}
+
+	for _, field := range fields {
+		if err := patchFields[field](&user, patch[field]); err != nil {
+			errs = append(errs, FieldError{Field: field, Message: "has the wrong type"})
+		}
+	}
+	if len(errs) == 0 {
+		errs = validateUser(s.cfg, user)
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+
+	user, err = s.store.UpdateIfVersion(r.Context(), id, user.Version, user)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	s.publish(r.Context(), EventUserUpdated, user)
+
+	w.Header().Set("ETag", userETag(user, responseFormatFrom(r.Context())))
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "User updated successfully",
+		Data:    user,
+	})
+}
+
+// Remove all of a user's metadata. Like PATCH, this needs the admin token
+// when metadata is outside PATCH_ALLOWED_FIELDS.
+func (s *Server) clearMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(r)
+	if !ok {
+		writeError(w, r, CodeUserNotFound, "")
+		return
+	}
+
+	if !s.isAdmin(r) && !s.cfg.PatchAllowedFields["metadata"] {
+		writeError(w, r, CodeForbidden, "Field metadata may not be changed")
+		return
+	}
+
+	user, err := s.getUser(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	user.Metadata = nil
+	user, err = s.store.UpdateIfVersion(r.Context(), id, user.Version, user)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	s.publish(r.Context(), EventUserUpdated, user)
+
+	w.Header().Set("ETag", userETag(user, responseFormatFrom(r.Context())))
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "User metadata cleared successfully",
+		Data:    user,
+	})
+}
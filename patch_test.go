@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPatchRestrictsFieldsToNonAdmins(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN=admin-secret")
+	h := srv.Handler()
+	u, err := srv.store.Create(context.Background(), User{Name: "Pat", Email: "pat@example.com", Created: time.Now().UTC()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/api/v1/users/" + strconv.Itoa(u.ID)
+
+	resp := decodeResponse(t, do(h, "PATCH", path, `{"role":"admin"}`), http.StatusForbidden)
+	if resp.Code != CodeForbidden || !strings.Contains(resp.Message, "role") {
+		t.Errorf("got %s %q, want %s naming role", resp.Code, resp.Message, CodeForbidden)
+	}
+	if stored, _ := srv.store.Get(context.Background(), u.ID); stored.Role != "" {
+		t.Errorf("role = %q after a rejected patch, want it unchanged", stored.Role)
+	}
+
+	decodeResponse(t, do(h, "PATCH", path, `{"name":"Patricia"}`), http.StatusOK)
+
+	r := newTestRequest("PATCH", path, strings.NewReader(`{"role":"admin"}`))
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	var patched User
+	decodeData(t, decodeResponse(t, serve(h, r), http.StatusOK), &patched)
+	if patched.Role != "admin" {
+		t.Errorf("role = %q after an admin patch, want admin", patched.Role)
+	}
+}
+
+func TestClearMetadataEmptiesTheMap(t *testing.T) {
+	srv := newTestServer(t)
+	h := srv.Handler()
+	u, err := srv.store.Create(context.Background(), User{
+		Name: "Meta", Email: "meta@example.com", Created: time.Now().UTC(),
+		Metadata: map[string]string{"plan": "pro", "team": "core"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond)
+	var cleared User
+	rec := do(h, "DELETE", "/api/v1/users/"+strconv.Itoa(u.ID)+"/metadata", "")
+	decodeData(t, decodeResponse(t, rec, http.StatusOK), &cleared)
+	if len(cleared.Metadata) != 0 || !cleared.UpdatedAt.After(u.UpdatedAt) {
+		t.Errorf("after clearing: metadata %v, updated %s; want none, after %s", cleared.Metadata, cleared.UpdatedAt, u.UpdatedAt)
+	}
+	if stored, _ := srv.store.Get(context.Background(), u.ID); len(stored.Metadata) != 0 {
+		t.Errorf("stored metadata = %v, want it cleared", stored.Metadata)
+	}
+
+	decodeResponse(t, do(h, "DELETE", "/api/v1/users/999/metadata", ""), http.StatusNotFound)
+}
@@ -0,0 +1,723 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// postgresSchema creates the users table on first start and adds columns
+// introduced since to existing tables
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	id             SERIAL PRIMARY KEY,
+	name           TEXT NOT NULL,
+	email          TEXT NOT NULL,
+	email_key      TEXT NOT NULL,
+	created        TIMESTAMPTZ NOT NULL,
+	email_verified BOOLEAN NOT NULL DEFAULT false,
+	role           TEXT NOT NULL DEFAULT '',
+	tags           TEXT[] NOT NULL DEFAULT '{}',
+	metadata       JSONB NOT NULL DEFAULT '{}',
+	org_id         TEXT NOT NULL DEFAULT '',
+	modified_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+	version        INTEGER NOT NULL DEFAULT 1
+);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_key_idx ON users (email_key);
+CREATE INDEX IF NOT EXISTS users_modified_at_idx ON users (modified_at);
+CREATE INDEX IF NOT EXISTS users_created_idx ON users (created, id);
+CREATE TABLE IF NOT EXISTS user_tombstones (
+	id         INTEGER PRIMARY KEY,
+	org_id     TEXT NOT NULL DEFAULT '',
+	deleted_at TIMESTAMPTZ NOT NULL,
+	data       JSONB
+);
+ALTER TABLE user_tombstones ADD COLUMN IF NOT EXISTS data JSONB;
+`
+
+// userColumns is the column list matching scanUser
+const userColumns = `id, name, email, created, email_verified, role, tags, metadata, org_id, modified_at, version`
+
+// uniqueViolation is the PostgreSQL error code for a unique constraint
+// violation
+const uniqueViolation = "23505"
+
+// primaryKeyConstraint is the name PostgreSQL gives the users primary key
+const primaryKeyConstraint = "users_pkey"
+
+// PostgresStore is a UserStore backed by PostgreSQL. Email uniqueness is
+// enforced by a unique index rather than by lookups.
+type PostgresStore struct {
+	db *sql.DB
+
+	// rules decide the email_key each row is stored with
+	rules emailRules
+}
+
+// NewPostgresStore connects to the database at url, creates the schema if
+// needed and brings the stored email keys in line with rules
+func NewPostgresStore(ctx context.Context, url string, rules emailRules) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connect to postgres: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, postgresSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create schema: %w", err)
+	}
+	p := &PostgresStore{db: db, rules: rules}
+	if err := p.rekeyEmails(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("rebuild email keys: %w", err)
+	}
+	return p, nil
+}
+
+// rekeyEmails rewrites the email_key of rows written under different
+// email rules, such as before CANONICALIZE_EMAIL was turned on. It fails
+// without changing anything when two rows' emails now have the same key.
+func (p *PostgresStore) rekeyEmails(ctx context.Context) error {
+	rows, err := p.db.QueryContext(ctx, `SELECT id, email, email_key FROM users ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	owners := make(map[string]int)
+	stale := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var email, stored string
+		if err := rows.Scan(&id, &email, &stored); err != nil {
+			return err
+		}
+		key := p.rules.key(email)
+		if other, taken := owners[key]; taken {
+			return fmt.Errorf("users %d and %d both have email %s under the email rules", other, id, key)
+		}
+		owners[key] = id
+		if key != stored {
+			stale[id] = key
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Park the stale keys first, since a row's new key may still be held
+	// by another row's old one
+	for id := range stale {
+		if _, err := tx.ExecContext(ctx, `UPDATE users SET email_key = $2 WHERE id = $1`, id, fmt.Sprintf("rekey:%d", id)); err != nil {
+			return err
+		}
+	}
+	for id, key := range stale {
+		if _, err := tx.ExecContext(ctx, `UPDATE users SET email_key = $2 WHERE id = $1`, id, key); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanUser reads a row selected with userColumns
+func scanUser(row rowScanner) (User, error) {
+	var u User
+	var tags pq.StringArray
+	var metadata []byte
+	if err := row.Scan(&u.ID, &u.Name, &u.Email, &u.Created, &u.EmailVerified, &u.Role, &tags, &metadata, &u.OrgID, &u.UpdatedAt, &u.Version); err != nil {
+		return User{}, err
+	}
+
+	u.Created = u.Created.UTC()
+	u.UpdatedAt = u.UpdatedAt.UTC()
+	if len(tags) > 0 {
+		u.Tags = tags
+	}
+	if err := json.Unmarshal(metadata, &u.Metadata); err != nil {
+		return User{}, err
+	}
+	if len(u.Metadata) == 0 {
+		u.Metadata = nil
+	}
+	return u, nil
+}
+
+// queryUsers runs a query selecting userColumns and collects the rows
+func (p *PostgresStore) queryUsers(ctx context.Context, query string, args ...interface{}) ([]User, error) {
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// storeError translates database errors into the store sentinels
+func storeError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		if pqErr.Constraint == primaryKeyConstraint {
+			return ErrDuplicateID
+		}
+		return ErrDuplicateEmail
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// encodeMetadata returns the JSONB value for a metadata map
+func encodeMetadata(metadata map[string]string) ([]byte, error) {
+	if metadata == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(metadata)
+}
+
+// List returns all users ordered by ID
+func (p *PostgresStore) List(ctx context.Context) ([]User, error) {
+	return p.queryUsers(ctx, `SELECT `+userColumns+` FROM users ORDER BY id`)
+}
+
+// Get returns the user with the given ID
+func (p *PostgresStore) Get(ctx context.Context, id int) (User, error) {
+	row := p.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1`, id)
+	u, err := scanUser(row)
+	if err != nil {
+		return User{}, storeError(err)
+	}
+	return u, nil
+}
+
+// GetMany returns the users with the given IDs using a single query
+func (p *PostgresStore) GetMany(ctx context.Context, ids []int) (map[int]User, error) {
+	users, err := p.queryUsers(ctx, `SELECT `+userColumns+` FROM users WHERE id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[int]User, len(users))
+	for _, u := range users {
+		found[u.ID] = u
+	}
+	return found, nil
+}
+
+// GetManyByEmail returns the users with the given emails using a single
+// query on the indexed email_key
+func (p *PostgresStore) GetManyByEmail(ctx context.Context, emails []string) (map[string]User, error) {
+	keys := make([]string, len(emails))
+	for i, email := range emails {
+		keys[i] = p.rules.key(email)
+	}
+	users, err := p.queryUsers(ctx, `SELECT `+userColumns+` FROM users WHERE email_key = ANY($1)`, pq.Array(keys))
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]User, len(users))
+	for _, u := range users {
+		found[p.rules.key(u.Email)] = u
+	}
+	return found, nil
+}
+
+// Create inserts u, letting the database assign its ID
+func (p *PostgresStore) Create(ctx context.Context, u User) (User, error) {
+	metadata, err := encodeMetadata(u.Metadata)
+	if err != nil {
+		return User{}, err
+	}
+
+	row := p.db.QueryRowContext(ctx, `
+		INSERT INTO users (name, email, email_key, created, email_verified, role, tags, metadata, org_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING `+userColumns,
+		u.Name, u.Email, p.rules.key(u.Email), u.Created, u.EmailVerified, u.Role, pq.Array(u.Tags), metadata, u.OrgID)
+	created, err := scanUser(row)
+	if err != nil {
+		return User{}, storeError(err)
+	}
+	return created, nil
+}
+
+// Insert stores u with its own ID and moves the ID sequence past it so
+// later creates don't collide
+func (p *PostgresStore) Insert(ctx context.Context, u User) (User, error) {
+	metadata, err := encodeMetadata(u.Metadata)
+	if err != nil {
+		return User{}, err
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, `
+		INSERT INTO users (id, name, email, email_key, created, email_verified, role, tags, metadata, org_id, modified_at, version)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, COALESCE($11, now()), GREATEST($12, 1))
+		RETURNING `+userColumns,
+		u.ID, u.Name, u.Email, p.rules.key(u.Email), u.Created, u.EmailVerified, u.Role, pq.Array(u.Tags), metadata, u.OrgID,
+		nullTime(u.UpdatedAt), u.Version)
+	inserted, err := scanUser(row)
+	if err != nil {
+		return User{}, storeError(err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_tombstones WHERE id = $1`, u.ID); err != nil {
+		return User{}, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`SELECT setval(pg_get_serial_sequence('users', 'id'), GREATEST((SELECT MAX(id) FROM users), 1))`,
+	); err != nil {
+		return User{}, err
+	}
+	return inserted, tx.Commit()
+}
+
+// Update replaces the stored user with the same ID as u
+func (p *PostgresStore) Update(ctx context.Context, u User) (User, error) {
+	updated, err := p.update(ctx, u, nil)
+	if err != nil {
+		return User{}, storeError(err)
+	}
+	return updated, nil
+}
+
+// UpdateIfVersion replaces the stored user with ID id by u in a single
+// conditional UPDATE. When no row matches, a follow-up lookup tells a
+// stale version apart from a missing user.
+func (p *PostgresStore) UpdateIfVersion(ctx context.Context, id, expectedVersion int, u User) (User, error) {
+	u.ID = id
+	updated, err := p.update(ctx, u, expectedVersion)
+	if !errors.Is(err, sql.ErrNoRows) {
+		if err != nil {
+			return User{}, storeError(err)
+		}
+		return updated, nil
+	}
+
+	var exists bool
+	if err := p.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, u.ID).Scan(&exists); err != nil {
+		return User{}, err
+	}
+	if exists {
+		return User{}, ErrVersionMismatch
+	}
+	return User{}, ErrNotFound
+}
+
+// update writes u, bumping its version. A non-nil expectedVersion limits
+// the write to that version.
+func (p *PostgresStore) update(ctx context.Context, u User, expectedVersion interface{}) (User, error) {
+	metadata, err := encodeMetadata(u.Metadata)
+	if err != nil {
+		return User{}, err
+	}
+
+	row := p.db.QueryRowContext(ctx, `
+		UPDATE users
+		SET name = $2, email = $3, email_key = $4, email_verified = $5, role = $6, tags = $7, metadata = $8,
+			org_id = $9, modified_at = now(), version = version + 1
+		WHERE id = $1 AND ($10::integer IS NULL OR version = $10)
+		RETURNING `+userColumns,
+		u.ID, u.Name, u.Email, p.rules.key(u.Email), u.EmailVerified, u.Role, pq.Array(u.Tags), metadata, u.OrgID,
+		expectedVersion)
+	return scanUser(row)
+}
+
+// Delete removes the user with the given ID and records a tombstone for
+// ModifiedSince
+func (p *PostgresStore) Delete(ctx context.Context, id int) error {
+	return p.remove(ctx, id, false, nil)
+}
+
+// SoftDelete removes the user with the given ID, keeping a copy in its
+// tombstone row for the trash
+func (p *PostgresStore) SoftDelete(ctx context.Context, id int) error {
+	return p.remove(ctx, id, true, nil)
+}
+
+// DeleteIfVersion removes the user with the given ID with a conditional
+// DELETE. When no row matches, a follow-up lookup tells a stale version
+// apart from a missing user.
+func (p *PostgresStore) DeleteIfVersion(ctx context.Context, id, expectedVersion int, soft bool) error {
+	err := p.remove(ctx, id, soft, expectedVersion)
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	var exists bool
+	if err := p.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrVersionMismatch
+	}
+	return ErrNotFound
+}
+
+// remove deletes a user and records its tombstone, holding the full user
+// as data when soft is set. A non-nil expectedVersion limits the delete to
+// that version.
+func (p *PostgresStore) remove(ctx context.Context, id int, soft bool, expectedVersion interface{}) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	u, err := scanUser(tx.QueryRowContext(ctx,
+		`DELETE FROM users WHERE id = $1 AND ($2::integer IS NULL OR version = $2) RETURNING `+userColumns,
+		id, expectedVersion))
+	if err != nil {
+		return storeError(err)
+	}
+	var data []byte
+	if soft {
+		if data, err = json.Marshal(storedUser(u)); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO user_tombstones (id, org_id, deleted_at, data) VALUES ($1, $2, now(), $3)
+		ON CONFLICT (id) DO UPDATE SET org_id = EXCLUDED.org_id, deleted_at = EXCLUDED.deleted_at, data = EXCLUDED.data`,
+		id, u.OrgID, data); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM user_tombstones WHERE deleted_at < now() - $1 * interval '1 second'`,
+		int64(tombstoneRetention/time.Second)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ModifiedSince returns the users and tombstones changed at or after
+// since, ordered by ID
+func (p *PostgresStore) ModifiedSince(ctx context.Context, since time.Time) ([]User, error) {
+	users, err := p.queryUsers(ctx, `SELECT `+userColumns+` FROM users WHERE modified_at >= $1`, since)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT id, org_id, deleted_at FROM user_tombstones WHERE deleted_at >= $1`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u User
+		var deleted time.Time
+		if err := rows.Scan(&u.ID, &u.OrgID, &deleted); err != nil {
+			return nil, err
+		}
+		users = append(users, newTombstone(u, deleted.UTC()))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+// Trash returns the soft-deleted users kept in tombstone rows
+func (p *PostgresStore) Trash(ctx context.Context) ([]User, error) {
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT data, deleted_at FROM user_tombstones WHERE data IS NOT NULL ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var data []byte
+		var deleted time.Time
+		if err := rows.Scan(&data, &deleted); err != nil {
+			return nil, err
+		}
+		var u storedUser
+		if err := json.Unmarshal(data, &u); err != nil {
+			return nil, err
+		}
+		users = append(users, newTrashEntry(User(u), deleted.UTC()))
+	}
+	return users, rows.Err()
+}
+
+// PurgeTrash drops the saved copies of the users in ids, leaving their
+// tombstones for ModifiedSince
+func (p *PostgresStore) PurgeTrash(ctx context.Context, ids []int) (int, error) {
+	res, err := p.db.ExecContext(ctx,
+		`UPDATE user_tombstones SET data = NULL WHERE data IS NOT NULL AND id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// extraScanner scans the columns of a row beyond those scanUser reads
+// into extra
+type extraScanner struct {
+	rowScanner
+	extra []interface{}
+}
+
+func (e extraScanner) Scan(dest ...interface{}) error {
+	return e.rowScanner.Scan(append(dest, e.extra...)...)
+}
+
+// IterateModifiedSince streams the users and tombstones changed at or
+// after since in modification order, using the modified_at index rather
+// than loading them all first
+func (p *PostgresStore) IterateModifiedSince(ctx context.Context, since time.Time, fn func(User) error) error {
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT `+userColumns+`, NULL::timestamptz AS deleted_at FROM users WHERE modified_at >= $1
+		UNION ALL
+		SELECT id, '', '', 'epoch', false, '', '{}', '{}', org_id, deleted_at, 0, deleted_at
+		FROM user_tombstones WHERE deleted_at >= $1
+		ORDER BY modified_at, id`, since)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var deleted sql.NullTime
+		u, err := scanUser(extraScanner{rows, []interface{}{&deleted}})
+		if err != nil {
+			return err
+		}
+		if deleted.Valid {
+			u = newTombstone(u, deleted.Time.UTC())
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// nullTime maps the zero time to NULL
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// filterClause translates f into a WHERE clause and its arguments. It
+// mirrors UserFilter.Matches.
+func filterClause(f UserFilter) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+
+	if f.Q != "" {
+		add(`(name ILIKE $%[1]d OR email ILIKE $%[1]d)`, "%"+likeEscaper.Replace(f.Q)+"%")
+	}
+	if f.Domain != "" {
+		add(`lower(substring(email from '@([^@]*)$')) = $%d`, strings.ToLower(f.Domain))
+	}
+	if f.CreatedAfter != nil {
+		add(`created >= $%d`, *f.CreatedAfter)
+	}
+	if f.CreatedBefore != nil {
+		add(`created < $%d`, *f.CreatedBefore)
+	}
+	if f.IDFrom > 0 {
+		add(`id >= $%d`, f.IDFrom)
+	}
+	if f.IDTo > 0 {
+		add(`id <= $%d`, f.IDTo)
+	}
+	if f.OrgID != nil {
+		add(`org_id = $%d`, *f.OrgID)
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// likeEscaper escapes LIKE wildcards so free text matches literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Count returns the number of users matching f with a single COUNT query
+func (p *PostgresStore) Count(ctx context.Context, f UserFilter) (int, error) {
+	where, args := filterClause(f)
+	var n int
+	err := p.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users`+where, args...).Scan(&n)
+	return n, err
+}
+
+// Domains returns the distinct domains of the users matching f with a
+// single DISTINCT query, in byte order like the memory store
+func (p *PostgresStore) Domains(ctx context.Context, f UserFilter) ([]string, error) {
+	where, args := filterClause(f)
+	rows, err := p.db.QueryContext(ctx, `SELECT DISTINCT lower(substring(email from '@([^@]*)$')) AS domain FROM users`+where+` ORDER BY domain COLLATE "C"`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	domains := []string{}
+	for rows.Next() {
+		var d sql.NullString
+		if err := rows.Scan(&d); err != nil {
+			return nil, err
+		}
+		if d.String != "" {
+			domains = append(domains, d.String)
+		}
+	}
+	return domains, rows.Err()
+}
+
+// ListPage fetches a single page with LIMIT and OFFSET, counting the
+// matches with a window function in the same query. Text columns sort
+// with the C collation, comparing bytes like the memory store does.
+func (p *PostgresStore) ListPage(ctx context.Context, f UserFilter, order UserSort, offset, limit int) ([]User, int, error) {
+	where, args := filterClause(f)
+	column, ok := sortColumns[order.Field]
+	if !ok {
+		column = "id"
+	}
+	if column == "name" || column == "email" {
+		column += ` COLLATE "C"`
+	}
+	direction := "ASC"
+	if order.Desc {
+		direction = "DESC"
+	}
+	orderBy := ` ORDER BY ` + column + ` ` + direction
+	if column != "id" {
+		orderBy += `, id ` + direction
+	}
+	offset = max(offset, 0)
+	// A NULL LIMIT is no limit
+	var pageLimit interface{}
+	if limit > 0 {
+		pageLimit = limit
+	}
+	args = append(args, pageLimit, offset)
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT `+userColumns+`, COUNT(*) OVER () FROM users`+where+orderBy+
+			fmt.Sprintf(` LIMIT $%d OFFSET $%d`, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	total := 0
+	for rows.Next() {
+		u, err := scanUser(extraScanner{rows, []interface{}{&total}})
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	// A page past the end has no rows to carry the count
+	if len(users) == 0 && offset > 0 {
+		if total, err = p.Count(ctx, f); err != nil {
+			return nil, 0, err
+		}
+	}
+	return users, total, nil
+}
+
+// Oldest returns the earliest created user matching f
+func (p *PostgresStore) Oldest(ctx context.Context, f UserFilter) (User, error) {
+	return p.boundary(ctx, f, "ASC")
+}
+
+// Newest returns the latest created user matching f
+func (p *PostgresStore) Newest(ctx context.Context, f UserFilter) (User, error) {
+	return p.boundary(ctx, f, "DESC")
+}
+
+// boundary fetches the first user matching f in created order, which
+// the users_created_idx index answers without a scan
+func (p *PostgresStore) boundary(ctx context.Context, f UserFilter, direction string) (User, error) {
+	where, args := filterClause(f)
+	row := p.db.QueryRowContext(ctx,
+		`SELECT `+userColumns+` FROM users`+where+` ORDER BY created `+direction+`, id `+direction+` LIMIT 1`, args...)
+	u, err := scanUser(row)
+	if err != nil {
+		return User{}, storeError(err)
+	}
+	return u, nil
+}
+
+// Modified approximates the last change time as the newest row
+// modification. Deletes are reflected through the changing count.
+func (p *PostgresStore) Modified(ctx context.Context) (time.Time, int, error) {
+	var modified time.Time
+	var count int
+	err := p.db.QueryRowContext(ctx,
+		`SELECT COALESCE(MAX(modified_at), 'epoch'::timestamptz), COUNT(*) FROM users`,
+	).Scan(&modified, &count)
+	return modified, count, err
+}
+
+// Ping checks that the database is reachable
+func (p *PostgresStore) Ping(ctx context.Context) error {
+	return p.db.PingContext(ctx)
+}
+
+// Close releases the database connection pool
+func (p *PostgresStore) Close() error {
+	return p.db.Close()
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordedQuery is a query run through a queryRecorder
+type recordedQuery struct {
+	query string
+	args  []interface{}
+}
+
+// queryRecorder is a database/sql connector whose connections record
+// every query and answer COUNT queries with 0 and anything else with no
+// rows, so the SQL a store issues can be checked without a database
+type queryRecorder struct {
+	mu      sync.Mutex
+	queries []recordedQuery
+}
+
+func (q *queryRecorder) Connect(ctx context.Context) (driver.Conn, error) {
+	return recorderConn{q}, nil
+}
+
+func (q *queryRecorder) Driver() driver.Driver { return nil }
+
+func (q *queryRecorder) recorded() []recordedQuery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]recordedQuery(nil), q.queries...)
+}
+
+type recorderConn struct{ rec *queryRecorder }
+
+func (c recorderConn) Prepare(query string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (c recorderConn) Close() error                              { return nil }
+func (c recorderConn) Begin() (driver.Tx, error)                 { return nil, driver.ErrSkip }
+
+func (c recorderConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	values := make([]interface{}, len(args))
+	for i, a := range args {
+		values[i] = a.Value
+	}
+	c.rec.mu.Lock()
+	c.rec.queries = append(c.rec.queries, recordedQuery{query, values})
+	c.rec.mu.Unlock()
+
+	if strings.HasPrefix(query, "SELECT COUNT(*) FROM") {
+		return &recorderRows{columns: []string{"count"}, values: [][]driver.Value{{int64(0)}}}, nil
+	}
+	return &recorderRows{}, nil
+}
+
+type recorderRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *recorderRows) Columns() []string { return r.columns }
+func (r *recorderRows) Close() error      { return nil }
+
+func (r *recorderRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func TestPostgresCountIssuesACountQuery(t *testing.T) {
+	rec := &queryRecorder{}
+	db := sql.OpenDB(rec)
+	defer db.Close()
+	store := &PostgresStore{db: db}
+
+	if _, err := store.Count(context.Background(), UserFilter{Q: "50%_off", Domain: "Example.com"}); err != nil {
+		t.Fatalf("Count: %v", err)
+	}
+	queries := rec.recorded()
+	if len(queries) != 1 {
+		t.Fatalf("Count ran %d queries, want 1: %v", len(queries), queries)
+	}
+	q := queries[0]
+	if !strings.HasPrefix(q.query, "SELECT COUNT(*) FROM users WHERE ") {
+		t.Errorf("Count query = %q, want a filtered SELECT COUNT(*) that selects no rows", q.query)
+	}
+	if len(q.args) != 2 || q.args[0] != `%50\%\_off%` || q.args[1] != "example.com" {
+		t.Errorf("Count args = %v, want the escaped text and lower-cased domain", q.args)
+	}
+}
+
+func TestPostgresBoundaryUsesOneOrderedRow(t *testing.T) {
+	rec := &queryRecorder{}
+	db := sql.OpenDB(rec)
+	defer db.Close()
+	store := &PostgresStore{db: db}
+
+	if _, err := store.Oldest(context.Background(), UserFilter{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Oldest on no rows = %v, want ErrNotFound", err)
+	}
+	if _, err := store.Newest(context.Background(), UserFilter{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Newest on no rows = %v, want ErrNotFound", err)
+	}
+	queries := rec.recorded()
+	if len(queries) != 2 {
+		t.Fatalf("ran %d queries, want 2: %v", len(queries), queries)
+	}
+	for i, want := range []string{"ORDER BY created ASC, id ASC LIMIT 1", "ORDER BY created DESC, id DESC LIMIT 1"} {
+		if !strings.HasSuffix(queries[i].query, want) {
+			t.Errorf("query %d = %q, want it to end %q", i, queries[i].query, want)
+		}
+	}
+}
+
+func TestPostgresListPageQueriesOnePage(t *testing.T) {
+	rec := &queryRecorder{}
+	db := sql.OpenDB(rec)
+	defer db.Close()
+	store := &PostgresStore{db: db}
+
+	if _, _, err := store.ListPage(context.Background(), UserFilter{Domain: "example.com"}, UserSort{Field: "name", Desc: true}, 40, 20); err != nil {
+		t.Fatalf("ListPage: %v", err)
+	}
+	queries := rec.recorded()
+	if len(queries) == 0 {
+		t.Fatal("ListPage ran no query")
+	}
+	page := queries[0]
+	for _, want := range []string{"WHERE ", `ORDER BY name COLLATE "C" DESC, id DESC`, "LIMIT $2 OFFSET $3", "COUNT(*) OVER ()"} {
+		if !strings.Contains(page.query, want) {
+			t.Errorf("page query doesn't contain %q:\n%s", want, page.query)
+		}
+	}
+	if n := len(page.args); n != 3 || page.args[1] != int64(20) || page.args[2] != int64(40) {
+		t.Errorf("page query args = %v, want the filter then limit 20 and offset 40", page.args)
+	}
+	// The page was past the end, so the total is counted separately
+	if len(queries) != 2 || !strings.HasPrefix(queries[1].query, "SELECT COUNT(*) FROM users WHERE ") {
+		t.Errorf("queries after an empty page = %v, want the page query then a filtered count", queries)
+	}
+}
+
+func TestPostgresListPageWithoutLimitHasNoRowCap(t *testing.T) {
+	rec := &queryRecorder{}
+	db := sql.OpenDB(rec)
+	defer db.Close()
+	store := &PostgresStore{db: db}
+
+	if _, _, err := store.ListPage(context.Background(), UserFilter{}, UserSort{}, 0, 0); err != nil {
+		t.Fatalf("ListPage: %v", err)
+	}
+	queries := rec.recorded()
+	if len(queries) != 1 || queries[0].args[0] != nil {
+		t.Errorf("queries = %v, want one with a NULL limit", queries)
+	}
+}
+
+func TestCursorPagesAreQueriedInThePostgresStore(t *testing.T) {
+	rec := &queryRecorder{}
+	db := sql.OpenDB(rec)
+	defer db.Close()
+	srv := newTestServer(t)
+	srv.store = &PostgresStore{db: db}
+
+	path := "/api/v1/users?limit=25&cursor=" + encodeCursor(40)
+	decodeResponse(t, do(http.HandlerFunc(srv.getUsersHandler), "GET", path, ""), http.StatusOK)
+	queries := rec.recorded()
+	if len(queries) == 0 {
+		t.Fatal("cursor page ran no query")
+	}
+	page := queries[0]
+	for _, want := range []string{"id >= $1", "LIMIT $2 OFFSET $3"} {
+		if !strings.Contains(page.query, want) {
+			t.Errorf("cursor page query doesn't contain %q:\n%s", want, page.query)
+		}
+	}
+	if len(page.args) != 3 || page.args[0] != int64(41) || page.args[1] != int64(25) || page.args[2] != int64(0) {
+		t.Errorf("cursor page query args = %v, want IDs from 41, limit 25 and offset 0", page.args)
+	}
+}
+
+func TestStatsEndpointsQueryThePostgresStoreWithoutListing(t *testing.T) {
+	rec := &queryRecorder{}
+	db := sql.OpenDB(rec)
+	defer db.Close()
+	srv := newTestServer(t)
+	srv.store = &PostgresStore{db: db}
+
+	decodeResponse(t, do(http.HandlerFunc(srv.getMonthlyStatsHandler), "GET", "/api/v1/users/stats/monthly?months=3", ""), http.StatusOK)
+	queries := rec.recorded()
+	if len(queries) != 3 {
+		t.Fatalf("monthly stats ran %d queries, want a count per month: %v", len(queries), queries)
+	}
+	for _, q := range queries {
+		if !strings.HasPrefix(q.query, "SELECT COUNT(*) FROM users WHERE created >= $1 AND created < $2") {
+			t.Errorf("monthly stats query = %q, want a count of one month's users", q.query)
+		}
+	}
+
+	decodeResponse(t, do(http.HandlerFunc(srv.getDomainsHandler), "GET", "/api/v1/users/domains", ""), http.StatusOK)
+	queries = rec.recorded()[3:]
+	if len(queries) != 1 || !strings.HasPrefix(queries[0].query, "SELECT DISTINCT lower(") {
+		t.Errorf("domains queries = %v, want one SELECT DISTINCT of the domains", queries)
+	}
+}
+
+func TestBatchGetByEmailQueriesOnlyTheRequestedEmails(t *testing.T) {
+	rec := &queryRecorder{}
+	db := sql.OpenDB(rec)
+	defer db.Close()
+	srv := newTestServer(t)
+	srv.store = &PostgresStore{db: db}
+
+	body := `{"emails":["Ann@Example.com","nobody@example.com"]}`
+	decodeResponse(t, do(http.HandlerFunc(srv.batchGetUsersByEmailHandler), "POST", "/api/v1/users/batch-get-by-email", body), http.StatusOK)
+	queries := rec.recorded()
+	if len(queries) != 1 || !strings.HasSuffix(queries[0].query, "FROM users WHERE email_key = ANY($1)") {
+		t.Fatalf("queries = %v, want one lookup by email key", queries)
+	}
+	if keys := fmt.Sprint(queries[0].args[0]); !strings.Contains(keys, "ann@example.com") || !strings.Contains(keys, "nobody@example.com") {
+		t.Errorf("looked up %s, want the lower-cased requested emails", keys)
+	}
+}
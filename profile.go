@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values accepted by ERROR_FORMAT, JSON_CASE and ID_FORMAT
+const (
+	errorFormatEnvelope = "envelope"
+	errorFormatProblem  = "problem"
+
+	jsonCaseSnake = "snake"
+	jsonCaseCamel = "camel"
+
+	idFormatNumber = "number"
+	idFormatString = "string"
+)
+
+// problemContentType is the media type of RFC 9457 problem details
+const problemContentType = "application/problem+json"
+
+// apiProfile is a coherent set of response format defaults selected with
+// API_PROFILE. Each setting can still be overridden on its own.
+type apiProfile struct {
+	ErrorFormat string
+	JSONCase    string
+	IDFormat    string
+	TimeFormat  string
+}
+
+// apiProfiles are the profiles API_PROFILE accepts. legacy is the
+// original response format.
+var apiProfiles = map[string]apiProfile{
+	"legacy": {ErrorFormat: errorFormatEnvelope, JSONCase: jsonCaseSnake, IDFormat: idFormatNumber, TimeFormat: timeFormatRFC3339},
+	"strict": {ErrorFormat: errorFormatProblem, JSONCase: jsonCaseCamel, IDFormat: idFormatString, TimeFormat: timeFormatRFC3339},
+}
+
+// checkResponseFormat validates the ERROR_FORMAT, JSON_CASE and ID_FORMAT
+// values in cfg
+func checkResponseFormat(cfg Config) error {
+	switch {
+	case cfg.ErrorFormat != errorFormatEnvelope && cfg.ErrorFormat != errorFormatProblem:
+		return fmt.Errorf("ERROR_FORMAT must be envelope or problem, got %q", cfg.ErrorFormat)
+	case cfg.JSONCase != jsonCaseSnake && cfg.JSONCase != jsonCaseCamel:
+		return fmt.Errorf("JSON_CASE must be snake or camel, got %q", cfg.JSONCase)
+	case cfg.IDFormat != idFormatNumber && cfg.IDFormat != idFormatString:
+		return fmt.Errorf("ID_FORMAT must be number or string, got %q", cfg.IDFormat)
+	}
+	return nil
+}
+
+// responseFormat is how responses are encoded: the configured
+// ERROR_FORMAT, JSON_CASE, ID_FORMAT and TIME_FORMAT plus the FIELD_ALIASES
+// renames selected for the request. The zero value is the legacy format.
+type responseFormat struct {
+	ErrorFormat string
+	JSONCase    string
+	IDFormat    string
+	TimeFormat  string
+	Aliases     map[string]string
+}
+
+// newResponseFormat returns the response format configured in cfg
+func newResponseFormat(cfg Config) responseFormat {
+	return responseFormat{ErrorFormat: cfg.ErrorFormat, JSONCase: cfg.JSONCase, IDFormat: cfg.IDFormat, TimeFormat: cfg.TimeFormat}
+}
+
+// responseFormatFrom returns the format responses to the request in ctx
+// are encoded in
+func responseFormatFrom(ctx context.Context) responseFormat {
+	f, _ := ctx.Value(responseFormatKey).(responseFormat)
+	return f
+}
+
+// streamed returns f for streamed exports, which keep snake_case keys and
+// aren't renamed but still format IDs and timestamps
+func (f responseFormat) streamed() responseFormat {
+	f.JSONCase, f.Aliases = "", nil
+	return f
+}
+
+// plain reports whether f encodes values exactly as encoding/json does
+func (f responseFormat) plain() bool {
+	return f.JSONCase != jsonCaseCamel && f.IDFormat != idFormatString &&
+		(f.TimeFormat == "" || f.TimeFormat == timeFormatRFC3339) && len(f.Aliases) == 0
+}
+
+// id returns a user ID as it appears in a response encoded in f
+func (f responseFormat) id(id int) interface{} {
+	if f.IDFormat == idFormatString {
+		return strconv.Itoa(id)
+	}
+	return id
+}
+
+// idKeys are the object keys holding user, event or audit entry IDs, or
+// lists of them. ID_FORMAT applies to all of them.
+var idKeys = map[string]bool{
+	"id":           true,
+	"ids":          true,
+	"user_id":      true,
+	"primary_id":   true,
+	"duplicate_id": true,
+	"id_from":      true,
+	"id_to":        true,
+	"not_found":    true,
+}
+
+// userTimeKeys are the user fields TIME_FORMAT applies to
+var userTimeKeys = map[string]bool{"created": true, "updated_at": true, "deleted_at": true}
+
+// encode returns the JSON encoding of v in f. Values are marshaled as
+// usual, then IDs, user timestamps and keys are rewritten when f differs
+// from the legacy format.
+func (f responseFormat) encode(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || f.plain() {
+		return data, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var decoded interface{}
+	if err := dec.Decode(&decoded); err != nil {
+		return nil, err
+	}
+	return json.Marshal(f.convert(decoded))
+}
+
+// isUserObject reports whether m is an encoded user, one with an id whose
+// other keys are all user fields. An expanded user may also carry stats.
+func isUserObject(m map[string]interface{}) bool {
+	if _, ok := m["id"]; !ok {
+		return false
+	}
+	for k := range m {
+		if !userFieldNames[k] && k != "stats" {
+			return false
+		}
+	}
+	return true
+}
+
+// convert rewrites a decoded JSON value in f. Metadata maps hold client
+// chosen keys and values and are left alone. FIELD_ALIASES renames only
+// apply to the keys of user objects.
+func (f responseFormat) convert(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		user := isUserObject(v)
+		converted := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			switch {
+			case k == "metadata":
+			case idKeys[k]:
+				child = f.convertID(child)
+			case user && userTimeKeys[k]:
+				child = f.convertTime(child)
+			default:
+				child = f.convert(child)
+			}
+			converted[f.key(k, user)] = child
+		}
+		return converted
+	case []interface{}:
+		for i, child := range v {
+			v[i] = f.convert(child)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// key returns the name key is written under
+func (f responseFormat) key(k string, user bool) string {
+	if alias, ok := f.Aliases[k]; ok && user {
+		return alias
+	}
+	if f.JSONCase == jsonCaseCamel {
+		return snakeToCamel(k)
+	}
+	return k
+}
+
+// convertID writes a decoded ID, or list of IDs, in the ID_FORMAT
+func (f responseFormat) convertID(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if f.IDFormat == idFormatString {
+			return v.String()
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = f.convertID(child)
+		}
+	}
+	return v
+}
+
+// convertTime writes a decoded RFC 3339 timestamp in the TIME_FORMAT
+func (f responseFormat) convertTime(v interface{}) interface{} {
+	raw, ok := v.(string)
+	if !ok {
+		return v
+	}
+	t, err := time.Parse(time.RFC3339Nano, raw)
+	if err != nil {
+		return v
+	}
+	switch f.TimeFormat {
+	case timeFormatUnix:
+		return t.Unix()
+	case timeFormatUnixMs:
+		return t.UnixMilli()
+	}
+	return v
+}
+
+// jsonID is a user ID in a request body. It may be sent as a number or,
+// as ID_FORMAT=string responses show it, a string of digits.
+type jsonID int
+
+func (id *jsonID) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("user ID %q is not a number", s)
+		}
+		*id = jsonID(n)
+		return nil
+	}
+	var n int
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*id = jsonID(n)
+	return nil
+}
+
+// snakeToCamel converts a snake_case name such as next_cursor to
+// nextCursor
+func snakeToCamel(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// writeProblem writes an error response as RFC 9457 problem details. The
+// Data of the response, such as validation errors, becomes extension
+// members.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, response Response) {
+	def := lookupError(response.Code)
+	problem := map[string]interface{}{}
+	if response.Data != nil {
+		// Objects are merged in, anything else is kept under data
+		data, err := json.Marshal(response.Data)
+		if err != nil || json.Unmarshal(data, &problem) != nil {
+			problem = map[string]interface{}{"data": response.Data}
+		}
+	}
+	problem["type"] = apiPrefix + "/errors#" + string(response.Code)
+	problem["title"] = def.Message
+	problem["status"] = status
+	problem["detail"] = response.Message
+	problem["code"] = response.Code
+	problem["instance"] = r.URL.Path
+	if id := requestIDFrom(r.Context()); id != "" {
+		problem["request_id"] = id
+	}
+	writeEncoded(w, r, status, problemContentType, problem)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestStrictProfileChangesErrorsAndIDsTogether(t *testing.T) {
+	cfg := testConfig(t, "API_PROFILE=strict")
+	srv, err := NewServer(cfg, NewMemoryStore(nil))
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	h := srv.Handler()
+
+	rec := do(h, "GET", "/api/v1/users/404", "")
+	if ct := rec.Header().Get("Content-Type"); rec.Code != http.StatusNotFound || ct != problemContentType {
+		t.Fatalf("missing user: %d with Content-Type %q, want a 404 %s", rec.Code, ct, problemContentType)
+	}
+	var problem map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem["status"] != float64(http.StatusNotFound) || problem["code"] != string(CodeUserNotFound) {
+		t.Errorf("problem = %v, want the status and error code", problem)
+	}
+
+	rec = do(h, "POST", "/api/v1/users", `{"name":"Ann","email":"ann@example.com"}`)
+	var created struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if string(created.Data["id"]) != `"1"` {
+		t.Errorf("id = %s, want the string \"1\"", created.Data["id"])
+	}
+	if _, ok := created.Data["emailVerified"]; !ok {
+		t.Errorf("user keys = %v, want camelCase emailVerified", created.Data)
+	}
+
+	// IDs shown as strings are accepted back as strings, and every ID in
+	// the response is a string too
+	rec = do(h, "POST", "/api/v1/users/batch-get", `{"ids":["1","2"]}`)
+	var found struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &found); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("batch get with string IDs: %d %s", rec.Code, rec.Body)
+	}
+	if got := string(found.Data["notFound"]); got != `["2"]` {
+		t.Errorf("notFound = %s, want the string IDs [\"2\"]", got)
+	}
+}
+
+func TestProfileSettingsCanBeOverridden(t *testing.T) {
+	legacy := testConfig(t)
+	if legacy.ErrorFormat != errorFormatEnvelope || legacy.JSONCase != jsonCaseSnake || legacy.IDFormat != idFormatNumber {
+		t.Errorf("default profile = %s/%s/%s, want the legacy envelope, snake case and numeric IDs", legacy.ErrorFormat, legacy.JSONCase, legacy.IDFormat)
+	}
+
+	cfg := testConfig(t, "API_PROFILE=strict", "ID_FORMAT=number")
+	if cfg.ErrorFormat != errorFormatProblem || cfg.IDFormat != idFormatNumber {
+		t.Errorf("strict with ID_FORMAT=number = %s/%s, want problem errors and numeric IDs", cfg.ErrorFormat, cfg.IDFormat)
+	}
+
+	t.Setenv("API_PROFILE", "loose")
+	if _, err := loadConfig(); err == nil {
+		t.Error("API_PROFILE=loose loaded, want an error")
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterClients tracks how many clients currently have a limiter
+var rateLimiterClients = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "rate_limiter_clients",
+	Help: "Number of client IPs and tenants tracked by the rate limiter.",
+})
+
+// rateSpec is a token bucket's refill rate per second and burst size
+type rateSpec struct {
+	Rate  float64
+	Burst int
+}
+
+// limiterEntry is a client's token bucket and when it was last used
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// ipRateLimiter keeps a token bucket per client, keyed by IP or tenant.
+// Buckets idle for longer than ttl are removed by the janitor so the map
+// can't grow without bound.
+type ipRateLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*limiterEntry
+	limit    rate.Limit
+	burst    int
+	ttl      time.Duration
+
+	// overrides replace the default rate for specific keys
+	overrides map[string]rateSpec
+}
+
+// newIPRateLimiter returns a limiter allowing each IP perSecond requests
+// per second with the given burst, forgetting IPs idle for ttl
+func newIPRateLimiter(perSecond float64, burst int, ttl time.Duration) *ipRateLimiter {
+	return &ipRateLimiter{
+		limiters: make(map[string]*limiterEntry),
+		limit:    rate.Limit(perSecond),
+		burst:    burst,
+		ttl:      ttl,
+
+		overrides: make(map[string]rateSpec),
+	}
+}
+
+// setLimit gives the bucket for key its own rate instead of the default
+func (l *ipRateLimiter) setLimit(key string, spec rateSpec) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.overrides[key] = spec
+}
+
+// get returns the limiter for key, creating it on first use. It returns
+// nil when key is unlimited: no default rate and no override.
+func (l *ipRateLimiter) get(key string, now time.Time) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.limiters[key]
+	if !ok {
+		limit, burst := l.limit, l.burst
+		if spec, ok := l.overrides[key]; ok {
+			limit, burst = rate.Limit(spec.Rate), spec.Burst
+		}
+		if limit == 0 {
+			return nil
+		}
+		entry = &limiterEntry{limiter: rate.NewLimiter(limit, burst)}
+		l.limiters[key] = entry
+		rateLimiterClients.Set(float64(len(l.limiters)))
+	}
+	entry.lastSeen = now
+	return entry.limiter
+}
+
+// size returns the number of tracked IPs
+func (l *ipRateLimiter) size() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.limiters)
+}
+
+// cleanup removes limiters that have been idle for longer than the TTL
+func (l *ipRateLimiter) cleanup(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ip, entry := range l.limiters {
+		if now.Sub(entry.lastSeen) > l.ttl {
+			delete(l.limiters, ip)
+		}
+	}
+	rateLimiterClients.Set(float64(len(l.limiters)))
+}
+
+// runJanitor periodically removes idle limiters until ctx is cancelled
+func (l *ipRateLimiter) runJanitor(ctx context.Context, interval time.Duration, now func() time.Time) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.cleanup(now())
+		}
+	}
+}
+
+// reserveToken takes a token from limiter without waiting, returning the
+// delay until one is available when the bucket is empty
+func reserveToken(limiter *rate.Limiter, now time.Time) (time.Duration, bool) {
+	return reserveTokens([]*rate.Limiter{limiter}, now)
+}
+
+// reserveTokens takes a token from every limiter or from none of them.
+// When any bucket is empty the tokens taken from the others are given
+// back, and the longest delay until all have one is returned.
+func reserveTokens(limiters []*rate.Limiter, now time.Time) (time.Duration, bool) {
+	var delay time.Duration
+	taken := make([]*rate.Reservation, 0, len(limiters))
+	for _, limiter := range limiters {
+		res := limiter.ReserveN(now, 1)
+		if !res.OK() {
+			delay = max(delay, time.Second)
+			continue
+		}
+		taken = append(taken, res)
+		delay = max(delay, res.DelayFrom(now))
+	}
+	if delay > 0 {
+		for _, res := range taken {
+			res.CancelAt(now)
+		}
+		return delay, false
+	}
+	return 0, true
+}
+
+// rateLimitState is a client's token bucket as reported back to it
+type rateLimitState struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+// bucketState returns the state of limiter at now without taking a token.
+// Reset is when the bucket will be full again.
+func bucketState(limiter *rate.Limiter, now time.Time) rateLimitState {
+	tokens := limiter.TokensAt(now)
+	state := rateLimitState{Limit: limiter.Burst(), Remaining: int(math.Max(0, math.Floor(tokens))), Reset: now}
+	if missing := float64(state.Limit) - tokens; missing > 0 && limiter.Limit() > 0 {
+		state.Reset = now.Add(time.Duration(missing / float64(limiter.Limit()) * float64(time.Second)))
+	}
+	return state
+}
+
+// setRateLimitHeaders reports state in the X-RateLimit-* headers. The
+// reset time is a Unix timestamp in seconds, rounded up.
+func setRateLimitHeaders(w http.ResponseWriter, state rateLimitState) {
+	reset := state.Reset.Unix()
+	if state.Reset.Nanosecond() > 0 {
+		reset++
+	}
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(state.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(state.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+}
+
+// clientIP returns the IP address of the client that sent r
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tenantBucket returns the limiter key for a tenant. The prefix keeps
+// tenant keys apart from IP addresses.
+func tenantBucket(tenant string) string {
+	return "tenant:" + tenant
+}
+
+// rateBucket is one of the token buckets a request is charged to, and
+// whether it belongs to the client IP or its tenant
+type rateBucket struct {
+	scope   string
+	limiter *rate.Limiter
+}
+
+// rateBuckets returns the limited buckets r is charged to. The client IP
+// is always charged, and with RATE_LIMIT_KEY=tenant so is the tenant
+// tenantContext recorded. Tenants aren't authenticated, so charging the IP
+// as well keeps a client from escaping its limit by naming a fresh tenant.
+func (s *Server) rateBuckets(r *http.Request, now time.Time) []rateBucket {
+	var buckets []rateBucket
+	if limiter := s.limiter.get(clientIP(r), now); limiter != nil {
+		buckets = append(buckets, rateBucket{scope: "ip", limiter: limiter})
+	}
+	if tenant := tenantFrom(r.Context()); s.cfg.RateLimitKey == "tenant" && tenant != "" {
+		if limiter := s.limiter.get(tenantBucket(tenant), now); limiter != nil {
+			buckets = append(buckets, rateBucket{scope: "tenant", limiter: limiter})
+		}
+	}
+	return buckets
+}
+
+// tightestBucket returns the bucket in buckets with the fewest tokens
+// left, and its state
+func tightestBucket(buckets []rateBucket, now time.Time) (rateBucket, rateLimitState) {
+	tightest, state := buckets[0], bucketState(buckets[0].limiter, now)
+	for _, b := range buckets[1:] {
+		if st := bucketState(b.limiter, now); st.Remaining < state.Remaining ||
+			(st.Remaining == state.Remaining && st.Reset.After(state.Reset)) {
+			tightest, state = b, st
+		}
+	}
+	return tightest, state
+}
+
+// writeRetryError writes an error response telling the client when it may
+// retry, both in the Retry-After header and the response body
+func writeRetryError(w http.ResponseWriter, r *http.Request, code ErrorCode, message string, retryAfter time.Duration) {
+	seconds := setRetryAfter(w, retryAfter)
+	def := lookupError(code)
+	writeJSON(w, r, def.Status, Response{
+		Status:  "error",
+		Code:    code,
+		Message: fmt.Sprintf("%s, retry after %d seconds", message, seconds),
+		Data:    map[string]int{"retry_after_seconds": seconds},
+	})
+}
+
+// setRetryAfter sets the Retry-After header to retryAfter, rounded up to
+// whole seconds and at least one, and returns the seconds it sent
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration) int {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	return seconds
+}
+
+// globalRateLimit rejects requests once the whole server exceeds
+// GLOBAL_RATE, whichever client sent them
+func (s *Server) globalRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if probePaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if delay, ok := reserveToken(s.globalLimiter, s.now()); !ok {
+			writeRetryError(w, r, CodeRateLimited, "Server is over its request budget", delay)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimit rejects requests from clients that exceed their per-IP or
+// per-tenant rate
+func (s *Server) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if probePaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		now := s.now()
+		buckets := s.rateBuckets(r, now)
+		if len(buckets) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limiters := make([]*rate.Limiter, len(buckets))
+		for i, b := range buckets {
+			limiters[i] = b.limiter
+		}
+		delay, ok := reserveTokens(limiters, now)
+		_, state := tightestBucket(buckets, now)
+		setRateLimitHeaders(w, state)
+		if !ok {
+			writeRetryError(w, r, CodeRateLimited, "Rate limit exceeded", delay)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitHandler reports the calling client's tightest bucket: how many
+// requests it has left and when the bucket is full again. The request
+// itself is charged like any other, so the figures include it.
+func (s *Server) rateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	now := s.now()
+	buckets := s.rateBuckets(r, now)
+	if len(buckets) == 0 {
+		writeJSON(w, r, http.StatusOK, Response{
+			Status:  "success",
+			Message: "Rate limit retrieved successfully",
+			Data:    map[string]interface{}{"limited": false},
+		})
+		return
+	}
+
+	bucket, state := tightestBucket(buckets, now)
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "Rate limit retrieved successfully",
+		Data: map[string]interface{}{
+			"limited":       true,
+			"scope":         bucket.scope,
+			"limit":         state.Limit,
+			"rate":          float64(bucket.limiter.Limit()),
+			"remaining":     state.Remaining,
+			"reset_at":      state.Reset.UTC(),
+			"reset_seconds": int(math.Ceil(state.Reset.Sub(now).Seconds())),
+		},
+	})
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// checkRetryAfter fails the test unless rec carries a Retry-After header
+// of whole seconds, repeated as retry_after_seconds in the body
+func checkRetryAfter(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	seconds, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if err != nil || seconds < 1 {
+		t.Fatalf("Retry-After = %q, want a positive number of seconds", rec.Header().Get("Retry-After"))
+	}
+	var data struct {
+		RetryAfterSeconds int `json:"retry_after_seconds"`
+	}
+	decodeData(t, decodeResponse(t, rec, status), &data)
+	if data.RetryAfterSeconds != seconds {
+		t.Errorf("retry_after_seconds = %d, want the header's %d", data.RetryAfterSeconds, seconds)
+	}
+}
+
+func TestThrottledRequestsCarryRetryAfter(t *testing.T) {
+	srv := newTestServer(t, "RATE_LIMIT=0.5", "RATE_BURST=1")
+	srv.now = newFakeClock().now
+	h := srv.rateLimit(http.HandlerFunc(srv.getUsersHandler))
+
+	decodeResponse(t, do(h, "GET", "/api/v1/users", ""), http.StatusOK)
+	rec := do(h, "GET", "/api/v1/users", "")
+	checkRetryAfter(t, rec, http.StatusTooManyRequests)
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %s, want the 2 seconds until the next token", got)
+	}
+}
+
+func TestUnavailableResponsesCarryRetryAfter(t *testing.T) {
+	t.Run("store", func(t *testing.T) {
+		srv := newTestServer(t)
+		srv.store = undeletableStore{NewMemoryStore(nil)}
+		u := createTestUser(t, srv.store, "stuck")
+		checkRetryAfter(t, do(srv.Handler(), "DELETE", "/api/v1/users/"+strconv.Itoa(u.ID), ""), http.StatusServiceUnavailable)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		srv := newTestServer(t, "REQUEST_TIMEOUT=5ms")
+		slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		})
+		checkRetryAfter(t, do(srv.timeout(slow), "GET", "/api/v1/users", ""), http.StatusServiceUnavailable)
+	})
+
+	t.Run("mx", func(t *testing.T) {
+		srv := newTestServer(t, "EMAIL_MX_CHECK=true")
+		srv.resolver = fakeResolver{err: errors.New("resolver unreachable")}
+		checkRetryAfter(t, do(srv.Handler(), "POST", "/api/v1/users", `{"name":"Unknown","email":"d@mail.example"}`), http.StatusServiceUnavailable)
+	})
+}
+
+func TestFullEventHubCarriesRetryAfter(t *testing.T) {
+	srv := newTestServer(t, "MAX_SUBSCRIBERS=1")
+	sub, _ := srv.events.Subscribe()
+	defer srv.events.Unsubscribe(sub)
+
+	checkRetryAfter(t, do(http.HandlerFunc(srv.eventsHandler), "GET", "/api/v1/events", ""), http.StatusServiceUnavailable)
+}
+
+func TestIPRateLimiterConcurrentClients(t *testing.T) {
+	l := newIPRateLimiter(10, 5, time.Minute)
+	start := time.Now()
+
+	const clients = 64
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ip := fmt.Sprintf("10.0.0.%d", i)
+			for j := 0; j < 50; j++ {
+				limiter := l.get(ip, start)
+				if limiter == nil {
+					t.Errorf("get(%s) returned no limiter", ip)
+					return
+				}
+				limiter.Allow()
+				l.cleanup(start)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := l.size(); n != clients {
+		t.Errorf("size = %d, want %d", n, clients)
+	}
+}
+
+func TestIPRateLimiterJanitorForgetsIdleClients(t *testing.T) {
+	l := newIPRateLimiter(10, 5, time.Minute)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		l.get(fmt.Sprintf("10.0.0.%d", i), start)
+	}
+	l.get("10.0.1.1", start.Add(2*time.Minute))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	later := func() time.Time { return start.Add(2 * time.Minute) }
+	go l.runJanitor(ctx, time.Millisecond, later)
+
+	deadline := time.Now().Add(time.Second)
+	for l.size() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("size = %d after the janitor ran, want only the active client left", l.size())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGlobalRateLimitThrottlesAcrossClients(t *testing.T) {
+	srv := newTestServer(t, "GLOBAL_RATE=1", "GLOBAL_BURST=3")
+	h := srv.Handler()
+
+	var statuses []int
+	for i := 0; i < 5; i++ {
+		r := newTestRequest("GET", "/api/v1/users", nil)
+		r.RemoteAddr = fmt.Sprintf("10.0.0.%d:1234", i+1)
+		statuses = append(statuses, serve(h, r).Code)
+	}
+	want := []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests}
+	for i := range want {
+		if statuses[i] != want[i] {
+			t.Fatalf("statuses from 5 clients = %v, want %v", statuses, want)
+		}
+	}
+	checkRetryAfter(t, serve(h, newTestRequest("GET", "/api/v1/users", nil)), http.StatusTooManyRequests)
+}
+
+func TestTenantRateLimitBucketsAreIndependent(t *testing.T) {
+	srv := newTestServer(t, "MULTI_TENANT=true", "RATE_LIMIT_KEY=tenant", "RATE_LIMIT=1", "RATE_BURST=2",
+		"TENANT_RATE_LIMITS=acme=1:1")
+	srv.now = newFakeClock().now
+	h := srv.Handler()
+	// Each request comes from a fresh IP, so only the tenant buckets can
+	// throttle it
+	clients := 0
+	request := func(tenant string) int {
+		clients++
+		r := newTestRequest("GET", "/api/v1/users", nil)
+		r.RemoteAddr = fmt.Sprintf("10.0.0.%d:1234", clients)
+		r.Header.Set("X-Tenant-ID", tenant)
+		return serve(h, r).Code
+	}
+
+	if got := []int{request("acme"), request("acme")}; got[0] != http.StatusOK || got[1] != http.StatusTooManyRequests {
+		t.Fatalf("acme statuses = %v, want its burst of 1 then 429", got)
+	}
+	// acme's empty bucket doesn't hold back globex, which gets the
+	// default burst
+	for i := 0; i < 2; i++ {
+		if code := request("globex"); code != http.StatusOK {
+			t.Fatalf("globex request %d = %d, want 200", i+1, code)
+		}
+	}
+	if code := request("globex"); code != http.StatusTooManyRequests {
+		t.Errorf("globex request past its burst = %d, want 429", code)
+	}
+
+	// Without a tenant the client IP is charged instead
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		r := newTestRequest("GET", "/api/v1/users", nil)
+		r.RemoteAddr = "10.0.1.1:1234"
+		if code := serve(h, r).Code; code != want {
+			t.Errorf("tenantless request %d = %d, want %d", i+1, code, want)
+		}
+	}
+}
+func TestRateLimitHeadersCountDown(t *testing.T) {
+	srv := newTestServer(t, "RATE_LIMIT=1", "RATE_BURST=3")
+	clock := newFakeClock()
+	srv.now = clock.now
+	h := srv.Handler()
+
+	for want := 2; want >= 0; want-- {
+		rec := do(h, "GET", "/api/v1/users", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d with %d requests left, want 200", rec.Code, want+1)
+		}
+		if got := rec.Header().Get("X-RateLimit-Limit"); got != "3" {
+			t.Errorf("X-RateLimit-Limit = %q, want 3", got)
+		}
+		if got := rec.Header().Get("X-RateLimit-Remaining"); got != strconv.Itoa(want) {
+			t.Errorf("X-RateLimit-Remaining = %q, want %d", got, want)
+		}
+		if got := rec.Header().Get("X-RateLimit-Reset"); got == "" {
+			t.Error("X-RateLimit-Reset not set")
+		}
+	}
+	rec := do(h, "GET", "/api/v1/users", "")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("request past the burst: status %d, remaining %q; want 429 with 0", rec.Code, rec.Header().Get("X-RateLimit-Remaining"))
+	}
+
+	// A second later one token is back, and the lookup itself spends it
+	clock.advance(time.Second)
+	var state struct {
+		Limited   bool `json:"limited"`
+		Remaining int  `json:"remaining"`
+	}
+	decodeData(t, decodeResponse(t, do(h, "GET", "/api/v1/rate-limit", ""), http.StatusOK), &state)
+	if !state.Limited || state.Remaining != 0 {
+		t.Errorf("rate-limit state = %+v, want limited with 0 remaining", state)
+	}
+}
+
+func TestFreshTenantsDontEscapeTheIPLimit(t *testing.T) {
+	srv := newTestServer(t, "MULTI_TENANT=true", "RATE_LIMIT_KEY=tenant", "RATE_LIMIT=1", "RATE_BURST=2")
+	srv.now = newFakeClock().now
+	h := srv.Handler()
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		r := newTestRequest("GET", "/api/v1/users", nil)
+		r.RemoteAddr = "10.0.2.1:1234"
+		r.Header.Set("X-Tenant-ID", fmt.Sprintf("tenant-%d", i))
+		if code := serve(h, r).Code; code != want {
+			t.Errorf("request %d under a fresh tenant = %d, want %d", i+1, code, want)
+		}
+	}
+}
+
+func TestProbesAreExemptFromTheRateLimits(t *testing.T) {
+	srv := newTestServer(t, "RATE_LIMIT=1", "RATE_BURST=1", "GLOBAL_RATE=1", "GLOBAL_BURST=1")
+	srv.now = newFakeClock().now
+	h := srv.Handler()
+
+	decodeResponse(t, do(h, "GET", "/api/v1/users", ""), http.StatusOK)
+	decodeResponse(t, do(h, "GET", "/api/v1/users", ""), http.StatusTooManyRequests)
+	for _, path := range []string{"/api/v1/health", "/readyz", "/metrics"} {
+		for i := 0; i < 3; i++ {
+			if code := do(h, "GET", path, "").Code; code == http.StatusTooManyRequests {
+				t.Errorf("%s request %d throttled, want probes exempt", path, i+1)
+			}
+		}
+	}
+}
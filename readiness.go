@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readinessCheckTimeout bounds a single dependency check
+const readinessCheckTimeout = 2 * time.Second
+
+// Pinger is implemented by stores that depend on an external service and
+// can check that it is reachable
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// errRecovering is reported while a passing check is still within the
+// cool-down after a failure
+var errRecovering = errors.New("recovering from a failed check")
+
+// readinessChecker caches the result of the dependency check so frequent
+// probes don't each hit the database. After a failure it keeps reporting
+// not ready until cooldown has passed, so a flapping dependency doesn't
+// flap the probe with it.
+type readinessChecker struct {
+	mu       sync.Mutex
+	check    func(ctx context.Context) error
+	ttl      time.Duration
+	cooldown time.Duration
+	checked  time.Time
+	failed   time.Time
+	err      error
+}
+
+// newReadinessChecker returns a checker running check at most once per
+// ttl. A ttl of 0 checks on every call, and a cooldown of 0 reports ready
+// as soon as a check passes.
+func newReadinessChecker(check func(ctx context.Context) error, ttl, cooldown time.Duration) *readinessChecker {
+	return &readinessChecker{check: check, ttl: ttl, cooldown: cooldown}
+}
+
+// Result returns the last check result while it is younger than the TTL,
+// running the check again otherwise
+func (c *readinessChecker) Result(ctx context.Context, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ttl > 0 && !c.checked.IsZero() && now.Sub(c.checked) < c.ttl {
+		return c.resultLocked(now)
+	}
+	return c.refreshLocked(ctx, now)
+}
+
+// refresh runs the check and caches its result
+func (c *readinessChecker) refresh(ctx context.Context, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.refreshLocked(ctx, now)
+}
+
+func (c *readinessChecker) refreshLocked(ctx context.Context, now time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+	defer cancel()
+
+	c.err = c.check(ctx)
+	c.checked = now
+	if c.err != nil {
+		c.failed = now
+	}
+	return c.resultLocked(now)
+}
+
+// resultLocked returns the cached result, or errRecovering if it passed
+// within the cool-down of the last failure
+func (c *readinessChecker) resultLocked(now time.Time) error {
+	if c.err == nil && !c.failed.IsZero() && now.Sub(c.failed) < c.cooldown {
+		return errRecovering
+	}
+	return c.err
+}
+
+// runRefresher re-runs the check every interval until ctx is cancelled,
+// so probes keep seeing a recent result
+func (c *readinessChecker) runRefresher(ctx context.Context, interval time.Duration, now func() time.Time) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.refresh(ctx, now())
+		}
+	}
+}
+
+// checkStore pings the store when it depends on an external service
+func (s *Server) checkStore(ctx context.Context) error {
+	if p, ok := s.store.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// BeginShutdown marks the server as draining. Requests are still served
+// but readiness fails so load balancers stop routing new traffic here.
+func (s *Server) BeginShutdown() {
+	s.shuttingDown.Store(true)
+}
+
+// ShuttingDown reports whether BeginShutdown has been called
+func (s *Server) ShuttingDown() bool {
+	return s.shuttingDown.Load()
+}
+
+// Report whether the service's dependencies are reachable and it isn't
+// shutting down. A 503 asks to be retried after READINESS_CACHE_TTL.
+func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if s.ShuttingDown() {
+		setRetryAfter(w, s.cfg.ReadinessCacheTTL)
+		writeJSON(w, r, http.StatusServiceUnavailable, Response{
+			Status:  "error",
+			Code:    CodeUnavailable,
+			Message: "Service is shutting down",
+			Data:    map[string]interface{}{"shutting_down": true},
+		})
+		return
+	}
+	if err := s.readiness.Result(r.Context(), s.now()); err != nil {
+		setRetryAfter(w, s.cfg.ReadinessCacheTTL)
+		writeJSON(w, r, http.StatusServiceUnavailable, Response{
+			Status:  "error",
+			Code:    CodeUnavailable,
+			Message: "Service is not ready",
+			Data:    map[string]string{"store": err.Error()},
+		})
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "Service is ready",
+		Data:    map[string]string{"store": "ok"},
+	})
+}
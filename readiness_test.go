@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pingingStore is a memory store that counts pings and fails them while
+// err is set
+type pingingStore struct {
+	*MemoryStore
+	mu    sync.Mutex
+	pings int
+	err   error
+}
+
+func (p *pingingStore) Ping(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pings++
+	return p.err
+}
+
+func (p *pingingStore) setErr(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+func (p *pingingStore) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pings
+}
+
+// newPingingServer returns a server over a pingingStore, on a fake clock
+func newPingingServer(t *testing.T, env ...string) (*Server, *pingingStore, *fakeClock) {
+	t.Helper()
+	cfg := testConfig(t, env...)
+	store := &pingingStore{MemoryStore: NewMemoryStore(nil)}
+	srv, err := NewServer(cfg, store)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	clock := newFakeClock()
+	srv.now = clock.now
+	return srv, store, clock
+}
+
+func TestReadyzCachesTheStorePing(t *testing.T) {
+	srv, store, clock := newPingingServer(t, "READINESS_CACHE_TTL=5s")
+	h := srv.Handler()
+
+	for i := 0; i < 10; i++ {
+		decodeResponse(t, do(h, "GET", "/readyz", ""), http.StatusOK)
+		clock.advance(400 * time.Millisecond)
+	}
+	if n := store.count(); n != 1 {
+		t.Errorf("store pinged %d times within the TTL, want 1", n)
+	}
+
+	clock.advance(2 * time.Second)
+	decodeResponse(t, do(h, "GET", "/readyz", ""), http.StatusOK)
+	if n := store.count(); n != 2 {
+		t.Errorf("store pinged %d times once the TTL passed, want 2", n)
+	}
+}
+
+func TestReadyzReportsAFailingStore(t *testing.T) {
+	srv, store, clock := newPingingServer(t, "READINESS_CACHE_TTL=5s")
+	h := srv.Handler()
+	store.setErr(errors.New("connection refused"))
+
+	rec := do(h, "GET", "/readyz", "")
+	if got := rec.Header().Get("Retry-After"); got != "5" {
+		t.Errorf("Retry-After = %q, want the 5 second cache TTL", got)
+	}
+	resp := decodeResponse(t, rec, http.StatusServiceUnavailable)
+	var data map[string]string
+	decodeData(t, resp, &data)
+	if data["store"] != "connection refused" {
+		t.Errorf("store status = %q, want the ping error", data["store"])
+	}
+
+	store.setErr(nil)
+	decodeResponse(t, do(h, "GET", "/readyz", ""), http.StatusServiceUnavailable)
+	clock.advance(5 * time.Second)
+	decodeResponse(t, do(h, "GET", "/readyz", ""), http.StatusOK)
+}
+
+func TestReadinessCheckerWithoutTTLChecksEveryTime(t *testing.T) {
+	calls := 0
+	c := newReadinessChecker(func(ctx context.Context) error {
+		calls++
+		return errors.New("down")
+	}, 0, 0)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := c.Result(context.Background(), now); err == nil {
+			t.Fatal("Result passed while the check fails")
+		}
+	}
+	if calls != 3 {
+		t.Errorf("check ran %d times, want 3", calls)
+	}
+}
+
+func TestReadyzFailsOnceShutdownBegins(t *testing.T) {
+	srv := newTestServer(t)
+	h := srv.Handler()
+	decodeResponse(t, do(h, "GET", "/readyz", ""), http.StatusOK)
+
+	srv.BeginShutdown()
+
+	rec := do(h, "GET", "/readyz", "")
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("readyz while draining has no Retry-After header")
+	}
+	resp := decodeResponse(t, rec, http.StatusServiceUnavailable)
+	var data map[string]bool
+	decodeData(t, resp, &data)
+	if resp.Code != CodeUnavailable || !data["shutting_down"] {
+		t.Errorf("readyz while draining = %s %v, want SERVICE_UNAVAILABLE with shutting_down", resp.Code, data)
+	}
+
+	var health map[string]string
+	decodeData(t, decodeResponse(t, do(h, "GET", "/api/v1/health", ""), http.StatusOK), &health)
+	if health["state"] != "shutting_down" {
+		t.Errorf("health state = %q while draining, want shutting_down", health["state"])
+	}
+}
+
+func TestReadyzHoldsThroughTheCooldown(t *testing.T) {
+	srv, store, clock := newPingingServer(t, "READINESS_CACHE_TTL=0s", "READINESS_COOLDOWN=30s")
+	h := srv.Handler()
+
+	store.setErr(errors.New("connection refused"))
+	decodeResponse(t, do(h, "GET", "/readyz", ""), http.StatusServiceUnavailable)
+	store.setErr(nil)
+
+	for _, elapsed := range []time.Duration{time.Second, 10 * time.Second, 10 * time.Second} {
+		clock.advance(elapsed)
+		decodeResponse(t, do(h, "GET", "/readyz", ""), http.StatusServiceUnavailable)
+	}
+	clock.advance(10 * time.Second)
+	decodeResponse(t, do(h, "GET", "/readyz", ""), http.StatusOK)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// panicHistory is how many recent panics are kept for the admin endpoint
+const panicHistory = 50
+
+// requestIDPattern limits client supplied request IDs to short,
+// log-safe tokens
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// requestIDFrom returns the ID assigned to the request in ctx
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// newRequestID returns a random 16 byte hex ID
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// requestID gives every request an ID, keeping a well formed X-Request-ID
+// from the client or gateway, and echoes it in the response
+func (s *Server) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// panicRecord describes a panic caught while serving a request
+type panicRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Value     string    `json:"value"`
+	Stack     string    `json:"stack"`
+}
+
+// panicLog keeps the most recent panics in a fixed-size ring
+type panicLog struct {
+	mu      sync.Mutex
+	records []panicRecord
+	next    int
+	total   int
+}
+
+// newPanicLog returns an empty log
+func newPanicLog() *panicLog {
+	return &panicLog{records: make([]panicRecord, 0, panicHistory)}
+}
+
+// Record adds p, evicting the oldest record once the log is full
+func (l *panicLog) Record(p panicRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.records) < panicHistory {
+		l.records = append(l.records, p)
+	} else {
+		l.records[l.next] = p
+	}
+	l.next = (l.next + 1) % panicHistory
+	l.total++
+}
+
+// Recent returns the kept records, newest first, and how many panics
+// have been recorded in total
+func (l *panicLog) Recent() ([]panicRecord, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	recent := make([]panicRecord, 0, len(l.records))
+	for i := 1; i <= len(l.records); i++ {
+		recent = append(recent, l.records[(l.next-i+len(l.records))%len(l.records)])
+	}
+	return recent, l.total
+}
+
+// recoverPanics turns a panicking handler into a 500 response and records
+// the panic. http.ErrAbortHandler is passed on, since it is the standard
+// way to abort a response on purpose.
+func (s *Server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+
+			record := panicRecord{
+				Time:      s.now().UTC(),
+				RequestID: requestIDFrom(r.Context()),
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Value:     fmt.Sprint(p),
+				Stack:     string(debug.Stack()),
+			}
+			s.panics.Record(record)
+			log.Printf("Panic serving %s %s (request %s): %s\n%s", r.Method, r.URL.Path, record.RequestID, record.Value, record.Stack)
+			writeError(w, r, CodeInternal, "")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// List the most recent panics caught by the recovery middleware
+func (s *Server) panicsHandler(w http.ResponseWriter, r *http.Request) {
+	recent, total := s.panics.Recent()
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "Recent panics retrieved successfully",
+		Data:    recent,
+		Meta:    map[string]int{"total": total, "kept": len(recent)},
+	})
+}
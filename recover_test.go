@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// panickingStore is a memory store whose Get panics
+type panickingStore struct {
+	*MemoryStore
+}
+
+func (panickingStore) Get(ctx context.Context, id int) (User, error) {
+	panic("store exploded")
+}
+
+func TestPanicsAreRetrievable(t *testing.T) {
+	cfg := testConfig(t, "ADMIN_TOKEN=admin-secret")
+	srv, err := NewServer(cfg, panickingStore{NewMemoryStore(nil)})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	h := srv.Handler()
+
+	r := newTestRequest("GET", "/api/v1/users/1", nil)
+	r.Header.Set("X-Request-ID", "panic-test")
+	resp := decodeResponse(t, serve(h, r), http.StatusInternalServerError)
+	if resp.Code != CodeInternal {
+		t.Errorf("code = %s, want %s", resp.Code, CodeInternal)
+	}
+
+	r = newTestRequest("GET", "/api/v1/admin/panics", nil)
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	var records []panicRecord
+	decodeData(t, decodeResponse(t, serve(h, r), http.StatusOK), &records)
+	if len(records) != 1 {
+		t.Fatalf("got %d panic records, want 1", len(records))
+	}
+	p := records[0]
+	if p.RequestID != "panic-test" || p.Method != "GET" || p.Path != "/api/v1/users/1" || p.Value != "store exploded" {
+		t.Errorf("record = %+v, want the panicking request", p)
+	}
+	if !strings.Contains(p.Stack, "panickingStore") {
+		t.Errorf("record stack doesn't reach the panicking store: %q", p.Stack)
+	}
+
+	decodeResponse(t, do(h, "GET", "/api/v1/admin/panics", ""), http.StatusUnauthorized)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Handler returns the complete HTTP handler: API routes, middleware and
+// CORS
+func (s *Server) Handler() http.Handler {
+	if isNilStore(s.store) {
+		// Only reachable for a Server not built by NewServer. Answer
+		// with a clear error instead of panicking in every handler.
+		log.Printf("Serving errors for every request: %v", errNoStore)
+		return s.requestID(s.writeOnce(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeError(w, r, CodeInternal, "Server misconfigured: "+errNoStore.Error())
+		})))
+	}
+
+	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(s.notFoundHandler)
+	router.MethodNotAllowedHandler = http.HandlerFunc(s.methodNotAllowedHandler)
+	router.HandleFunc("/readyz", s.readyHandler).Methods("GET")
+
+	// Admin routes are the ones served on the ADMIN_PORT listener when it
+	// is set. Those registered with adminRoute also require the admin
+	// token.
+	adminRoutes := make(map[*mux.Route]bool)
+	adminRoutes[router.Handle("/metrics", promhttp.Handler()).Methods("GET")] = true
+
+	// API routes
+	api := router.PathPrefix("/api/v1").Subrouter()
+	adminRoute := func(path string, h http.HandlerFunc) *mux.Route {
+		route := api.HandleFunc(path, s.requireAdmin(h))
+		adminRoutes[route] = true
+		return route
+	}
+	api.HandleFunc("/health", s.healthHandler).Methods("GET")
+	api.HandleFunc("/errors", s.errorCatalogHandler).Methods("GET")
+	api.HandleFunc("/features", s.featuresHandler).Methods("GET")
+	api.HandleFunc("/rate-limit", s.rateLimitHandler).Methods("GET")
+	api.HandleFunc("/users", s.getUsersHandler).Methods("GET")
+	api.HandleFunc("/users/count", s.countUsersHandler).Methods("GET")
+	api.HandleFunc("/users/page-info", s.getPageInfoHandler).Methods("GET")
+	api.HandleFunc("/users/me", s.getCurrentUserHandler).Methods("GET")
+	api.HandleFunc("/users/domains", s.getDomainsHandler).Methods("GET")
+	api.HandleFunc("/users/stats/monthly", s.getMonthlyStatsHandler).Methods("GET")
+	api.HandleFunc("/users/sample", s.getSampleHandler).Methods("GET")
+	api.HandleFunc("/users/oldest", s.getOldestUserHandler).Methods("GET")
+	api.HandleFunc("/users/newest", s.getNewestUserHandler).Methods("GET")
+	api.HandleFunc("/users/{id:[0-9]+}", s.getUserHandler).Methods("GET")
+	api.HandleFunc("/users", s.idempotent(s.createUserHandler)).Methods("POST")
+	api.HandleFunc("/users/batch", s.batchCreateUsersHandler).Methods("POST")
+	api.HandleFunc("/users/validate-batch", s.validateBatchHandler).Methods("POST")
+	api.HandleFunc("/users/batch-get", s.batchGetUsersHandler).Methods("POST")
+	api.HandleFunc("/users/batch-get-by-email", s.batchGetUsersByEmailHandler).Methods("POST")
+	api.HandleFunc("/users/export", s.exportUsersHandler).Methods("POST")
+	api.HandleFunc("/users/archive", s.archiveUsersHandler).Methods("GET")
+	adminRoute("/users/merge", s.mergeUsersHandler).Methods("POST")
+	adminRoute("/users/diff", s.diffUsersHandler).Methods("GET")
+	adminRoute("/users/bulk-delete", s.bulkDeleteUsersHandler).Methods("POST")
+	adminRoute("/users/bulk-tag", s.bulkTagUsersHandler).Methods("POST")
+	adminRoute("/users/trash", s.getTrashHandler).Methods("GET")
+	api.HandleFunc("/users/{id:[0-9]+}", s.patchUserHandler).Methods("PATCH")
+	api.HandleFunc("/users/{id:[0-9]+}", s.deleteUserHandler).Methods("DELETE")
+	api.HandleFunc("/users/{id:[0-9]+}/metadata", s.clearMetadataHandler).Methods("DELETE")
+	adminRoute("/users/{id:[0-9]+}/history", s.getUserHistoryHandler).Methods("GET")
+	api.HandleFunc("/events", s.eventsHandler).Methods("GET")
+
+	// Admin routes
+	adminRoute("/debug/buildinfo", s.buildInfoHandler).Methods("GET")
+	adminRoute("/admin/runtime", s.runtimeStatsHandler).Methods("GET")
+	adminRoute("/admin/latency", s.latencyHandler).Methods("GET")
+	adminRoute("/admin/metrics.json", s.metricsJSONHandler).Methods("GET")
+	adminRoute("/admin/top-endpoints", s.topEndpointsHandler).Methods("GET")
+	adminRoute("/admin/config/validate", s.validateConfigHandler).Methods("GET")
+	adminRoute("/admin/panics", s.panicsHandler).Methods("GET")
+	adminRoute("/admin/trash/purge", s.purgeTrashHandler).Methods("POST")
+	adminRoute("/admin/events/{id:[0-9]+}/replay", s.replayEventHandler).Methods("POST")
+
+	// Registered last so the discovery document covers every route
+	if s.cfg.Discovery {
+		api.HandleFunc("", s.discoveryHandler(router)).Methods("OPTIONS")
+	}
+
+	if s.cfg.AdminPort != "" {
+		router.Use(s.separateAdmin(adminRoutes))
+	}
+	router.Use(s.recordLatency)
+	if s.cfg.DegradedReadCache {
+		router.Use(s.markStale)
+	}
+	router.Use(s.measureRequestSize)
+	router.Use(s.tenantContext)
+	router.Use(s.authenticate)
+	if s.globalLimiter != nil {
+		router.Use(s.globalRateLimit)
+	}
+	if s.cfg.rateLimited() {
+		router.Use(s.rateLimit)
+	}
+	if s.inFlight != nil {
+		router.Use(s.limitConcurrency)
+	}
+	if s.cfg.RequestTimeout > 0 {
+		router.Use(s.timeout)
+	}
+	router.Use(s.negotiateVersion)
+
+	// CORS middleware. It answers every OPTIONS request as a preflight,
+	// so discovery requests go straight to the router.
+	cors := handlers.CORS(
+		handlers.AllowedOrigins(s.cfg.CORSOrigins),
+		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "Authorization", "If-Match", "Idempotency-Key", "If-None-Match", "X-Field-Profile", "X-Request-ID", "X-Tenant-ID"}),
+		handlers.ExposedHeaders([]string{"ETag", "Idempotent-Replayed", "Retry-After", "Warning", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "X-Request-ID", "X-Store-Backend", "X-Supported-Versions", "X-Total-Count"}),
+	)(router)
+	var handler http.Handler = cors
+	if s.cfg.Discovery {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isDiscoveryRequest(r) {
+				router.ServeHTTP(w, r)
+				return
+			}
+			cors.ServeHTTP(w, r)
+		})
+	}
+
+	// Outside the router so unmatched routes are covered too
+	if s.cfg.CompressAlgo != "" {
+		handler = s.compress(handler)
+	}
+	if s.cfg.RequiredHeader != "" {
+		handler = s.requireHeader(handler)
+	}
+	if s.cfg.StoreBackendHeader {
+		handler = s.storeBackendHeader(handler)
+	}
+	if len(s.cfg.ResponseHeaders) > 0 {
+		handler = s.responseHeaders(handler)
+	}
+	if s.cfg.HSTSMaxAge > 0 {
+		handler = s.strictTransport(handler)
+	}
+	handler = s.writeOnce(s.recoverPanics(handler))
+	if s.cfg.AccessLog {
+		handler = s.accessLog(handler)
+	}
+	return s.requestID(s.formatResponses(handler))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+)
+
+// Default sample size for the user sample
+const defaultSampleSize = 5
+
+// sampleParams are the query parameters accepted by the user sample
+var sampleParams = []string{"n", "seed"}
+
+// sampleUsers returns n distinct users picked at random with rng, or all
+// of them in random order when there are fewer than n
+func sampleUsers(users []User, n int, rng *rand.Rand) []User {
+	picked := append([]User(nil), users...)
+	rng.Shuffle(len(picked), func(i, j int) { picked[i], picked[j] = picked[j], picked[i] })
+	if n < len(picked) {
+		picked = picked[:n]
+	}
+	return picked
+}
+
+// Get ?n=N randomly chosen users. Passing ?seed= makes the selection
+// repeatable for as long as the set of users doesn't change.
+func (s *Server) getSampleHandler(w http.ResponseWriter, r *http.Request) {
+	if err := checkQueryParams(s.cfg, r, sampleParams); err != nil {
+		writeParamError(w, r, err)
+		return
+	}
+	n, err := parseIntParam(r, "n", defaultSampleSize, 1, maxListLimit)
+	if err != nil {
+		writeParamError(w, r, err)
+		return
+	}
+
+	meta := map[string]interface{}{"n": n}
+	seed := s.now().UnixNano()
+	if raw := r.URL.Query().Get("seed"); raw != "" {
+		if seed, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			writeParamError(w, r, &ParamError{Param: "seed", Message: "must be an integer"})
+			return
+		}
+		meta["seed"] = seed
+	}
+
+	users, err := s.listUsers(r.Context())
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "User sample retrieved successfully",
+		Data:    sampleUsers(users, n, rand.New(rand.NewSource(seed))),
+		Meta:    meta,
+	})
+}
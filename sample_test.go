@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestSampleIsDistinctAndRepeatableWithSeed(t *testing.T) {
+	srv := newTestServer(t)
+	for i := 0; i < 10; i++ {
+		createTestUser(t, srv.store, fmt.Sprintf("sample%d", i))
+	}
+	h := srv.Handler()
+
+	sample := func(query string) []User {
+		var users []User
+		decodeData(t, decodeResponse(t, do(h, "GET", "/api/v1/users/sample"+query, ""), http.StatusOK), &users)
+		return users
+	}
+
+	first := sample("?n=4&seed=42")
+	if len(first) != 4 {
+		t.Fatalf("sample size = %d, want 4", len(first))
+	}
+	seen := map[int]bool{}
+	for _, u := range first {
+		if seen[u.ID] {
+			t.Errorf("user %d sampled twice", u.ID)
+		}
+		seen[u.ID] = true
+	}
+	again := sample("?n=4&seed=42")
+	for i := range first {
+		if again[i].ID != first[i].ID {
+			t.Fatalf("seed 42 picked user %d then %d at position %d, want the same selection", first[i].ID, again[i].ID, i)
+		}
+	}
+
+	if all := sample("?n=50&seed=1"); len(all) != 10 {
+		t.Errorf("oversized sample returned %d users, want all 10", len(all))
+	}
+	decodeResponse(t, do(h, "GET", "/api/v1/users/sample?seed=abc", ""), http.StatusBadRequest)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// seedRecord is a single entry in a seed file
+type seedRecord struct {
+	importInput
+	EmailVerified bool `json:"email_verified"`
+}
+
+// seedUsers imports the users listed in the JSON array at path into
+// store. Invalid entries and emails that already exist are skipped and
+// logged. It returns the number of users created.
+func seedUsers(ctx context.Context, cfg Config, store UserStore, path string, now time.Time) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var records []seedRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return 0, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	seeded := 0
+	for i, rec := range records {
+		created, errs := rec.check(cfg, now)
+		if len(errs) > 0 {
+			log.Printf("Seed: skipping entry %d: %s %s", i, errs[0].Field, errs[0].Message)
+			continue
+		}
+
+		u := rec.toUser(created)
+		u.EmailVerified = rec.EmailVerified
+		if _, err := store.Create(ctx, u); err != nil {
+			if errors.Is(err, ErrDuplicateEmail) {
+				log.Printf("Seed: skipping entry %d: email %s already exists", i, rec.Email)
+				continue
+			}
+			return seeded, err
+		}
+		seeded++
+	}
+	return seeded, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSeedUsersFromFile(t *testing.T) {
+	cfg := testConfig(t)
+	store := NewMemoryStore(nil)
+	ctx := context.Background()
+	existing := createTestUser(t, store, "existing")
+
+	path := filepath.Join(t.TempDir(), "users.json")
+	seed := `[
+		{"name": "Ada", "email": "ada@example.com", "tags": ["math"]},
+		{"name": "Alan", "email": "alan@example.com", "created": "2020-06-23T08:00:00Z"},
+		{"name": "Bad Email", "email": "not-an-email"},
+		{"name": "Again", "email": "` + existing.Email + `"}
+	]`
+	if err := os.WriteFile(path, []byte(seed), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	n, err := seedUsers(ctx, cfg, store, path, now)
+	if err != nil {
+		t.Fatalf("seedUsers: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("seeded %d users, want 2", n)
+	}
+
+	users, _ := store.List(ctx)
+	byEmail := make(map[string]User, len(users))
+	for _, u := range users {
+		byEmail[u.Email] = u
+	}
+	if len(users) != 3 {
+		t.Errorf("store has %d users, want the existing one and 2 seeded", len(users))
+	}
+	if u, ok := byEmail["ada@example.com"]; !ok || u.ID == 0 || !u.Created.Equal(now) {
+		t.Errorf("seeded Ada = %+v, want an assigned ID created now", u)
+	}
+	if u := byEmail["alan@example.com"]; !u.Created.Equal(time.Date(2020, 6, 23, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("seeded Alan created %v, want the time from the file", u.Created)
+	}
+}
+
+func TestSeedUsersRejectsMalformedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	os.WriteFile(path, []byte(`{"name": "not an array"}`), 0o600)
+	if _, err := seedUsers(context.Background(), testConfig(t), NewMemoryStore(nil), path, time.Now()); err == nil {
+		t.Error("seedUsers accepted a file that isn't a JSON array")
+	}
+}
+
+func TestSeedUsersAppliesTheFutureTimestampPolicy(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "users.json")
+	seed := `[{"name": "Skewed", "email": "skewed@example.com", "created": "2030-01-01T00:00:00Z"}]`
+	if err := os.WriteFile(path, []byte(seed), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("clamp", func(t *testing.T) {
+		store := NewMemoryStore(nil)
+		if n, err := seedUsers(context.Background(), testConfig(t, "REJECT_FUTURE_TIMESTAMPS=false"), store, path, now); err != nil || n != 1 {
+			t.Fatalf("seedUsers = %d, %v; want the user clamped and seeded", n, err)
+		}
+		if users, _ := store.List(context.Background()); len(users) != 1 || !users[0].Created.Equal(now) {
+			t.Errorf("seeded %+v, want one user created now", users)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		store := NewMemoryStore(nil)
+		if n, err := seedUsers(context.Background(), testConfig(t, "REJECT_FUTURE_TIMESTAMPS=true"), store, path, now); err != nil || n != 0 {
+			t.Errorf("seedUsers = %d, %v; want the future-dated user skipped", n, err)
+		}
+	})
+}
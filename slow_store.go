@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"time"
+)
+
+// timedStore logs store calls that take longer than SLOW_QUERY_THRESHOLD,
+// tagged with the ID of the request that made them
+type timedStore struct {
+	UserStore
+	threshold time.Duration
+}
+
+// newTimedStore wraps primary, logging calls slower than threshold
+func newTimedStore(primary UserStore, threshold time.Duration) *timedStore {
+	return &timedStore{UserStore: primary, threshold: threshold}
+}
+
+// observe logs op if it has run for at least the threshold since start.
+// Calls are deferred at the top of each method.
+func (t *timedStore) observe(ctx context.Context, op string, start time.Time) {
+	if d := time.Since(start); d >= t.threshold {
+		id := requestIDFrom(ctx)
+		if id == "" {
+			id = "none"
+		}
+		log.Printf("Slow store call %s took %s (request %s)", op, d.Round(time.Microsecond), id)
+	}
+}
+
+func (t *timedStore) List(ctx context.Context) ([]User, error) {
+	defer t.observe(ctx, "List", time.Now())
+	return t.UserStore.List(ctx)
+}
+
+func (t *timedStore) Get(ctx context.Context, id int) (User, error) {
+	defer t.observe(ctx, "Get", time.Now())
+	return t.UserStore.Get(ctx, id)
+}
+
+func (t *timedStore) GetMany(ctx context.Context, ids []int) (map[int]User, error) {
+	defer t.observe(ctx, "GetMany", time.Now())
+	return t.UserStore.GetMany(ctx, ids)
+}
+
+func (t *timedStore) GetManyByEmail(ctx context.Context, emails []string) (map[string]User, error) {
+	defer t.observe(ctx, "GetManyByEmail", time.Now())
+	return t.UserStore.GetManyByEmail(ctx, emails)
+}
+
+func (t *timedStore) Create(ctx context.Context, u User) (User, error) {
+	defer t.observe(ctx, "Create", time.Now())
+	return t.UserStore.Create(ctx, u)
+}
+
+func (t *timedStore) Insert(ctx context.Context, u User) (User, error) {
+	defer t.observe(ctx, "Insert", time.Now())
+	return t.UserStore.Insert(ctx, u)
+}
+
+func (t *timedStore) Update(ctx context.Context, u User) (User, error) {
+	defer t.observe(ctx, "Update", time.Now())
+	return t.UserStore.Update(ctx, u)
+}
+
+func (t *timedStore) UpdateIfVersion(ctx context.Context, id, expectedVersion int, u User) (User, error) {
+	defer t.observe(ctx, "UpdateIfVersion", time.Now())
+	return t.UserStore.UpdateIfVersion(ctx, id, expectedVersion, u)
+}
+
+func (t *timedStore) Delete(ctx context.Context, id int) error {
+	defer t.observe(ctx, "Delete", time.Now())
+	return t.UserStore.Delete(ctx, id)
+}
+
+func (t *timedStore) SoftDelete(ctx context.Context, id int) error {
+	defer t.observe(ctx, "SoftDelete", time.Now())
+	return t.UserStore.SoftDelete(ctx, id)
+}
+
+func (t *timedStore) DeleteIfVersion(ctx context.Context, id, expectedVersion int, soft bool) error {
+	defer t.observe(ctx, "DeleteIfVersion", time.Now())
+	return t.UserStore.DeleteIfVersion(ctx, id, expectedVersion, soft)
+}
+
+func (t *timedStore) Trash(ctx context.Context) ([]User, error) {
+	defer t.observe(ctx, "Trash", time.Now())
+	return t.UserStore.Trash(ctx)
+}
+
+func (t *timedStore) PurgeTrash(ctx context.Context, ids []int) (int, error) {
+	defer t.observe(ctx, "PurgeTrash", time.Now())
+	return t.UserStore.PurgeTrash(ctx, ids)
+}
+
+func (t *timedStore) Count(ctx context.Context, f UserFilter) (int, error) {
+	defer t.observe(ctx, "Count", time.Now())
+	return t.UserStore.Count(ctx, f)
+}
+
+func (t *timedStore) Domains(ctx context.Context, f UserFilter) ([]string, error) {
+	defer t.observe(ctx, "Domains", time.Now())
+	return t.UserStore.Domains(ctx, f)
+}
+
+func (t *timedStore) ListPage(ctx context.Context, f UserFilter, order UserSort, offset, limit int) ([]User, int, error) {
+	defer t.observe(ctx, "ListPage", time.Now())
+	return t.UserStore.ListPage(ctx, f, order, offset, limit)
+}
+
+func (t *timedStore) Oldest(ctx context.Context, f UserFilter) (User, error) {
+	defer t.observe(ctx, "Oldest", time.Now())
+	return t.UserStore.Oldest(ctx, f)
+}
+
+func (t *timedStore) Newest(ctx context.Context, f UserFilter) (User, error) {
+	defer t.observe(ctx, "Newest", time.Now())
+	return t.UserStore.Newest(ctx, f)
+}
+
+func (t *timedStore) ModifiedSince(ctx context.Context, since time.Time) ([]User, error) {
+	defer t.observe(ctx, "ModifiedSince", time.Now())
+	return t.UserStore.ModifiedSince(ctx, since)
+}
+
+// IterateModifiedSince is timed as a whole, including the time fn takes
+// to stream each user
+func (t *timedStore) IterateModifiedSince(ctx context.Context, since time.Time, fn func(User) error) error {
+	defer t.observe(ctx, "IterateModifiedSince", time.Now())
+	return t.UserStore.IterateModifiedSince(ctx, since, fn)
+}
+
+func (t *timedStore) Modified(ctx context.Context) (time.Time, int, error) {
+	defer t.observe(ctx, "Modified", time.Now())
+	return t.UserStore.Modified(ctx)
+}
+
+// Ping checks the wrapped store, which the readiness probe relies on
+func (t *timedStore) Ping(ctx context.Context) error {
+	if p, ok := t.UserStore.(Pinger); ok {
+		defer t.observe(ctx, "Ping", time.Now())
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// Close closes the wrapped store
+func (t *timedStore) Close() error {
+	if closer, ok := t.UserStore.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sleepyStore is a memory store whose Get takes delay
+type sleepyStore struct {
+	*MemoryStore
+	delay time.Duration
+}
+
+func (s sleepyStore) Get(ctx context.Context, id int) (User, error) {
+	time.Sleep(s.delay)
+	return s.MemoryStore.Get(ctx, id)
+}
+
+func TestSlowStoreCallsAreLoggedWithTheRequestID(t *testing.T) {
+	store := newTimedStore(sleepyStore{MemoryStore: NewMemoryStore(nil), delay: 20 * time.Millisecond}, 10*time.Millisecond)
+	srv, err := NewServer(testConfig(t), store)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	h := srv.Handler()
+	logs := captureLog(t)
+
+	r := newTestRequest("GET", "/api/v1/users/1", nil)
+	r.Header.Set("X-Request-ID", "slow-request")
+	decodeResponse(t, serve(h, r), http.StatusNotFound)
+	if !strings.Contains(logs.String(), "Slow store call Get took") || !strings.Contains(logs.String(), "(request slow-request)") {
+		t.Errorf("log = %q, want the slow Get tagged with the request ID", logs.String())
+	}
+
+	logs.Reset()
+	decodeResponse(t, do(h, "GET", "/api/v1/users", ""), http.StatusOK)
+	if strings.Contains(logs.String(), "Slow store call") {
+		t.Errorf("fast calls were logged: %q", logs.String())
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emailDomain returns the lower-cased domain part of email
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(email[at+1:])
+}
+
+// userDomains returns the distinct email domains of the users matching f,
+// sorted
+func userDomains(users map[int]User, f UserFilter) []string {
+	seen := make(map[string]bool)
+	domains := []string{}
+	for _, u := range users {
+		if d := emailDomain(u.Email); d != "" && !seen[d] && f.Matches(u) {
+			seen[d] = true
+			domains = append(domains, d)
+		}
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// List the distinct email domains across all users, sorted. They are
+// collected by the store.
+func (s *Server) getDomainsHandler(w http.ResponseWriter, r *http.Request) {
+	domains, err := s.emailDomains(r.Context())
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "Email domains retrieved successfully",
+		Data:    domains,
+	})
+}
+
+// Default and maximum number of months in the monthly creation report
+const (
+	defaultStatsMonths = 12
+	maxStatsMonths     = 120
+)
+
+// monthCount is the number of users created in one calendar month
+type monthCount struct {
+	Month string `json:"month"`
+	Count int    `json:"count"`
+}
+
+// monthlyCounts counts the users created in each calendar month in loc
+// for the months months ending with the one containing now, with one
+// store count per month. Months without users are included with a zero
+// count; the result is oldest first.
+func (s *Server) monthlyCounts(ctx context.Context, now time.Time, loc *time.Location, months int) ([]monthCount, error) {
+	now = now.In(loc)
+	current := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+	first := current.AddDate(0, -(months - 1), 0)
+
+	counts := make([]monthCount, months)
+	for i := range counts {
+		start, end := first.AddDate(0, i, 0), first.AddDate(0, i+1, 0)
+		n, err := s.countUsers(ctx, UserFilter{CreatedAfter: &start, CreatedBefore: &end})
+		if err != nil {
+			return nil, err
+		}
+		counts[i] = monthCount{Month: start.Format("2006-01"), Count: n}
+	}
+	return counts, nil
+}
+
+// Count users created per month over the last ?months=N months, using
+// the configured TIMEZONE for month boundaries
+func (s *Server) getMonthlyStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := checkQueryParams(s.cfg, r, []string{"months"}); err != nil {
+		writeParamError(w, r, err)
+		return
+	}
+	months, err := parseIntParam(r, "months", defaultStatsMonths, 1, maxStatsMonths)
+	if err != nil {
+		writeParamError(w, r, err)
+		return
+	}
+
+	counts, err := s.monthlyCounts(r.Context(), s.now(), s.cfg.Location, months)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "Monthly user counts retrieved successfully",
+		Data:    counts,
+		Meta:    map[string]interface{}{"months": months, "timezone": s.cfg.Location.String()},
+	})
+}
+
+// Count the users matching the filter in the query string
+func (s *Server) countUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if err := checkQueryParams(s.cfg, r, filterParams); err != nil {
+		writeParamError(w, r, err)
+		return
+	}
+	filter, err := parseUserFilter(r)
+	if err == nil {
+		err = checkFilterLimit(filter.constraints(), s.cfg.MaxFilters)
+	}
+	if err != nil {
+		writeParamError(w, r, err)
+		return
+	}
+
+	count, err := s.countUsers(r.Context(), filter)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "Users counted successfully",
+		Data:    map[string]int{"count": count},
+	})
+}
+
+// Get the earliest created user
+func (s *Server) getOldestUserHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeBoundaryUser(w, r, false)
+}
+
+// Get the latest created user
+func (s *Server) getNewestUserHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeBoundaryUser(w, r, true)
+}
+
+// writeBoundaryUser responds with the oldest or newest user visible to
+// the request, or 404 when there are none
+func (s *Server) writeBoundaryUser(w http.ResponseWriter, r *http.Request, newest bool) {
+	if err := checkQueryParams(s.cfg, r, nil); err != nil {
+		writeParamError(w, r, err)
+		return
+	}
+
+	user, err := s.boundaryUser(r.Context(), newest)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", userETag(user, responseFormatFrom(r.Context())))
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "User found",
+		Data:    user,
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createUserWithEmail stores a user with the given email
+func createUserWithEmail(t *testing.T, store UserStore, email string) User {
+	t.Helper()
+	u, err := store.Create(context.Background(), User{Name: email, Email: email, Created: time.Now().UTC().Truncate(time.Second)})
+	if err != nil {
+		t.Fatalf("create %s: %v", email, err)
+	}
+	return u
+}
+
+func TestDomainsAreDistinctAndSorted(t *testing.T) {
+	srv := newTestServer(t)
+	for _, email := range []string{"ann@zeta.io", "bob@acme.com", "cy@Example.org", "dee@ACME.com", "eve@example.org"} {
+		createUserWithEmail(t, srv.store, email)
+	}
+
+	var domains []string
+	decodeData(t, decodeResponse(t, do(http.HandlerFunc(srv.getDomainsHandler), "GET", "/api/v1/users/domains", ""), http.StatusOK), &domains)
+	if want := []string{"acme.com", "example.org", "zeta.io"}; !reflect.DeepEqual(domains, want) {
+		t.Errorf("domains = %v, want %v", domains, want)
+	}
+}
+
+func TestCountUsersAppliesTheFilter(t *testing.T) {
+	srv := newTestServer(t)
+	for _, email := range []string{"ann@acme.com", "bob@acme.com", "cy@zeta.io"} {
+		createUserWithEmail(t, srv.store, email)
+	}
+	count := http.HandlerFunc(srv.countUsersHandler)
+
+	for _, tt := range []struct {
+		query string
+		want  int
+	}{
+		{"", 3},
+		{"?domain=acme.com", 2},
+		{"?domain=acme.com&q=bob", 1},
+		{"?created_before=2000-01-01T00:00:00Z", 0},
+	} {
+		var got struct {
+			Count int `json:"count"`
+		}
+		decodeData(t, decodeResponse(t, do(count, "GET", "/api/v1/users/count"+tt.query, ""), http.StatusOK), &got)
+		if got.Count != tt.want {
+			t.Errorf("count%s = %d, want %d", tt.query, got.Count, tt.want)
+		}
+	}
+	decodeResponse(t, do(count, "GET", "/api/v1/users/count?created_after=yesterday", ""), http.StatusBadRequest)
+}
+
+func TestMonthlyStatsBucketInTheConfiguredTimezone(t *testing.T) {
+	for _, tt := range []struct {
+		timezone string
+		want     []monthCount
+	}{
+		{"UTC", []monthCount{{"2023-11", 0}, {"2023-12", 1}, {"2024-01", 2}}},
+		// 03:00 UTC on January 1st is still December 31st in New York
+		{"America/New_York", []monthCount{{"2023-11", 0}, {"2023-12", 2}, {"2024-01", 1}}},
+	} {
+		t.Run(tt.timezone, func(t *testing.T) {
+			srv := newTestServer(t, "TIMEZONE="+tt.timezone)
+			srv.now = newFakeClock().now
+			for i, created := range []time.Time{
+				time.Date(2023, 12, 15, 12, 0, 0, 0, time.UTC),
+				time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC),
+				time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC),
+			} {
+				u := User{Name: "Monthly", Email: fmt.Sprintf("monthly%d@example.com", i), Created: created}
+				if _, err := srv.store.Create(context.Background(), u); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var counts []monthCount
+			rec := do(http.HandlerFunc(srv.getMonthlyStatsHandler), "GET", "/api/v1/users/stats/monthly?months=3", "")
+			decodeData(t, decodeResponse(t, rec, http.StatusOK), &counts)
+			if !reflect.DeepEqual(counts, tt.want) {
+				t.Errorf("counts = %v, want %v", counts, tt.want)
+			}
+		})
+	}
+}
+
+func TestOldestAndNewestUsers(t *testing.T) {
+	srv := newTestServer(t)
+	h := srv.Handler()
+	decodeResponse(t, do(h, "GET", "/api/v1/users/oldest", ""), http.StatusNotFound)
+	decodeResponse(t, do(h, "GET", "/api/v1/users/newest", ""), http.StatusNotFound)
+
+	base := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	var ids []int
+	for i, offset := range []int{5, 1, 9, 3} {
+		u, err := srv.store.Create(context.Background(), User{Name: fmt.Sprint("user ", i), Email: fmt.Sprintf("bound%d@example.com", i), Created: base.AddDate(0, 0, offset)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, u.ID)
+	}
+
+	for path, want := range map[string]int{"/api/v1/users/oldest": ids[1], "/api/v1/users/newest": ids[2]} {
+		var u User
+		decodeData(t, decodeResponse(t, do(h, "GET", path, ""), http.StatusOK), &u)
+		if u.ID != want {
+			t.Errorf("%s = user %d, want %d", path, u.ID, want)
+		}
+	}
+}
+
+func TestTooManyFiltersAreRejected(t *testing.T) {
+	srv := newTestServer(t, "MAX_FILTERS=2")
+	createUserWithEmail(t, srv.store, "ann@acme.com")
+	count := http.HandlerFunc(srv.countUsersHandler)
+
+	decodeResponse(t, do(count, "GET", "/api/v1/users/count?domain=acme.com&q=ann", ""), http.StatusOK)
+	resp := decodeResponse(t, do(count, "GET", "/api/v1/users/count?domain=acme.com&q=ann&created_after=2020-01-01T00:00:00Z", ""), http.StatusBadRequest)
+	if resp.Code != CodeInvalidParameter || !strings.Contains(resp.Message, "at most 2") {
+		t.Errorf("over-limit filter: %s %q, want invalid_parameter naming the limit", resp.Code, resp.Message)
+	}
+
+	bulk := http.HandlerFunc(srv.bulkDeleteUsersHandler)
+	body := `{"filter":{"q":"ann","domain":"acme.com","created_after":"2020-01-01T00:00:00Z"}}`
+	decodeResponse(t, do(bulk, "POST", "/api/v1/users/bulk-delete", body), http.StatusBadRequest)
+	if n, _ := srv.store.Count(context.Background(), UserFilter{}); n != 1 {
+		t.Errorf("rejected bulk delete left %d users, want 1", n)
+	}
+
+	// The list counts its windows and ordering the same way
+	list := http.HandlerFunc(srv.getUsersHandler)
+	decodeResponse(t, do(list, "GET", "/api/v1/users?id_from=1&sort=email", ""), http.StatusOK)
+	resp = decodeResponse(t, do(list, "GET", "/api/v1/users?id_from=1&id_to=5&sort=email", ""), http.StatusBadRequest)
+	if resp.Code != CodeInvalidParameter || !strings.Contains(resp.Message, "at most 2") {
+		t.Errorf("over-limit list: %s %q, want invalid_parameter naming the limit", resp.Code, resp.Message)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sentinel errors returned by UserStore implementations
+var (
+	ErrNotFound        = errors.New("user not found")
+	ErrDuplicateEmail  = errors.New("email already in use")
+	ErrDuplicateID     = errors.New("user ID already in use")
+	ErrVersionMismatch = errors.New("user version has changed")
+)
+
+// UserStore is the persistence layer behind the user handlers.
+// Implementations own data integrity rules such as email uniqueness and
+// report violations with the sentinel errors above.
+type UserStore interface {
+	List(ctx context.Context) ([]User, error)
+	Get(ctx context.Context, id int) (User, error)
+	// GetMany returns the users with the given IDs in a single lookup,
+	// keyed by ID. Missing IDs are absent from the map.
+	GetMany(ctx context.Context, ids []int) (map[int]User, error)
+	// GetManyByEmail returns the users with the given emails in a single
+	// lookup, keyed by the email key the store's rules give them. Emails
+	// nobody uses are absent from the map.
+	GetManyByEmail(ctx context.Context, emails []string) (map[string]User, error)
+	Create(ctx context.Context, u User) (User, error)
+	// Insert stores u as is, keeping its ID and timestamps. Later
+	// creates are assigned IDs above it.
+	Insert(ctx context.Context, u User) (User, error)
+	Update(ctx context.Context, u User) (User, error)
+	// UpdateIfVersion replaces the stored user with ID id by u only if
+	// its version is still expectedVersion, returning ErrVersionMismatch
+	// otherwise. The check and write are atomic, and u's own ID is
+	// ignored.
+	UpdateIfVersion(ctx context.Context, id, expectedVersion int, u User) (User, error)
+	Delete(ctx context.Context, id int) error
+	// SoftDelete removes the user like Delete but keeps a full copy, with
+	// DeletedAt set, in the trash until tombstoneRetention passes
+	SoftDelete(ctx context.Context, id int) error
+	// DeleteIfVersion removes the user like Delete, or SoftDelete when
+	// soft is set, only if its version is still expectedVersion,
+	// returning ErrVersionMismatch otherwise. The check and delete are
+	// atomic.
+	DeleteIfVersion(ctx context.Context, id, expectedVersion int, soft bool) error
+	// Trash returns the soft-deleted users ordered by ID
+	Trash(ctx context.Context) ([]User, error)
+	// PurgeTrash permanently removes the trash entries for ids, keeping
+	// their tombstones, and returns how many were removed
+	PurgeTrash(ctx context.Context, ids []int) (int, error)
+	// Count returns the number of users matching f without loading them
+	Count(ctx context.Context, f UserFilter) (int, error)
+	// Domains returns the distinct lower-cased email domains of the users
+	// matching f, sorted, without loading the users
+	Domains(ctx context.Context, f UserFilter) ([]string, error)
+	// ListPage returns up to limit of the users matching f, ordered by
+	// order and skipping the first offset, along with how many match in
+	// total. A limit of 0 returns every match after offset, and a
+	// negative offset counts as 0. Names and emails compare by their
+	// bytes, not a locale's collation. SQL stores apply the ordering and
+	// limits in the query.
+	ListPage(ctx context.Context, f UserFilter, order UserSort, offset, limit int) ([]User, int, error)
+	// Oldest and Newest return the user matching f with the earliest or
+	// latest Created time, ties going to the lowest or highest ID, or
+	// ErrNotFound when none match
+	Oldest(ctx context.Context, f UserFilter) (User, error)
+	Newest(ctx context.Context, f UserFilter) (User, error)
+	// ModifiedSince returns the users written at or after since, plus a
+	// tombstone for each user deleted since then. Tombstones carry only
+	// ID, OrgID, UpdatedAt and DeletedAt.
+	ModifiedSince(ctx context.Context, since time.Time) ([]User, error)
+	// IterateModifiedSince calls fn for the same users and tombstones as
+	// ModifiedSince, ordered by UpdatedAt then ID, stopping at the first
+	// error fn returns
+	IterateModifiedSince(ctx context.Context, since time.Time, fn func(User) error) error
+	// Modified reports when the store last changed and how many users
+	// it holds
+	Modified(ctx context.Context) (time.Time, int, error)
+}
+
+// tombstoneRetention is how long stores remember deleted users for
+// ModifiedSince, and keep soft-deleted users in the trash
+const tombstoneRetention = 30 * 24 * time.Hour
+
+// newTombstone returns the record kept for u after it is deleted at t
+func newTombstone(u User, t time.Time) User {
+	return User{ID: u.ID, OrgID: u.OrgID, UpdatedAt: t, DeletedAt: &t}
+}
+
+// isTombstone reports whether u is a record made by newTombstone rather
+// than a user. Trash entries keep their data, so they aren't tombstones.
+func (u User) isTombstone() bool {
+	return u.DeletedAt != nil && u.Email == ""
+}
+
+// tombstoneView is how a tombstone is written: just what a sync client
+// needs to drop the user, without the empty fields of a user
+type tombstoneView struct {
+	ID        int       `json:"id"`
+	UpdatedAt time.Time `json:"updated_at"`
+	DeletedAt time.Time `json:"deleted_at"`
+	OrgID     string    `json:"org_id,omitempty"`
+}
+
+// MarshalJSON writes tombstones as a tombstoneView and users as they are
+func (u User) MarshalJSON() ([]byte, error) {
+	if u.isTombstone() {
+		return json.Marshal(tombstoneView{ID: u.ID, UpdatedAt: u.UpdatedAt, DeletedAt: *u.DeletedAt, OrgID: u.OrgID})
+	}
+	return json.Marshal(storedUser(u))
+}
+
+// newTrashEntry returns the copy of u kept in the trash after it is soft
+// deleted at t
+func newTrashEntry(u User, t time.Time) User {
+	u = cloneUser(u)
+	u.UpdatedAt = t
+	u.DeletedAt = &t
+	return u
+}
+
+// openStore creates the store selected by cfg.Store, timed when
+// SLOW_QUERY_THRESHOLD is set and wrapped in the degraded read cache when
+// DEGRADED_READ_CACHE is set
+func openStore(ctx context.Context, cfg Config) (UserStore, error) {
+	store, err := openBackend(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.SlowQueryThreshold > 0 {
+		store = newTimedStore(store, cfg.SlowQueryThreshold)
+	}
+	if cfg.DegradedReadCache {
+		store = newCachedStore(store)
+	}
+	if cfg.UserCacheTTL > 0 {
+		store = newUserCache(store, cfg.UserCacheTTL, cfg.UserCacheSize)
+	}
+	return store, nil
+}
+
+// openBackend creates the store backend selected by cfg.Store
+func openBackend(ctx context.Context, cfg Config) (UserStore, error) {
+	switch cfg.Store {
+	case "memory":
+		return NewMemoryStore(cfg.EmailRules), nil
+	case "file":
+		f, err := NewFileStore(cfg.DataFile, cfg.EmailRules)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.FileFlushInterval > 0 {
+			f.writeBehind(cfg.FileFlushInterval, cfg.FileFlushAfter)
+		}
+		return f, nil
+	case "postgres":
+		return NewPostgresStore(ctx, cfg.DatabaseURL, cfg.EmailRules)
+	default:
+		return nil, fmt.Errorf("unknown store %q", cfg.Store)
+	}
+}
+
+// createdBefore reports whether a was created before b, comparing IDs
+// when the times are equal
+func createdBefore(a, b User) bool {
+	if !a.Created.Equal(b.Created) {
+		return a.Created.Before(b.Created)
+	}
+	return a.ID < b.ID
+}
+
+// UserSort orders the users returned by ListPage. Ties are broken by ID
+// in the same direction.
+type UserSort struct {
+	// Field is a key of sortColumns; empty sorts by ID
+	Field string
+	Desc  bool
+}
+
+// sortColumns maps the fields users can be sorted by to their columns
+var sortColumns = map[string]string{"id": "id", "name": "name", "email": "email", "created": "created"}
+
+// byID reports whether the order is the default ascending ID order
+func (o UserSort) byID() bool {
+	return (o.Field == "" || o.Field == "id") && !o.Desc
+}
+
+// less reports whether a sorts before b
+func (o UserSort) less(a, b User) bool {
+	var before, after bool
+	switch o.Field {
+	case "name":
+		before, after = a.Name < b.Name, a.Name > b.Name
+	case "email":
+		before, after = a.Email < b.Email, a.Email > b.Email
+	case "created":
+		before, after = a.Created.Before(b.Created), a.Created.After(b.Created)
+	}
+	if !before && !after {
+		before = a.ID < b.ID
+		after = a.ID > b.ID
+	}
+	if o.Desc {
+		return after
+	}
+	return before
+}
+
+// sortUsers orders users in place by order
+func sortUsers(users []User, order UserSort) {
+	if order.byID() {
+		sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+		return
+	}
+	sort.Slice(users, func(i, j int) bool { return order.less(users[i], users[j]) })
+}
+
+// pageOf returns the limit users of users after skipping offset, with the
+// limit and offset semantics of UserStore.ListPage
+func pageOf(users []User, offset, limit int) []User {
+	offset = max(offset, 0)
+	if offset >= len(users) {
+		return []User{}
+	}
+	end := len(users)
+	if limit > 0 && limit < end-offset {
+		end = offset + limit
+	}
+	return users[offset:end]
+}
+
+// emailRule says which parts of an address's local part are ignored when
+// comparing emails on a domain
+type emailRule struct {
+	// Plus drops everything from the first "+"
+	Plus bool
+	// Dots drops every "."
+	Dots bool
+}
+
+// defaultEmailRules are used by CANONICALIZE_EMAIL when EMAIL_RULES is
+// unset: plus-addressing everywhere, and dots too for Gmail
+const defaultEmailRules = "gmail.com=plus+dots,googlemail.com=plus+dots,*=plus"
+
+// emailRules holds the CANONICALIZE_EMAIL rules keyed by domain, with "*"
+// covering any other domain. With no rules emails are only compared
+// case-insensitively.
+type emailRules map[string]emailRule
+
+// key returns the value used to compare email for uniqueness. The stored
+// email is never rewritten.
+func (rules emailRules) key(email string) string {
+	key := strings.ToLower(strings.TrimSpace(email))
+	if rules == nil {
+		return key
+	}
+
+	at := strings.LastIndex(key, "@")
+	if at < 0 {
+		return key
+	}
+	local, domain := key[:at], key[at+1:]
+	rule, ok := rules[domain]
+	if !ok {
+		rule = rules["*"]
+	}
+	if rule.Plus {
+		local, _, _ = strings.Cut(local, "+")
+	}
+	if rule.Dots {
+		local = strings.ReplaceAll(local, ".", "")
+	}
+	return local + "@" + domain
+}
+
+// emailKey returns the uniqueness key of email under the configured
+// CANONICALIZE_EMAIL rules
+func (s *Server) emailKey(email string) string {
+	return s.cfg.EmailRules.key(email)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// benchSizes are the store sizes the read benchmarks run at
+var benchSizes = []int{100, 1000, 10000}
+
+// forEachStoreB runs bench as a sub-benchmark against every store backend,
+// so a new store only needs an entry in storeBackends
+func forEachStoreB(b *testing.B, bench func(b *testing.B, store UserStore)) {
+	for _, backend := range storeBackends {
+		backend := backend
+		b.Run(backend.name, func(b *testing.B) {
+			bench(b, backend.open(b, nil))
+		})
+	}
+}
+
+// forEachStoreSize runs bench against every store backend holding each of
+// benchSizes users
+func forEachStoreSize(b *testing.B, bench func(b *testing.B, store UserStore, size int)) {
+	for _, backend := range storeBackends {
+		backend := backend
+		for _, size := range benchSizes {
+			size := size
+			b.Run(backend.name+"/"+strconv.Itoa(size), func(b *testing.B) {
+				store := backend.open(b, nil)
+				seedBenchUsers(b, store, size)
+				bench(b, store, size)
+			})
+		}
+	}
+}
+
+// benchUser returns a user with a fresh email for benchmark run n
+func benchUser(n int) User {
+	return User{Name: fmt.Sprintf("Bench %d", n), Email: testEmail(fmt.Sprintf("bench%d", n)), Created: time.Now().UTC()}
+}
+
+// seedBenchUsers adds n users to store, in one write where the store
+// supports it, and returns their IDs. Users seeded into Postgres are
+// deleted when the benchmark ends; the other stores start empty each time.
+func seedBenchUsers(b *testing.B, store UserStore, n int) []int {
+	b.Helper()
+	ctx := context.Background()
+	ids := make([]int, 0, n)
+	if inserter, ok := store.(batchInserter); ok {
+		users := make([]User, n)
+		for i := range users {
+			users[i] = benchUser(i)
+			users[i].ID = i + 1
+		}
+		errs, err := inserter.InsertMany(ctx, users)
+		if err != nil {
+			b.Fatalf("InsertMany: %v", err)
+		}
+		for i, err := range errs {
+			if err != nil {
+				b.Fatalf("InsertMany user %d: %v", i, err)
+			}
+			ids = append(ids, users[i].ID)
+		}
+	} else {
+		for i := 0; i < n; i++ {
+			u, err := store.Create(ctx, benchUser(i))
+			if err != nil {
+				b.Fatalf("Create: %v", err)
+			}
+			ids = append(ids, u.ID)
+		}
+	}
+	if _, shared := store.(*PostgresStore); shared {
+		b.Cleanup(func() {
+			for _, id := range ids {
+				store.Delete(ctx, id)
+			}
+		})
+	}
+	return ids
+}
+
+func BenchmarkStoreCreate(b *testing.B) {
+	forEachStoreB(b, func(b *testing.B, store UserStore) {
+		ctx := context.Background()
+		users := make([]User, b.N)
+		for i := range users {
+			users[i] = benchUser(i)
+		}
+		ids := make([]int, 0, b.N)
+		b.Cleanup(func() {
+			for _, id := range ids {
+				store.Delete(ctx, id)
+			}
+		})
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			u, err := store.Create(ctx, users[i])
+			if err != nil {
+				b.Fatal(err)
+			}
+			ids = append(ids, u.ID)
+		}
+	})
+}
+
+func BenchmarkStoreGet(b *testing.B) {
+	forEachStoreSize(b, func(b *testing.B, store UserStore, size int) {
+		ctx := context.Background()
+		ids := make([]int, 0, size)
+		users, err := store.List(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, u := range users {
+			ids = append(ids, u.ID)
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := store.Get(ctx, ids[i%len(ids)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkStoreList(b *testing.B) {
+	forEachStoreSize(b, func(b *testing.B, store UserStore, size int) {
+		ctx := context.Background()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := store.List(ctx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkStoreListPage(b *testing.B) {
+	forEachStoreSize(b, func(b *testing.B, store UserStore, size int) {
+		ctx := context.Background()
+		order := UserSort{Field: "name"}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := store.ListPage(ctx, UserFilter{}, order, size/2, 20); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkStoreDelete(b *testing.B) {
+	forEachStoreB(b, func(b *testing.B, store UserStore) {
+		ctx := context.Background()
+		ids := seedBenchUsers(b, store, b.N)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for _, id := range ids {
+			if err := store.Delete(ctx, id); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkListUsersEndpoint fetches a page from the middle of the user
+// list through the handler stack, for each store and size
+func BenchmarkListUsersEndpoint(b *testing.B) {
+	forEachStoreSize(b, func(b *testing.B, store UserStore, size int) {
+		srv, err := NewServer(testConfig(b), store)
+		if err != nil {
+			b.Fatalf("NewServer: %v", err)
+		}
+		h := srv.Handler()
+		path := fmt.Sprintf("/api/v1/users?page=%d&limit=20", size/40+1)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if rec := do(h, "GET", path, ""); rec.Code != http.StatusOK {
+				b.Fatalf("status = %d; body: %s", rec.Code, rec.Body.String())
+			}
+		}
+	})
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// storeBackend opens an empty UserStore of one kind for a test, keying
+// emails under the given rules
+type storeBackend struct {
+	name string
+	open func(tb testing.TB, rules emailRules) UserStore
+}
+
+// storeBackends are the stores the store tests run against. Postgres is
+// skipped unless DATABASE_URL points at a database the tests may write
+// to.
+var storeBackends = []storeBackend{
+	{"memory", func(tb testing.TB, rules emailRules) UserStore {
+		return NewMemoryStore(rules)
+	}},
+	{"file", func(tb testing.TB, rules emailRules) UserStore {
+		f, err := NewFileStore(filepath.Join(tb.TempDir(), "users.json"), rules)
+		if err != nil {
+			tb.Fatalf("NewFileStore: %v", err)
+		}
+		return f
+	}},
+	{"postgres", func(tb testing.TB, rules emailRules) UserStore {
+		url := os.Getenv("DATABASE_URL")
+		if url == "" {
+			tb.Skip("DATABASE_URL is not set")
+		}
+		p, err := NewPostgresStore(context.Background(), url, rules)
+		if err != nil {
+			tb.Fatalf("NewPostgresStore: %v", err)
+		}
+		tb.Cleanup(func() { p.Close() })
+		return p
+	}},
+}
+
+// forEachStore runs test as a subtest against every store backend
+func forEachStore(t *testing.T, test func(t *testing.T, store UserStore)) {
+	forEachStoreWithRules(t, nil, test)
+}
+
+// forEachStoreWithRules is forEachStore with stores keying emails under
+// rules
+func forEachStoreWithRules(t *testing.T, rules emailRules, test func(t *testing.T, store UserStore)) {
+	for _, backend := range storeBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			test(t, backend.open(t, rules))
+		})
+	}
+}
+
+// testEmail returns an email no earlier run can have stored
+func testEmail(name string) string {
+	return fmt.Sprintf("%s-%d@example.com", name, time.Now().UnixNano())
+}
+
+// createTestUser stores a user with the given name and a fresh email,
+// deleting it again when the test ends
+func createTestUser(tb testing.TB, store UserStore, name string) User {
+	tb.Helper()
+	u, err := store.Create(context.Background(), User{Name: name, Email: testEmail(name), Created: time.Now().UTC().Truncate(time.Second)})
+	if err != nil {
+		tb.Fatalf("Create %s: %v", name, err)
+	}
+	tb.Cleanup(func() { store.Delete(context.Background(), u.ID) })
+	return u
+}
+
+func TestStoreRejectsDuplicateEmail(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		first := createTestUser(t, store, "first")
+
+		for _, email := range []string{first.Email, "  " + strings.ToUpper(first.Email)} {
+			_, err := store.Create(ctx, User{Name: "second", Email: email, Created: time.Now().UTC().Truncate(time.Second)})
+			if !errors.Is(err, ErrDuplicateEmail) {
+				t.Errorf("Create with %q: got %v, want ErrDuplicateEmail", email, err)
+			}
+		}
+	})
+}
+
+func TestConcurrentUpdateIfVersionHasOneWinner(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		u := createTestUser(t, store, "contended")
+
+		const writers = 8
+		var wg sync.WaitGroup
+		errs := make([]error, writers)
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				change := u
+				change.Name = fmt.Sprintf("writer %d", i)
+				_, errs[i] = store.UpdateIfVersion(ctx, u.ID, u.Version, change)
+			}(i)
+		}
+		wg.Wait()
+
+		won := 0
+		for _, err := range errs {
+			switch {
+			case err == nil:
+				won++
+			case !errors.Is(err, ErrVersionMismatch):
+				t.Errorf("UpdateIfVersion: got %v, want success or ErrVersionMismatch", err)
+			}
+		}
+		if won != 1 {
+			t.Errorf("%d of %d updates on version %d succeeded, want exactly 1", won, writers, u.Version)
+		}
+
+		stored, err := store.Get(ctx, u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Version != u.Version+1 {
+			t.Errorf("version = %d after the race, want %d", stored.Version, u.Version+1)
+		}
+	})
+}
+
+func TestUpdateIfVersionWritesTheUserItIsGiven(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		target := createTestUser(t, store, "target")
+		other := createTestUser(t, store, "other")
+
+		change := target
+		change.ID = other.ID
+		change.Name = "Renamed"
+		updated, err := store.UpdateIfVersion(ctx, target.ID, target.Version, change)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated.ID != target.ID {
+			t.Errorf("updated user %d, want %d", updated.ID, target.ID)
+		}
+		if stored, _ := store.Get(ctx, other.ID); stored.Name != other.Name {
+			t.Errorf("user %d renamed to %q by an update of user %d", other.ID, stored.Name, target.ID)
+		}
+	})
+}
+
+func TestReadUsersDoNotShareTheStoredUser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		created, err := store.Create(ctx, User{Name: "ann", Email: testEmail("ann"), Created: time.Now().UTC().Truncate(time.Second),
+			Tags: []string{"admin"}, Metadata: map[string]string{"plan": "pro"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Delete(ctx, created.ID) })
+
+		scribble := func(u User) {
+			if len(u.Tags) > 0 {
+				u.Tags[0] = "scribbled"
+			}
+			if u.Metadata != nil {
+				u.Metadata["plan"] = "scribbled"
+			}
+		}
+		scribble(created)
+		if u, err := store.Get(ctx, created.ID); err == nil {
+			scribble(u)
+		}
+		if users, err := store.List(ctx); err == nil {
+			for _, u := range users {
+				scribble(u)
+			}
+		}
+		if found, err := store.GetMany(ctx, []int{created.ID}); err == nil {
+			scribble(found[created.ID])
+		}
+		if found, err := store.GetManyByEmail(ctx, []string{created.Email}); err == nil {
+			for _, u := range found {
+				scribble(u)
+			}
+		}
+		if changed, err := store.ModifiedSince(ctx, time.Time{}); err == nil {
+			for _, u := range changed {
+				scribble(u)
+			}
+		}
+
+		stored, err := store.Get(ctx, created.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(stored.Tags, []string{"admin"}) || stored.Metadata["plan"] != "pro" {
+			t.Errorf("stored user changed through a returned copy: tags %v, metadata %v", stored.Tags, stored.Metadata)
+		}
+	})
+}
+
+func TestGetManyByEmailMatchesTheEmailKey(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ann := createTestUser(t, store, "ann")
+		bob := createTestUser(t, store, "bob")
+
+		found, err := store.GetManyByEmail(context.Background(), []string{strings.ToUpper(ann.Email), bob.Email, testEmail("nobody")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 2 || found[strings.ToLower(ann.Email)].ID != ann.ID || found[bob.Email].ID != bob.ID {
+			t.Errorf("GetManyByEmail = %+v, want ann and bob keyed by their lower-cased emails", found)
+		}
+	})
+}
+
+func TestDeleteIfVersionChecksTheVersion(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		u := createTestUser(t, store, "versioned")
+
+		if err := store.DeleteIfVersion(ctx, u.ID, u.Version+1, false); !errors.Is(err, ErrVersionMismatch) {
+			t.Errorf("DeleteIfVersion with a stale version = %v, want ErrVersionMismatch", err)
+		}
+		if _, err := store.Get(ctx, u.ID); err != nil {
+			t.Fatalf("user gone after a refused delete: %v", err)
+		}
+		if err := store.DeleteIfVersion(ctx, u.ID, u.Version, true); err != nil {
+			t.Fatalf("DeleteIfVersion with the current version: %v", err)
+		}
+		if err := store.DeleteIfVersion(ctx, u.ID, u.Version, false); !errors.Is(err, ErrNotFound) {
+			t.Errorf("DeleteIfVersion of a deleted user = %v, want ErrNotFound", err)
+		}
+		trash, err := store.Trash(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, trashed := range trash {
+			found = found || trashed.ID == u.ID
+		}
+		if !found {
+			t.Errorf("soft deleted user %d isn't in the trash", u.ID)
+		}
+	})
+}
+
+func TestIterateModifiedSinceYieldsChangesInUpdateOrder(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		first := createTestUser(t, store, "first")
+		unchanged := createTestUser(t, store, "unchanged")
+		last := createTestUser(t, store, "last")
+
+		time.Sleep(2 * time.Millisecond)
+		since := time.Now().UTC()
+		var want []int
+		for _, u := range []User{last, first} {
+			time.Sleep(2 * time.Millisecond)
+			u.Name += " renamed"
+			if _, err := store.Update(ctx, u); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, u.ID)
+		}
+		time.Sleep(2 * time.Millisecond)
+		gone := createTestUser(t, store, "gone")
+		if err := store.Delete(ctx, gone.ID); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, gone.ID)
+
+		var got []int
+		var prev time.Time
+		err := store.IterateModifiedSince(ctx, since, func(u User) error {
+			if u.UpdatedAt.Before(prev) {
+				t.Errorf("user %d updated at %s comes after %s", u.ID, u.UpdatedAt, prev)
+			}
+			prev = u.UpdatedAt
+			if u.ID == gone.ID && u.DeletedAt == nil {
+				t.Errorf("deleted user %d isn't a tombstone", u.ID)
+			}
+			got = append(got, u.ID)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("IterateModifiedSince: %v", err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("iterated %v, want %v and not unchanged user %d", got, want, unchanged.ID)
+		}
+
+		stop := errors.New("stop")
+		calls := 0
+		err = store.IterateModifiedSince(ctx, since, func(User) error {
+			calls++
+			return stop
+		})
+		if !errors.Is(err, stop) || calls != 1 {
+			t.Errorf("iteration stopped by fn: %d calls and %v, want 1 call and fn's error", calls, err)
+		}
+	})
+}
+
+func TestCanonicalEmailVariantsCollide(t *testing.T) {
+	rules, err := parseEmailRules(defaultEmailRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forEachStoreWithRules(t, rules, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		base := fmt.Sprintf("first.last%d", time.Now().UnixNano())
+		stored, err := store.Create(ctx, User{Name: "Original", Email: base + "+news@gmail.com", Created: time.Now().UTC().Truncate(time.Second)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Delete(ctx, stored.ID) })
+		if stored.Email != base+"+news@gmail.com" {
+			t.Errorf("stored email = %q, want the address as given", stored.Email)
+		}
+
+		for _, email := range []string{base + "@gmail.com", strings.ReplaceAll(base, ".", "") + "+other@GMail.com"} {
+			if _, err := store.Create(ctx, User{Name: "Variant", Email: email, Created: time.Now().UTC().Truncate(time.Second)}); !errors.Is(err, ErrDuplicateEmail) {
+				t.Errorf("Create with %q: got %v, want ErrDuplicateEmail", email, err)
+			}
+		}
+
+		// Dots only matter on the domains whose rules say so
+		other := createTestUser(t, store, "dotted.name")
+		dotless := strings.Replace(other.Email, "dotted.name", "dottedname", 1)
+		u, err := store.Create(ctx, User{Name: "Distinct", Email: dotless, Created: time.Now().UTC().Truncate(time.Second)})
+		if err != nil {
+			t.Errorf("Create with %q: %v, want it distinct from %q", dotless, err, other.Email)
+		} else {
+			store.Delete(ctx, u.ID)
+		}
+	})
+}
+
+func TestEmailKeyIgnoresRulesWhenOff(t *testing.T) {
+	if got := emailRules(nil).key(" A.B+x@Gmail.com "); got != "a.b+x@gmail.com" {
+		t.Errorf("emailKey = %q, want only case and space normalized", got)
+	}
+}
+
+func TestDomainsAreCollectedInTheStore(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		// A tag shared by this run's domains keeps other users out of the
+		// result on a shared database
+		tag := fmt.Sprint(time.Now().UnixNano())
+		for _, email := range []string{"ann@zeta" + tag + ".io", "bob@acme" + tag + ".com", "cy@Example" + tag + ".org", "dee@ACME" + tag + ".com"} {
+			u, err := store.Create(ctx, User{Name: "Domain", Email: email, Created: time.Now().UTC()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { store.Delete(ctx, u.ID) })
+		}
+
+		domains, err := store.Domains(ctx, UserFilter{Q: tag})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"acme" + tag + ".com", "example" + tag + ".org", "zeta" + tag + ".io"}; !reflect.DeepEqual(domains, want) {
+			t.Errorf("domains = %v, want %v", domains, want)
+		}
+	})
+}
+
+func TestListPageOrdersAndCounts(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		domain := fmt.Sprintf("page%d.example", time.Now().UnixNano())
+		var ids []int
+		for _, name := range []string{"Cy", "Ann", "Bob", "Dee"} {
+			u, err := store.Create(ctx, User{Name: name, Email: strings.ToLower(name) + "@" + domain, Created: time.Now().UTC().Truncate(time.Second)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { store.Delete(ctx, u.ID) })
+			ids = append(ids, u.ID)
+		}
+
+		users, total, err := store.ListPage(ctx, UserFilter{Domain: domain}, UserSort{Field: "name"}, 1, 2)
+		if err != nil {
+			t.Fatalf("ListPage: %v", err)
+		}
+		if total != 4 || len(users) != 2 || users[0].Name != "Bob" || users[1].Name != "Cy" {
+			t.Errorf("name page 2 = %+v of %d, want Bob and Cy of 4", users, total)
+		}
+
+		users, _, err = store.ListPage(ctx, UserFilter{Domain: domain}, UserSort{Desc: true}, 0, 1)
+		if err != nil || len(users) != 1 || users[0].ID != ids[3] {
+			t.Errorf("newest by ID = %+v, %v; want user %d", users, err, ids[3])
+		}
+
+		users, total, err = store.ListPage(ctx, UserFilter{Domain: domain}, UserSort{}, 10, 2)
+		if err != nil || len(users) != 0 || total != 4 {
+			t.Errorf("page past the end = %+v of %d, %v; want no users of 4", users, total, err)
+		}
+
+		users, total, err = store.ListPage(ctx, UserFilter{Domain: domain, IDFrom: ids[1], IDTo: ids[2]}, UserSort{}, 0, 0)
+		if err != nil || total != 2 || len(users) != 2 || users[0].ID != ids[1] || users[1].ID != ids[2] {
+			t.Errorf("ID window without a limit = %+v of %d, %v; want users %d and %d", users, total, err, ids[1], ids[2])
+		}
+
+		// Names compare by their bytes, so upper case sorts first
+		lower, err := store.Create(ctx, User{Name: "aaron", Email: "aaron@" + domain, Created: time.Now().UTC().Truncate(time.Second)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Delete(ctx, lower.ID) })
+		users, _, err = store.ListPage(ctx, UserFilter{Domain: domain}, UserSort{Field: "name"}, 0, 0)
+		if err != nil || len(users) != 5 || users[0].Name != "Ann" || users[4].Name != "aaron" {
+			t.Errorf("names by byte order = %+v, %v; want Ann first and aaron last", users, err)
+		}
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// contextKey namespaces values this package stores in request contexts
+type contextKey int
+
+// Keys for the values this package stores in request contexts
+const (
+	tenantKey contextKey = iota
+	subjectKey
+	staleKey
+	requestIDKey
+	responseFormatKey
+	adminListenerKey
+)
+
+// tenantIDPattern restricts tenant IDs to short, header-safe identifiers
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// tenantFrom returns the tenant recorded in ctx, or "" when there is none
+func tenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey).(string)
+	return tenant
+}
+
+// isWriteMethod reports whether method modifies state
+func isWriteMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// tenantContext captures X-Tenant-ID into the request context. In
+// multi-tenant mode the header must be well formed and is required for
+// writes.
+func (s *Server) tenantContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.cfg.MultiTenant {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tenant := r.Header.Get("X-Tenant-ID")
+		if tenant == "" && isWriteMethod(r.Method) {
+			writeError(w, r, CodeInvalidRequest, "X-Tenant-ID header is required")
+			return
+		}
+		if tenant != "" && !tenantIDPattern.MatchString(tenant) {
+			writeError(w, r, CodeInvalidRequest, "X-Tenant-ID must be 1-64 letters, digits, '_' or '-'")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), tenantKey, tenant)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// visible reports whether the request's tenant may see u. Without
+// multi-tenancy every user is visible.
+func (s *Server) visible(ctx context.Context, u User) bool {
+	return !s.cfg.MultiTenant || u.OrgID == tenantFrom(ctx)
+}
+
+// getUser loads a user, reporting users outside the request's tenant as
+// not found
+func (s *Server) getUser(ctx context.Context, id int) (User, error) {
+	u, err := s.store.Get(ctx, id)
+	if err != nil {
+		return User{}, err
+	}
+	if !s.visible(ctx, u) {
+		return User{}, ErrNotFound
+	}
+	return u, nil
+}
+
+// listUsers returns every user visible to the request's tenant
+func (s *Server) listUsers(ctx context.Context) ([]User, error) {
+	users, err := s.store.List(ctx)
+	if err != nil || !s.cfg.MultiTenant {
+		return users, err
+	}
+
+	scoped := make([]User, 0, len(users))
+	for _, u := range users {
+		if s.visible(ctx, u) {
+			scoped = append(scoped, u)
+		}
+	}
+	return scoped, nil
+}
+
+// modifiedUsers returns the users and tombstones changed since t that are
+// visible to the request's tenant
+func (s *Server) modifiedUsers(ctx context.Context, t time.Time) ([]User, error) {
+	users, err := s.store.ModifiedSince(ctx, t)
+	if err != nil || !s.cfg.MultiTenant {
+		return users, err
+	}
+
+	scoped := make([]User, 0, len(users))
+	for _, u := range users {
+		if s.visible(ctx, u) {
+			scoped = append(scoped, u)
+		}
+	}
+	return scoped, nil
+}
+
+// iterateModified calls fn for the users and tombstones changed since t
+// that match f and are visible to the request's tenant, in modification
+// order
+func (s *Server) iterateModified(ctx context.Context, t time.Time, f UserFilter, fn func(User) error) error {
+	return s.store.IterateModifiedSince(ctx, t, func(u User) error {
+		if !s.visible(ctx, u) || !f.Matches(u) {
+			return nil
+		}
+		return fn(u)
+	})
+}
+
+// trashedUsers returns the soft-deleted users visible to the request's
+// tenant
+func (s *Server) trashedUsers(ctx context.Context) ([]User, error) {
+	users, err := s.store.Trash(ctx)
+	if err != nil || !s.cfg.MultiTenant {
+		return users, err
+	}
+
+	scoped := make([]User, 0, len(users))
+	for _, u := range users {
+		if s.visible(ctx, u) {
+			scoped = append(scoped, u)
+		}
+	}
+	return scoped, nil
+}
+
+// getManyUsers loads users by ID, dropping those outside the request's
+// tenant
+func (s *Server) getManyUsers(ctx context.Context, ids []int) (map[int]User, error) {
+	found, err := s.store.GetMany(ctx, ids)
+	if err != nil || !s.cfg.MultiTenant {
+		return found, err
+	}
+
+	for id, u := range found {
+		if !s.visible(ctx, u) {
+			delete(found, id)
+		}
+	}
+	return found, nil
+}
+
+// getManyUsersByEmail loads users by email, keyed by emailKey, dropping
+// those outside the request's tenant
+func (s *Server) getManyUsersByEmail(ctx context.Context, emails []string) (map[string]User, error) {
+	found, err := s.store.GetManyByEmail(ctx, emails)
+	if err != nil {
+		return nil, err
+	}
+
+	byKey := make(map[string]User, len(found))
+	for _, u := range found {
+		if s.visible(ctx, u) {
+			byKey[s.emailKey(u.Email)] = u
+		}
+	}
+	return byKey, nil
+}
+
+// countUsers counts the users matching f within the request's tenant
+func (s *Server) countUsers(ctx context.Context, f UserFilter) (int, error) {
+	if s.cfg.MultiTenant {
+		tenant := tenantFrom(ctx)
+		f.OrgID = &tenant
+	}
+	return s.store.Count(ctx, f)
+}
+
+// emailDomains returns the distinct email domains of the request's
+// tenant's users
+func (s *Server) emailDomains(ctx context.Context) ([]string, error) {
+	var f UserFilter
+	if s.cfg.MultiTenant {
+		tenant := tenantFrom(ctx)
+		f.OrgID = &tenant
+	}
+	return s.store.Domains(ctx, f)
+}
+
+// listPage returns a page of the request's tenant's users matching f and
+// how many there are in total
+func (s *Server) listPage(ctx context.Context, f UserFilter, order UserSort, offset, limit int) ([]User, int, error) {
+	if s.cfg.MultiTenant {
+		tenant := tenantFrom(ctx)
+		f.OrgID = &tenant
+	}
+	return s.store.ListPage(ctx, f, order, offset, limit)
+}
+
+// boundaryUser returns the oldest or newest user of the request's tenant
+func (s *Server) boundaryUser(ctx context.Context, newest bool) (User, error) {
+	var f UserFilter
+	if s.cfg.MultiTenant {
+		tenant := tenantFrom(ctx)
+		f.OrgID = &tenant
+	}
+	if newest {
+		return s.store.Newest(ctx, f)
+	}
+	return s.store.Oldest(ctx, f)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// tenantRequest returns a request sent on behalf of tenant, if any
+func tenantRequest(method, path, tenant, body string) *http.Request {
+	var r *http.Request
+	if body != "" {
+		r = newTestRequest(method, path, strings.NewReader(body))
+	} else {
+		r = newTestRequest(method, path, nil)
+	}
+	if tenant != "" {
+		r.Header.Set("X-Tenant-ID", tenant)
+	}
+	return r
+}
+
+func TestTenantsAreIsolated(t *testing.T) {
+	srv := newTestServer(t, "MULTI_TENANT=true")
+	create := srv.tenantContext(http.HandlerFunc(srv.createUserHandler))
+	list := srv.tenantContext(http.HandlerFunc(srv.getUsersHandler))
+	get := srv.tenantContext(http.HandlerFunc(srv.getUserHandler))
+
+	var alice, bob User
+	decodeData(t, decodeResponse(t, serve(create, tenantRequest("POST", "/api/v1/users", "acme", `{"name":"Alice","email":"alice@acme.com"}`)), http.StatusCreated), &alice)
+	decodeData(t, decodeResponse(t, serve(create, tenantRequest("POST", "/api/v1/users", "globex", `{"name":"Bob","email":"bob@globex.com"}`)), http.StatusCreated), &bob)
+	if alice.OrgID != "acme" {
+		t.Errorf("created user org_id = %q, want acme", alice.OrgID)
+	}
+
+	var users []User
+	decodeData(t, decodeResponse(t, serve(list, tenantRequest("GET", "/api/v1/users", "acme", "")), http.StatusOK), &users)
+	if len(users) != 1 || users[0].ID != alice.ID {
+		t.Errorf("acme lists %+v, want only Alice", users)
+	}
+
+	getAs := func(tenant string, id int) *http.Request {
+		r := tenantRequest("GET", "/api/v1/users/"+strconv.Itoa(id), tenant, "")
+		return mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(id)})
+	}
+	decodeResponse(t, serve(get, getAs("globex", bob.ID)), http.StatusOK)
+	decodeResponse(t, serve(get, getAs("acme", bob.ID)), http.StatusNotFound)
+}
+
+func TestTenantHeaderIsRequiredForWrites(t *testing.T) {
+	srv := newTestServer(t, "MULTI_TENANT=true")
+	create := srv.tenantContext(http.HandlerFunc(srv.createUserHandler))
+
+	decodeResponse(t, serve(create, tenantRequest("POST", "/api/v1/users", "", `{"name":"Anon","email":"anon@example.com"}`)), http.StatusBadRequest)
+	decodeResponse(t, serve(create, tenantRequest("POST", "/api/v1/users", "bad tenant!", `{"name":"Anon","email":"anon@example.com"}`)), http.StatusBadRequest)
+
+	single := newTestServer(t, "MULTI_TENANT=false")
+	decodeResponse(t, serve(single.tenantContext(http.HandlerFunc(single.createUserHandler)),
+		tenantRequest("POST", "/api/v1/users", "", `{"name":"Anon","email":"anon@example.com"}`)), http.StatusCreated)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Values accepted by TIME_FORMAT
+const (
+	timeFormatRFC3339 = "rfc3339"
+	timeFormatUnix    = "unix"
+	timeFormatUnixMs  = "unix_ms"
+)
+
+// checkTimeFormat validates a TIME_FORMAT value
+func checkTimeFormat(format string) error {
+	switch format {
+	case timeFormatRFC3339, timeFormatUnix, timeFormatUnixMs:
+		return nil
+	}
+	return fmt.Errorf("TIME_FORMAT must be rfc3339, unix or unix_ms, got %q", format)
+}
+
+// unixMsThreshold separates the two unix formats when reading a numeric
+// timestamp: values this large would be seconds past the year 5000, so
+// they are read as milliseconds
+const unixMsThreshold = 1e11
+
+// jsonTime is a timestamp in a request body or an encoded user. It may be
+// an RFC 3339 string or, as the unix TIME_FORMATs write it, a number of
+// seconds or milliseconds since the epoch.
+type jsonTime time.Time
+
+func (t *jsonTime) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return (*time.Time)(t).UnmarshalJSON(data)
+	}
+	var n int64
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("timestamp must be an RFC 3339 string or a unix time, got %s", data)
+	}
+	if n >= unixMsThreshold || n <= -unixMsThreshold {
+		*t = jsonTime(time.UnixMilli(n).UTC())
+	} else {
+		*t = jsonTime(time.Unix(n, 0).UTC())
+	}
+	return nil
+}
+
+// storedUser is a User without its JSON methods, for encoding and
+// decoding its fields as they are
+type storedUser User
+
+// UnmarshalJSON reads a user in any response format the API writes, so
+// exported users can be read back whatever ID_FORMAT and TIME_FORMAT were
+// in effect
+func (u *User) UnmarshalJSON(data []byte) error {
+	var in struct {
+		storedUser
+		ID        jsonID    `json:"id"`
+		Created   jsonTime  `json:"created"`
+		UpdatedAt jsonTime  `json:"updated_at"`
+		DeletedAt *jsonTime `json:"deleted_at"`
+	}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	*u = User(in.storedUser)
+	u.ID, u.Created, u.UpdatedAt = int(in.ID), time.Time(in.Created), time.Time(in.UpdatedAt)
+	u.DeletedAt = nil
+	if in.DeletedAt != nil {
+		deleted := time.Time(*in.DeletedAt)
+		u.DeletedAt = &deleted
+	}
+	return nil
+}
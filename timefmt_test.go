@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTimeFormatControlsTimestampEncoding(t *testing.T) {
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	u := User{ID: 1, Name: "Ada", Email: "ada@example.com", Created: created}
+
+	for _, tt := range []struct {
+		format string
+		check  func(raw json.RawMessage) bool
+	}{
+		{timeFormatRFC3339, func(raw json.RawMessage) bool {
+			var s string
+			if json.Unmarshal(raw, &s) != nil {
+				return false
+			}
+			parsed, err := time.Parse(time.RFC3339, s)
+			return err == nil && parsed.Equal(created)
+		}},
+		{timeFormatUnix, func(raw json.RawMessage) bool {
+			var n int64
+			return json.Unmarshal(raw, &n) == nil && n == created.Unix()
+		}},
+		{timeFormatUnixMs, func(raw json.RawMessage) bool {
+			var n int64
+			return json.Unmarshal(raw, &n) == nil && n == created.UnixMilli()
+		}},
+	} {
+		data, err := newResponseFormat(testConfig(t, "TIME_FORMAT="+tt.format)).encode(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatal(err)
+		}
+		if !tt.check(fields["created"]) {
+			t.Errorf("TIME_FORMAT=%s: created = %s", tt.format, fields["created"])
+		}
+	}
+}
+
+func TestStoredUsersKeepRFC3339Timestamps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	cfg := testConfig(t, "TIME_FORMAT=unix", "STORE=file", "DATA_FILE="+path)
+	store, err := openStore(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer(cfg, store)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	decodeResponse(t, do(srv.Handler(), "POST", "/api/v1/users", `{"name":"Ada","email":"ada@example.com"}`), http.StatusCreated)
+	if err := store.(*FileStore).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewFileStore(path, nil)
+	if err != nil {
+		t.Fatalf("data written under TIME_FORMAT=unix doesn't read back: %v", err)
+	}
+	users, err := f.List(context.Background())
+	if err != nil || len(users) != 1 || users[0].Created.IsZero() {
+		t.Errorf("reopened store holds %+v (%v), want the user with its created time", users, err)
+	}
+}
+
+func TestUsersReadBackInEveryResponseFormat(t *testing.T) {
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	u := User{ID: 7, Name: "Ada", Email: "ada@example.com", Created: created, UpdatedAt: created.Add(time.Hour)}
+
+	for _, env := range [][]string{
+		{"TIME_FORMAT=rfc3339"},
+		{"TIME_FORMAT=unix", "ID_FORMAT=string"},
+		{"TIME_FORMAT=unix_ms"},
+	} {
+		data, err := newResponseFormat(testConfig(t, env...)).encode(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got User
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Errorf("%v: decoding %s: %v", env, data, err)
+			continue
+		}
+		if got.ID != u.ID || !got.Created.Equal(u.Created) || !got.UpdatedAt.Equal(u.UpdatedAt) {
+			t.Errorf("%v: read back %+v, want %+v", env, got, u)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// timeoutRetryAfter is how long a client is asked to wait after its
+// request timed out
+const timeoutRetryAfter = time.Second
+
+// timeoutWriter buffers a handler's response so it can be thrown away if
+// the handler runs out of time. Writes after the timeout fail with
+// http.ErrHandlerTimeout.
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.status == 0 && !tw.timedOut {
+		tw.status = status
+	}
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	return tw.body.Write(p)
+}
+
+// flushTo sends the buffered response to w
+func (tw *timeoutWriter) flushTo(w http.ResponseWriter) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	for name, values := range tw.header {
+		w.Header()[name] = values
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	w.WriteHeader(tw.status)
+	w.Write(tw.body.Bytes())
+}
+
+// empty reports whether the handler has written nothing at all
+func (tw *timeoutWriter) empty() bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	return tw.status == 0
+}
+
+// expire marks the response as abandoned, so the handler's later writes
+// are dropped
+func (tw *timeoutWriter) expire() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.timedOut = true
+}
+
+// timeout bounds how long a handler may run, answering with a 503 once
+// REQUEST_TIMEOUT passes. Streaming responses are exempt since the body is
+// buffered until the handler finishes.
+//
+// The handler keeps the connection's context, so a client that goes away
+// cancels its store queries. net/http also cancels that context when a
+// body read fails, so only the deadline ends the wait early: the handler
+// still gets to send its 400 for the failed read. A handler that returns
+// on the deadline without writing anything has timed out too, even if it
+// beat the timer.
+func (s *Server) timeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isStreamingRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), s.cfg.RequestTimeout)
+		defer cancel()
+		tw := &timeoutWriter{header: make(http.Header)}
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+		// Panics are recovered in the handler's own goroutine so the
+		// recorded stack is the handler's. Only http.ErrAbortHandler makes
+		// it out, and is re-raised here to abort the response.
+		handler := s.recoverPanics(next)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+					return
+				}
+				close(done)
+			}()
+			handler.ServeHTTP(tw, r.WithContext(ctx))
+		}()
+
+		// The timeout response is written for a request whose own deadline
+		// may have passed too, which writeJSON would otherwise drop.
+		timedOut := r.WithContext(context.WithoutCancel(r.Context()))
+		timer := time.NewTimer(s.cfg.RequestTimeout)
+		defer timer.Stop()
+		select {
+		case <-done:
+			if tw.empty() && ctx.Err() == context.DeadlineExceeded {
+				writeRetryError(w, timedOut, CodeUnavailable, "Request timed out", timeoutRetryAfter)
+				return
+			}
+			tw.flushTo(w)
+		case p := <-panicked:
+			panic(p)
+		case <-timer.C:
+			tw.expire()
+			writeRetryError(w, timedOut, CodeUnavailable, "Request timed out", timeoutRetryAfter)
+		}
+	})
+}
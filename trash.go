@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// trashParams are the query parameters accepted by the trash view
+var trashParams = []string{"page", "limit"}
+
+// purgeParams are the query parameters accepted by the trash purge
+var purgeParams = []string{"confirm"}
+
+// deleteUser removes a user, moving it to the trash instead when
+// SOFT_DELETE is enabled
+func (s *Server) deleteUser(ctx context.Context, id int) error {
+	if s.cfg.SoftDelete {
+		return s.store.SoftDelete(ctx, id)
+	}
+	return s.store.Delete(ctx, id)
+}
+
+// deleteUserIfVersion removes the user like deleteUser if its version is
+// still expectedVersion
+func (s *Server) deleteUserIfVersion(ctx context.Context, id, expectedVersion int) error {
+	return s.store.DeleteIfVersion(ctx, id, expectedVersion, s.cfg.SoftDelete)
+}
+
+// List the soft-deleted users ordered by ID, so they can be reviewed
+// before they are purged
+func (s *Server) getTrashHandler(w http.ResponseWriter, r *http.Request) {
+	if err := checkQueryParams(s.cfg, r, trashParams); err != nil {
+		writeParamError(w, r, err)
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		writeParamError(w, r, err)
+		return
+	}
+	limit, err := parseLimit(r, defaultListLimit, maxListLimit)
+	if err != nil {
+		writeParamError(w, r, err)
+		return
+	}
+
+	users, err := s.trashedUsers(r.Context())
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	users, meta := paginate(users, page, limit)
+	meta.Applied = listQuery{Page: page, Limit: limit}
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: "Deleted users retrieved successfully",
+		Data:    users,
+		Meta:    meta,
+	})
+}
+
+// Permanently remove every soft-deleted user. Nothing is removed unless
+// ?confirm=true is passed; without it the response says how many users
+// would be purged.
+func (s *Server) purgeTrashHandler(w http.ResponseWriter, r *http.Request) {
+	if err := checkQueryParams(s.cfg, r, purgeParams); err != nil {
+		writeParamError(w, r, err)
+		return
+	}
+
+	users, err := s.trashedUsers(r.Context())
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if r.URL.Query().Get("confirm") != "true" {
+		writeError(w, r, CodeInvalidRequest,
+			fmt.Sprintf("Pass confirm=true to permanently purge %d deleted users", len(users)))
+		return
+	}
+
+	ids := make([]int, 0, len(users))
+	for _, u := range users {
+		ids = append(ids, u.ID)
+	}
+	purged := 0
+	if len(ids) > 0 {
+		if purged, err = s.store.PurgeTrash(r.Context(), ids); err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		s.auditLog.Forget(ids)
+	}
+
+	writeJSON(w, r, http.StatusOK, Response{
+		Status:  "success",
+		Message: fmt.Sprintf("Purged %d deleted users", purged),
+		Data:    map[string]int{"purged": purged},
+	})
+}
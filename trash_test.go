@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestSoftDeletedUsersMoveToTheTrash(t *testing.T) {
+	srv := newTestServer(t, "SOFT_DELETE=true", "ADMIN_TOKEN=admin-secret")
+	h := srv.Handler()
+	kept := createTestUser(t, srv.store, "kept")
+	trashed := createTestUser(t, srv.store, "trashed")
+
+	if rec := do(h, "DELETE", "/api/v1/users/"+strconv.Itoa(trashed.ID), ""); rec.Code != http.StatusOK {
+		t.Fatalf("delete = %d, want 200", rec.Code)
+	}
+
+	var listed []User
+	decodeData(t, decodeResponse(t, do(h, "GET", "/api/v1/users", ""), http.StatusOK), &listed)
+	if len(listed) != 1 || listed[0].ID != kept.ID {
+		t.Errorf("list = %+v, want only user %d", listed, kept.ID)
+	}
+
+	decodeResponse(t, do(h, "GET", "/api/v1/users/trash", ""), http.StatusUnauthorized)
+
+	r := newTestRequest("GET", "/api/v1/users/trash", nil)
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	var trash []User
+	decodeData(t, decodeResponse(t, serve(h, r), http.StatusOK), &trash)
+	if len(trash) != 1 || trash[0].ID != trashed.ID || trash[0].Email != trashed.Email || trash[0].DeletedAt == nil {
+		t.Errorf("trash = %+v, want user %d with its deletion time", trash, trashed.ID)
+	}
+}
+
+func TestPurgeEmptiesTheTrashOnlyWhenConfirmed(t *testing.T) {
+	srv := newTestServer(t, "SOFT_DELETE=true", "ADMIN_TOKEN=admin-secret")
+	h := srv.Handler()
+	kept := createTestUser(t, srv.store, "kept")
+	for _, name := range []string{"trashed1", "trashed2"} {
+		u := createTestUser(t, srv.store, name)
+		if rec := do(h, "DELETE", "/api/v1/users/"+strconv.Itoa(u.ID), ""); rec.Code != http.StatusOK {
+			t.Fatalf("delete = %d, want 200", rec.Code)
+		}
+	}
+	admin := func(method, path string, want int) testResponse {
+		r := newTestRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer admin-secret")
+		return decodeResponse(t, serve(h, r), want)
+	}
+
+	decodeResponse(t, do(h, "POST", "/api/v1/admin/trash/purge?confirm=true", ""), http.StatusUnauthorized)
+	admin("POST", "/api/v1/admin/trash/purge", http.StatusBadRequest)
+	var trash []User
+	decodeData(t, admin("GET", "/api/v1/users/trash", http.StatusOK), &trash)
+	if len(trash) != 2 {
+		t.Fatalf("unconfirmed purge left %d users in the trash, want 2", len(trash))
+	}
+
+	var result map[string]int
+	decodeData(t, admin("POST", "/api/v1/admin/trash/purge?confirm=true", http.StatusOK), &result)
+	if result["purged"] != 2 {
+		t.Errorf("purged = %d, want 2", result["purged"])
+	}
+	decodeData(t, admin("GET", "/api/v1/users/trash", http.StatusOK), &trash)
+	if len(trash) != 0 {
+		t.Errorf("trash after purge = %+v, want it empty", trash)
+	}
+	var listed []User
+	decodeData(t, decodeResponse(t, do(h, "GET", "/api/v1/users", ""), http.StatusOK), &listed)
+	if len(listed) != 1 || listed[0].ID != kept.ID {
+		t.Errorf("list after purge = %+v, want active user %d kept", listed, kept.ID)
+	}
+}
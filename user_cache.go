@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// userCacheEntry is a cached user and when it stops being served
+type userCacheEntry struct {
+	user    User
+	expires time.Time
+}
+
+// userCache serves single-user lookups from memory for USER_CACHE_TTL.
+// Writes through this server update or drop the entry straight away;
+// changes made by other replicas show once the entry expires.
+type userCache struct {
+	UserStore
+	ttl time.Duration
+	max int
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[int]userCacheEntry
+}
+
+// newUserCache wraps primary, keeping up to max users for ttl each
+func newUserCache(primary UserStore, ttl time.Duration, max int) *userCache {
+	return &userCache{
+		UserStore: primary,
+		ttl:       ttl,
+		max:       max,
+		now:       time.Now,
+		entries:   make(map[int]userCacheEntry),
+	}
+}
+
+// remember caches u, first dropping expired entries and then arbitrary
+// ones when the cache is full
+func (c *userCache) remember(u User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if _, cached := c.entries[u.ID]; !cached && len(c.entries) >= c.max {
+		for id, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, id)
+			}
+		}
+		for id := range c.entries {
+			if len(c.entries) < c.max {
+				break
+			}
+			delete(c.entries, id)
+		}
+	}
+	c.entries[u.ID] = userCacheEntry{user: cloneUser(u), expires: now.Add(c.ttl)}
+}
+
+// forget drops the cached copy of the user with the given ID
+func (c *userCache) forget(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, id)
+}
+
+// cached returns the unexpired cached user with the given ID
+func (c *userCache) cached(id int) (User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[id]
+	if !ok || !c.now().Before(e.expires) {
+		return User{}, false
+	}
+	return cloneUser(e.user), true
+}
+
+// Warm caches the n most recently created users, so the first lookups
+// after a deploy don't all go to the backend
+func (c *userCache) Warm(ctx context.Context, n int) (int, error) {
+	users, _, err := c.UserStore.ListPage(ctx, UserFilter{}, UserSort{Field: "created", Desc: true}, 0, n)
+	if err != nil {
+		return 0, err
+	}
+	for _, u := range users {
+		c.remember(u)
+	}
+	return len(users), nil
+}
+
+// Get returns the cached user or loads and caches it
+func (c *userCache) Get(ctx context.Context, id int) (User, error) {
+	if u, ok := c.cached(id); ok {
+		return u, nil
+	}
+	u, err := c.UserStore.Get(ctx, id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.forget(id)
+		}
+		return u, err
+	}
+	c.remember(u)
+	return u, nil
+}
+
+// Create caches the created user
+func (c *userCache) Create(ctx context.Context, u User) (User, error) {
+	created, err := c.UserStore.Create(ctx, u)
+	if err == nil {
+		c.remember(created)
+	}
+	return created, err
+}
+
+// Insert caches the inserted user
+func (c *userCache) Insert(ctx context.Context, u User) (User, error) {
+	inserted, err := c.UserStore.Insert(ctx, u)
+	if err == nil {
+		c.remember(inserted)
+	}
+	return inserted, err
+}
+
+// Update caches the updated user, or drops it when the update fails
+func (c *userCache) Update(ctx context.Context, u User) (User, error) {
+	return c.updated(u.ID)(c.UserStore.Update(ctx, u))
+}
+
+// UpdateIfVersion caches the updated user, or drops it when the update
+// fails, since a version mismatch means the cached copy is out of date
+func (c *userCache) UpdateIfVersion(ctx context.Context, id, expectedVersion int, u User) (User, error) {
+	return c.updated(id)(c.UserStore.UpdateIfVersion(ctx, id, expectedVersion, u))
+}
+
+// updated returns a function recording the outcome of an update to the
+// user with the given ID
+func (c *userCache) updated(id int) func(User, error) (User, error) {
+	return func(u User, err error) (User, error) {
+		if err != nil {
+			c.forget(id)
+			return u, err
+		}
+		c.remember(u)
+		return u, nil
+	}
+}
+
+// Delete drops the deleted user
+func (c *userCache) Delete(ctx context.Context, id int) error {
+	defer c.forget(id)
+	return c.UserStore.Delete(ctx, id)
+}
+
+// SoftDelete drops the deleted user
+func (c *userCache) SoftDelete(ctx context.Context, id int) error {
+	defer c.forget(id)
+	return c.UserStore.SoftDelete(ctx, id)
+}
+
+// DeleteIfVersion drops the user, deleted or not, since a version
+// mismatch means the cached copy is stale
+func (c *userCache) DeleteIfVersion(ctx context.Context, id, expectedVersion int, soft bool) error {
+	defer c.forget(id)
+	return c.UserStore.DeleteIfVersion(ctx, id, expectedVersion, soft)
+}
+
+// Ping checks the wrapped store
+func (c *userCache) Ping(ctx context.Context) error {
+	if p, ok := c.UserStore.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// Close closes the wrapped store
+func (c *userCache) Close() error {
+	if closer, ok := c.UserStore.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// warmUserCache fills the user cache at startup when WARM_CACHE is set.
+// A failure only costs the warm start, so it is logged rather than fatal.
+func warmUserCache(ctx context.Context, cfg Config, store UserStore) {
+	cache, ok := store.(*userCache)
+	if !cfg.WarmCache || !ok {
+		return
+	}
+	start := time.Now()
+	n, err := cache.Warm(ctx, cfg.WarmCacheUsers)
+	if err != nil {
+		log.Printf("Failed to warm user cache: %v", err)
+		return
+	}
+	log.Printf("Warmed user cache with %d users in %s", n, time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWarmUpFillsTheUserCache(t *testing.T) {
+	cfg := testConfig(t, "USER_CACHE_TTL=1m", "WARM_CACHE=true", "WARM_CACHE_USERS=2")
+	primary := NewMemoryStore(nil)
+	ctx := context.Background()
+	start := time.Now().UTC().Truncate(time.Second)
+	var ids []int
+	for i, name := range []string{"Oldest", "Middle", "Newest"} {
+		u, err := primary.Create(ctx, User{Name: name, Email: name + "@example.com", Created: start.Add(time.Duration(i) * time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, u.ID)
+	}
+
+	cache := newUserCache(primary, cfg.UserCacheTTL, cfg.UserCacheSize)
+	if _, ok := cache.cached(ids[2]); ok {
+		t.Fatal("user cached before the warm-up ran")
+	}
+	warmUserCache(ctx, cfg, cache)
+
+	for i, id := range ids {
+		_, ok := cache.cached(id)
+		if want := i > 0; ok != want {
+			t.Errorf("user %d cached = %v after warm-up, want %v", id, ok, want)
+		}
+	}
+}
+
+func TestWarmUpIsOffByDefault(t *testing.T) {
+	cfg := testConfig(t, "USER_CACHE_TTL=1m")
+	primary := NewMemoryStore(nil)
+	u, err := primary.Create(context.Background(), User{Name: "Cold", Email: "cold@example.com", Created: time.Now().UTC()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := newUserCache(primary, cfg.UserCacheTTL, cfg.UserCacheSize)
+	warmUserCache(context.Background(), cfg, cache)
+	if _, ok := cache.cached(u.ID); ok {
+		t.Error("user cached without WARM_CACHE")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"sort"
+	"time"
+)
+
+// FieldError describes a validation problem with a single request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// writeValidationErrors writes a 400 response listing the field errors
+func writeValidationErrors(w http.ResponseWriter, r *http.Request, errs []FieldError) {
+	writeJSON(w, r, http.StatusBadRequest, Response{
+		Status:  "error",
+		Code:    CodeValidationFailed,
+		Message: "Validation failed",
+		Data:    map[string]interface{}{"errors": errs},
+	})
+}
+
+// validEmail reports whether email is a bare address such as
+// user@example.com, without a display name
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+// validateTags checks tags against the configured count, length and
+// character set limits. field names the request field being validated.
+func validateTags(cfg Config, field string, tags []string) []FieldError {
+	var errs []FieldError
+	if len(tags) > cfg.MaxTags {
+		errs = append(errs, FieldError{
+			Field:   field,
+			Message: fmt.Sprintf("at most %d tags are allowed", cfg.MaxTags),
+		})
+	}
+	for i, tag := range tags {
+		name := fmt.Sprintf("%s[%d]", field, i)
+		switch {
+		case tag == "":
+			errs = append(errs, FieldError{Field: name, Message: "must not be empty"})
+		case len(tag) > cfg.MaxTagLength:
+			errs = append(errs, FieldError{
+				Field:   name,
+				Message: fmt.Sprintf("must be at most %d characters", cfg.MaxTagLength),
+			})
+		case !cfg.TagPattern.MatchString(tag):
+			errs = append(errs, FieldError{
+				Field:   name,
+				Message: fmt.Sprintf("must match %s", cfg.TagPattern),
+			})
+		}
+	}
+	return errs
+}
+
+// validateMetadata checks metadata against the configured per-value and
+// total size limits. The total counts the bytes of every key and value.
+func validateMetadata(cfg Config, field string, metadata map[string]string) []FieldError {
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var errs []FieldError
+	total := 0
+	for _, k := range keys {
+		v := metadata[k]
+		total += len(k) + len(v)
+		if cfg.MaxMetadataValueBytes > 0 && len(v) > cfg.MaxMetadataValueBytes {
+			errs = append(errs, FieldError{
+				Field:   fmt.Sprintf("%s.%s", field, k),
+				Message: fmt.Sprintf("must be at most %d bytes", cfg.MaxMetadataValueBytes),
+			})
+		}
+	}
+	if cfg.MaxMetadataBytes > 0 && total > cfg.MaxMetadataBytes {
+		errs = append(errs, FieldError{
+			Field:   field,
+			Message: fmt.Sprintf("must total at most %d bytes of keys and values", cfg.MaxMetadataBytes),
+		})
+	}
+	return errs
+}
+
+// importInput is a user from a seed file or an import batch, which may
+// carry the time it was created elsewhere
+type importInput struct {
+	userInput
+	Created *time.Time `json:"created"`
+}
+
+// validate returns the problems with the input, including a future
+// creation time when REJECT_FUTURE_TIMESTAMPS is set
+func (in importInput) validate(cfg Config, now time.Time) []FieldError {
+	errs := in.userInput.validate(cfg)
+	if in.Created != nil {
+		_, createdErrs := checkCreated(cfg, "created", *in.Created, now)
+		errs = append(errs, createdErrs...)
+	}
+	return errs
+}
+
+// check validates the input and returns the time the user is created at:
+// its own creation time under the future timestamp policy, or now when it
+// has none. Clamping a future time is logged.
+func (in importInput) check(cfg Config, now time.Time) (time.Time, []FieldError) {
+	if errs := in.validate(cfg, now); len(errs) > 0 {
+		return now, errs
+	}
+	if in.Created == nil {
+		return now, nil
+	}
+	created, _ := checkCreated(cfg, "created", *in.Created, now)
+	if !created.Equal(*in.Created) {
+		log.Printf("Clamping future created time %s to %s", in.Created.Format(time.RFC3339), created.Format(time.RFC3339))
+	}
+	return created, nil
+}
+
+// checkCreated applies the future timestamp policy to a client supplied
+// creation time. With REJECT_FUTURE_TIMESTAMPS a time after now is a
+// field error; otherwise it is clamped to now.
+func checkCreated(cfg Config, field string, created, now time.Time) (time.Time, []FieldError) {
+	if !created.After(now) {
+		return created, nil
+	}
+	if cfg.RejectFutureTimestamps {
+		return created, []FieldError{{Field: field, Message: "must not be in the future"}}
+	}
+	return now, nil
+}
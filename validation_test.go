@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateRejectsInvalidTags(t *testing.T) {
+	srv := newTestServer(t, "MAX_TAGS=3", "MAX_TAG_LENGTH=8")
+	h := http.HandlerFunc(srv.createUserHandler)
+
+	for _, tt := range []struct {
+		name      string
+		tags      string
+		wantField string
+	}{
+		{"too many", `["a","b","c","d"]`, "tags"},
+		{"too long", `["ok","much-too-long"]`, "tags[1]"},
+		{"illegal character", `["has space"]`, "tags[0]"},
+		{"empty", `[""]`, "tags[0]"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"name":"Tagged","email":"tagged@example.com","tags":%s}`, tt.tags)
+			resp := decodeResponse(t, do(h, "POST", "/api/v1/users", body), http.StatusBadRequest)
+			var data struct {
+				Errors []FieldError `json:"errors"`
+			}
+			decodeData(t, resp, &data)
+			if len(data.Errors) != 1 || data.Errors[0].Field != tt.wantField {
+				t.Errorf("errors = %+v, want one for %s", data.Errors, tt.wantField)
+			}
+		})
+	}
+
+	body := `{"name":"Tagged","email":"tagged@example.com","tags":["a","b-2","c_3"]}`
+	var u User
+	decodeData(t, decodeResponse(t, do(h, "POST", "/api/v1/users", body), http.StatusCreated), &u)
+	if strings.Join(u.Tags, ",") != "a,b-2,c_3" {
+		t.Errorf("tags = %v, want them stored as sent", u.Tags)
+	}
+}
+
+func TestCreateRejectsOversizedMetadata(t *testing.T) {
+	srv := newTestServer(t, "MAX_METADATA_VALUE_BYTES=16", "MAX_METADATA_BYTES=40")
+	h := http.HandlerFunc(srv.createUserHandler)
+
+	for _, tt := range []struct {
+		name      string
+		metadata  string
+		wantField string
+	}{
+		{"oversized value", `{"plan":"pro","notes":"` + strings.Repeat("n", 17) + `"}`, "metadata.notes"},
+		{"oversized aggregate", `{"a":"0123456789abcd","b":"0123456789abcd","c":"0123456789abcd"}`, "metadata"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"name":"Meta","email":"meta@example.com","metadata":%s}`, tt.metadata)
+			var data struct {
+				Errors []FieldError `json:"errors"`
+			}
+			decodeData(t, decodeResponse(t, do(h, "POST", "/api/v1/users", body), http.StatusBadRequest), &data)
+			if len(data.Errors) != 1 || data.Errors[0].Field != tt.wantField {
+				t.Errorf("errors = %+v, want one for %s", data.Errors, tt.wantField)
+			}
+		})
+	}
+
+	body := `{"name":"Meta","email":"meta@example.com","metadata":{"plan":"pro","notes":"` + strings.Repeat("n", 16) + `"}}`
+	decodeResponse(t, do(h, "POST", "/api/v1/users", body), http.StatusCreated)
+}
+
+func TestCheckCreated(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	future := now.Add(time.Hour)
+
+	if got, errs := checkCreated(Config{}, "created", future, now); len(errs) != 0 || !got.Equal(now) {
+		t.Errorf("clamp mode = %v, %v; want now and no error", got, errs)
+	}
+	_, errs := checkCreated(Config{RejectFutureTimestamps: true}, "created", future, now)
+	if len(errs) != 1 || errs[0].Field != "created" || errs[0].Message != "must not be in the future" {
+		t.Errorf("reject mode errors = %v, want a created field error", errs)
+	}
+	if got, errs := checkCreated(Config{RejectFutureTimestamps: true}, "created", now, now); len(errs) != 0 || !got.Equal(now) {
+		t.Errorf("now itself = %v, %v; want it accepted", got, errs)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// apiVersions are the response versions the server implements, oldest
+// first. A client asks for one with Accept: application/json; version=1
+// or the vendor type application/vnd.go-backend-api.v1+json.
+var apiVersions = []string{"1"}
+
+// vendorMediaPrefix starts the vendor media type naming a version
+const vendorMediaPrefix = "application/vnd.go-backend-api.v"
+
+// supportedVersionsHeader lists apiVersions on responses to requests for
+// a version the server doesn't implement
+const supportedVersionsHeader = "X-Supported-Versions"
+
+// acceptedVersions returns the versions named in the Accept header, and
+// whether it also accepts JSON without naming a version
+func acceptedVersions(accept string) (versions []string, unversioned bool) {
+	for _, entry := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(entry))
+		if err != nil {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(mediaType, vendorMediaPrefix) && strings.HasSuffix(mediaType, "+json"):
+			versions = append(versions, strings.TrimSuffix(strings.TrimPrefix(mediaType, vendorMediaPrefix), "+json"))
+		case mediaType == "application/json" && params["version"] != "":
+			versions = append(versions, params["version"])
+		case mediaType == "application/json", mediaType == "application/*", mediaType == "*/*":
+			unversioned = true
+		}
+	}
+	return versions, unversioned
+}
+
+// isSupportedVersion reports whether version is in apiVersions
+func isSupportedVersion(version string) bool {
+	for _, v := range apiVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateVersion turns away requests whose Accept header only names
+// versions the server doesn't implement with a 406 listing the ones it
+// does, so clients can negotiate down. With ACCEPT_VERSION_FALLBACK they
+// are served the latest version instead, still with the list.
+func (s *Server) negotiateVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		versions, unversioned := acceptedVersions(r.Header.Get("Accept"))
+		if len(versions) == 0 || unversioned {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, v := range versions {
+			if isSupportedVersion(v) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		w.Header().Set(supportedVersionsHeader, strings.Join(apiVersions, ", "))
+		w.Header().Add("Vary", "Accept")
+		if s.cfg.AcceptVersionFallback {
+			next.ServeHTTP(w, r)
+			return
+		}
+		writeError(w, r, CodeNotAcceptable, fmt.Sprintf("API version %s is not supported, use one of: %s",
+			strings.Join(versions, ", "), strings.Join(apiVersions, ", ")))
+	})
+}
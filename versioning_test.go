@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestUnsupportedVersionListsTheSupportedOnes(t *testing.T) {
+	h := newTestServer(t).Handler()
+	get := func(accept string) *http.Response {
+		r := newTestRequest("GET", "/api/v1/users", nil)
+		r.Header.Set("Accept", accept)
+		return serve(h, r).Result()
+	}
+
+	for _, accept := range []string{"application/vnd.go-backend-api.v3+json", "application/json; version=2"} {
+		resp := get(accept)
+		if resp.StatusCode != http.StatusNotAcceptable {
+			t.Errorf("Accept %q: status %d, want 406", accept, resp.StatusCode)
+		}
+		if got := resp.Header.Get(supportedVersionsHeader); got != "1" {
+			t.Errorf("Accept %q: %s = %q, want 1", accept, supportedVersionsHeader, got)
+		}
+	}
+
+	for _, accept := range []string{"application/vnd.go-backend-api.v1+json", "application/vnd.go-backend-api.v2+json, application/json", "*/*"} {
+		if resp := get(accept); resp.StatusCode != http.StatusOK || resp.Header.Get(supportedVersionsHeader) != "" {
+			t.Errorf("Accept %q: status %d with %s %q, want a plain 200", accept, resp.StatusCode, supportedVersionsHeader, resp.Header.Get(supportedVersionsHeader))
+		}
+	}
+}
+
+func TestVersionFallbackServesTheLatestVersion(t *testing.T) {
+	h := newTestServer(t, "ACCEPT_VERSION_FALLBACK=true").Handler()
+	r := newTestRequest("GET", "/api/v1/users", nil)
+	r.Header.Set("Accept", "application/vnd.go-backend-api.v9+json")
+	rec := serve(h, r)
+	decodeResponse(t, rec, http.StatusOK)
+	if got := rec.Header().Get(supportedVersionsHeader); got != "1" {
+		t.Errorf("%s = %q, want the supported versions listed", supportedVersionsHeader, got)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// webhookDispatcher posts user change events to the WEBHOOK_URLS. Events
+// wait in an in-memory queue, so a crash loses those not yet delivered;
+// a graceful shutdown flushes them first.
+type webhookDispatcher struct {
+	urls   []string
+	client *http.Client
+	queue  chan Event
+
+	// format is the ID and time format event bodies are encoded in
+	format responseFormat
+}
+
+// newWebhookDispatcher returns a dispatcher queueing up to size events
+// and giving each delivery timeout to complete
+func newWebhookDispatcher(urls []string, size int, timeout time.Duration, format responseFormat) *webhookDispatcher {
+	return &webhookDispatcher{
+		urls:   urls,
+		client: &http.Client{Timeout: timeout},
+		queue:  make(chan Event, size),
+		format: format,
+	}
+}
+
+// Enqueue queues e for delivery without blocking, dropping it and
+// returning false if the queue is full
+func (d *webhookDispatcher) Enqueue(e Event) bool {
+	select {
+	case d.queue <- e:
+		return true
+	default:
+		log.Printf("Webhook queue full, dropped %s event for user %d", e.Type, e.UserID)
+		return false
+	}
+}
+
+// run delivers queued events until ctx is cancelled. A delivery in
+// progress is completed first, but the rest of the queue is left for
+// Flush.
+func (d *webhookDispatcher) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-d.queue:
+			d.deliver(context.WithoutCancel(ctx), e)
+		}
+	}
+}
+
+// Flush delivers the events still queued until ctx is done, then logs
+// how many had to be dropped. A delivery still in progress when ctx is
+// done is cancelled.
+func (d *webhookDispatcher) Flush(ctx context.Context) {
+	delivered := 0
+	for {
+		if ctx.Err() != nil {
+			if dropped := len(d.queue); dropped > 0 {
+				log.Printf("Dropped %d undelivered webhook events at shutdown", dropped)
+			}
+			return
+		}
+		select {
+		case e := <-d.queue:
+			d.deliver(ctx, e)
+			delivered++
+		default:
+			if delivered > 0 {
+				log.Printf("Flushed %d webhook events at shutdown", delivered)
+			}
+			return
+		}
+	}
+}
+
+// deliver posts e to every webhook URL within ctx, logging failures
+func (d *webhookDispatcher) deliver(ctx context.Context, e Event) {
+	body, err := d.format.encode(e)
+	if err != nil {
+		log.Printf("Failed to encode %s webhook event: %v", e.Type, err)
+		return
+	}
+	for _, target := range d.urls {
+		if err := d.post(ctx, target, e.Type, body); err != nil {
+			log.Printf("Failed to deliver %s event for user %d to %s: %v", e.Type, e.UserID, target, err)
+		}
+	}
+}
+
+// post sends a single webhook request
+func (d *webhookDispatcher) post(ctx context.Context, target, eventType string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Type", eventType)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
+
+// webhookRetryAfter is the retry hint given when a replay finds the
+// webhook queue full
+const webhookRetryAfter = 5 * time.Second
+
+// Queue a past event, looked up by its ID in the audit log, for delivery
+// to the webhooks again
+func (s *Server) replayEventHandler(w http.ResponseWriter, r *http.Request) {
+	if s.webhooks == nil {
+		writeError(w, r, CodeNotFound, "Webhooks are not configured")
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, CodeNotFound, "Event not found")
+		return
+	}
+	entry, ok := s.auditLog.Entry(id)
+	if !ok || !s.visible(r.Context(), User{OrgID: entry.OrgID}) {
+		writeError(w, r, CodeNotFound, "Event not found")
+		return
+	}
+
+	e := Event{
+		ID:     entry.ID,
+		Replay: true,
+		Type:   entry.Action,
+		UserID: entry.UserID,
+		User:   entry.After,
+		Time:   entry.Time,
+		OrgID:  entry.OrgID,
+	}
+	if !s.webhooks.Enqueue(e) {
+		writeRetryError(w, r, CodeUnavailable, "Webhook queue is full", webhookRetryAfter)
+		return
+	}
+	writeJSON(w, r, http.StatusAccepted, Response{
+		Status:  "success",
+		Message: "Event queued for redelivery",
+		Data:    e,
+	})
+}
+
+// parseWebhookURLs reads the comma-separated WEBHOOK_URLS list
+func parseWebhookURLs(raw string) ([]string, error) {
+	var urls []string
+	for _, target := range strings.Split(raw, ",") {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("WEBHOOK_URLS: %q must be an http or https URL", target)
+		}
+		urls = append(urls, target)
+	}
+	return urls, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the events posted to it
+type webhookReceiver struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var e Event
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil || r.Header.Get("X-Event-Type") != e.Type {
+		http.Error(w, "bad event", http.StatusBadRequest)
+		return
+	}
+	rcv.mu.Lock()
+	rcv.events = append(rcv.events, e)
+	rcv.mu.Unlock()
+}
+
+func (rcv *webhookReceiver) received() []Event {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]Event(nil), rcv.events...)
+}
+
+func TestShutdownFlushesQueuedWebhooks(t *testing.T) {
+	rcv := &webhookReceiver{}
+	ts := httptest.NewServer(rcv)
+	defer ts.Close()
+	srv := newTestServer(t, "WEBHOOK_URLS="+ts.URL)
+	h := srv.Handler()
+
+	// The dispatcher isn't running, so the events stay queued
+	for _, body := range []string{`{"name":"Ann","email":"ann@example.com"}`, `{"name":"Bob","email":"bob@example.com"}`} {
+		decodeResponse(t, do(h, "POST", "/api/v1/users", body), http.StatusCreated)
+	}
+	if n := len(rcv.received()); n != 0 {
+		t.Fatalf("%d events delivered before shutdown, want them queued", n)
+	}
+
+	logs := captureLog(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.webhooks.Flush(ctx)
+
+	events := rcv.received()
+	if len(events) != 2 || events[0].Type != EventUserCreated || events[1].User == nil || events[1].User.Name != "Bob" {
+		t.Errorf("flushed events = %+v, want both creations in order", events)
+	}
+	if !strings.Contains(logs.String(), "Flushed 2 webhook events") {
+		t.Errorf("log = %q, want the flush reported", logs.String())
+	}
+}
+
+func TestFlushPastItsDeadlineLogsDroppedWebhooks(t *testing.T) {
+	d := newWebhookDispatcher([]string{"http://127.0.0.1:0"}, 4, time.Second, newResponseFormat(testConfig(t)).streamed())
+	for i := 0; i < 3; i++ {
+		d.Enqueue(Event{Type: EventUserCreated, UserID: i + 1})
+	}
+
+	logs := captureLog(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.Flush(ctx)
+	if !strings.Contains(logs.String(), "Dropped 3 undelivered webhook events") {
+		t.Errorf("log = %q, want the dropped events counted", logs.String())
+	}
+}
+
+func TestFlushDeadlineCancelsAHangingDelivery(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+	d := newWebhookDispatcher([]string{ts.URL}, 4, time.Minute, newResponseFormat(testConfig(t)).streamed())
+	d.Enqueue(Event{Type: EventUserCreated, UserID: 1})
+
+	captureLog(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	d.Flush(ctx)
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("flush took %s with a %s deadline, want the delivery cancelled", took, 50*time.Millisecond)
+	}
+}
+
+// waitForEvents waits for rcv to have received n events
+func waitForEvents(t *testing.T, rcv *webhookReceiver, n int) []Event {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events := rcv.received()
+		if len(events) >= n {
+			return events
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("received %d webhook events, want %d", len(events), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReplayRedeliversAPastEvent(t *testing.T) {
+	rcv := &webhookReceiver{}
+	ts := httptest.NewServer(rcv)
+	defer ts.Close()
+	srv := newTestServer(t, "WEBHOOK_URLS="+ts.URL, "ADMIN_TOKEN=admin-secret")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.webhooks.run(ctx)
+	h := srv.Handler()
+
+	decodeResponse(t, do(h, "POST", "/api/v1/users", `{"name":"Ann","email":"ann@example.com"}`), http.StatusCreated)
+	original := waitForEvents(t, rcv, 1)[0]
+	if original.ID == 0 || original.Replay {
+		t.Fatalf("original delivery = %+v, want an event ID and no replay flag", original)
+	}
+
+	replay := func(id int, want int) {
+		r := newTestRequest("POST", fmt.Sprintf("/api/v1/admin/events/%d/replay", id), nil)
+		r.Header.Set("Authorization", "Bearer admin-secret")
+		decodeResponse(t, serve(h, r), want)
+	}
+	replay(original.ID, http.StatusAccepted)
+	again := waitForEvents(t, rcv, 2)[1]
+	if !again.Replay || again.ID != original.ID || again.Type != original.Type || again.User == nil || again.User.Email != "ann@example.com" {
+		t.Errorf("replayed delivery = %+v, want the original event flagged as a replay", again)
+	}
+
+	replay(original.ID+100, http.StatusNotFound)
+
+	unhooked := newTestServer(t, "ADMIN_TOKEN=admin-secret").Handler()
+	r := newTestRequest("POST", "/api/v1/admin/events/1/replay", nil)
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	decodeResponse(t, serve(unhooked, r), http.StatusNotFound)
+}